@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
-	"strings"
 	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	smarthome "github.com/orktes/go-alexa-smarthome"
 	"github.com/orktes/go-lambda-mqtt/structs"
 	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/config"
 	"github.com/orktes/homeautomation/util"
 )
@@ -19,13 +20,17 @@ type Alexa struct {
 	conf      config.Config
 	smarthome *smarthome.Smarthome
 	c         mqtt.Client
+	topics    util.TopicLayout
 
-	subscriptionID int
-	subscriptions  map[string]map[int]mqtt.MessageHandler
-	data           map[string]interface{}
+	subscriptions *util.Subscriptions
+	data          map[string]interface{}
+	// scenes are the scene names of scene controller endpoints
+	scenes map[string]string
 
 	runtime      *goja.Runtime
 	runtimeMutex sync.Mutex
+	// source of the directive currently being executed (guarded by runtimeMutex)
+	source *adapter.Source
 
 	sync.Mutex
 }
@@ -33,8 +38,10 @@ type Alexa struct {
 func New(conf config.Config) *Alexa {
 	a := &Alexa{
 		conf:          conf,
-		subscriptions: map[string]map[int]mqtt.MessageHandler{},
+		topics:        util.MustTopicLayout(conf.Topics),
+		subscriptions: util.NewSubscriptions(),
 		data:          map[string]interface{}{},
+		scenes:        map[string]string{},
 		runtime:       goja.New(),
 	}
 
@@ -68,14 +75,20 @@ func New(conf config.Config) *Alexa {
 			capability := dev.NewCapability(capabilityConfig.Interface)
 
 			for _, conf := range capabilityConfig.Properties {
-				capability.AddPropertyHandler(conf.Name, a.getMQTTPropertyHandler(conf))
+				capability.AddPropertyHandler(conf.Name, a.getMQTTPropertyHandler(id, capabilityConfig.Interface, conf))
 			}
 
 			for _, conf := range capabilityConfig.Actions {
-				capability.AddAction(conf.Name, a.getMQTTActionHandler(conf))
+				capability.AddAction(conf.Name, a.getMQTTActionHandler(id, capabilityConfig.Interface, conf))
 			}
 		}
 
+		if device.Scene != "" {
+			a.scenes[id] = device.Scene
+			sm.AddDevice(&sceneDevice{dev})
+			continue
+		}
+
 		sm.AddDevice(dev)
 
 	}
@@ -84,10 +97,13 @@ func New(conf config.Config) *Alexa {
 	return a
 }
 
-func (a *Alexa) exec(str string, context map[string]interface{}) (val goja.Value, err error) {
+func (a *Alexa) exec(str string, context map[string]interface{}, source *adapter.Source) (val goja.Value, err error) {
 	a.runtimeMutex.Lock()
 	defer a.runtimeMutex.Unlock()
 
+	a.source = source
+	defer func() { a.source = nil }()
+
 	contextData := []byte("{}")
 
 	if context != nil {
@@ -106,14 +122,21 @@ func (a *Alexa) exec(str string, context map[string]interface{}) (val goja.Value
 	return a.runtime.RunString(script)
 }
 
-func (a *Alexa) getMQTTPropertyHandler(conf config.AlexaDeviceCapabilityProperty) smarthome.PropertyHandler {
-	return &propertyHandler{alexa: a, conf: conf}
+func (a *Alexa) getMQTTPropertyHandler(endpoint, interf string, conf config.AlexaDeviceCapabilityProperty) smarthome.PropertyHandler {
+	return &propertyHandler{alexa: a, endpoint: endpoint, interf: interf, conf: conf}
 }
 
-func (a *Alexa) getMQTTActionHandler(conf config.AlexaDeviceCapabilityAction) func(interface{}) (interface{}, error) {
+func (a *Alexa) getMQTTActionHandler(endpoint, interf string, conf config.AlexaDeviceCapabilityAction) func(interface{}) (interface{}, error) {
+	source := &adapter.Source{
+		Type:   adapter.SourceAlexa,
+		ID:     endpoint,
+		Detail: interf + "." + conf.Name,
+		Client: a.conf.ClientID,
+	}
+
 	return func(arg interface{}) (interface{}, error) {
 		script := conf.Script
-		gval, err := a.exec(script, map[string]interface{}{"value": arg})
+		gval, err := a.exec(script, map[string]interface{}{"value": arg}, source)
 		if err != nil {
 			return nil, err
 		}
@@ -149,27 +172,13 @@ func (a *Alexa) handler(client mqtt.Client, msg mqtt.Message) {
 	defer a.Unlock()
 
 	topic := msg.Topic()
-	topicParts := strings.Split(topic, "/")
-	if len(topicParts) >= 2 && topicParts[1] == "status" {
-		valKey := strings.Join(append([]string{topicParts[0]}, topicParts[2:]...), "/")
-		var val interface{}
-		json.Unmarshal(msg.Payload(), &val)
+	if valKey, ok := a.topics.ParseFunction(util.FunctionStatus, topic); ok {
+		val, _ := util.DecodeStatus(msg.Payload())
 		a.data[valKey] = val
 	}
 
-	for subTopic, subs := range a.subscriptions {
-		if subTopic != topic {
-			if strings.HasSuffix(subTopic, "#") {
-				if !strings.HasPrefix(topic, subTopic[:len(subTopic)-1]) {
-					continue
-				}
-			} else {
-				continue
-			}
-		}
-		for _, sub := range subs {
-			go sub(client, msg)
-		}
+	for _, sub := range a.subscriptions.Match(topic) {
+		go sub(client, msg)
 	}
 }
 
@@ -177,30 +186,41 @@ func (a *Alexa) subscribe(topic string, handler mqtt.MessageHandler) int {
 	a.Lock()
 	defer a.Unlock()
 
-	id := a.subscriptionID
-	a.subscriptionID++
-
-	if len(a.subscriptions[topic]) == 0 {
+	id, first := a.subscriptions.Add(topic, handler)
+	if first {
 		if token := a.c.Subscribe(topic, 1, a.handler); token.Wait() && token.Error() != nil {
+			a.subscriptions.Remove(topic, id)
 			// TODO handle in a proper way
 			panic(token.Error())
 		}
-		a.subscriptions[topic] = map[int]mqtt.MessageHandler{}
 	}
 
-	a.subscriptions[topic][id] = handler
-
 	return id
 }
 
+// unsubscribe removes a handler and unsubscribes the topic after the last one. The lock isn't held
+// while waiting for the broker as the message router may be waiting for it.
 func (a *Alexa) unsubscribe(topic string, id int) {
 	a.Lock()
-	defer a.Unlock()
+	last := a.subscriptions.Remove(topic, id)
+	a.Unlock()
 
-	if subs, ok := a.subscriptions[topic]; ok {
-		delete(subs, id)
-		if len(subs) == 0 {
-			// TODO figure out a proper way to unsubscribe
+	if !last {
+		return
+	}
+
+	if token := a.c.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error unsubscribing from %s %s\n", topic, token.Error().Error())
+	}
+
+	// Subscribe again if a handler was added while unsubscribing
+	a.Lock()
+	resubscribe := a.subscriptions.Has(topic)
+	a.Unlock()
+
+	if resubscribe {
+		if token := a.c.Subscribe(topic, 1, a.handler); token.Wait() && token.Error() != nil {
+			fmt.Printf("Error subscribing to %s %s\n", topic, token.Error().Error())
 		}
 	}
 }
@@ -216,14 +236,14 @@ getVal:
 	if !ok {
 		ch := make(chan struct{})
 
-		statusTopic := util.ConvertValueToTopic(key, "status")
+		statusTopic := a.topics.Build(util.FunctionStatus, key)
 		id := a.subscribe(statusTopic, func(client mqtt.Client, msg mqtt.Message) {
 			ch <- struct{}{}
 		})
 		defer a.unsubscribe(statusTopic, id)
 
 		// TODO figure out right qos and retain
-		if token := a.c.Publish(util.ConvertValueToTopic(key, "get"), 0, false, []byte{}); token.Wait() && token.Error() != nil {
+		if token := a.c.Publish(a.topics.Build(util.FunctionGet, key), 0, false, []byte{}); token.Wait() && token.Error() != nil {
 			// TODO handle error
 		}
 
@@ -240,15 +260,42 @@ func (a *Alexa) set(call goja.FunctionCall) goja.Value {
 	key := call.Argument(0).String()
 	val := call.Argument(1).Export()
 
-	topic := util.ConvertValueToTopic(key, "set")
+	topic := a.topics.Build(util.FunctionSet, key)
+	req := util.SetRequest{Value: val, Source: a.source}
 
-	if b, err := json.Marshal(val); err == nil {
+	publish := func() error {
+		b, err := util.EncodeRequest(req, a.conf.SetSource)
+		if err != nil {
+			return err
+		}
 		if token := a.c.Publish(topic, 1, false, b); token.Wait() && token.Error() != nil {
-			// TODO handle error
+			return token.Error()
 		}
+		return nil
 	}
 
-	return goja.Undefined()
+	wait, timeout := util.ResultOptions(call.Argument(2).Export())
+	if !wait {
+		if err := publish(); err != nil {
+			panic(a.runtime.NewGoError(err))
+		}
+		return goja.Undefined()
+	}
+
+	// Failures are thrown so that they end up in the directive response
+	correlation := uuid.New().String()
+	req.Correlation = correlation
+
+	res, err := util.AwaitResult(a.topics.Build(util.FunctionResult, key), correlation, timeout, a.subscribe, a.unsubscribe, publish)
+	if err != nil {
+		panic(a.runtime.NewGoError(err))
+	}
+
+	return a.runtime.ToValue(map[string]interface{}{
+		"status":      res.Status,
+		"path":        res.Path,
+		"correlation": res.Correlation,
+	})
 }
 
 func (a *Alexa) handleLambdaMessage(client mqtt.Client, msg mqtt.Message) {
@@ -271,7 +318,12 @@ func (a *Alexa) handleLambdaMessage(client mqtt.Client, msg mqtt.Message) {
 	}
 
 	go func() {
-		res := a.smarthome.Handle(alexaReq)
+		var res *smarthome.Response
+		if alexaReq.Directive.Header.Namespace == sceneController {
+			res = a.handleScene(alexaReq)
+		} else {
+			res = a.smarthome.Handle(alexaReq)
+		}
 
 		resb, err := json.Marshal(res)
 		if err != nil {
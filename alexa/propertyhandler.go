@@ -3,17 +3,29 @@ package alexa
 import (
 	"math"
 
+	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/config"
 	"github.com/orktes/homeautomation/util"
 )
 
 type propertyHandler struct {
-	alexa *Alexa
-	conf  config.AlexaDeviceCapabilityProperty
+	alexa    *Alexa
+	endpoint string
+	interf   string
+	conf     config.AlexaDeviceCapabilityProperty
+}
+
+func (ph *propertyHandler) source() *adapter.Source {
+	return &adapter.Source{
+		Type:   adapter.SourceAlexa,
+		ID:     ph.endpoint,
+		Detail: ph.interf + "." + ph.conf.Name,
+		Client: ph.alexa.conf.ClientID,
+	}
 }
 
 func (ph *propertyHandler) GetValue() (interface{}, error) {
-	gval, err := ph.alexa.exec(ph.conf.Get, nil)
+	gval, err := ph.alexa.exec(ph.conf.Get, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -56,7 +68,7 @@ func (ph *propertyHandler) SetValue(val interface{}) error {
 		}
 	}
 
-	_, err := ph.alexa.exec(ph.conf.Set, map[string]interface{}{"value": val})
+	_, err := ph.alexa.exec(ph.conf.Set, map[string]interface{}{"value": val}, ph.source())
 	if err != nil {
 		return err
 	}
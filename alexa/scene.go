@@ -0,0 +1,106 @@
+package alexa
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	smarthome "github.com/orktes/go-alexa-smarthome"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/scene"
+	"github.com/orktes/homeautomation/util"
+)
+
+const sceneController = "Alexa.SceneController"
+
+// sceneDevice is a device which also is a scene controller. The smarthome package doesn't
+// support scene controllers so the capability is added to discovery and its directives are handled here.
+type sceneDevice struct {
+	*smarthome.AbstractDevice
+}
+
+func (d *sceneDevice) Capabilities() []smarthome.Capability {
+	supportsDeactivation := true
+	return append(d.AbstractDevice.Capabilities(), smarthome.Capability{
+		Type:                 "AlexaInterface",
+		Interface:            sceneController,
+		Version:              "3",
+		SupportsDeactivation: &supportsDeactivation,
+	})
+}
+
+// handleScene applies the scene of an endpoint on Activate and restores the values it replaced on Deactivate
+func (a *Alexa) handleScene(req *smarthome.Request) *smarthome.Response {
+	header := req.Directive.Header
+	endpoint := req.Directive.Endpoint
+
+	res := &smarthome.Response{
+		Event: smarthome.Event{
+			Header: smarthome.Header{
+				Namespace:        sceneController,
+				PayloadVersion:   "3",
+				MessageID:        uuid.New().String(),
+				CorrelationToken: header.CorrelationToken,
+			},
+			Endpoint: endpoint,
+		},
+		Context: map[string]interface{}{},
+	}
+
+	fail := func(typ string, message string) *smarthome.Response {
+		res.Event.Header.Namespace = "Alexa"
+		res.Event.Header.Name = "ErrorResponse"
+		res.Event.Payload = map[string]interface{}{"type": typ, "message": message}
+		res.Context = nil
+		return res
+	}
+
+	if endpoint == nil || a.scenes[endpoint.EndpointID] == "" {
+		return fail("NO_SUCH_ENDPOINT", "endpoint is not a scene")
+	}
+
+	action := scene.ActionApply
+	switch header.Name {
+	case "Activate":
+		res.Event.Header.Name = "ActivationStarted"
+	case "Deactivate":
+		action = scene.ActionRestore
+		res.Event.Header.Name = "DeactivationStarted"
+	default:
+		return fail("INVALID_DIRECTIVE", "unknown directive "+header.Name)
+	}
+
+	key := scene.Key(a.conf, a.scenes[endpoint.EndpointID])
+	correlation := uuid.New().String()
+	cmd := util.SetRequest{
+		Value: scene.Command{Action: action},
+		Source: &adapter.Source{
+			Type:   adapter.SourceAlexa,
+			ID:     endpoint.EndpointID,
+			Detail: "SceneController." + header.Name,
+			Client: a.conf.ClientID,
+		},
+		Correlation: correlation,
+	}
+
+	publish := func() error {
+		b, err := util.EncodeRequest(cmd, a.conf.SetSource)
+		if err != nil {
+			return err
+		}
+		if token := a.c.Publish(a.topics.Build(util.FunctionCommand, key), 1, false, b); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+		return nil
+	}
+
+	if _, err := util.AwaitResult(a.topics.Build(util.FunctionResult, key), correlation, 0, a.subscribe, a.unsubscribe, publish); err != nil {
+		return fail("ENDPOINT_UNREACHABLE", err.Error())
+	}
+
+	res.Event.Payload = map[string]interface{}{
+		"cause":     map[string]interface{}{"type": "VOICE_INTERACTION"},
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	return res
+}
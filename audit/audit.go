@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+// Entry is a single audit log entry
+type Entry struct {
+	Time   time.Time       `json:"time"`
+	Path   string          `json:"path"`
+	Value  interface{}     `json:"value"`
+	Source *adapter.Source `json:"source,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Log is an append-only log of set operations. Entries are written as JSON lines.
+type Log struct {
+	f   *os.File
+	enc *json.Encoder
+	sync.Mutex
+}
+
+// Open opens the audit log file for appending
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record appends an entry to the log
+func (l *Log) Record(e Entry) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	return l.enc.Encode(e)
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.f.Close()
+}
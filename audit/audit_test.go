@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+func TestLogAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = l.Record(Entry{
+			Path:   "haaga/deconz/groups/1/on",
+			Value:  false,
+			Source: &adapter.Source{Type: adapter.SourceTrigger, ID: "porch"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Source == nil || e.Source.ID != "porch" || e.Time.IsZero() {
+			t.Error("Wrong entry", scanner.Text())
+		}
+		lines++
+	}
+
+	if lines != 2 {
+		t.Error("Wrong number of entries", lines)
+	}
+}
@@ -0,0 +1,12 @@
+package adapter
+
+import "errors"
+
+var (
+	NoSuchCommandError = errors.New("no such command")
+)
+
+// Commander is implemented by adapters that support commands which are not tied to a value (e.g. remote control keys)
+type Commander interface {
+	Command(id string, args interface{}) error
+}
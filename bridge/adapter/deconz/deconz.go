@@ -34,6 +34,8 @@ type Deconz struct {
 	groups  map[string]*groupDevice
 	sensors map[string]*sensorDevice
 
+	connected bool
+
 	sync.RWMutex
 }
 
@@ -58,6 +60,24 @@ func (deconz *Deconz) Set(id string, val interface{}) error {
 	return vc.Set(parts[len(parts)-1], val)
 }
 
+func (deconz *Deconz) SetMulti(id string, vals map[string]interface{}) error {
+	if id == "" {
+		return errors.New("Values can't be assigned to the deconz router")
+	}
+
+	c, err := deconz.Get(id)
+	if err != nil {
+		return err
+	}
+
+	vc, ok := c.(adapter.ValueContainer)
+	if !ok {
+		return fmt.Errorf("%s is not a value container", id)
+	}
+
+	return adapter.SetMulti(vc, "", vals)
+}
+
 func (deconz *Deconz) Get(id string) (interface{}, error) {
 	deconz.RLock()
 	defer deconz.RUnlock()
@@ -117,6 +137,21 @@ func (deconz *Deconz) ID() string {
 	return deconz.id
 }
 
+// Connected returns true when the websocket connection to deconz is up
+func (deconz *Deconz) Connected() bool {
+	deconz.RLock()
+	defer deconz.RUnlock()
+
+	return deconz.connected
+}
+
+func (deconz *Deconz) setConnected(connected bool) {
+	deconz.Lock()
+	defer deconz.Unlock()
+
+	deconz.connected = connected
+}
+
 func (deconz *Deconz) UpdateChannel() <-chan adapter.Update {
 	deconz.RLock()
 	defer deconz.RUnlock()
@@ -196,6 +231,8 @@ start:
 
 func (deconz *Deconz) initWebsocketConnection(host string, port int) {
 	defer func() {
+		deconz.setConnected(false)
+
 		// Keep the connection up no matter what happens
 		fmt.Print("Retrying in 5 seconds")
 		time.Sleep(5 * time.Second)
@@ -208,6 +245,8 @@ func (deconz *Deconz) initWebsocketConnection(host string, port int) {
 		return
 	}
 
+	deconz.setConnected(true)
+
 	for {
 		messageType, message, err := c.ReadMessage()
 		if err != nil {
@@ -224,6 +263,11 @@ func (deconz *Deconz) initWebsocketConnection(host string, port int) {
 			fmt.Printf("Error occured while parsing event: %s", err.Error())
 			continue
 		}
+		if ev.Event == "deleted" {
+			deconz.removeDevices(ev.Route, []string{ev.ID})
+			continue
+		}
+
 		if ev.Event == "changed" {
 			device, err := deconz.Get(ev.Route + "/" + ev.ID)
 			if err != nil {
@@ -283,6 +327,18 @@ func (deconz *Deconz) getLights() error {
 
 	deconz.Lock()
 	defer deconz.Unlock()
+
+	removed := []string{}
+	for id := range deconz.lights {
+		if _, ok := lights[id]; !ok {
+			delete(deconz.lights, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		go deconz.sendRemoved("lights", removed)
+	}
+
 	for id, lightData := range lights {
 		if d, ok := deconz.lights[id]; ok {
 			go func(l light, d *lightDevice) {
@@ -306,6 +362,18 @@ func (deconz *Deconz) getGroups() error {
 
 	deconz.Lock()
 	defer deconz.Unlock()
+
+	removed := []string{}
+	for id := range deconz.groups {
+		if _, ok := groups[id]; !ok {
+			delete(deconz.groups, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		go deconz.sendRemoved("groups", removed)
+	}
+
 	for id, groupData := range groups {
 		if d, ok := deconz.groups[id]; ok {
 			go func(g group, d *groupDevice) {
@@ -329,6 +397,18 @@ func (deconz *Deconz) getSensors() error {
 
 	deconz.Lock()
 	defer deconz.Unlock()
+
+	removed := []string{}
+	for id := range deconz.sensors {
+		if _, ok := sensors[id]; !ok {
+			delete(deconz.sensors, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		go deconz.sendRemoved("sensors", removed)
+	}
+
 	for id, sensorData := range sensors {
 		if d, ok := deconz.sensors[id]; ok {
 			go func(s sensor, d *sensorDevice) {
@@ -344,6 +424,37 @@ func (deconz *Deconz) getSensors() error {
 	return nil
 }
 
+// removeDevices removes devices from the given route (lights, groups or sensors)
+func (deconz *Deconz) removeDevices(route string, ids []string) {
+	deconz.Lock()
+	for _, id := range ids {
+		switch route {
+		case "lights":
+			delete(deconz.lights, id)
+		case "groups":
+			delete(deconz.groups, id)
+		case "sensors":
+			delete(deconz.sensors, id)
+		}
+	}
+	deconz.Unlock()
+
+	deconz.sendRemoved(route, ids)
+}
+
+func (deconz *Deconz) sendRemoved(route string, ids []string) {
+	u := adapter.Update{ValueContainer: deconz}
+	for _, id := range ids {
+		fmt.Printf("Deconz device %s/%s removed\n", route, id)
+		u.Updates = append(u.Updates, adapter.ValueUpdate{
+			Key:     deconz.id + "/" + route + "/" + id,
+			Removed: true,
+		})
+	}
+
+	deconz.sendUpdate(u)
+}
+
 func (deconz *Deconz) pipeUpdates(d adapter.Device) {
 	go func() {
 		ch := d.UpdateChannel()
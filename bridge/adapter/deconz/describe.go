@@ -0,0 +1,82 @@
+package deconz
+
+import "github.com/orktes/homeautomation/bridge/adapter"
+
+func describeLightState(state lightState) map[string]adapter.ValueDescription {
+	values := map[string]adapter.ValueDescription{}
+
+	if state.On != nil {
+		values["on"] = adapter.ValueDescription{Type: adapter.TypeBoolean, Settable: true}
+	}
+	if state.Bri != nil {
+		values["bri"] = adapter.ValueDescription{Type: adapter.TypeInteger, Settable: true, Min: 0, Max: 255}
+	}
+	if state.Ct != nil {
+		values["ct"] = adapter.ValueDescription{Type: adapter.TypeInteger, Settable: true, Min: 153, Max: 500}
+	}
+	if state.Hue != nil {
+		values["hue"] = adapter.ValueDescription{Type: adapter.TypeInteger, Settable: true, Min: 0, Max: 65535}
+	}
+	if state.Sat != nil {
+		values["sat"] = adapter.ValueDescription{Type: adapter.TypeInteger, Settable: true, Min: 0, Max: 255}
+	}
+	if state.Reachable != nil {
+		values["reachable"] = adapter.ValueDescription{Type: adapter.TypeBoolean}
+	}
+
+	return values
+}
+
+func (ld *lightDevice) Describe() adapter.Description {
+	return adapter.Description{
+		Kind:         adapter.KindLight,
+		Name:         ld.data.Name,
+		Manufacturer: ld.data.ManufacturerName,
+		Model:        ld.data.ModelID,
+		Values:       describeLightState(ld.data.State),
+	}
+}
+
+func (gd *groupDevice) Describe() adapter.Description {
+	values := describeLightState(gd.data.Action)
+	if gd.data.State.AnyOn != nil {
+		values["any_on"] = adapter.ValueDescription{Type: adapter.TypeBoolean}
+	}
+
+	return adapter.Description{
+		Kind:   adapter.KindLight,
+		Name:   gd.data.Name,
+		Model:  "group",
+		Values: values,
+	}
+}
+
+func (sd *sensorDevice) Describe() adapter.Description {
+	state := sd.data.State
+	values := map[string]adapter.ValueDescription{}
+
+	if state.ButtonEvent != nil {
+		values["buttonevent"] = adapter.ValueDescription{Type: adapter.TypeInteger}
+	}
+	if state.Dark != nil {
+		values["dark"] = adapter.ValueDescription{Type: adapter.TypeBoolean}
+	}
+	if state.Daylight != nil {
+		values["daylight"] = adapter.ValueDescription{Type: adapter.TypeBoolean}
+	}
+	if state.LightLevel != nil {
+		values["lightlevel"] = adapter.ValueDescription{Type: adapter.TypeInteger}
+	}
+	if state.Lux != nil {
+		values["lux"] = adapter.ValueDescription{Type: adapter.TypeInteger, Unit: "lx"}
+	}
+	if state.Presence != nil {
+		values["presence"] = adapter.ValueDescription{Type: adapter.TypeBoolean}
+	}
+
+	return adapter.Description{
+		Kind:   adapter.KindSensor,
+		Name:   sd.data.Name,
+		Values: values,
+	}
+}
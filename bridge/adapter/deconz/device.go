@@ -1,6 +1,8 @@
 package deconz
 
 import (
+	"fmt"
+
 	"github.com/orktes/homeautomation/bridge/adapter"
 )
 
@@ -35,20 +37,29 @@ func (ld *lightDevice) GetAll() (map[string]interface{}, error) {
 }
 
 func (ld *lightDevice) Set(id string, val interface{}) error {
-	stateUpdate := map[string]interface{}{}
-	stateUpdate[id] = val
+	return ld.SetMulti("", map[string]interface{}{id: val})
+}
+
+// SetMulti updates multiple state values with a single request
+func (ld *lightDevice) SetMulti(id string, vals map[string]interface{}) error {
+	if id != "" {
+		return fmt.Errorf("Light %s has no container %s", ld.id, id)
+	}
 
 	res := &lightStateChangeResponse{}
-	return ld.deconz.put("/lights/"+ld.id+"/state", stateUpdate, res)
+	return ld.deconz.put("/lights/"+ld.id+"/state", vals, res)
 }
 
 func (ld *lightDevice) updateState(state *lightState, sendUnchanged bool) {
 	keys := mergeStructs(&ld.data.State, state)
 	du := adapter.Update{}
 	du.ValueContainer = ld
+
+	// Values of unreachable lights are what deconz last knew
+	stale := ld.data.State.Reachable != nil && !*ld.data.State.Reachable
 	for _, kp := range keys {
 		if sendUnchanged || kp.changed {
-			du.Updates = append(du.Updates, adapter.ValueUpdate{Key: ld.ID() + "/" + kp.key, Value: kp.val})
+			du.Updates = append(du.Updates, adapter.ValueUpdate{Key: ld.ID() + "/" + kp.key, Value: kp.val, Stale: stale && kp.key != "reachable"})
 		}
 	}
 
@@ -94,21 +105,27 @@ func (gd *groupDevice) GetAll() (map[string]interface{}, error) {
 }
 
 func (gd *groupDevice) Set(id string, val interface{}) error {
-	stateUpdate := map[string]interface{}{}
-	stateUpdate[id] = val
+	return gd.SetMulti("", map[string]interface{}{id: val})
+}
+
+// SetMulti updates multiple action values with a single request
+func (gd *groupDevice) SetMulti(id string, vals map[string]interface{}) error {
+	if id != "" {
+		return fmt.Errorf("Group %s has no container %s", gd.id, id)
+	}
 
 	res := &lightStateChangeResponse{}
-	err := gd.deconz.put("/groups/"+gd.id+"/action", stateUpdate, res)
+	err := gd.deconz.put("/groups/"+gd.id+"/action", vals, res)
 
 	if err == nil {
 		// Groups are slow to update state in deconz. So lets fake it a little bit
 		du := adapter.Update{}
 		du.ValueContainer = gd
-		du.Updates = []adapter.ValueUpdate{
-			{
-				Key:   gd.ID() + "/" + id,
+		for key, val := range vals {
+			du.Updates = append(du.Updates, adapter.ValueUpdate{
+				Key:   gd.ID() + "/" + key,
 				Value: val,
-			},
+			})
 		}
 
 		for _, ch := range gd.updateChannels {
@@ -156,13 +173,7 @@ func (sd *sensorDevice) Get(id string) (interface{}, error) {
 		return sd.data.Name, nil
 	}
 
-	val := getStructValueByName(sd.data.State, id)
-	res := map[string]interface{}{
-		"value":   val,
-		"updated": sd.data.State.LastUpdated,
-	}
-
-	return res, nil
+	return getStructValueByName(sd.data.State, id), nil
 }
 
 func (sd *sensorDevice) GetAll() (map[string]interface{}, error) {
@@ -187,13 +198,11 @@ func (sd *sensorDevice) updateState(state *sensorState, sendUnchanged bool) {
 		}
 
 		if sendUnchanged || kp.changed {
-			du.Updates = append(du.Updates, adapter.ValueUpdate{
-				Key: sd.ID() + "/" + kp.key,
-				Value: map[string]interface{}{
-					"updated": sd.data.State.LastUpdated,
-					"value":   kp.val,
-				},
-			})
+			kvu := adapter.ValueUpdate{Key: sd.ID() + "/" + kp.key, Value: kp.val}
+			if sd.data.State.LastUpdated != nil {
+				kvu.Timestamp = sd.data.State.LastUpdated.Time
+			}
+			du.Updates = append(du.Updates, kvu)
 		}
 	}
 
@@ -0,0 +1,50 @@
+package adapter
+
+// Device kinds
+const (
+	KindLight        = "light"
+	KindSensor       = "sensor"
+	KindMediaPlayer  = "media_player"
+	KindSwitch       = "switch"
+	KindBinarySensor = "binary_sensor"
+)
+
+// Value types
+const (
+	TypeBoolean = "boolean"
+	TypeInteger = "integer"
+	TypeFloat   = "float"
+	TypeString  = "string"
+	TypeEnum    = "enum"
+)
+
+// ValueDescription describes a single value of a device
+type ValueDescription struct {
+	Type     string
+	Settable bool
+	Unit     string
+	// Min and Max define the range of numeric values when Max > Min
+	Min float64
+	Max float64
+	// Values contains the allowed values for enums
+	Values []string
+}
+
+// Description describes a device for discovery purposes
+type Description struct {
+	Kind         string
+	Name         string
+	Manufacturer string
+	Model        string
+	Values       map[string]ValueDescription
+}
+
+// Describer is implemented by devices that can describe their values
+type Describer interface {
+	Describe() Description
+}
+
+// Connector is implemented by adapters that can tell if they are connected to the underlying device or service
+type Connector interface {
+	Connected() bool
+}
@@ -3,6 +3,7 @@ package dra
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	denondra "github.com/orktes/go-dra"
@@ -12,11 +13,29 @@ import (
 type DRA struct {
 	id   string
 	addr string
-	*denondra.DRA
+
+	// conn is nil while disconnected
+	mutex sync.Mutex
+	conn  *denondra.DRA
 
 	adapter.Updater
 }
 
+// receiver returns the current connection or nil if disconnected
+func (dra *DRA) receiver() *denondra.DRA {
+	dra.mutex.Lock()
+	defer dra.mutex.Unlock()
+
+	return dra.conn
+}
+
+func (dra *DRA) setReceiver(d *denondra.DRA) {
+	dra.mutex.Lock()
+	defer dra.mutex.Unlock()
+
+	dra.conn = d
+}
+
 func (dra *DRA) connect() {
 start:
 	d, err := denondra.NewFromAddr(dra.addr)
@@ -27,7 +46,7 @@ start:
 	}
 
 	d.OnUpdate = make(chan string)
-	dra.DRA = d
+	dra.setReceiver(d)
 
 	for u := range d.OnUpdate {
 		switch {
@@ -37,7 +56,7 @@ start:
 				Updates: []adapter.ValueUpdate{
 					adapter.ValueUpdate{
 						Key:   dra.id + "/master_volume",
-						Value: dra.GetMasterVolume(),
+						Value: d.GetMasterVolume(),
 					},
 				},
 			})
@@ -47,7 +66,7 @@ start:
 				Updates: []adapter.ValueUpdate{
 					adapter.ValueUpdate{
 						Key:   dra.id + "/mute",
-						Value: dra.GetMute(),
+						Value: d.GetMute(),
 					},
 				},
 			})
@@ -57,7 +76,7 @@ start:
 				Updates: []adapter.ValueUpdate{
 					adapter.ValueUpdate{
 						Key:   dra.id + "/input",
-						Value: dra.GetInput(),
+						Value: d.GetInput(),
 					},
 				},
 			})
@@ -67,42 +86,66 @@ start:
 				Updates: []adapter.ValueUpdate{
 					adapter.ValueUpdate{
 						Key:   dra.id + "/power",
-						Value: dra.GetPower(),
+						Value: d.GetPower(),
 					},
 				},
 			})
 		}
 	}
 
+	dra.setReceiver(nil)
+
 	time.Sleep(5 * time.Second)
 	goto start
 }
 
+// Connected returns true when there is a connection to the receiver
+func (dra *DRA) Connected() bool {
+	return dra.receiver() != nil
+}
+
+func (dra *DRA) Describe() adapter.Description {
+	return adapter.Description{
+		Kind:         adapter.KindMediaPlayer,
+		Name:         dra.id,
+		Manufacturer: "Denon",
+		Model:        "DRA",
+		Values: map[string]adapter.ValueDescription{
+			"power":         {Type: adapter.TypeBoolean, Settable: true},
+			"mute":          {Type: adapter.TypeBoolean, Settable: true},
+			"master_volume": {Type: adapter.TypeFloat, Settable: true, Min: 0, Max: 98},
+			"input":         {Type: adapter.TypeString, Settable: true},
+		},
+	}
+}
+
 func (dra *DRA) ID() string {
 	return dra.id
 }
 
 func (dra *DRA) Get(id string) (interface{}, error) {
-	if dra.DRA == nil {
+	d := dra.receiver()
+	if d == nil {
 		return nil, nil
 	}
 
 	switch id {
 	case "master_volume":
-		return dra.DRA.GetMasterVolume(), nil
+		return d.GetMasterVolume(), nil
 	case "mute":
-		return dra.DRA.GetMute(), nil
+		return d.GetMute(), nil
 	case "power":
-		return dra.DRA.GetPower(), nil
+		return d.GetPower(), nil
 	case "input":
-		return dra.DRA.GetInput(), nil
+		return d.GetInput(), nil
 	}
 
 	return nil, nil
 }
 
 func (dra *DRA) Set(id string, val interface{}) error {
-	if dra.DRA == nil {
+	d := dra.receiver()
+	if d == nil {
 		return nil
 	}
 
@@ -110,29 +153,29 @@ func (dra *DRA) Set(id string, val interface{}) error {
 	case "master_volume":
 		switch val := val.(type) {
 		case int:
-			return dra.DRA.SetMasterVolume(val)
+			return d.SetMasterVolume(val)
 		case int64:
-			return dra.DRA.SetMasterVolume(int(val))
+			return d.SetMasterVolume(int(val))
 		case float64:
-			return dra.DRA.SetMasterVolume(int(val))
+			return d.SetMasterVolume(int(val))
 		case string:
 			if val == "UP" {
-				return dra.DRA.Send("MVUP")
+				return d.Send("MVUP")
 			} else if val == "DOWN" {
-				return dra.DRA.Send("MVDOWN")
+				return d.Send("MVDOWN")
 			}
 		}
 	case "mute":
 		if boolval, ok := val.(bool); ok {
-			return dra.DRA.SetMute(boolval)
+			return d.SetMute(boolval)
 		}
 	case "power":
 		if boolval, ok := val.(bool); ok {
-			return dra.DRA.SetPower(boolval)
+			return d.SetPower(boolval)
 		}
 	case "input":
 		if strval, ok := val.(string); ok {
-			return dra.DRA.SetInput(strval)
+			return d.SetInput(strval)
 		}
 	}
 	return nil
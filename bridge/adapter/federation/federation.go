@@ -0,0 +1,527 @@
+package federation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+var (
+	ErrorNotConnected = errors.New("not connected to the remote broker")
+	ErrorNotShared    = errors.New("path is not shared by the remote instance")
+)
+
+// Federation mirrors the status tree of a remote homeautomation instance and forwards
+// set, get and command requests to it over the remote broker
+type Federation struct {
+	id      string
+	root    string
+	share   []string
+	exclude []string
+	topics  util.TopicLayout
+	opts    *mqtt.ClientOptions
+
+	newClient func(opts *mqtt.ClientOptions) mqtt.Client
+	client    mqtt.Client
+
+	values map[string]interface{}
+
+	// updates are queued so that the message router of the client never blocks on them
+	updateMutex sync.Mutex
+	updates     []adapter.Update
+	wake        chan struct{}
+	// closed is guarded by updateMutex. stop is closed with wake.
+	closed bool
+	stop   chan struct{}
+
+	adapter.Updater
+	sync.Mutex
+}
+
+func newFederation(id string, config map[string]interface{}) (*Federation, error) {
+	root, _ := config["root"].(string)
+	if root == "" {
+		return nil, errors.New("federation root must be defined")
+	}
+
+	topics, err := topicLayout(config["topics"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid federation topics %s", err.Error())
+	}
+
+	f := &Federation{
+		id:        id,
+		root:      root,
+		share:     stringList(config["share"]),
+		exclude:   stringList(config["exclude"]),
+		topics:    topics,
+		newClient: mqtt.NewClient,
+		values:    map[string]interface{}{},
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+
+	opts := mqtt.NewClientOptions()
+	for _, server := range stringList(config["servers"]) {
+		opts.AddBroker(server)
+	}
+	clientID, _ := config["client_id"].(string)
+	if clientID == "" {
+		clientID = "homeautomation-federation-" + id
+	}
+	opts.SetClientID(clientID)
+	if username, _ := config["username"].(string); username != "" {
+		opts.SetUsername(username)
+	}
+	if password, _ := config["password"].(string); password != "" {
+		opts.SetPassword(password)
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(f.onConnect)
+	opts.SetConnectionLostHandler(f.onConnectionLost)
+	f.opts = opts
+
+	go f.sendUpdates()
+
+	return f, nil
+}
+
+// queueUpdate queues an update to be sent to the listeners of the adapter
+func (f *Federation) queueUpdate(u adapter.Update) {
+	f.updateMutex.Lock()
+	defer f.updateMutex.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.updates = append(f.updates, u)
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendUpdates sends the queued updates in order until the federation is closed
+func (f *Federation) sendUpdates() {
+	for range f.wake {
+		f.updateMutex.Lock()
+		updates := f.updates
+		f.updates = nil
+		f.updateMutex.Unlock()
+
+		for _, u := range updates {
+			f.Updater.SendUpdate(u)
+		}
+	}
+}
+
+// stringList converts a HCL list (or a single string) to a string slice
+func stringList(val interface{}) []string {
+	switch val := val.(type) {
+	case string:
+		return []string{val}
+	case []string:
+		return val
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, v := range val {
+			if str, ok := v.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// topicLayout returns the topic layout of the remote instance from a HCL topics block
+func topicLayout(val interface{}) (util.TopicLayout, error) {
+	// HCL decodes blocks within maps as lists of maps
+	if list, ok := val.([]map[string]interface{}); ok && len(list) > 0 {
+		val = list[0]
+	}
+
+	templates, ok := val.(map[string]interface{})
+	if !ok {
+		return util.DefaultTopicLayout, nil
+	}
+
+	str := func(key string) string {
+		s, _ := templates[key].(string)
+		return s
+	}
+
+	return util.NewTopicLayout(&config.Topics{
+		Status:  str("status"),
+		Set:     str("set"),
+		Get:     str("get"),
+		Command: str("command"),
+		Result:  str("result"),
+	})
+}
+
+// connect keeps trying to connect to the remote broker until it succeeds or the federation is closed
+func (f *Federation) connect() {
+	f.Lock()
+	f.client = f.newClient(f.opts)
+	c := f.client
+	f.Unlock()
+
+	for {
+		token := c.Connect()
+		if token.Wait() && token.Error() == nil {
+			select {
+			case <-f.stop:
+				// Closed while connecting
+				c.Disconnect(250)
+			default:
+			}
+			return
+		}
+		fmt.Printf("Unable to connect to federated instance %s: %s\n", f.id, token.Error())
+
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (f *Federation) onConnect(c mqtt.Client) {
+	fmt.Printf("Connected to federated instance %s\n", f.id)
+
+	topic := f.topics.Subscription(util.FunctionStatus, f.root)
+	if token := c.Subscribe(topic, 1, f.statusHandler); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error subscribing to federated instance %s %s\n", f.id, token.Error())
+		return
+	}
+
+	// Values that are not retained on the remote broker are only published on change
+	for _, path := range f.refreshPaths() {
+		f.publish(util.FunctionGet, path, nil)
+	}
+}
+
+func (f *Federation) onConnectionLost(c mqtt.Client, err error) {
+	fmt.Printf("Lost connection to federated instance %s %s\n", f.id, err.Error())
+
+	f.Lock()
+	updates := make([]adapter.ValueUpdate, 0, len(f.values))
+	for path, val := range f.values {
+		updates = append(updates, adapter.ValueUpdate{
+			Key:    f.id + "/" + path,
+			Value:  val,
+			Source: &adapter.Source{Type: adapter.SourceFederation, ID: f.id},
+			Stale:  true,
+		})
+	}
+	f.Unlock()
+
+	if len(updates) > 0 {
+		f.queueUpdate(adapter.Update{ValueContainer: f, Updates: updates})
+	}
+}
+
+// refreshPaths returns the paths that are requested from the remote instance after connecting
+func (f *Federation) refreshPaths() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	paths := map[string]bool{}
+	for path := range f.values {
+		paths[strings.Split(path, "/")[0]] = true
+	}
+
+	for _, pattern := range f.share {
+		static := []string{}
+		for _, part := range strings.Split(pattern, "/") {
+			if part == "+" || part == "#" {
+				break
+			}
+			static = append(static, part)
+		}
+
+		if len(static) > 1 && static[0] == f.root {
+			paths[strings.Join(static[1:], "/")] = true
+		}
+	}
+
+	list := make([]string, 0, len(paths))
+	for path := range paths {
+		list = append(list, path)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// shared checks if a remote key is shared through the federation
+func (f *Federation) shared(key string) bool {
+	for _, pattern := range f.exclude {
+		if util.MatchPattern(pattern, key) {
+			return false
+		}
+	}
+
+	if len(f.share) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.share {
+		if util.MatchPattern(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Federation) statusHandler(client mqtt.Client, msg mqtt.Message) {
+	key, ok := f.topics.ParseFunction(util.FunctionStatus, msg.Topic())
+	if !ok || !strings.HasPrefix(key, f.root+"/") || !f.shared(key) {
+		return
+	}
+	path := strings.TrimPrefix(key, f.root+"/")
+
+	kvu := adapter.ValueUpdate{
+		Key:    f.id + "/" + path,
+		Source: &adapter.Source{Type: adapter.SourceFederation, ID: f.id},
+	}
+
+	if len(msg.Payload()) == 0 {
+		// Cleared retained status
+		kvu.Removed = true
+	} else {
+		status := util.DecodeStatusPayload(msg.Payload())
+		if status.Source != nil && status.Source.Type == adapter.SourceFederation {
+			// Value has been mirrored from another instance. Mirroring it again could create a loop.
+			return
+		}
+
+		kvu.Value = status.Value
+		if status.Source != nil {
+			kvu.Source.Detail = status.Source.String()
+		}
+		if status.Timestamp != nil {
+			kvu.Timestamp = *status.Timestamp
+		}
+		if status.Stale != nil {
+			kvu.Stale = *status.Stale
+		}
+	}
+
+	f.Lock()
+	if kvu.Removed {
+		delete(f.values, path)
+	} else {
+		f.values[path] = kvu.Value
+	}
+	f.Unlock()
+
+	f.queueUpdate(adapter.Update{ValueContainer: f, Updates: []adapter.ValueUpdate{kvu}})
+}
+
+// publish forwards a request to the remote instance
+func (f *Federation) publish(function string, path string, val interface{}) error {
+	key := f.root + "/" + path
+	if !f.shared(key) {
+		return ErrorNotShared
+	}
+
+	f.Lock()
+	c := f.client
+	f.Unlock()
+
+	if c == nil || !c.IsConnected() {
+		return ErrorNotConnected
+	}
+
+	payload := []byte{}
+	if function != util.FunctionGet {
+		// The remote instance is a bridge which understands the envelope
+		b, err := util.EncodeRequest(util.SetRequest{
+			Value:  val,
+			Source: &adapter.Source{Type: adapter.SourceMQTT, ID: f.id},
+		}, true)
+		if err != nil {
+			return err
+		}
+		payload = b
+	}
+
+	topic := f.topics.Build(function, key)
+	if token := c.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// Get returns the mirrored value and asks the remote instance to republish it
+func (f *Federation) Get(id string) (interface{}, error) {
+	if id == "" {
+		return f, nil
+	}
+
+	if err := f.publish(util.FunctionGet, id, nil); err != nil && err != ErrorNotConnected {
+		return nil, err
+	}
+
+	return f.get(id), nil
+}
+
+func (f *Federation) get(id string) interface{} {
+	f.Lock()
+	defer f.Unlock()
+
+	if val, ok := f.values[id]; ok {
+		return val
+	}
+
+	for path := range f.values {
+		if strings.HasPrefix(path, id+"/") {
+			return &container{federation: f, prefix: id}
+		}
+	}
+
+	return nil
+}
+
+// getAll returns the direct children of a prefix
+func (f *Federation) getAll(prefix string) map[string]interface{} {
+	f.Lock()
+	defer f.Unlock()
+
+	vals := map[string]interface{}{}
+	for path, val := range f.values {
+		if prefix != "" {
+			if !strings.HasPrefix(path, prefix+"/") {
+				continue
+			}
+			path = strings.TrimPrefix(path, prefix+"/")
+		}
+
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) == 1 {
+			vals[parts[0]] = val
+			continue
+		}
+
+		childPrefix := parts[0]
+		if prefix != "" {
+			childPrefix = prefix + "/" + parts[0]
+		}
+		vals[parts[0]] = &container{federation: f, prefix: childPrefix}
+	}
+
+	return vals
+}
+
+// Set forwards the value to the remote instance
+func (f *Federation) Set(id string, val interface{}) error {
+	if id == "" {
+		return errors.New("Value can't be assigned to the federated instance")
+	}
+
+	return f.publish(util.FunctionSet, id, val)
+}
+
+// SetMulti forwards all values to the remote instance as a single set request
+func (f *Federation) SetMulti(id string, vals map[string]interface{}) error {
+	if id == "" {
+		return errors.New("Values can't be assigned to the federated instance")
+	}
+
+	return f.publish(util.FunctionSet, id, vals)
+}
+
+// Command forwards the command to the remote instance
+func (f *Federation) Command(id string, args interface{}) error {
+	return f.publish(util.FunctionCommand, id, args)
+}
+
+func (f *Federation) GetAll() (map[string]interface{}, error) {
+	return f.getAll(""), nil
+}
+
+// Connected returns true when there is a connection to the remote broker
+func (f *Federation) Connected() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.client != nil && f.client.IsConnected()
+}
+
+func (f *Federation) ID() string {
+	return f.id
+}
+
+func (f *Federation) UpdateChannel() <-chan adapter.Update {
+	return f.Updater.UpdateChannel()
+}
+
+func (f *Federation) Close() error {
+	f.updateMutex.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.stop)
+		close(f.wake)
+	}
+	f.updateMutex.Unlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.client != nil {
+		f.client.Disconnect(250)
+	}
+
+	return nil
+}
+
+// container exposes a subtree of the mirrored values
+type container struct {
+	federation *Federation
+	prefix     string
+}
+
+func (c *container) Get(id string) (interface{}, error) {
+	return c.federation.get(c.prefix + "/" + id), nil
+}
+
+func (c *container) Set(id string, val interface{}) error {
+	return c.federation.Set(c.prefix+"/"+id, val)
+}
+
+func (c *container) SetMulti(id string, vals map[string]interface{}) error {
+	if id == "" {
+		return c.federation.SetMulti(c.prefix, vals)
+	}
+	return c.federation.SetMulti(c.prefix+"/"+id, vals)
+}
+
+func (c *container) GetAll() (map[string]interface{}, error) {
+	return c.federation.getAll(c.prefix), nil
+}
+
+// Create returns a new federation adapter connected to a remote homeautomation instance
+func Create(id string, config map[string]interface{}) (adapter.Adapter, error) {
+	f, err := newFederation(id, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go f.connect()
+
+	return f, nil
+}
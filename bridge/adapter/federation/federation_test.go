@@ -0,0 +1,255 @@
+package federation
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+type mockToken bool
+
+func (mt mockToken) Wait() bool                     { return bool(mt) }
+func (mt mockToken) WaitTimeout(time.Duration) bool { return bool(mt) }
+func (mt mockToken) Error() error                   { return nil }
+
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (mm mockMessage) Duplicate() bool   { return false }
+func (mm mockMessage) Qos() byte         { return 1 }
+func (mm mockMessage) Retained() bool    { return false }
+func (mm mockMessage) Topic() string     { return mm.topic }
+func (mm mockMessage) MessageID() uint16 { return 0 }
+func (mm mockMessage) Payload() []byte   { return mm.payload }
+
+type mockClient struct {
+	sync.Mutex
+	subs map[string]mqtt.MessageHandler
+	pubs []mockMessage
+}
+
+func (mc *mockClient) IsConnected() bool       { return true }
+func (mc *mockClient) Connect() mqtt.Token     { return mockToken(true) }
+func (mc *mockClient) Disconnect(quiesce uint) {}
+
+func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.pubs = append(mc.pubs, mockMessage{topic: topic, payload: payload.([]byte)})
+	return mockToken(false)
+}
+
+func (mc *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	mc.subs[topic] = callback
+	return mockToken(false)
+}
+
+func (mc *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	panic("not implemented")
+}
+
+func (mc *mockClient) Unsubscribe(topics ...string) mqtt.Token {
+	return mockToken(false)
+}
+
+func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	panic("not implemented")
+}
+
+func (mc *mockClient) published() []mockMessage {
+	mc.Lock()
+	defer mc.Unlock()
+	pubs := mc.pubs
+	mc.pubs = nil
+	return pubs
+}
+
+func TestFederation(t *testing.T) {
+	f, err := newFederation("cabin", map[string]interface{}{
+		"servers": []interface{}{"tcp://cabin:1883"},
+		"root":    "cabin",
+		"share":   []interface{}{"cabin/deconz/#"},
+		"exclude": []interface{}{"cabin/deconz/config/#"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc := &mockClient{subs: map[string]mqtt.MessageHandler{}}
+	f.newClient = func(opts *mqtt.ClientOptions) mqtt.Client { return mc }
+	f.connect()
+	f.onConnect(mc)
+
+	if pubs := mc.published(); len(pubs) != 1 || pubs[0].topic != "cabin/get/deconz" {
+		t.Error("Wrong refresh requests", pubs)
+	}
+
+	handler := mc.subs["cabin/status/#"]
+	if handler == nil {
+		t.Fatal("Not subscribed to remote status topics", mc.subs)
+	}
+
+	ch := f.UpdateChannel()
+
+	handler(mc, mockMessage{topic: "cabin/status/db/foo", payload: []byte("1")})
+	handler(mc, mockMessage{topic: "cabin/status/deconz/config/version", payload: []byte("1")})
+	handler(mc, mockMessage{topic: "cabin/status/deconz/lights/2/on", payload: []byte(`{"value":true,"source":{"type":"federation","id":"haaga"}}`)})
+	handler(mc, mockMessage{topic: "cabin/status/deconz/lights/1/on", payload: []byte(`{"value":true,"source":{"type":"trigger","id":"night"}}`)})
+
+	u := <-ch
+	if len(u.Updates) != 1 {
+		t.Fatal("Wrong number of updates", u.Updates)
+	}
+	kvu := u.Updates[0]
+	if kvu.Key != "cabin/deconz/lights/1/on" || kvu.Value != true {
+		t.Error("Wrong update", kvu)
+	}
+	if kvu.Source == nil || kvu.Source.Type != adapter.SourceFederation || kvu.Source.Detail != "trigger:night" {
+		t.Error("Wrong source", kvu.Source)
+	}
+
+	all, _ := f.GetAll()
+	if len(all) != 1 {
+		t.Error("Wrong values", all)
+	}
+
+	val, _ := f.Get("deconz/lights/1/on")
+	if val != true {
+		t.Error("Wrong value", val)
+	}
+	mc.published()
+
+	if err := f.Set("deconz/lights/1/on", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("db/foo", false); err != ErrorNotShared {
+		t.Error("Set on an unshared path should fail", err)
+	}
+	if err := adapter.SetMulti(f, "deconz/lights/1", map[string]interface{}{"on": true, "bri": 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	pubs := mc.published()
+	if len(pubs) != 2 {
+		t.Fatal("Wrong number of forwarded requests", pubs)
+	}
+	if pubs[0].topic != "cabin/set/deconz/lights/1/on" || string(pubs[0].payload) != `{"value":false,"source":{"type":"mqtt","id":"cabin"}}` {
+		t.Error("Wrong set request", pubs[0].topic, string(pubs[0].payload))
+	}
+	if pubs[1].topic != "cabin/set/deconz/lights/1" || string(pubs[1].payload) != `{"value":{"bri":100,"on":true},"source":{"type":"mqtt","id":"cabin"}}` {
+		t.Error("Wrong set request", pubs[1].topic, string(pubs[1].payload))
+	}
+
+	handler(mc, mockMessage{topic: "cabin/status/deconz/lights/1/on", payload: []byte{}})
+	u = <-ch
+	if !u.Updates[0].Removed {
+		t.Error("Cleared status should remove the value", u.Updates[0])
+	}
+
+	// The handler doesn't block the message router while updates are not read
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			handler(mc, mockMessage{topic: "cabin/status/deconz/lights/1/bri", payload: []byte(strconv.Itoa(i))})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Status handler blocked")
+	}
+
+	for i := 0; i < 200; i++ {
+		if u := <-ch; u.Updates[0].Value != float64(i) {
+			t.Fatal("Wrong update order", u.Updates[0].Value, i)
+		}
+	}
+}
+
+func TestFederationTopics(t *testing.T) {
+	f, err := newFederation("cabin", map[string]interface{}{
+		"root": "cabin",
+		"topics": []map[string]interface{}{{
+			"status": "home/{path}/state",
+			"set":    "home/{path}/set",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mc := &mockClient{subs: map[string]mqtt.MessageHandler{}}
+	f.newClient = func(opts *mqtt.ClientOptions) mqtt.Client { return mc }
+	f.connect()
+	f.onConnect(mc)
+
+	handler := mc.subs["home/cabin/#"]
+	if handler == nil {
+		t.Fatal("Not subscribed with the remote layout", mc.subs)
+	}
+
+	ch := f.UpdateChannel()
+	handler(mc, mockMessage{topic: "home/cabin/deconz/lights/1/on/state", payload: []byte("true")})
+	if u := <-ch; u.Updates[0].Key != "cabin/deconz/lights/1/on" {
+		t.Error("Wrong update", u.Updates[0])
+	}
+
+	mc.published()
+	f.Set("deconz/lights/1/on", false)
+	if pubs := mc.published(); len(pubs) != 1 || pubs[0].topic != "home/cabin/deconz/lights/1/on/set" {
+		t.Error("Wrong set request", pubs)
+	}
+
+	if _, err := newFederation("cabin", map[string]interface{}{
+		"root":   "cabin",
+		"topics": map[string]interface{}{"status": "home/state"},
+	}); err == nil {
+		t.Error("Invalid templates should return an error")
+	}
+}
+
+// failingToken never connects
+type failingToken struct{}
+
+func (ft failingToken) Wait() bool                     { return true }
+func (ft failingToken) WaitTimeout(time.Duration) bool { return true }
+func (ft failingToken) Error() error                   { return errors.New("connection refused") }
+
+type unreachableClient struct {
+	mockClient
+}
+
+func (uc *unreachableClient) Connect() mqtt.Token { return failingToken{} }
+
+func TestFederationClose(t *testing.T) {
+	f, err := newFederation("cabin", map[string]interface{}{"root": "cabin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.newClient = func(opts *mqtt.ClientOptions) mqtt.Client { return &unreachableClient{} }
+	done := make(chan struct{})
+	go func() {
+		f.connect()
+		close(done)
+	}()
+
+	f.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Connect loop should stop when closed")
+	}
+
+	// Updates after close are dropped instead of panicking
+	f.queueUpdate(adapter.Update{ValueContainer: f})
+}
@@ -32,8 +32,12 @@ func NewMultiAdapter(id string, adapters ...Adapter) Adapter {
 
 				for _, kvu := range u.Updates {
 					proxyU.Updates = append(proxyU.Updates, ValueUpdate{
-						Key:   id + "/" + kvu.Key,
-						Value: kvu.Value,
+						Key:       id + "/" + kvu.Key,
+						Value:     kvu.Value,
+						Source:    kvu.Source,
+						Timestamp: kvu.Timestamp,
+						Stale:     kvu.Stale,
+						Removed:   kvu.Removed,
 					})
 				}
 
@@ -74,6 +78,35 @@ func (ma *MultiAdapter) Set(id string, val interface{}) error {
 	return adapter.Set(strings.Join(parts[1:], "/"), val)
 }
 
+func (ma *MultiAdapter) SetMulti(id string, vals map[string]interface{}) error {
+	if id == "" {
+		return nil
+	}
+
+	parts := strings.Split(id, "/")
+	adapter, ok := ma.adapters[parts[0]]
+	if !ok {
+		return NoSuchAdapterError
+	}
+
+	return SetMulti(adapter, strings.Join(parts[1:], "/"), vals)
+}
+
+func (ma *MultiAdapter) Command(id string, args interface{}) error {
+	parts := strings.Split(id, "/")
+	adapter, ok := ma.adapters[parts[0]]
+	if !ok {
+		return NoSuchAdapterError
+	}
+
+	commander, ok := adapter.(Commander)
+	if !ok {
+		return NoSuchCommandError
+	}
+
+	return commander.Command(strings.Join(parts[1:], "/"), args)
+}
+
 func (ma *MultiAdapter) GetAll() (map[string]interface{}, error) {
 	vals := map[string]interface{}{}
 
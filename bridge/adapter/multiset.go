@@ -0,0 +1,63 @@
+package adapter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MultiSetter is implemented by value containers that can set several keys of a container in a single operation.
+// Id is the path of the container (empty for the receiver itself).
+type MultiSetter interface {
+	SetMulti(id string, vals map[string]interface{}) error
+}
+
+// MultiSetError contains the failed keys of a sequential multi-key set
+type MultiSetError map[string]error
+
+func (mse MultiSetError) Error() string {
+	keys := make([]string, 0, len(mse))
+	for key := range mse {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", key, mse[key].Error()))
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+// SetMulti sets the given keys of the container in id. Containers implementing MultiSetter
+// handle it in one operation, otherwise keys are set one by one and the errors are aggregated.
+func SetMulti(vc ValueContainer, id string, vals map[string]interface{}) error {
+	if ms, ok := vc.(MultiSetter); ok {
+		return ms.SetMulti(id, vals)
+	}
+
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := MultiSetError{}
+	for _, key := range keys {
+		fullKey := key
+		if id != "" {
+			fullKey = id + "/" + key
+		}
+
+		if err := vc.Set(fullKey, vals[key]); err != nil {
+			errs[key] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package adapter
+
+import (
+	"errors"
+	"testing"
+)
+
+type mapContainer map[string]interface{}
+
+func (mc mapContainer) Get(id string) (interface{}, error) {
+	return mc[id], nil
+}
+
+func (mc mapContainer) Set(id string, val interface{}) error {
+	if id == "group/fail" {
+		return errors.New("failed")
+	}
+	mc[id] = val
+	return nil
+}
+
+func (mc mapContainer) GetAll() (map[string]interface{}, error) {
+	return mc, nil
+}
+
+type multiSetContainer struct {
+	mapContainer
+	calls int
+}
+
+func (msc *multiSetContainer) SetMulti(id string, vals map[string]interface{}) error {
+	msc.calls++
+	return nil
+}
+
+func TestSetMulti(t *testing.T) {
+	mc := mapContainer{}
+	err := SetMulti(mc, "group", map[string]interface{}{"on": true, "bri": 120, "fail": 1})
+
+	if mc["group/on"] != true || mc["group/bri"] != 120 {
+		t.Error("Values should be set one by one", mc)
+	}
+
+	mse, ok := err.(MultiSetError)
+	if !ok || len(mse) != 1 || mse["fail"] == nil {
+		t.Error("Expected aggregated error", err)
+	}
+
+	if err.Error() != "fail: failed" {
+		t.Error("Wrong error message", err.Error())
+	}
+
+	msc := &multiSetContainer{mapContainer: mapContainer{}}
+	if err := SetMulti(msc, "group", map[string]interface{}{"on": true, "bri": 120}); err != nil {
+		t.Error(err)
+	}
+
+	if msc.calls != 1 || len(msc.mapContainer) != 0 {
+		t.Error("MultiSetter should be used", msc.calls)
+	}
+}
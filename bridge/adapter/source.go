@@ -0,0 +1,38 @@
+package adapter
+
+import "strings"
+
+// Source types
+const (
+	SourceDevice     = "device"
+	SourceTrigger    = "trigger"
+	SourceAlexa      = "alexa"
+	SourceHTTP       = "http"
+	SourceMQTT       = "mqtt"
+	SourceFederation = "federation"
+	SourceScene      = "scene"
+	SourceHomie      = "homie"
+)
+
+// Source describes who initiated a change
+type Source struct {
+	// Type of the source (trigger, alexa, http, mqtt, federation, scene, homie or device)
+	Type string `json:"type"`
+	// ID identifies the source within its type (trigger name, alexa endpoint, http user, scene name, homie device etc.)
+	ID string `json:"id,omitempty"`
+	// Detail contains additional information such as the alexa directive
+	Detail string `json:"detail,omitempty"`
+	// Client is the MQTT client id of the publisher when known
+	Client string `json:"client,omitempty"`
+}
+
+func (s Source) String() string {
+	parts := []string{s.Type}
+	if s.ID != "" {
+		parts = append(parts, s.ID)
+	}
+	if s.Detail != "" {
+		parts = append(parts, s.Detail)
+	}
+	return strings.Join(parts, ":")
+}
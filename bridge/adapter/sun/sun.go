@@ -0,0 +1,155 @@
+package sun
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/bridge/util"
+	rootutil "github.com/orktes/homeautomation/util"
+)
+
+// UpdateInterval defines how often the sun position is recalculated
+var UpdateInterval = time.Minute
+
+// Sun publishes the solar events of the current day and the position of the sun
+type Sun struct {
+	id        string
+	latitude  float64
+	longitude float64
+
+	values map[string]interface{}
+	stop   func()
+
+	adapter.Updater
+	sync.Mutex
+}
+
+// calculate returns the current values
+func (s *Sun) calculate(now time.Time) map[string]interface{} {
+	vals := map[string]interface{}{}
+
+	times := rootutil.CalculateSunTimes(now, s.latitude, s.longitude)
+	for _, event := range rootutil.SunEvents {
+		at, _ := times.Event(event)
+		if at.IsZero() {
+			vals[event] = nil
+			continue
+		}
+		vals[event] = at.Format(time.RFC3339)
+	}
+
+	elevation, azimuth := rootutil.SunPosition(now, s.latitude, s.longitude)
+	vals["elevation"] = math.Round(elevation*10) / 10
+	vals["azimuth"] = math.Round(azimuth*10) / 10
+	vals["daylight"] = elevation > rootutil.SunriseAltitude
+
+	return vals
+}
+
+func (s *Sun) update() {
+	vals := s.calculate(time.Now())
+
+	s.Lock()
+	updates := []adapter.ValueUpdate{}
+	for key, val := range vals {
+		if old, ok := s.values[key]; ok && old == val {
+			continue
+		}
+		updates = append(updates, adapter.ValueUpdate{Key: s.id + "/" + key, Value: val})
+	}
+	s.values = vals
+	s.Unlock()
+
+	if len(updates) > 0 {
+		s.Updater.SendUpdate(adapter.Update{ValueContainer: s, Updates: updates})
+	}
+}
+
+func (s *Sun) Describe() adapter.Description {
+	values := map[string]adapter.ValueDescription{
+		"elevation": {Type: adapter.TypeFloat, Unit: "°", Min: -90, Max: 90},
+		"azimuth":   {Type: adapter.TypeFloat, Unit: "°", Min: 0, Max: 360},
+		"daylight":  {Type: adapter.TypeBoolean},
+	}
+	for _, event := range rootutil.SunEvents {
+		values[event] = adapter.ValueDescription{Type: adapter.TypeString}
+	}
+
+	return adapter.Description{
+		Kind:   adapter.KindSensor,
+		Name:   s.id,
+		Values: values,
+	}
+}
+
+func (s *Sun) ID() string {
+	return s.id
+}
+
+func (s *Sun) Get(id string) (interface{}, error) {
+	if id == "" {
+		return s, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.values[id], nil
+}
+
+func (s *Sun) Set(id string, val interface{}) error {
+	return errors.New("Sun values are read only")
+}
+
+func (s *Sun) GetAll() (map[string]interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	vals := map[string]interface{}{}
+	for key, val := range s.values {
+		vals[key] = val
+	}
+
+	return vals, nil
+}
+
+func (s *Sun) UpdateChannel() <-chan adapter.Update {
+	return s.Updater.UpdateChannel()
+}
+
+func (s *Sun) Close() error {
+	if s.stop != nil {
+		s.stop()
+	}
+	return nil
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch val := val.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	}
+	return 0, false
+}
+
+// Create returns a new sun adapter for the latitude and longitude in the config
+func Create(id string, config map[string]interface{}) (adapter.Adapter, error) {
+	latitude, latOk := toFloat(config["latitude"])
+	longitude, lonOk := toFloat(config["longitude"])
+	if !latOk || !lonOk {
+		return nil, errors.New("latitude and longitude must be defined")
+	}
+
+	s := &Sun{id: id, latitude: latitude, longitude: longitude}
+	s.values = s.calculate(time.Now())
+	s.stop = util.Interval(s.update, UpdateInterval)
+
+	return s, nil
+}
@@ -2,12 +2,21 @@ package adapter
 
 import (
 	"sync"
+	"time"
 )
 
 // ValueUpdate reperesents a single updated value
 type ValueUpdate struct {
 	Key   string
 	Value interface{}
+	// Source of the change if known
+	Source *Source
+	// Timestamp of the value as reported by the device. Zero means the time the update was sent.
+	Timestamp time.Time
+	// Stale is set when the value can't be trusted to reflect the device (e.g. device unreachable)
+	Stale bool
+	// Removed is set when the key (and everything under it) no longer exists
+	Removed bool
 }
 
 // Update a device update event
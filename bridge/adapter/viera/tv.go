@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -44,6 +45,8 @@ type VieraTV struct {
 	volume int
 	mute   bool
 
+	closeChannel chan struct{}
+
 	sync.Mutex
 }
 
@@ -52,6 +55,7 @@ func (vt *VieraTV) init() error {
 		return err
 	}
 
+	vt.closeChannel = make(chan struct{})
 	go vt.updateLoop()
 
 	return nil
@@ -59,11 +63,19 @@ func (vt *VieraTV) init() error {
 
 func (vt *VieraTV) updateLoop() {
 	for {
-		time.Sleep(time.Duration(UPDATE_LOOP_INTERVAL) * time.Second)
-		vt.readValues(true)
+		select {
+		case <-time.After(time.Duration(UPDATE_LOOP_INTERVAL) * time.Second):
+			vt.readValues(true)
+		case <-vt.closeChannel:
+			return
+		}
 	}
 }
 
+func (vt *VieraTV) close() {
+	close(vt.closeChannel)
+}
+
 func (vt *VieraTV) readValues(emitUpdate bool) error {
 	if err := vt.readVolume(emitUpdate); err != nil {
 		return err
@@ -308,6 +320,25 @@ func (vt *VieraTV) Set(id string, val interface{}) error {
 	return nil
 }
 
+// Command supports sending remote control keys (e.g. "NRC_MUTE-ONOFF") with the "key" command
+func (vt *VieraTV) Command(id string, args interface{}) error {
+	switch id {
+	case "key":
+		key, ok := args.(string)
+		if !ok {
+			return fmt.Errorf("Invalid key %v", args)
+		}
+
+		vt.Lock()
+		defer vt.Unlock()
+
+		_, err := vt.sendCMD("control", "X_SendKey", "<X_KeyEvent>"+html.EscapeString(key)+"</X_KeyEvent>")
+		return err
+	}
+
+	return adapter.NoSuchCommandError
+}
+
 func (vt *VieraTV) GetAll() (map[string]interface{}, error) {
 	vals := map[string]interface{}{}
 
@@ -322,8 +353,22 @@ func (vt *VieraTV) GetAll() (map[string]interface{}, error) {
 	return vals, nil
 }
 
+func (vt *VieraTV) Describe() adapter.Description {
+	return adapter.Description{
+		Kind:         adapter.KindMediaPlayer,
+		Name:         vt.id,
+		Manufacturer: "Panasonic",
+		Model:        "Viera",
+		Values: map[string]adapter.ValueDescription{
+			"power":  {Type: adapter.TypeBoolean, Settable: true},
+			"mute":   {Type: adapter.TypeBoolean, Settable: true},
+			"volume": {Type: adapter.TypeInteger, Settable: true, Min: 0, Max: 100},
+		},
+	}
+}
+
 func (vt *VieraTV) ID() string {
-	return vt.ID()
+	return vt.id
 }
 
 func (vt *VieraTV) UpdateChannel() <-chan adapter.Update {
@@ -2,40 +2,104 @@ package viera
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/huin/goupnp"
 	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/bridge/util"
 )
 
+// DISCOVERY_INTERVAL defines how often (in seconds) TVs are rediscovered
+var DISCOVERY_INTERVAL = 300
+
 type VieraDiscovery struct {
 	adapter.Updater
 
 	id string
 
 	// TODO make the mac address a map from uuid to mac
-	mac string
-	tvs []*VieraTV
+	mac    string
+	tvs    map[string]*VieraTV
+	nextID int
+
+	stopDiscovery func()
 
 	sync.Mutex
 }
 
 func (vd *VieraDiscovery) initialize() error {
+	if err := vd.discover(); err != nil {
+		return err
+	}
+
+	vd.stopDiscovery = util.Interval(func() {
+		if err := vd.discover(); err != nil {
+			fmt.Printf("Error while discovering viera tvs %s\n", err.Error())
+		}
+	}, time.Duration(DISCOVERY_INTERVAL)*time.Second)
+
+	return nil
+}
+
+func (vd *VieraDiscovery) discover() error {
 	responses, err := goupnp.DiscoverDevices("urn:panasonic-com:service:p00NetworkControl:1")
 	if err != nil {
 		return err
 	}
 
-	for i, info := range responses {
-		tv := &VieraTV{id: fmt.Sprintf("%s/%d", vd.id, i+1), host: info.Root.URLBase.Host, mac: vd.mac}
+	hosts := map[string]bool{}
+	for _, info := range responses {
+		if info.Root == nil {
+			continue
+		}
+		hosts[info.Root.URLBase.Host] = true
+	}
+
+	vd.Lock()
+	removed := []*VieraTV{}
+	known := map[string]bool{}
+	for id, tv := range vd.tvs {
+		if !hosts[tv.host] {
+			delete(vd.tvs, id)
+			removed = append(removed, tv)
+			continue
+		}
+		known[tv.host] = true
+	}
+	vd.Unlock()
+
+	for _, tv := range removed {
+		tv.close()
+		fmt.Printf("Viera tv %s no longer discovered\n", tv.id)
+		vd.Updater.SendUpdate(adapter.Update{
+			ValueContainer: vd,
+			Updates: []adapter.ValueUpdate{
+				adapter.ValueUpdate{Key: tv.id, Removed: true},
+			},
+		})
+	}
+
+	for host := range hosts {
+		if known[host] {
+			continue
+		}
+
+		vd.Lock()
+		vd.nextID++
+		id := fmt.Sprintf("%d", vd.nextID)
+		vd.Unlock()
+
+		tv := &VieraTV{id: vd.id + "/" + id, host: host, mac: vd.mac}
 		vd.pipeUpdates(tv)
 		if err := tv.init(); err != nil {
 			return err
 		}
 
-		vd.tvs = append(vd.tvs, tv)
+		vd.Lock()
+		vd.tvs[id] = tv
+		vd.Unlock()
 	}
 
 	return nil
@@ -59,9 +123,7 @@ func (vd *VieraDiscovery) Get(id string) (interface{}, error) {
 	}
 
 	parts := strings.Split(id, "/")
-	intID, _ := strconv.ParseInt(parts[0], 10, 64)
-	if intID >= 1 && len(vd.tvs) >= int(intID) {
-		tv := vd.tvs[int(intID)-1]
+	if tv, ok := vd.tvs[parts[0]]; ok {
 		if len(parts) == 1 {
 			return tv, nil
 		}
@@ -90,24 +152,40 @@ func (vd *VieraDiscovery) Set(id string, val interface{}) error {
 	return vc.Set(strings.Join(parts[1:], "/"), val)
 }
 
-func (vd *VieraDiscovery) GetAll() (map[string]interface{}, error) {
+func (vd *VieraDiscovery) Command(id string, args interface{}) error {
+	parts := strings.Split(id, "/")
+
 	vd.Lock()
-	l := len(vd.tvs)
+	tv, ok := vd.tvs[parts[0]]
 	vd.Unlock()
 
+	if !ok {
+		return adapter.NoSuchCommandError
+	}
+
+	return tv.Command(strings.Join(parts[1:], "/"), args)
+}
+
+func (vd *VieraDiscovery) GetAll() (map[string]interface{}, error) {
+	vd.Lock()
+	defer vd.Unlock()
+
 	vals := map[string]interface{}{}
-	for i := 1; i <= l; i++ {
-		id := fmt.Sprintf("%d", i)
-		c, err := vd.Get(id)
-		if err != nil {
-			return nil, err
-		}
-		vals[id] = c
+	for id, tv := range vd.tvs {
+		vals[id] = tv
 	}
 
 	return vals, nil
 }
 
+// Connected returns true when at least one TV has been discovered
+func (vd *VieraDiscovery) Connected() bool {
+	vd.Lock()
+	defer vd.Unlock()
+
+	return len(vd.tvs) > 0
+}
+
 func (vd *VieraDiscovery) ID() string {
 	return vd.id
 }
@@ -125,6 +203,6 @@ func Create(id string, config map[string]interface{}) (adapter.Adapter, error) {
 
 	mac, _ := config["mac"].(string)
 
-	viera := &VieraDiscovery{id: id, mac: mac}
+	viera := &VieraDiscovery{id: id, mac: mac, tvs: map[string]*VieraTV{}}
 	return viera, viera.initialize()
 }
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+// Connection states follow the mqtt-smarthome convention
+const (
+	stateDisconnected        = "0"
+	stateAdapterDisconnected = "1"
+	stateConnected           = "2"
+)
+
+var availabilityInterval = 10 * time.Second
+
+func (bridge *MQTTBridge) bridgeStatusTopic() string {
+	return bridge.getRoot() + "/connected"
+}
+
+func (bridge *MQTTBridge) availabilityTopic(a adapter.Adapter) string {
+	return bridge.bridgeStatusTopic() + "/" + a.ID()
+}
+
+// adapters returns the adapters behind the main adapter
+func (bridge *MQTTBridge) adapters() []adapter.Adapter {
+	multi, ok := bridge.adapter.(*adapter.MultiAdapter)
+	if !ok {
+		return []adapter.Adapter{bridge.adapter}
+	}
+
+	adapters := []adapter.Adapter{}
+	vals, _ := multi.GetAll()
+	for _, val := range vals {
+		if a, ok := val.(adapter.Adapter); ok {
+			adapters = append(adapters, a)
+		}
+	}
+	return adapters
+}
+
+// adapterFor returns the adapter that owns the given path
+func (bridge *MQTTBridge) adapterFor(path string) adapter.Adapter {
+	if _, ok := bridge.adapter.(*adapter.MultiAdapter); !ok {
+		return bridge.adapter
+	}
+
+	rest := strings.TrimPrefix(path, bridge.adapter.ID()+"/")
+	id := strings.Split(rest, "/")[0]
+	for _, a := range bridge.adapters() {
+		if a.ID() == id {
+			return a
+		}
+	}
+
+	return bridge.adapter
+}
+
+func adapterState(a adapter.Adapter) string {
+	if connector, ok := a.(adapter.Connector); ok && !connector.Connected() {
+		return stateAdapterDisconnected
+	}
+	return stateConnected
+}
+
+// publishAvailability publishes the connection state of each adapter when it has changed
+func (bridge *MQTTBridge) publishAvailability() {
+	for _, a := range bridge.adapters() {
+		topic := bridge.availabilityTopic(a)
+		state := adapterState(a)
+
+		bridge.availabilityMutex.Lock()
+		changed := bridge.availability[topic] != state
+		bridge.availability[topic] = state
+		bridge.availabilityMutex.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		if token := bridge.c.Publish(topic, 1, true, []byte(state)); token.Wait() && token.Error() != nil {
+			fmt.Printf("Error publishing availability for %s %s\n", a.ID(), token.Error())
+		}
+	}
+}
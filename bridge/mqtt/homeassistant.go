@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/bridge/util"
+	"github.com/orktes/homeautomation/queue"
+	rootutil "github.com/orktes/homeautomation/util"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+// valueTemplate extracts the value from plain and enveloped status payloads
+const valueTemplate = "{{ (value_json.value if value_json is mapping else value_json) | tojson }}"
+
+var discoveryInterval = time.Minute
+
+type discoveryEntry struct {
+	path    string
+	payload string
+}
+
+type haConfig map[string]interface{}
+
+func (bridge *MQTTBridge) discoveryPrefix() string {
+	if prefix := bridge.conf.Bridge.HomeAssistant.Prefix; prefix != "" {
+		return prefix
+	}
+	return defaultDiscoveryPrefix
+}
+
+func (bridge *MQTTBridge) startDiscovery() {
+	if bridge.conf.Bridge.HomeAssistant == nil {
+		return
+	}
+
+	publish := func() {
+		if err := bridge.publishDiscovery(); err != nil {
+			fmt.Printf("Error publishing home assistant discovery %s\n", err.Error())
+		}
+	}
+
+	publish()
+	bridge.stopDiscovery = util.Interval(publish, discoveryInterval)
+}
+
+// publishDiscovery publishes home assistant discovery configs for all devices that describe themselves.
+// Configs are only republished when they have changed.
+func (bridge *MQTTBridge) publishDiscovery() error {
+	configs := map[string]discoveryEntry{}
+
+	err := util.TraverseContainers(bridge.adapter, func(path string, vc adapter.ValueContainer) error {
+		describer, ok := vc.(adapter.Describer)
+		if !ok {
+			return nil
+		}
+
+		for topic, conf := range bridge.discoveryConfigs(path, describer.Describe()) {
+			b, err := json.Marshal(conf)
+			if err != nil {
+				return err
+			}
+			configs[topic] = discoveryEntry{path: path, payload: string(b)}
+		}
+
+		return nil
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	for topic, entry := range configs {
+		bridge.discoveryMutex.Lock()
+		previous, ok := bridge.discovered[topic]
+		bridge.discovered[topic] = entry
+		bridge.discoveryMutex.Unlock()
+
+		if ok && previous.payload == entry.payload {
+			continue
+		}
+
+		fmt.Printf("MQTT publish %s %s\n", topic, entry.payload)
+		if token := bridge.c.Publish(topic, 1, true, []byte(entry.payload)); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	return nil
+}
+
+// clearDiscovery removes discovery configs of the device in path and devices under it
+func (bridge *MQTTBridge) clearDiscovery(path string) error {
+	bridge.discoveryMutex.Lock()
+	topics := []string{}
+	for topic, entry := range bridge.discovered {
+		if entry.path == path || strings.HasPrefix(entry.path, path+"/") {
+			topics = append(topics, topic)
+			delete(bridge.discovered, topic)
+		}
+	}
+	bridge.discoveryMutex.Unlock()
+
+	// Removals arrive on the update goroutine which must not wait for the broker
+	for _, topic := range topics {
+		bridge.queue.Publish(queue.Message{Topic: topic, QoS: 1, Retained: true, Payload: []byte{}, Coalesce: true})
+	}
+
+	return nil
+}
+
+func (bridge *MQTTBridge) discoveryConfigs(path string, desc adapter.Description) map[string]haConfig {
+	objectID := strings.Replace(path, "/", "_", -1)
+	name := desc.Name
+	if name == "" {
+		name = path
+	}
+
+	device := haConfig{
+		"identifiers": []string{objectID},
+		"name":        name,
+	}
+	if desc.Manufacturer != "" {
+		device["manufacturer"] = desc.Manufacturer
+	}
+	if desc.Model != "" {
+		device["model"] = desc.Model
+	}
+
+	availability := []haConfig{
+		{
+			"topic":                 bridge.bridgeStatusTopic(),
+			"payload_available":     stateConnected,
+			"payload_not_available": stateDisconnected,
+		},
+		{
+			"topic":                 bridge.availabilityTopic(bridge.adapterFor(path)),
+			"payload_available":     stateConnected,
+			"payload_not_available": stateAdapterDisconnected,
+		},
+	}
+
+	base := func(id string, name string) haConfig {
+		return haConfig{
+			"unique_id":         id,
+			"name":              name,
+			"device":            device,
+			"availability":      availability,
+			"availability_mode": "all",
+		}
+	}
+
+	configs := map[string]haConfig{}
+
+	if desc.Kind == adapter.KindLight {
+		if _, ok := desc.Values["on"]; ok {
+			conf := base(objectID, name)
+			stateKey := "on"
+			if _, ok := desc.Values["any_on"]; ok {
+				stateKey = "any_on"
+			}
+
+			conf["command_topic"] = bridge.buildTopic(path+"/on", rootutil.FunctionSet)
+			conf["state_topic"] = bridge.buildTopic(path+"/"+stateKey, rootutil.FunctionStatus)
+			conf["state_value_template"] = valueTemplate
+			conf["payload_on"] = "true"
+			conf["payload_off"] = "false"
+
+			if _, ok := desc.Values["bri"]; ok {
+				conf["brightness_command_topic"] = bridge.buildTopic(path+"/bri", rootutil.FunctionSet)
+				conf["brightness_state_topic"] = bridge.buildTopic(path+"/bri", rootutil.FunctionStatus)
+				conf["brightness_value_template"] = valueTemplate
+				conf["brightness_scale"] = 255
+			}
+
+			if _, ok := desc.Values["ct"]; ok {
+				conf["color_temp_command_topic"] = bridge.buildTopic(path+"/ct", rootutil.FunctionSet)
+				conf["color_temp_state_topic"] = bridge.buildTopic(path+"/ct", rootutil.FunctionStatus)
+				conf["color_temp_value_template"] = valueTemplate
+			}
+
+			configs[bridge.discoveryPrefix()+"/light/"+objectID+"/config"] = conf
+			return configs
+		}
+	}
+
+	for key, val := range desc.Values {
+		id := objectID + "_" + key
+		conf := base(id, name+" "+key)
+		conf["state_topic"] = bridge.buildTopic(path+"/"+key, rootutil.FunctionStatus)
+		conf["value_template"] = valueTemplate
+
+		component := "sensor"
+		switch val.Type {
+		case adapter.TypeBoolean:
+			component = "binary_sensor"
+			if val.Settable {
+				component = "switch"
+				conf["state_on"] = "true"
+				conf["state_off"] = "false"
+			}
+			conf["payload_on"] = "true"
+			conf["payload_off"] = "false"
+		case adapter.TypeInteger, adapter.TypeFloat:
+			if val.Settable {
+				component = "number"
+				if val.Max > val.Min {
+					conf["min"] = val.Min
+					conf["max"] = val.Max
+				}
+				if val.Type == adapter.TypeInteger {
+					conf["step"] = 1
+				}
+			}
+		case adapter.TypeEnum:
+			if val.Settable {
+				component = "select"
+				conf["options"] = val.Values
+			}
+		case adapter.TypeString:
+			if val.Settable {
+				component = "text"
+			}
+		}
+
+		if val.Settable {
+			conf["command_topic"] = bridge.buildTopic(path+"/"+key, rootutil.FunctionSet)
+		}
+
+		if val.Unit != "" && (component == "sensor" || component == "number") {
+			conf["unit_of_measurement"] = val.Unit
+		}
+
+		if component == "sensor" && val.Type == adapter.TypeString {
+			// Strings are published as JSON strings
+			conf["value_template"] = "{{ value_json.value if value_json is mapping else value_json }}"
+		}
+
+		configs[bridge.discoveryPrefix()+"/"+component+"/"+id+"/config"] = conf
+	}
+
+	return configs
+}
@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+	rootutil "github.com/orktes/homeautomation/util"
+)
+
+// httpMaxBody is the maximum size of a set request body
+const httpMaxBody = 1 << 20
+
+// authenticate returns the user of a request. Requests are anonymous if no users have been configured.
+func (bridge *MQTTBridge) authenticate(req *http.Request) (string, bool) {
+	users := bridge.conf.Bridge.HTTPUsers
+	if len(users) == 0 {
+		return "", true
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", false
+	}
+
+	return user, true
+}
+
+// httpSetHandler sets the key of a PUT /set/<key> request to the JSON value in the body.
+// The set is attributed to the authenticated user and the result is returned as JSON.
+func (bridge *MQTTBridge) httpSetHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := bridge.authenticate(req)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="homeautomation"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	key := strings.TrimPrefix(req.URL.Path, "/set/")
+	_, id, pathString, ok := bridge.parseTopic(bridge.topics.Build(rootutil.FunctionSet, key))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var val interface{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, httpMaxBody)).Decode(&val); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := &adapter.Source{Type: adapter.SourceHTTP, ID: user, Detail: req.RemoteAddr}
+	err := bridge.set(id, pathString, val, source)
+	if err != nil {
+		fmt.Printf("Error occured while writing key %s %s\n", pathString, err.Error())
+	}
+
+	res := rootutil.NewResult(rootutil.FunctionSet, pathString, err, nil)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// startHTTP serves set requests on the configured address
+func (bridge *MQTTBridge) startHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set/", bridge.httpSetHandler)
+	bridge.server = &http.Server{Addr: bridge.conf.Bridge.HTTPAddress, Handler: mux}
+	go func() {
+		if err := bridge.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Bridge http server stopped %s\n", err.Error())
+		}
+	}()
+}
@@ -3,28 +3,88 @@ package mqtt
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/audit"
 	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/bridge/util"
 	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/queue"
+	rootutil "github.com/orktes/homeautomation/util"
 )
 
+// sourceTTL defines how long the source of a set is attached to the resulting status updates
+var sourceTTL = 10 * time.Second
+
+type pendingSource struct {
+	source  *adapter.Source
+	expires time.Time
+}
+
 type MQTTBridge struct {
 	adapter adapter.Adapter
 	conf    config.Config
 	c       mqtt.Client
+	topics  rootutil.TopicLayout
+
+	auditLog *audit.Log
+	server   *http.Server
+
+	sourceMutex sync.Mutex
+	sources     map[string]pendingSource
+
+	// metadata of the latest update of each key for statuses published on get
+	metaMutex sync.Mutex
+	meta      map[string]adapter.ValueUpdate
+
+	retainMutex sync.Mutex
+	retained    map[string]string
+
+	availabilityMutex sync.Mutex
+	availability      map[string]string
+	stopAvailability  func()
+
+	discoveryMutex sync.Mutex
+	discovered     map[string]discoveryEntry
+	stopDiscovery  func()
+
+	// outbound queue for status and result messages
+	queue            *queue.Queue
+	queueMutex       sync.Mutex
+	queueMetrics     *queue.Metrics
+	stopQueueMetrics func()
 }
 
 func New(conf config.Config, adapter adapter.Adapter) *MQTTBridge {
-	bri := &MQTTBridge{conf: conf, adapter: adapter}
+	if conf.Bridge == nil {
+		conf.Bridge = &config.BridgeConfig{}
+	}
+
+	bri := &MQTTBridge{
+		conf:         conf,
+		adapter:      adapter,
+		topics:       rootutil.MustTopicLayout(conf.Topics),
+		sources:      map[string]pendingSource{},
+		retained:     map[string]string{},
+		availability: map[string]string{},
+		discovered:   map[string]discoveryEntry{},
+		// Updates may arrive before the client has been created in Connect
+		queue: queue.New(nil, "bridge", conf.Queue),
+	}
 	bri.subscribeToAdapter()
 	return bri
 }
 
 func (bridge *MQTTBridge) Connect() error {
 	conf := bridge.conf
+	if err := rootutil.ValidatePayloadFormat(conf.Bridge.PayloadFormat); err != nil {
+		return err
+	}
+
 	opts := mqtt.NewClientOptions()
 	for _, server := range conf.Servers {
 
@@ -40,13 +100,23 @@ func (bridge *MQTTBridge) Connect() error {
 		opts = opts.SetPassword(conf.Password)
 	}
 	opts = opts.SetDefaultPublishHandler(bridge.defaultHandler)
+	opts = opts.SetWill(bridge.bridgeStatusTopic(), stateDisconnected, 1, true)
+	opts = opts.SetOnConnectHandler(bridge.onConnect)
 	c := mqtt.NewClient(opts)
 
+	if conf.Bridge.AuditLog != "" {
+		auditLog, err := audit.Open(conf.Bridge.AuditLog)
+		if err != nil {
+			return err
+		}
+		bridge.auditLog = auditLog
+	}
+
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 
-	bridge.c = c
+	bridge.setClient(c)
 
 	if err := bridge.publishStatuses(); err != nil {
 		return err
@@ -56,22 +126,62 @@ func (bridge *MQTTBridge) Connect() error {
 		return err
 	}
 
+	bridge.publishAvailability()
+	bridge.stopAvailability = util.Interval(bridge.publishAvailability, availabilityInterval)
+
+	bridge.publishQueueMetrics()
+	bridge.stopQueueMetrics = util.Interval(bridge.publishQueueMetrics, queueMetricsInterval)
+
+	bridge.startRetainedSweep()
+	bridge.startDiscovery()
+
+	if conf.Bridge.HTTPAddress != "" {
+		bridge.startHTTP()
+	}
+
 	return nil
 }
 
+// setClient sets the client used by the bridge and its outbound queue
+func (bridge *MQTTBridge) setClient(c mqtt.Client) {
+	bridge.c = c
+	bridge.queue.SetClient(c)
+}
+
 func (bridge *MQTTBridge) Disconnect(wait uint) error {
+	if bridge.server != nil {
+		bridge.server.Close()
+	}
+	if bridge.stopAvailability != nil {
+		bridge.stopAvailability()
+	}
+	if bridge.stopDiscovery != nil {
+		bridge.stopDiscovery()
+	}
+	if bridge.stopQueueMetrics != nil {
+		bridge.stopQueueMetrics()
+	}
+
+	if token := bridge.c.Publish(bridge.bridgeStatusTopic(), 1, true, []byte(stateDisconnected)); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error publishing bridge status %s\n", token.Error())
+	}
+
 	bridge.c.Disconnect(wait)
+	if err := bridge.queue.Close(); err != nil {
+		fmt.Printf("Error spooling queued messages %s\n", err.Error())
+	}
+	if bridge.auditLog != nil {
+		return bridge.auditLog.Close()
+	}
 	return nil
 }
 
 func (bridge *MQTTBridge) buildTopic(key string, function string) string {
-	parts := strings.Split(key, "/")
 	if bridge.conf.Bridge.Root != "" {
-		parts = append(strings.Split(bridge.conf.Bridge.Root, "/"), parts...)
+		key = bridge.conf.Bridge.Root + "/" + key
 	}
 
-	toplevel := parts[0]
-	return fmt.Sprintf("%s/%s/%s", toplevel, function, strings.Join(parts[1:], "/"))
+	return bridge.topics.Build(function, key)
 }
 
 func (bridge *MQTTBridge) getRoot() string {
@@ -83,10 +193,7 @@ func (bridge *MQTTBridge) getRoot() string {
 }
 
 func (bridge *MQTTBridge) publishBridgeStatus() error {
-	root := bridge.getRoot()
-
-	// TODO add way for adaptor to tell state
-	if token := bridge.c.Publish(root+"/connected", 2, false, []byte("2")); token.Wait() && token.Error() != nil {
+	if token := bridge.c.Publish(bridge.bridgeStatusTopic(), 2, true, []byte(stateConnected)); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 
@@ -94,11 +201,50 @@ func (bridge *MQTTBridge) publishBridgeStatus() error {
 }
 
 func (bridge *MQTTBridge) publishStatus(key string, val interface{}) error {
-	topic := bridge.buildTopic(key, "status")
-	if b, err := json.Marshal(val); err == nil {
+	bridge.metaMutex.Lock()
+	kvu, ok := bridge.meta[key]
+	bridge.metaMutex.Unlock()
+
+	if !ok {
+		kvu = adapter.ValueUpdate{Key: key}
+	}
+	kvu.Value = val
+
+	return bridge.publishUpdate(kvu)
+}
+
+func (bridge *MQTTBridge) rememberMeta(kvu adapter.ValueUpdate) {
+	bridge.metaMutex.Lock()
+	defer bridge.metaMutex.Unlock()
+
+	if kvu.Removed {
+		for key := range bridge.meta {
+			if key == kvu.Key || strings.HasPrefix(key, kvu.Key+"/") {
+				delete(bridge.meta, key)
+			}
+		}
+		return
+	}
+
+	if kvu.Timestamp.IsZero() {
+		kvu.Timestamp = time.Now()
+	}
+	kvu.Value = nil
+	if bridge.meta == nil {
+		bridge.meta = map[string]adapter.ValueUpdate{}
+	}
+	bridge.meta[kvu.Key] = kvu
+}
+
+func (bridge *MQTTBridge) publishUpdate(kvu adapter.ValueUpdate) error {
+	topic := bridge.buildTopic(kvu.Key, rootutil.FunctionStatus)
+	retain := bridge.shouldRetain(kvu.Key)
+
+	if b, err := rootutil.EncodeStatus(kvu, bridge.conf.Bridge.PayloadFormat, bridge.conf.Bridge.IncludeSource); err == nil {
 		fmt.Printf("MQTT publish %s %s\n", topic, string(b))
-		if token := bridge.c.Publish(topic, 1, false, b); token.Wait() && token.Error() != nil {
-			return token.Error()
+		bridge.queue.Publish(queue.Message{Topic: topic, QoS: 1, Retained: retain, Payload: b, Coalesce: true})
+		if retain {
+			bridge.trackRetained(topic, kvu.Key)
 		}
 	}
 
@@ -115,25 +261,44 @@ func (bridge *MQTTBridge) publishStatuses() error {
 func (bridge *MQTTBridge) subscribeToTopics() error {
 	root := bridge.getRoot()
 
-	if token := bridge.c.Subscribe(root+"/set/#", 2, bridge.defaultHandler); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
+	subscribed := map[string]bool{}
+	for _, function := range []string{rootutil.FunctionSet, rootutil.FunctionGet, rootutil.FunctionCommand} {
+		// Templates may share a filter
+		filter := bridge.topics.Subscription(function, root)
+		if subscribed[filter] {
+			continue
+		}
+		subscribed[filter] = true
 
-	if token := bridge.c.Subscribe(root+"/get/#", 2, bridge.defaultHandler); token.Wait() && token.Error() != nil {
-		return token.Error()
+		if token := bridge.c.Subscribe(filter, 2, bridge.defaultHandler); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
 	}
 
-	// TODO adapter command
-
 	return nil
 }
 
 func (bridge *MQTTBridge) subscribeToAdapter() {
+	ch := bridge.adapter.UpdateChannel()
 	go func() {
-		ch := bridge.adapter.UpdateChannel()
 		for u := range ch {
 			for _, kvu := range u.Updates {
-				bridge.publishStatus(kvu.Key, kvu.Value)
+				if kvu.Removed {
+					bridge.rememberMeta(kvu)
+					if err := bridge.clearRetained(kvu.Key); err != nil {
+						fmt.Printf("Error clearing retained topics for %s %s\n", kvu.Key, err.Error())
+					}
+					if err := bridge.clearDiscovery(kvu.Key); err != nil {
+						fmt.Printf("Error clearing discovery topics for %s %s\n", kvu.Key, err.Error())
+					}
+					continue
+				}
+
+				if kvu.Source == nil {
+					kvu.Source = bridge.sourceFor(kvu.Key, u.ValueContainer)
+				}
+				bridge.rememberMeta(kvu)
+				bridge.publishUpdate(kvu)
 			}
 		}
 	}()
@@ -141,30 +306,95 @@ func (bridge *MQTTBridge) subscribeToAdapter() {
 	return
 }
 
-func (bridge *MQTTBridge) defaultHandler(client mqtt.Client, msg mqtt.Message) {
-	topic := msg.Topic()
-	payload := msg.Payload()
+// rememberSource stores the source of a set so that it can be attached to the resulting status updates
+func (bridge *MQTTBridge) rememberSource(key string, source *adapter.Source) {
+	bridge.sourceMutex.Lock()
+	defer bridge.sourceMutex.Unlock()
 
-	fmt.Printf("MQTT received %s %s\n", topic, string(payload))
+	now := time.Now()
+	for k, ps := range bridge.sources {
+		if now.After(ps.expires) {
+			delete(bridge.sources, k)
+		}
+	}
 
-	parts := strings.Split(topic, "/")
-	root := bridge.getRoot()
+	bridge.sources[key] = pendingSource{source: source, expires: now.Add(sourceTTL)}
+}
 
-	if parts[0] != root {
-		return
+func (bridge *MQTTBridge) sourceFor(key string, vc adapter.ValueContainer) *adapter.Source {
+	bridge.sourceMutex.Lock()
+	ps, ok := bridge.sources[key]
+	bridge.sourceMutex.Unlock()
+
+	if ok && time.Now().Before(ps.expires) {
+		return ps.source
 	}
 
-	if len(parts) < 2 {
-		return
+	if d, ok := vc.(adapter.Device); ok {
+		return &adapter.Source{Type: adapter.SourceDevice, ID: d.ID()}
 	}
 
-	var val interface{}
-	json.Unmarshal(payload, &val)
+	return nil
+}
 
-	function := parts[1]
-	path := parts[2:]
+// isContainer checks if id points to a value container
+func (bridge *MQTTBridge) isContainer(id string) bool {
+	val, err := bridge.adapter.Get(id)
+	if err != nil {
+		return false
+	}
+	_, ok := val.(adapter.ValueContainer)
+	return ok
+}
 
-	path = append([]string{root}, path...)
+func (bridge *MQTTBridge) set(id, pathString string, val interface{}, source *adapter.Source) error {
+	var err error
+	if vals, ok := val.(map[string]interface{}); ok && bridge.isContainer(id) {
+		// Objects published to containers set multiple keys at once
+		for key := range vals {
+			bridge.rememberSource(pathString+"/"+key, source)
+		}
+		err = adapter.SetMulti(bridge.adapter, id, vals)
+	} else {
+		bridge.rememberSource(pathString, source)
+		err = bridge.adapter.Set(id, val)
+	}
+
+	if bridge.auditLog != nil {
+		entry := audit.Entry{Path: pathString, Value: val, Source: source}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if auditErr := bridge.auditLog.Record(entry); auditErr != nil {
+			fmt.Printf("Error writing audit log %s\n", auditErr.Error())
+		}
+	}
+
+	return err
+}
+
+func (bridge *MQTTBridge) command(id string, args interface{}) error {
+	commander, ok := bridge.adapter.(adapter.Commander)
+	if !ok {
+		return adapter.NoSuchCommandError
+	}
+
+	return commander.Command(id, args)
+}
+
+// parseTopic splits a topic into its function, the id of the key within the adapter
+// and the full path of the key (including adapter id)
+func (bridge *MQTTBridge) parseTopic(topic string) (function string, id string, pathString string, ok bool) {
+	function, key, ok := bridge.topics.Parse(topic)
+	if !ok {
+		return
+	}
+	ok = false
+
+	path := strings.Split(key, "/")
+	if path[0] != bridge.getRoot() {
+		return
+	}
 
 	if bridge.conf.Bridge.Root != "" {
 		start := len(strings.Split(bridge.conf.Bridge.Root, "/"))
@@ -176,7 +406,6 @@ func (bridge *MQTTBridge) defaultHandler(client mqtt.Client, msg mqtt.Message) {
 		}
 	}
 
-	var id, pathString string
 	if len(path) > 1 {
 		id = strings.Join(path[1:], "/")
 	}
@@ -186,23 +415,84 @@ func (bridge *MQTTBridge) defaultHandler(client mqtt.Client, msg mqtt.Message) {
 		pathString = bridge.adapter.ID()
 	}
 
+	ok = true
+	return
+}
+
+func (bridge *MQTTBridge) defaultHandler(client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+	payload := msg.Payload()
+
+	fmt.Printf("MQTT received %s %s\n", topic, string(payload))
+
+	function, id, pathString, ok := bridge.parseTopic(topic)
+	if !ok {
+		return
+	}
+
+	var err error
+	var correlation interface{}
+
 	switch function {
-	case "set":
-		if err := bridge.adapter.Set(id, val); err != nil {
-			fmt.Printf("Error occured while reading key %s %s\n", pathString, err.Error())
+	case rootutil.FunctionSet:
+		req := rootutil.DecodeRequest(payload)
+		correlation = req.Correlation
+		// MQTT messages don't identify their publisher so the client id is only known when
+		// the publisher includes it in the source
+		if req.Source == nil {
+			req.Source = &adapter.Source{Type: adapter.SourceMQTT}
+		} else if req.Source.Type == "" {
+			req.Source.Type = adapter.SourceMQTT
 		}
-	case "get":
-		if val, err := bridge.adapter.Get(id); err != nil {
+
+		if err = bridge.set(id, pathString, req.Value, req.Source); err != nil {
 			fmt.Printf("Error occured while writing key %s %s\n", pathString, err.Error())
-		} else {
-			switch val := val.(type) {
-			case adapter.ValueContainer:
-				util.Traverse(val, func(key string, val interface{}) error {
-					return bridge.publishStatus(pathString+"/"+key, val)
-				}, false)
-			default:
-				bridge.publishStatus(pathString, val)
-			}
 		}
+	case rootutil.FunctionCommand:
+		req := rootutil.DecodeRequest(payload)
+		correlation = req.Correlation
+		if err = bridge.command(id, req.Value); err != nil {
+			fmt.Printf("Error occured while executing command %s %s\n", pathString, err.Error())
+		}
+	case rootutil.FunctionGet:
+		correlation = rootutil.DecodeGetRequest(payload).Correlation
+		if err = bridge.get(id, pathString); err != nil {
+			fmt.Printf("Error occured while reading key %s %s\n", pathString, err.Error())
+		}
+	default:
+		return
+	}
+
+	if err := bridge.publishResult(rootutil.NewResult(function, pathString, err, correlation)); err != nil {
+		fmt.Printf("Error publishing result for %s %s\n", pathString, err.Error())
+	}
+}
+
+func (bridge *MQTTBridge) get(id string, pathString string) error {
+	val, err := bridge.adapter.Get(id)
+	if err != nil {
+		return err
+	}
+
+	switch val := val.(type) {
+	case adapter.ValueContainer:
+		return util.Traverse(val, func(key string, val interface{}) error {
+			return bridge.publishStatus(pathString+"/"+key, val)
+		}, false)
+	default:
+		return bridge.publishStatus(pathString, val)
+	}
+}
+
+func (bridge *MQTTBridge) publishResult(res rootutil.Result) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
 	}
+
+	topic := bridge.buildTopic(res.Path, rootutil.FunctionResult)
+	fmt.Printf("MQTT publish %s %s\n", topic, string(b))
+	bridge.queue.Publish(queue.Message{Topic: topic, QoS: 1, Payload: b})
+
+	return nil
 }
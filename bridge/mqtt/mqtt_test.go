@@ -1,17 +1,24 @@
 package mqtt
 
 import (
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
 )
 
 type mockMessage struct {
-	topic   string
-	payload []byte
+	topic    string
+	payload  []byte
+	retained bool
 }
 
 func (mm mockMessage) Duplicate() bool {
@@ -23,7 +30,7 @@ func (mm mockMessage) Qos() byte {
 }
 
 func (mm mockMessage) Retained() bool {
-	panic("not implemented")
+	return mm.retained
 }
 
 func (mm mockMessage) Topic() string {
@@ -64,10 +71,12 @@ type mockClient struct {
 		topic   string
 		payload []byte
 	}
+	// results receives result topics. Results are dropped if nil.
+	results chan mockMessage
 }
 
 func (mc *mockClient) IsConnected() bool {
-	panic("not implemented")
+	return true
 }
 
 func (mc *mockClient) Connect() mqtt.Token {
@@ -79,6 +88,13 @@ func (mc *mockClient) Disconnect(quiesce uint) {
 }
 
 func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if strings.Contains(topic, "/result") {
+		if mc.results != nil {
+			mc.results <- mockMessage{topic: topic, payload: payload.([]byte)}
+		}
+		return mockToken(false)
+	}
+
 	mc.pubs <- struct {
 		topic   string
 		payload []byte
@@ -100,7 +116,7 @@ func (mc *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.M
 }
 
 func (mc *mockClient) Unsubscribe(topics ...string) mqtt.Token {
-	panic("not implemented")
+	return mockToken(false)
 }
 
 func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
@@ -110,9 +126,8 @@ func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
 func TestMQTTBridgeGet(t *testing.T) {
 	ma := &mockAdapter{
 		id:   "adid",
-		vals: map[string]interface{}{},
+		vals: map[string]interface{}{"foo": "bar"},
 	}
-	ma.Set("foo", "bar")
 
 	bridge := New(config.Config{}, ma)
 
@@ -124,7 +139,7 @@ func TestMQTTBridgeGet(t *testing.T) {
 		topic   string
 		payload []byte
 	})
-	bridge.c = &mockClient{subs, pubs}
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
 
 	t.Run("publish statuses", func(t *testing.T) {
 		go bridge.publishStatuses()
@@ -153,6 +168,11 @@ func TestMQTTBridgeGet(t *testing.T) {
 			t.Error("Wrong topic subs", sub.topic)
 		}
 
+		sub = <-subs
+		if sub.topic != "adid/command/#" {
+			t.Error("Wrong topic subs", sub.topic)
+		}
+
 	})
 
 	t.Run("value update", func(t *testing.T) {
@@ -206,6 +226,11 @@ func TestMQTTBridgeGet(t *testing.T) {
 				t.Error("Wrong topic subs", sub.topic)
 			}
 
+			sub = <-subs
+			if sub.topic != "bridgeroot/command/#" {
+				t.Error("Wrong topic subs", sub.topic)
+			}
+
 		})
 
 		t.Run("value update", func(t *testing.T) {
@@ -258,6 +283,11 @@ func TestMQTTBridgeGet(t *testing.T) {
 				t.Error("Wrong topic subs", sub.topic)
 			}
 
+			sub = <-subs
+			if sub.topic != "bridgeroot/command/#" {
+				t.Error("Wrong topic subs", sub.topic)
+			}
+
 		})
 
 		t.Run("value update", func(t *testing.T) {
@@ -369,7 +399,7 @@ func TestMQTTBridgeSet(t *testing.T) {
 		topic   string
 		payload []byte
 	})
-	bridge.c = &mockClient{subs, pubs}
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
 
 	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/bar", payload: []byte("\"foo\"")})
 	stus := <-pubs
@@ -381,3 +411,384 @@ func TestMQTTBridgeSet(t *testing.T) {
 		t.Error("Wrong val received", ma.vals)
 	}
 }
+
+func TestMQTTBridgeSetSource(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{Bridge: &config.BridgeConfig{IncludeSource: true}}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
+
+	payload := []byte(`{"value":"foo","source":{"type":"trigger","id":"porch"}}`)
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/bar", payload: payload})
+	stus := <-pubs
+	if stus.topic != "adid/status/bar" {
+		t.Error("Wrong topic received", stus.topic)
+	}
+
+	if ma.vals["bar"] != "foo" {
+		t.Error("Wrong val received", ma.vals)
+	}
+
+	val, source := util.DecodeStatus(stus.payload)
+	if val != "foo" || source == nil || source.Type != adapter.SourceTrigger || source.ID != "porch" {
+		t.Error("Wrong status payload", string(stus.payload))
+	}
+
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/biz", payload: []byte(`"foo"`)})
+	stus = <-pubs
+	if _, source := util.DecodeStatus(stus.payload); source == nil || source.Type != adapter.SourceMQTT {
+		t.Error("Wrong status payload", string(stus.payload))
+	}
+
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/biz", payload: []byte(`{"value":"bar","source":{"client":"zigbee2mqtt"}}`)})
+	stus = <-pubs
+	if _, source := util.DecodeStatus(stus.payload); source == nil || source.Type != adapter.SourceMQTT || source.Client != "zigbee2mqtt" {
+		t.Error("Wrong status payload", string(stus.payload))
+	}
+}
+
+func TestMQTTBridgeHTTPSet(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{Bridge: &config.BridgeConfig{
+		IncludeSource: true,
+		HTTPUsers:     map[string]string{"jaakko": "secret"},
+	}}, ma)
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 1)
+	bridge.setClient(&mockClient{pubs: pubs})
+
+	set := func(user string, password string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/set/adid/bar", strings.NewReader(body))
+		req.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		bridge.httpSetHandler(w, req)
+		return w
+	}
+
+	if w := set("jaakko", "wrong", `"foo"`); w.Code != http.StatusUnauthorized {
+		t.Error("Wrong status for invalid credentials", w.Code)
+	}
+	if w := set("jaakko", "secret", `foo`); w.Code != http.StatusBadRequest {
+		t.Error("Wrong status for invalid body", w.Code)
+	}
+
+	w := set("jaakko", "secret", `"foo"`)
+	res := util.Result{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK || res.Status != util.ResultOK || res.Path != "adid/bar" {
+		t.Error("Wrong response", w.Code, w.Body.String())
+	}
+	if ma.vals["bar"] != "foo" {
+		t.Error("Wrong val received", ma.vals)
+	}
+
+	stus := <-pubs
+	if _, source := util.DecodeStatus(stus.payload); stus.topic != "adid/status/bar" || source == nil || source.Type != adapter.SourceHTTP || source.ID != "jaakko" {
+		t.Error("Wrong status", stus.topic, string(stus.payload))
+	}
+}
+
+func TestMQTTBridgeRetained(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{Bridge: &config.BridgeConfig{Retain: []string{"adid/#"}}}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
+
+	t.Run("clear removed", func(t *testing.T) {
+		go ma.Set("foo", "bar")
+		<-pubs
+
+		go ma.Updater.SendUpdate(adapter.Update{
+			ValueContainer: ma,
+			Updates:        []adapter.ValueUpdate{{Key: "adid/foo", Removed: true}},
+		})
+
+		stus := <-pubs
+		if stus.topic != "adid/status/foo" || len(stus.payload) != 0 {
+			t.Error("Retained topic should be cleared", stus.topic, string(stus.payload))
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		sweepCollectTime = 10 * time.Millisecond
+		ma.vals["biz"] = "foz"
+
+		go bridge.sweepRetained()
+
+		sub := <-subs
+		if sub.topic != "adid/status/#" {
+			t.Error("Wrong topic subs", sub.topic)
+		}
+
+		sub.callback(bridge.c, &mockMessage{topic: "adid/status/biz", payload: []byte(`"foz"`), retained: true})
+		sub.callback(bridge.c, &mockMessage{topic: "adid/status/gone", payload: []byte(`"foz"`), retained: true})
+		sub.callback(bridge.c, &mockMessage{topic: "adid/status/other", payload: []byte(`"foz"`)})
+
+		stus := <-pubs
+		if stus.topic != "adid/status/gone" || len(stus.payload) != 0 {
+			t.Error("Orphaned topic should be cleared", stus.topic, string(stus.payload))
+		}
+	})
+}
+
+func TestMQTTBridgeDiscoveryConfigs(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{Bridge: &config.BridgeConfig{HomeAssistant: &config.HomeAssistant{}}}, ma)
+
+	t.Run("light", func(t *testing.T) {
+		configs := bridge.discoveryConfigs("adid/lights/1", adapter.Description{
+			Kind: adapter.KindLight,
+			Name: "Lamp",
+			Values: map[string]adapter.ValueDescription{
+				"on":  {Type: adapter.TypeBoolean, Settable: true},
+				"bri": {Type: adapter.TypeInteger, Settable: true, Min: 0, Max: 255},
+			},
+		})
+
+		conf, ok := configs["homeassistant/light/adid_lights_1/config"]
+		if !ok || len(configs) != 1 {
+			t.Fatal("Expected a single light config", configs)
+		}
+
+		if conf["command_topic"] != "adid/set/lights/1/on" || conf["state_topic"] != "adid/status/lights/1/on" {
+			t.Error("Wrong topics", conf["command_topic"], conf["state_topic"])
+		}
+
+		if conf["brightness_command_topic"] != "adid/set/lights/1/bri" {
+			t.Error("Wrong brightness topic", conf["brightness_command_topic"])
+		}
+	})
+
+	t.Run("sensor", func(t *testing.T) {
+		configs := bridge.discoveryConfigs("adid/sensors/2", adapter.Description{
+			Kind: adapter.KindSensor,
+			Values: map[string]adapter.ValueDescription{
+				"temperature": {Type: adapter.TypeFloat, Unit: "°C"},
+				"enabled":     {Type: adapter.TypeBoolean, Settable: true},
+			},
+		})
+
+		temp, ok := configs["homeassistant/sensor/adid_sensors_2_temperature/config"]
+		if !ok || temp["unit_of_measurement"] != "°C" {
+			t.Error("Wrong sensor config", configs)
+		}
+
+		if _, ok := configs["homeassistant/switch/adid_sensors_2_enabled/config"]; !ok {
+			t.Error("Expected switch config", configs)
+		}
+	})
+}
+
+func TestMQTTBridgeTopicTemplates(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{
+		Topics: &config.Topics{Status: "home/{path}/state", Set: "home/{path}/set"},
+	}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
+
+	t.Run("subscribe", func(t *testing.T) {
+		go bridge.subscribeToTopics()
+
+		for _, topic := range []string{"home/adid/#", "adid/get/#", "adid/command/#"} {
+			if sub := <-subs; sub.topic != topic {
+				t.Error("Wrong topic subs", sub.topic)
+			}
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		go bridge.defaultHandler(bridge.c, &mockMessage{topic: "home/adid/bar/set", payload: []byte(`"foo"`)})
+
+		stus := <-pubs
+		if stus.topic != "home/adid/bar/state" || string(stus.payload) != `"foo"` {
+			t.Error("Wrong publish received", stus.topic, string(stus.payload))
+		}
+	})
+
+	t.Run("ignore status", func(t *testing.T) {
+		bridge.defaultHandler(bridge.c, &mockMessage{topic: "home/adid/biz/state", payload: []byte(`"foo"`)})
+		if _, ok := ma.vals["biz"]; ok {
+			t.Error("Status topic should not set a value")
+		}
+	})
+}
+
+func TestMQTTBridgeEnvelope(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{Bridge: &config.BridgeConfig{PayloadFormat: util.PayloadEnvelope}}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
+
+	timestamp := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	ma.vals["temp"] = float64(21)
+	go ma.Updater.SendUpdate(adapter.Update{
+		ValueContainer: ma,
+		Updates:        []adapter.ValueUpdate{{Key: "adid/temp", Value: float64(21), Timestamp: timestamp, Stale: true}},
+	})
+
+	stus := <-pubs
+	status := util.DecodeStatusPayload(stus.payload)
+	if status.Value != float64(21) || status.Timestamp == nil || !status.Timestamp.Equal(timestamp) ||
+		status.Stale == nil || !*status.Stale || status.Source == nil {
+		t.Error("Wrong status payload", string(stus.payload))
+	}
+
+	// Statuses published on get keep the metadata of the latest update
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/get/temp", payload: []byte{}})
+	stus = <-pubs
+	status = util.DecodeStatusPayload(stus.payload)
+	if status.Timestamp == nil || !status.Timestamp.Equal(timestamp) || status.Stale == nil || !*status.Stale {
+		t.Error("Wrong status payload on get", string(stus.payload))
+	}
+}
+
+func TestMQTTBridgeSetMulti(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+	ma.vals["group"] = &mockAdapter{id: "group", vals: map[string]interface{}{}}
+
+	bridge := New(config.Config{}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs})
+
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/group", payload: []byte(`{"on":true,"bri":120}`)})
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		stus := <-pubs
+		received[stus.topic] = string(stus.payload)
+	}
+
+	if received["adid/status/group/on"] != "true" || received["adid/status/group/bri"] != "120" {
+		t.Error("Wrong statuses received", received)
+	}
+
+	// Objects set to plain values are stored as is
+	go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/obj", payload: []byte(`{"on":true}`)})
+	stus := <-pubs
+	if stus.topic != "adid/status/obj" {
+		t.Error("Wrong topic received", stus.topic)
+	}
+}
+
+func TestMQTTBridgeResults(t *testing.T) {
+	ma := &mockAdapter{
+		id:   "adid",
+		vals: map[string]interface{}{},
+	}
+
+	bridge := New(config.Config{}, ma)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 10)
+	results := make(chan mockMessage)
+	bridge.setClient(&mockClient{subs: subs, pubs: pubs, results: results})
+
+	t.Run("set", func(t *testing.T) {
+		go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/set/bar", payload: []byte(`{"value":"foo","correlation":"abc"}`)})
+
+		msg := <-results
+		res := util.Result{}
+		json.Unmarshal(msg.payload, &res)
+		if msg.topic != "adid/result/bar" || res.Status != util.ResultOK || res.Function != util.FunctionSet || res.Correlation != "abc" {
+			t.Error("Wrong result", msg.topic, string(msg.payload))
+		}
+	})
+
+	t.Run("command error", func(t *testing.T) {
+		go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/command/bar", payload: []byte(`{"value":"foo","correlation":1}`)})
+
+		msg := <-results
+		res := util.Result{}
+		json.Unmarshal(msg.payload, &res)
+		if res.Status != util.ResultError || res.Code != util.ErrorCodeNotSupported || res.Error == "" || res.Correlation != float64(1) {
+			t.Error("Wrong result", msg.topic, string(msg.payload))
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		go bridge.defaultHandler(bridge.c, &mockMessage{topic: "adid/get/bar", payload: []byte(`{"correlation":"def"}`)})
+
+		msg := <-results
+		res := util.Result{}
+		json.Unmarshal(msg.payload, &res)
+		if res.Status != util.ResultOK || res.Function != util.FunctionGet || res.Correlation != "def" {
+			t.Error("Wrong result", msg.topic, string(msg.payload))
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var queueMetricsInterval = time.Minute
+
+func (bridge *MQTTBridge) queueMetricsTopic() string {
+	return bridge.getRoot() + "/queue"
+}
+
+// onConnect flushes messages queued while the broker was unreachable
+func (bridge *MQTTBridge) onConnect(c mqtt.Client) {
+	bridge.queue.Flush()
+}
+
+// publishQueueMetrics publishes the depth and dropped message count of the outbound queue when they have changed
+func (bridge *MQTTBridge) publishQueueMetrics() {
+	metrics := bridge.queue.Metrics()
+	// Sent changes with every message
+	metrics.Sent = 0
+
+	bridge.queueMutex.Lock()
+	changed := bridge.queueMetrics == nil || *bridge.queueMetrics != metrics
+	bridge.queueMetrics = &metrics
+	bridge.queueMutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		return
+	}
+
+	if token := bridge.c.Publish(bridge.queueMetricsTopic(), 1, true, b); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error publishing queue metrics %s\n", token.Error())
+	}
+}
@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/util"
+	"github.com/orktes/homeautomation/queue"
+	rootutil "github.com/orktes/homeautomation/util"
+)
+
+// Adapters populate their state asynchronously so orphaned retained topics
+// are swept only after the adapters have had time to settle
+var (
+	sweepDelay       = time.Minute
+	sweepCollectTime = 5 * time.Second
+)
+
+func (bridge *MQTTBridge) shouldRetain(key string) bool {
+	for _, pattern := range bridge.conf.Bridge.Retain {
+		if rootutil.MatchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bridge *MQTTBridge) trackRetained(topic string, key string) {
+	bridge.retainMutex.Lock()
+	defer bridge.retainMutex.Unlock()
+
+	bridge.retained[topic] = key
+}
+
+func (bridge *MQTTBridge) clearRetainedTopic(topic string) error {
+	fmt.Printf("MQTT clear retained %s\n", topic)
+	// Queued with the status messages so that a pending status can't override the clear
+	bridge.queue.Publish(queue.Message{Topic: topic, QoS: 1, Retained: true, Payload: []byte{}, Coalesce: true})
+	return nil
+}
+
+// clearRetained clears all retained topics published for the key and keys under it
+func (bridge *MQTTBridge) clearRetained(key string) error {
+	bridge.retainMutex.Lock()
+	topics := []string{}
+	for topic, k := range bridge.retained {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			topics = append(topics, topic)
+			delete(bridge.retained, topic)
+		}
+	}
+	bridge.retainMutex.Unlock()
+
+	for _, topic := range topics {
+		if err := bridge.clearRetainedTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweepRetained removes retained status topics under the root that no longer match any key in the adapter
+func (bridge *MQTTBridge) sweepRetained() error {
+	keys := map[string]bool{}
+	err := util.Traverse(bridge.adapter, func(key string, val interface{}) error {
+		keys[key] = true
+		return nil
+	}, true)
+	if err != nil {
+		return err
+	}
+
+	var mutex sync.Mutex
+	topics := []string{}
+
+	statusTopic := bridge.topics.Subscription(rootutil.FunctionStatus, bridge.getRoot())
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() || len(msg.Payload()) == 0 {
+			return
+		}
+
+		mutex.Lock()
+		topics = append(topics, msg.Topic())
+		mutex.Unlock()
+	}
+
+	if token := bridge.c.Subscribe(statusTopic, 1, handler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	time.Sleep(sweepCollectTime)
+
+	if token := bridge.c.Unsubscribe(statusTopic); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, topic := range topics {
+		function, _, path, ok := bridge.parseTopic(topic)
+		if !ok || function != rootutil.FunctionStatus || bridge.buildTopic(path, rootutil.FunctionStatus) != topic {
+			// Not published by this bridge
+			continue
+		}
+
+		if !keys[path] {
+			if err := bridge.clearRetainedTopic(topic); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (bridge *MQTTBridge) startRetainedSweep() {
+	if len(bridge.conf.Bridge.Retain) == 0 {
+		return
+	}
+
+	go func() {
+		time.Sleep(sweepDelay)
+		if err := bridge.sweepRetained(); err != nil {
+			fmt.Printf("Error while sweeping retained topics %s\n", err.Error())
+		}
+	}()
+}
@@ -44,3 +44,42 @@ func Traverse(vc adapter.ValueContainer, cb func(key string, val interface{}) er
 
 	return iterate(vc, prefix)
 }
+
+// TraverseContainers calls cb for the given value container and all value containers under it
+func TraverseContainers(vc adapter.ValueContainer, cb func(key string, vc adapter.ValueContainer) error, includeRoot bool) error {
+	var iterate func(vc adapter.ValueContainer, prefix []string) error
+	iterate = func(vc adapter.ValueContainer, prefix []string) error {
+		if err := cb(strings.Join(prefix, "/"), vc); err != nil {
+			return err
+		}
+
+		vals, err := vc.GetAll()
+		if err != nil {
+			return err
+		}
+
+		for key, val := range vals {
+			if child, ok := val.(adapter.ValueContainer); ok {
+				fullkeysparts := make([]string, len(prefix)+1)
+				copy(fullkeysparts, prefix)
+				fullkeysparts[len(fullkeysparts)-1] = key
+
+				if err := iterate(child, fullkeysparts); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	prefix := []string{}
+
+	if includeRoot {
+		if ad, ok := vc.(adapter.Adapter); ok {
+			prefix = append(prefix, ad.ID())
+		}
+	}
+
+	return iterate(vc, prefix)
+}
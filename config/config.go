@@ -12,24 +12,97 @@ import (
 
 	"github.com/gosimple/slug"
 	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
 )
 
 // Adapter represents a single adapter config
 type Adapter struct {
 	ID     string                 `hcl:"id,key"`
 	Type   string                 `hcl:"type"`
+	Retain bool                   `hcl:"retain"`
 	Config map[string]interface{} `hcl:"config"`
 }
 
+// HomeAssistant discovery config
+type HomeAssistant struct {
+	Prefix string `hcl:"prefix"`
+}
+
 // BridgeConfig represents homeautomation config
 type BridgeConfig struct {
 	Adapters []Adapter `hcl:"adapter"`
 	Root     string    `hcl:"root"`
+	AuditLog string    `hcl:"audit_log"`
+	// HTTPAddress serves PUT /set/<key> requests with the JSON value as the body
+	HTTPAddress string `hcl:"http_address"`
+	// HTTPUsers maps user names to the passwords of basic authentication. Sets are attributed to the user.
+	// Requests are not authenticated if no users have been configured.
+	HTTPUsers     map[string]string `hcl:"http_users"`
+	IncludeSource bool              `hcl:"include_source"`
+	PayloadFormat string            `hcl:"payload_format"`
+	Retain        []string          `hcl:"retain"`
+	HomeAssistant *HomeAssistant    `hcl:"homeassistant"`
 }
 
 // Trigger represents a single toggle
 type Trigger struct {
-	Script string `hcl:"script"`
+	Name string `hcl:"name,key"`
+	// Enabled defaults to true
+	Enabled *bool  `hcl:"enabled"`
+	Script  string `hcl:"script"`
+	// File is a script file relative to the scripts directory used instead of Script
+	File string `hcl:"file"`
+}
+
+// AutomationWhen starts an automation. Kind is one of state (path matches equals, changes or
+// crosses above/below, optionally for a duration), schedule (cron), at (time of day) or sun (event with an offset).
+type AutomationWhen struct {
+	Kind     string      `hcl:"kind,key"`
+	Path     string      `hcl:"path"`
+	Equals   interface{} `hcl:"equals"`
+	Changes  bool        `hcl:"changes"`
+	Above    *float64    `hcl:"above"`
+	Below    *float64    `hcl:"below"`
+	For      string      `hcl:"for"`
+	Cron     string      `hcl:"cron"`
+	Time     string      `hcl:"time"`
+	Event    string      `hcl:"event"`
+	Offset   string      `hcl:"offset"`
+	Timezone string      `hcl:"timezone"`
+}
+
+// AutomationCondition must hold for the actions of an automation to run. Kind is either
+// state (path matches equals, not_equals, above and below) or time (time of day between after and before).
+type AutomationCondition struct {
+	Kind      string      `hcl:"kind,key"`
+	Path      string      `hcl:"path"`
+	Equals    interface{} `hcl:"equals"`
+	NotEquals interface{} `hcl:"not_equals"`
+	Above     *float64    `hcl:"above"`
+	Below     *float64    `hcl:"below"`
+	After     string      `hcl:"after"`
+	Before    string      `hcl:"before"`
+}
+
+// AutomationAction is a single step of an automation. Kind is one of set, command, delay, publish or script.
+type AutomationAction struct {
+	Kind     string      `hcl:"kind,key"`
+	Path     string      `hcl:"path"`
+	Value    interface{} `hcl:"value"`
+	Duration string      `hcl:"duration"`
+	Topic    string      `hcl:"topic"`
+	Payload  string      `hcl:"payload"`
+	Retain   bool        `hcl:"retain"`
+	Source   string      `hcl:"source"`
+}
+
+// Automation is a declarative trigger
+type Automation struct {
+	Name       string                `hcl:"name,key"`
+	When       []AutomationWhen      `hcl:"when"`
+	Conditions []AutomationCondition `hcl:"condition"`
+	Actions    []AutomationAction    `hcl:"action"`
 }
 
 // AlexaDeviceCapabilityProperty device property
@@ -65,6 +138,9 @@ type AlexaDevice struct {
 	Description       string   `hcl:"description"`
 	Manafacturer      string   `hcl:"manafacturer"`
 	DisplayCategories []string `hcl:"display_categories"`
+	// Scene makes the device a scene controller. Activate applies the scene and deactivate restores
+	// the values it replaced.
+	Scene string `hcl:"scene"`
 
 	Capabilities []AlexaDeviceCapability `hcl:"capability"`
 }
@@ -75,15 +151,110 @@ type Alexa struct {
 	Devices []AlexaDevice `hcl:"device"`
 }
 
+// HistoryRule retention and downsampling rule for values matching a path pattern
+type HistoryRule struct {
+	Pattern    string `hcl:"pattern,key"`
+	Retention  string `hcl:"retention"`
+	Resolution string `hcl:"resolution"`
+}
+
+// History value history config
+type History struct {
+	DatabaseFile string        `hcl:"database_file"`
+	Topic        string        `hcl:"topic"`
+	HTTPAddress  string        `hcl:"http_address"`
+	Rules        []HistoryRule `hcl:"rule"`
+}
+
+// Topics defines the templates used to build and parse mqtt topics.
+// {root} is replaced with the first segment of a key and {path} with the rest of it.
+type Topics struct {
+	Status  string `hcl:"status"`
+	Set     string `hcl:"set"`
+	Get     string `hcl:"get"`
+	Command string `hcl:"command"`
+	Result  string `hcl:"result"`
+}
+
+// Queue outbound publish queue config
+type Queue struct {
+	// Size is the maximum number of queued messages. The oldest messages are dropped when the queue is full.
+	Size int `hcl:"size"`
+	// SpoolDir is the directory where queued messages are stored so that they survive restarts
+	SpoolDir string `hcl:"spool_dir"`
+}
+
+// Location of the home used for solar calculations
+type Location struct {
+	Latitude  float64 `hcl:"latitude"`
+	Longitude float64 `hcl:"longitude"`
+}
+
+// Store persistent key-value store used by trigger scripts
+type Store struct {
+	DatabaseFile string `hcl:"database_file"`
+}
+
+// HTTP client config of trigger scripts
+type HTTP struct {
+	// AllowedHosts are the hosts (example.com or example.com:8080) requests may be sent to
+	AllowedHosts []string `hcl:"allowed_hosts"`
+	// Timeout is the default request timeout (10s if empty)
+	Timeout string `hcl:"timeout"`
+	// RateLimit is the maximum number of requests of a trigger per rate interval. 0 disables the limit.
+	RateLimit int `hcl:"rate_limit"`
+	// RateInterval defaults to 1m
+	RateInterval string `hcl:"rate_interval"`
+}
+
+// Scene is a named set of values. Values are explicit and capture lists the path patterns whose
+// current values are stored in the scene when it is captured. Captured values override explicit ones.
+type Scene struct {
+	Name    string                 `hcl:"name,key"`
+	Values  map[string]interface{} `hcl:"values"`
+	Capture []string               `hcl:"capture"`
+	// Transition is the default duration numeric values are faded over when the scene is applied
+	Transition string `hcl:"transition"`
+}
+
+// Scenes config
+type Scenes struct {
+	// Root is the first segment of the scene keys (scenes if empty). Commands are sent to <root>/<name>.
+	Root string `hcl:"root"`
+	// DatabaseFile stores captured scenes and the values replaced by applied scenes
+	DatabaseFile string  `hcl:"database_file"`
+	Scenes       []Scene `hcl:"scene"`
+}
+
+// Homie convention publisher config
+type Homie struct {
+	BaseTopic string `hcl:"base_topic"`
+}
+
 // Config represents homeautomation config
 type Config struct {
-	Servers  []string      `hcl:"servers"`
-	Username string        `hcl:"username"`
-	Password string        `hcl:"password"`
-	ClientID string        `hcl:"client_id"`
-	Bridge   *BridgeConfig `hcl:"bridge"`
-	Triggers []Trigger     `hcl:"trigger"`
-	Alexa    *Alexa        `hcl:"alexa"`
+	Servers  []string `hcl:"servers"`
+	Username string   `hcl:"username"`
+	Password string   `hcl:"password"`
+	ClientID string   `hcl:"client_id"`
+	// SetSource publishes the sets of triggers, alexa, scenes and homie as {"value": ..., "source": ...}
+	// envelopes. Consumers of the set topics must then understand the envelope.
+	SetSource  bool          `hcl:"set_source"`
+	Topics     *Topics       `hcl:"topics"`
+	Queue      *Queue        `hcl:"queue"`
+	Location   *Location     `hcl:"location"`
+	Bridge     *BridgeConfig `hcl:"bridge"`
+	ScriptsDir string        `hcl:"scripts_dir"`
+	// TriggerTopic is the topic for trigger statuses and control (<topic>/<name>/status and set)
+	TriggerTopic string       `hcl:"trigger_topic"`
+	Triggers     []Trigger    `hcl:"trigger"`
+	Automations  []Automation `hcl:"automation"`
+	Alexa        *Alexa       `hcl:"alexa"`
+	History      *History     `hcl:"history"`
+	Store        *Store       `hcl:"store"`
+	HTTP         *HTTP        `hcl:"http"`
+	Scenes       *Scenes      `hcl:"scenes"`
+	Homie        *Homie       `hcl:"homie"`
 }
 
 // Parse config returns a Config struct pointer parsed from a given reader
@@ -114,8 +285,57 @@ func ParseConfig(reader io.Reader) (Config, error) {
 
 	fmt.Printf("Using config\n%s\n", string(b.Bytes()))
 
+	file, err := hcl.ParseBytes(b.Bytes())
+	if err != nil {
+		return Config{}, err
+	}
+
+	triggers, err := decodeTriggers(file)
+	if err != nil {
+		return Config{}, err
+	}
+
 	conf := &Config{}
-	err = hcl.Decode(conf, string(b.Bytes()))
+	err = hcl.DecodeObject(conf, file)
+	conf.Triggers = triggers
 
 	return *conf, err
 }
+
+// decodeTriggers decodes and removes the trigger blocks of the file. HCL would use the first attribute
+// of an unlabeled block as its name so blocks are decoded one by one and unlabeled ones are left unnamed.
+func decodeTriggers(file *ast.File) ([]Trigger, error) {
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, nil
+	}
+
+	var triggers []Trigger
+	items := make([]*ast.ObjectItem, 0, len(list.Items))
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 || item.Keys[0].Token.Value() != "trigger" {
+			items = append(items, item)
+			continue
+		}
+
+		if _, ok := item.Val.(*ast.ObjectType); !ok || len(item.Keys) > 2 {
+			return nil, fmt.Errorf("line %d: trigger must be a block with at most one name label", item.Pos().Line)
+		}
+
+		// The name is read from the first key of the item
+		keys := item.Keys[1:]
+		if len(keys) == 0 {
+			keys = []*ast.ObjectKey{{Token: token.Token{Type: token.STRING, Text: `""`}}}
+		}
+
+		trigger := Trigger{}
+		if err := hcl.DecodeObject(&trigger, &ast.ObjectItem{Keys: keys, Val: item.Val}); err != nil {
+			return nil, err
+		}
+
+		triggers = append(triggers, trigger)
+	}
+	list.Items = items
+
+	return triggers, nil
+}
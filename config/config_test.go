@@ -1 +1,45 @@
 package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfigTriggers(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`
+trigger {
+    enabled = false
+    file = "legacy.js"
+}
+
+trigger "script" {
+    script = "print(1)"
+}
+
+trigger {
+    script = "print(2)"
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.Triggers) != 3 {
+		t.Fatal("Wrong number of triggers", conf.Triggers)
+	}
+
+	// Unlabeled blocks stay unnamed and in order
+	if tr := conf.Triggers[0]; tr.Name != "" || tr.File != "legacy.js" || tr.Enabled == nil || *tr.Enabled {
+		t.Error("Wrong unlabeled trigger", tr)
+	}
+	if tr := conf.Triggers[1]; tr.Name != "script" || tr.Script != "print(1)" {
+		t.Error("Wrong labeled trigger", tr)
+	}
+	if tr := conf.Triggers[2]; tr.Name != "" || tr.Script != "print(2)" {
+		t.Error("Wrong unlabeled trigger", tr)
+	}
+
+	if _, err := ParseConfig(strings.NewReader(`trigger "a" "b" { script = "" }`)); err == nil {
+		t.Error("Triggers with multiple labels should be rejected")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/orktes/homeautomation/trigger"
+)
+
+const consolePrompt = "> "
+
+// runConsole starts an interactive JavaScript console with the trigger API: homeautomation console <config>.
+// Returns the exit code.
+func runConsole(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("usage: homeautomation console <config>")
+		return 2
+	}
+
+	conf, err := loadConfig(args[0])
+	if err != nil {
+		fmt.Printf("Error loading config %s\n", err.Error())
+		return 2
+	}
+
+	// Only the console runtime is run and it must not take over the client id or spool of the running system
+	conf.Triggers = nil
+	conf.Automations = nil
+	conf.Queue = nil
+	if conf.ClientID != "" {
+		conf.ClientID += "-console"
+	}
+
+	ts := trigger.New(conf)
+	if err := ts.Connect(); err != nil {
+		fmt.Printf("Error connecting to mqtt brokers %s\n", err.Error())
+		return 1
+	}
+	defer ts.Disconnect(250)
+
+	term := newLineEditor(os.Stdin, os.Stdout)
+	defer term.Close()
+
+	console := ts.NewConsole(term.Print)
+	defer console.Close()
+
+	term.complete = console.Complete
+
+	for {
+		line, err := term.ReadLine()
+		if err != nil {
+			return 0
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		res, err := console.Eval(line)
+		if err != nil {
+			term.Print("Error: " + err.Error())
+			continue
+		}
+		term.Print(res)
+	}
+}
+
+// lineEditor reads lines from a terminal with history and tab completion. Output printed while
+// a line is being edited is shown above the line. Falls back to plain line reading when the input
+// isn't a terminal.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	// complete returns the word at the end of a line and its completions
+	complete func(line string) (string, []string)
+
+	// state is the stty state restored on close, empty if the terminal isn't in raw mode
+	state string
+
+	mutex   sync.Mutex
+	buf     []rune
+	cursor  int
+	editing bool
+
+	history []string
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), out: out}
+
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = in
+	state, err := cmd.Output()
+	if err != nil {
+		return e
+	}
+
+	cmd = exec.Command("stty", "-icanon", "-echo", "-isig", "min", "1")
+	cmd.Stdin = in
+	if err := cmd.Run(); err != nil {
+		return e
+	}
+	e.state = strings.TrimSpace(string(state))
+
+	return e
+}
+
+// Close restores the terminal
+func (e *lineEditor) Close() {
+	if e.state == "" {
+		return
+	}
+
+	cmd := exec.Command("stty", e.state)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+	fmt.Fprintln(e.out)
+}
+
+// Print prints a line above the line being edited
+func (e *lineEditor) Print(str string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.editing || e.state == "" {
+		fmt.Fprintln(e.out, str)
+		return
+	}
+
+	fmt.Fprintf(e.out, "\r\033[K%s\n", str)
+	e.redraw()
+}
+
+// redraw draws the prompt and the line and moves the cursor in place. Has to be called with the mutex held.
+func (e *lineEditor) redraw() {
+	fmt.Fprintf(e.out, "\r\033[K%s%s", consolePrompt, string(e.buf))
+	if back := len(e.buf) - e.cursor; back > 0 {
+		fmt.Fprintf(e.out, "\033[%dD", back)
+	}
+}
+
+// ReadLine reads a line. Returns io.EOF on ctrl-d on an empty line.
+func (e *lineEditor) ReadLine() (string, error) {
+	if e.state == "" {
+		fmt.Fprint(e.out, consolePrompt)
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	e.mutex.Lock()
+	e.buf, e.cursor, e.editing = nil, 0, true
+	e.redraw()
+	e.mutex.Unlock()
+
+	historyIndex := len(e.history)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		e.mutex.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(e.buf)
+			e.editing = false
+			fmt.Fprintln(e.out)
+			e.mutex.Unlock()
+
+			if strings.TrimSpace(line) != "" {
+				e.history = append(e.history, line)
+			}
+			return line, nil
+		case 3: // ctrl-c clears the line
+			e.buf, e.cursor = nil, 0
+		case 4: // ctrl-d exits on an empty line
+			if len(e.buf) == 0 {
+				e.editing = false
+				e.mutex.Unlock()
+				return "", io.EOF
+			}
+		case 127, 8: // backspace
+			if e.cursor > 0 {
+				e.buf = append(e.buf[:e.cursor-1], e.buf[e.cursor:]...)
+				e.cursor--
+			}
+		case '\t':
+			// Completion evaluates in the runtime which may be printing
+			before := string(e.buf[:e.cursor])
+			e.mutex.Unlock()
+			word, completions := e.complete(before)
+			e.mutex.Lock()
+
+			e.completeLine(word, completions)
+		case 27: // escape sequences of the arrow keys
+			e.mutex.Unlock()
+			seq := make([]byte, 2)
+			if _, err := io.ReadFull(e.in, seq); err != nil {
+				return "", err
+			}
+			e.mutex.Lock()
+
+			if seq[0] != '[' {
+				break
+			}
+			switch seq[1] {
+			case 'A', 'B':
+				if seq[1] == 'A' && historyIndex > 0 {
+					historyIndex--
+				} else if seq[1] == 'B' && historyIndex < len(e.history) {
+					historyIndex++
+				}
+				e.buf = nil
+				if historyIndex < len(e.history) {
+					e.buf = []rune(e.history[historyIndex])
+				}
+				e.cursor = len(e.buf)
+			case 'C':
+				if e.cursor < len(e.buf) {
+					e.cursor++
+				}
+			case 'D':
+				if e.cursor > 0 {
+					e.cursor--
+				}
+			}
+		default:
+			if r >= 32 {
+				e.buf = append(e.buf[:e.cursor], append([]rune{r}, e.buf[e.cursor:]...)...)
+				e.cursor++
+			}
+		}
+		e.redraw()
+		e.mutex.Unlock()
+	}
+}
+
+// completeLine completes the word before the cursor to the longest common prefix of the completions
+// and lists the completions when there is nothing to add. Has to be called with the mutex held.
+func (e *lineEditor) completeLine(word string, completions []string) {
+	if len(completions) == 0 {
+		return
+	}
+
+	common := completions[0]
+	for _, completion := range completions[1:] {
+		for !strings.HasPrefix(completion, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(common) > len(word) {
+		insert := []rune(common[len(word):])
+		e.buf = append(e.buf[:e.cursor], append(insert, e.buf[e.cursor:]...)...)
+		e.cursor += len(insert)
+		return
+	}
+
+	if len(completions) > 1 {
+		fmt.Fprintf(e.out, "\r\033[K%s\n", strings.Join(completions, "  "))
+	}
+}
@@ -20,4 +20,5 @@ require (
 	golang.org/x/net v0.0.0-20170413175226-5602c733f70a
 	golang.org/x/sys v0.0.0-20180110071738-810d70003458
 	golang.org/x/text v0.3.1-0.20171227012246-e19ae1496984
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,160 @@
+package history
+
+import (
+	"fmt"
+	"time"
+)
+
+// Supported aggregation functions
+const (
+	AggregateLast         = "last"
+	AggregateMin          = "min"
+	AggregateMax          = "max"
+	AggregateAvg          = "avg"
+	AggregateDurationTrue = "duration_true"
+)
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isTrue(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false" && v != "OFF"
+	}
+
+	if f, ok := toFloat(val); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+// Aggregate reduces samples within from and to into a single value. prev is the last sample
+// recorded before from and is used to determine the value at the start of the range.
+func Aggregate(fn string, prev *Sample, samples []Sample, from, to time.Time) (interface{}, error) {
+	switch fn {
+	case AggregateLast:
+		if len(samples) > 0 {
+			return samples[len(samples)-1].Value, nil
+		}
+		if prev != nil {
+			return prev.Value, nil
+		}
+		return nil, nil
+	case AggregateAvg:
+		return average(prev, samples, from, to), nil
+	case AggregateMin, AggregateMax:
+		var res float64
+		count := 0
+		for _, sample := range samples {
+			f, ok := toFloat(sample.Value)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case count == 0:
+				res = f
+			case fn == AggregateMin && f < res:
+				res = f
+			case fn == AggregateMax && f > res:
+				res = f
+			}
+
+			count++
+		}
+
+		if count == 0 {
+			return nil, nil
+		}
+		return res, nil
+	case AggregateDurationTrue:
+		var total time.Duration
+		state := prev != nil && isTrue(prev.Value)
+		since := from
+
+		for _, sample := range samples {
+			if state {
+				total += sample.Time.Sub(since)
+			}
+			state = isTrue(sample.Value)
+			since = sample.Time
+		}
+
+		if state && to.After(since) {
+			total += to.Sub(since)
+		}
+
+		return total.Seconds(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown aggregate function %s", fn)
+}
+
+// average returns the time weighted average of the numeric values between from and to. Each value
+// is weighted by how long it was held so that downsampled and irregular samples don't skew the result.
+// Non numeric values leave a gap. Falls back to the plain mean if no time has passed between samples.
+func average(prev *Sample, samples []Sample, from, to time.Time) interface{} {
+	var sum, mean float64
+	var total time.Duration
+	count := 0
+
+	var val float64
+	numeric := false
+	if prev != nil {
+		val, numeric = toFloat(prev.Value)
+	}
+	since := from
+
+	for _, sample := range samples {
+		t := sample.Time
+		if t.Before(from) {
+			t = from
+		}
+		if numeric && t.After(since) {
+			sum += val * t.Sub(since).Seconds()
+			total += t.Sub(since)
+		}
+
+		val, numeric = toFloat(sample.Value)
+		since = t
+		if numeric {
+			mean += val
+			count++
+		}
+	}
+
+	if numeric && to.After(since) {
+		sum += val * to.Sub(since).Seconds()
+		total += to.Sub(since)
+	}
+
+	switch {
+	case total > 0:
+		return sum / total.Seconds()
+	case count > 0:
+		return mean / float64(count)
+	}
+	return nil
+}
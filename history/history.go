@@ -0,0 +1,340 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	bridgeutil "github.com/orktes/homeautomation/bridge/util"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+// DefaultTopic is used for MQTT queries if no topic has been configured
+const DefaultTopic = "history"
+
+// recordBuffer defines how many updates may wait to be recorded before new ones are dropped
+const recordBuffer = 256
+
+// Query describes a history request
+type Query struct {
+	Path          string `json:"path"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Aggregate     string `json:"aggregate"`
+	ResponseTopic string `json:"response_topic,omitempty"`
+}
+
+// Result is returned for a query
+type Result struct {
+	Path      string      `json:"path"`
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Aggregate string      `json:"aggregate,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+	Samples   []Sample    `json:"samples,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type rule struct {
+	pattern    string
+	retention  time.Duration
+	resolution time.Duration
+}
+
+// History records all adapter updates and answers queries over MQTT and HTTP
+type History struct {
+	conf    config.Config
+	adapter adapter.Adapter
+	rules   []rule
+
+	store     *Store
+	c         mqtt.Client
+	server    *http.Server
+	stopPrune func()
+
+	// entries of each adapter update waiting to be written
+	entries chan []Entry
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// New returns a new History for the given adapter
+func New(conf config.Config, adapter adapter.Adapter) (*History, error) {
+	h := &History{
+		conf:    conf,
+		adapter: adapter,
+		entries: make(chan []Entry, recordBuffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	for _, ruleConf := range conf.History.Rules {
+		r := rule{pattern: ruleConf.Pattern}
+		if ruleConf.Retention != "" {
+			d, err := util.ParseDuration(ruleConf.Retention)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid retention for %s: %s", ruleConf.Pattern, err.Error())
+			}
+			r.retention = d
+		}
+		if ruleConf.Resolution != "" {
+			d, err := util.ParseDuration(ruleConf.Resolution)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid resolution for %s: %s", ruleConf.Pattern, err.Error())
+			}
+			r.resolution = d
+		}
+		h.rules = append(h.rules, r)
+	}
+
+	return h, nil
+}
+
+func (h *History) topic() string {
+	if h.conf.History.Topic != "" {
+		return h.conf.History.Topic
+	}
+	return DefaultTopic
+}
+
+func (h *History) ruleFor(key string) rule {
+	for _, r := range h.rules {
+		if util.MatchPattern(r.pattern, key) {
+			return r
+		}
+	}
+	return rule{}
+}
+
+func (h *History) subscribeToAdapter() {
+	ch := h.adapter.UpdateChannel()
+	go func() {
+		for u := range ch {
+			var source string
+			if d, ok := u.ValueContainer.(adapter.Device); ok {
+				source = d.ID()
+			}
+
+			now := time.Now()
+			entries := make([]Entry, 0, len(u.Updates))
+			for _, kvu := range u.Updates {
+				if kvu.Removed {
+					continue
+				}
+
+				sample := Sample{Time: now, Value: kvu.Value, Source: source}
+				if kvu.Source != nil {
+					sample.Source = kvu.Source.String()
+				}
+				entries = append(entries, Entry{Key: kvu.Key, Sample: sample, Resolution: h.ruleFor(kvu.Key).resolution})
+			}
+
+			if len(entries) == 0 {
+				continue
+			}
+
+			// Adapters are never blocked by a slow disk
+			select {
+			case h.entries <- entries:
+			default:
+				fmt.Printf("History buffer full. Dropping %d samples\n", len(entries))
+			}
+		}
+	}()
+}
+
+// writeEntries records buffered entries. Entries that have piled up are written in a single transaction.
+func (h *History) writeEntries() {
+	defer close(h.done)
+
+	for {
+		var entries []Entry
+		select {
+		case <-h.stop:
+			return
+		case entries = <-h.entries:
+		}
+
+	drain:
+		for {
+			select {
+			case more := <-h.entries:
+				entries = append(entries, more...)
+			default:
+				break drain
+			}
+		}
+
+		if err := h.store.RecordBatch(entries); err != nil {
+			fmt.Printf("Error recording history %s\n", err.Error())
+		}
+	}
+}
+
+func (h *History) prune() {
+	keys, err := h.store.Keys()
+	if err != nil {
+		fmt.Printf("Error while pruning history %s\n", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		r := h.ruleFor(key)
+		if r.retention == 0 {
+			continue
+		}
+
+		if err := h.store.Prune(key, now.Add(-r.retention)); err != nil {
+			fmt.Printf("Error while pruning history for %s %s\n", key, err.Error())
+		}
+	}
+}
+
+// Query executes a history query
+func (h *History) Query(q Query) Result {
+	now := time.Now()
+	res := Result{Path: q.Path, Aggregate: q.Aggregate, From: now.Add(-24 * time.Hour), To: now}
+
+	if q.From != "" {
+		from, err := util.ParseTime(q.From, now)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.From = from
+	}
+
+	if q.To != "" {
+		to, err := util.ParseTime(q.To, now)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if to.Before(now) {
+			res.To = to
+		}
+	}
+
+	prev, samples, err := h.store.Query(q.Path, res.From, res.To)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if q.Aggregate == "" {
+		res.Samples = samples
+		return res
+	}
+
+	res.Value, err = Aggregate(q.Aggregate, prev, samples, res.From, res.To)
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+func (h *History) mqttHandler(client mqtt.Client, msg mqtt.Message) {
+	prefix := h.topic() + "/get/"
+	if !strings.HasPrefix(msg.Topic(), prefix) {
+		return
+	}
+
+	q := Query{}
+	if len(msg.Payload()) > 0 {
+		if err := json.Unmarshal(msg.Payload(), &q); err != nil {
+			fmt.Printf("Invalid history query %s %s\n", msg.Topic(), err.Error())
+			return
+		}
+	}
+	q.Path = msg.Topic()[len(prefix):]
+
+	responseTopic := q.ResponseTopic
+	if responseTopic == "" {
+		responseTopic = h.topic() + "/result/" + q.Path
+	}
+
+	b, err := json.Marshal(h.Query(q))
+	if err != nil {
+		return
+	}
+
+	if token := client.Publish(responseTopic, 1, false, b); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error publishing history result %s\n", token.Error())
+	}
+}
+
+func (h *History) httpHandler(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	res := h.Query(Query{
+		Path:      strings.TrimPrefix(req.URL.Path, "/history/"),
+		From:      params.Get("from"),
+		To:        params.Get("to"),
+		Aggregate: params.Get("aggregate"),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// Connect opens the history database, starts recording updates and connects to the mqtt brokers
+func (h *History) Connect() error {
+	store, err := Open(h.conf.History.DatabaseFile)
+	if err != nil {
+		return err
+	}
+	h.store = store
+
+	go h.writeEntries()
+	h.subscribeToAdapter()
+	h.stopPrune = bridgeutil.Interval(h.prune, time.Hour)
+
+	opts := util.NewClientOptions(h.conf, "-history")
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	h.c = c
+
+	if token := c.Subscribe(h.topic()+"/get/#", 1, h.mqttHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	if h.conf.History.HTTPAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/history/", h.httpHandler)
+		h.server = &http.Server{Addr: h.conf.History.HTTPAddress, Handler: mux}
+		go func() {
+			if err := h.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("History http server stopped %s\n", err.Error())
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Disconnect stops recording and closes all connections
+func (h *History) Disconnect(wait uint) error {
+	if h.server != nil {
+		h.server.Close()
+	}
+	if h.stopPrune != nil {
+		h.stopPrune()
+	}
+	if h.c != nil {
+		h.c.Disconnect(wait)
+	}
+	close(h.stop)
+	<-h.done
+	return h.store.Close()
+}
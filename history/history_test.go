@@ -0,0 +1,164 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStoreRecordAndQuery(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if err := store.Record("haaga/foo", Sample{Time: start.Add(time.Duration(i) * time.Minute), Value: float64(i)}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prev, samples, err := store.Query("haaga/foo", start.Add(90*time.Second), start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prev == nil || prev.Value != float64(1) {
+		t.Error("Wrong previous sample", prev)
+	}
+
+	if len(samples) != 2 || samples[0].Value != float64(2) || samples[1].Value != float64(3) {
+		t.Error("Wrong samples returned", samples)
+	}
+
+	prev, samples, err = store.Query("haaga/foo", start.Add(time.Hour), start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prev == nil || prev.Value != float64(4) || len(samples) != 0 {
+		t.Error("Wrong result for range after all samples", prev, samples)
+	}
+
+	if err := store.Prune("haaga/foo", start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, samples, _ = store.Query("haaga/foo", start, start.Add(time.Hour))
+	if prev != nil || len(samples) != 3 {
+		t.Error("Prune did not remove old samples", prev, samples)
+	}
+}
+
+func TestStoreResolution(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		store.Record("haaga/foo", Sample{Time: start.Add(time.Duration(i) * 20 * time.Second), Value: float64(i)}, time.Minute)
+	}
+
+	_, samples, _ := store.Query("haaga/foo", start, start.Add(time.Hour))
+	if len(samples) != 4 {
+		t.Fatal("Wrong number of samples", samples)
+	}
+
+	if samples[0].Value != float64(2) || samples[3].Value != float64(9) {
+		t.Error("Latest sample of each window should be kept", samples)
+	}
+}
+
+func TestStoreRecordBatch(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	err := store.RecordBatch([]Entry{
+		{Key: "haaga/foo", Sample: Sample{Time: start, Value: float64(1)}, Resolution: time.Minute},
+		{Key: "haaga/bar", Sample: Sample{Time: start, Value: "on"}},
+		{Key: "haaga/foo", Sample: Sample{Time: start.Add(time.Second), Value: float64(2)}, Resolution: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, samples, _ := store.Query("haaga/foo", start, start.Add(time.Hour)); len(samples) != 1 || samples[0].Value != float64(2) {
+		t.Error("Resolution should apply within a batch", samples)
+	}
+	if _, samples, _ := store.Query("haaga/bar", start, start.Add(time.Hour)); len(samples) != 1 || samples[0].Value != "on" {
+		t.Error("Wrong samples for second key", samples)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	prev := &Sample{Time: start.Add(-time.Hour), Value: true}
+	samples := []Sample{
+		{Time: start.Add(10 * time.Minute), Value: false},
+		{Time: start.Add(30 * time.Minute), Value: true},
+		{Time: start.Add(40 * time.Minute), Value: false},
+	}
+
+	val, err := Aggregate(AggregateDurationTrue, prev, samples, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != float64(20*60) {
+		t.Error("Wrong duration", val)
+	}
+
+	numbers := []Sample{
+		{Time: start, Value: float64(3)},
+		{Time: start.Add(15 * time.Minute), Value: float64(1)},
+		{Time: start.Add(30 * time.Minute), Value: float64(5)},
+	}
+	for fn, expected := range map[string]interface{}{
+		AggregateMin: float64(1),
+		AggregateMax: float64(5),
+		// Weighted by the time each value was held
+		AggregateAvg:  float64(3*15+1*15+5*30) / 60,
+		AggregateLast: float64(5),
+	} {
+		val, err := Aggregate(fn, nil, numbers, start, end)
+		if err != nil {
+			t.Error(err)
+		}
+		if val != expected {
+			t.Errorf("Wrong result for %s got %v", fn, val)
+		}
+	}
+
+	// The value before the range counts until the first sample and samples without time between them are averaged
+	val, _ = Aggregate(AggregateAvg, &Sample{Time: start.Add(-time.Hour), Value: float64(10)}, samples[:0], start, end)
+	if val != float64(10) {
+		t.Error("Previous value should hold for the whole range", val)
+	}
+	val, _ = Aggregate(AggregateAvg, nil, []Sample{{Time: end, Value: float64(2)}, {Time: end, Value: float64(4)}}, start, end)
+	if val != float64(3) {
+		t.Error("Samples at the same time should be averaged", val)
+	}
+
+	if _, err := Aggregate("median", nil, numbers, start, end); err == nil {
+		t.Error("Should return error for unknown function")
+	}
+}
@@ -0,0 +1,211 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var bucketName = []byte("history")
+
+// Sample is a single recorded value
+type Sample struct {
+	Time   time.Time   `json:"time"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source,omitempty"`
+}
+
+type storedSample struct {
+	Value  interface{} `json:"v"`
+	Source string      `json:"s,omitempty"`
+}
+
+// Store persists samples in a bolt database. Each key has its own bucket with
+// samples ordered by their timestamp.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) a history store in the given file
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func keyTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+func decodeSample(k, v []byte) (Sample, error) {
+	stored := storedSample{}
+	if err := json.Unmarshal(v, &stored); err != nil {
+		return Sample{}, err
+	}
+
+	return Sample{Time: keyTime(k), Value: stored.Value, Source: stored.Source}, nil
+}
+
+// Entry is a sample of a key to be recorded
+type Entry struct {
+	Key    string
+	Sample Sample
+	// Resolution of the key. The previous sample is replaced when both fall into the same resolution window.
+	Resolution time.Duration
+}
+
+// Record stores a sample for a key. If resolution is non zero the previous sample is
+// replaced when both fall into the same resolution window.
+func (s *Store) Record(key string, sample Sample, resolution time.Duration) error {
+	return s.RecordBatch([]Entry{{Key: key, Sample: sample, Resolution: resolution}})
+}
+
+// RecordBatch stores multiple samples in a single transaction
+func (s *Store) RecordBatch(entries []Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := record(root, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func record(root *bolt.Bucket, entry Entry) error {
+	d, err := json.Marshal(storedSample{Value: entry.Sample.Value, Source: entry.Sample.Source})
+	if err != nil {
+		return err
+	}
+
+	bucket, err := root.CreateBucketIfNotExists([]byte(entry.Key))
+	if err != nil {
+		return err
+	}
+
+	if entry.Resolution > 0 {
+		c := bucket.Cursor()
+		if k, _ := c.Last(); k != nil {
+			if keyTime(k).Truncate(entry.Resolution).Equal(entry.Sample.Time.Truncate(entry.Resolution)) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return bucket.Put(timeKey(entry.Sample.Time), d)
+}
+
+// Query returns samples recorded for a key between from and to. The last sample recorded
+// before from is returned separately (nil if there is none) so that the value at the start
+// of the range is known.
+func (s *Store) Query(key string, from, to time.Time) (*Sample, []Sample, error) {
+	var prev *Sample
+	samples := []Sample{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketName)
+		if root == nil {
+			return nil
+		}
+
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+
+		start := timeKey(from)
+
+		c := bucket.Cursor()
+		pk, pv := c.Seek(start)
+		if pk == nil {
+			pk, pv = c.Last()
+		} else {
+			pk, pv = c.Prev()
+		}
+		if pk != nil {
+			sample, err := decodeSample(pk, pv)
+			if err != nil {
+				return err
+			}
+			prev = &sample
+		}
+
+		end := timeKey(to)
+		for k, v := c.Seek(start); k != nil && string(k) <= string(end); k, v = c.Next() {
+			sample, err := decodeSample(k, v)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, sample)
+		}
+
+		return nil
+	})
+
+	return prev, samples, err
+}
+
+// Prune removes all samples of a key older than before
+func (s *Store) Prune(key string, before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketName)
+		if root == nil {
+			return nil
+		}
+
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+
+		end := timeKey(before)
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Keys returns all keys that have recorded samples
+func (s *Store) Keys() ([]string, error) {
+	keys := []string{}
+	return keys, s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(bucketName)
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,242 @@
+package homie
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+	bridgeutil "github.com/orktes/homeautomation/bridge/util"
+)
+
+// Homie datatypes
+const (
+	datatypeBoolean = "boolean"
+	datatypeInteger = "integer"
+	datatypeFloat   = "float"
+	datatypeString  = "string"
+	datatypeEnum    = "enum"
+)
+
+// rootNode is used for values directly under the adapter
+const rootNode = "root"
+
+var invalidID = regexp.MustCompile("[^a-z0-9-]+")
+
+// ID converts a path segment to a valid homie id
+func ID(str string) string {
+	id := strings.Trim(invalidID.ReplaceAllString(strings.ToLower(str), "-"), "-")
+	if id == "" {
+		return "-"
+	}
+	return id
+}
+
+type property struct {
+	id string
+	// key is the full key used in updates and path the key within the adapter
+	key      string
+	path     string
+	topic    string
+	value    interface{}
+	datatype string
+	settable bool
+	unit     string
+	format   string
+	// json is set for values that can't be presented with homie datatypes
+	json bool
+}
+
+type node struct {
+	id         string
+	name       string
+	typ        string
+	properties []*property
+}
+
+type device struct {
+	id      string
+	prefix  string
+	adapter adapter.Adapter
+	nodes   []*node
+	keys    map[string]*property
+	topics  map[string]*property
+	// attributes contains all published attribute topics
+	attributes map[string]bool
+	state      string
+}
+
+func datatypeFor(val interface{}) (string, bool) {
+	switch val.(type) {
+	case bool:
+		return datatypeBoolean, false
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return datatypeInteger, false
+	case float32, float64:
+		return datatypeFloat, false
+	case string:
+		return datatypeString, false
+	default:
+		return datatypeString, true
+	}
+}
+
+func newProperty(key string, path string, name string, val interface{}, desc *adapter.ValueDescription) *property {
+	p := &property{id: ID(name), key: key, path: path, value: val, settable: true}
+	p.datatype, p.json = datatypeFor(val)
+
+	if desc == nil {
+		return p
+	}
+
+	p.settable = desc.Settable
+	p.unit = desc.Unit
+
+	switch desc.Type {
+	case adapter.TypeBoolean:
+		p.datatype = datatypeBoolean
+	case adapter.TypeInteger:
+		p.datatype = datatypeInteger
+	case adapter.TypeFloat:
+		p.datatype = datatypeFloat
+	case adapter.TypeString:
+		p.datatype = datatypeString
+	case adapter.TypeEnum:
+		p.datatype = datatypeEnum
+		p.format = strings.Join(desc.Values, ",")
+	}
+
+	if desc.Type != "" {
+		p.json = false
+	}
+
+	if (p.datatype == datatypeInteger || p.datatype == datatypeFloat) && desc.Max > desc.Min {
+		p.format = fmt.Sprintf("%s:%s", formatNumber(desc.Min), formatNumber(desc.Max))
+	}
+
+	return p
+}
+
+// scan builds the homie structure for the adapter
+func (d *device) scan(base string) error {
+	d.nodes = nil
+	d.keys = map[string]*property{}
+	d.topics = map[string]*property{}
+
+	err := bridgeutil.TraverseContainers(d.adapter, func(path string, vc adapter.ValueContainer) error {
+		vals, err := vc.GetAll()
+		if err != nil {
+			return err
+		}
+
+		n := &node{id: rootNode, name: d.adapter.ID()}
+		if path != "" {
+			n.id = ID(strings.Replace(path, "/", "-", -1))
+			n.name = path
+		}
+
+		var desc adapter.Description
+		if describer, ok := vc.(adapter.Describer); ok {
+			desc = describer.Describe()
+			n.typ = desc.Kind
+			if desc.Name != "" {
+				n.name = desc.Name
+			}
+		}
+
+		keys := make([]string, 0, len(vals))
+		for key, val := range vals {
+			if _, ok := val.(adapter.ValueContainer); !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "/" + key
+			}
+
+			var valueDesc *adapter.ValueDescription
+			if vd, ok := desc.Values[key]; ok {
+				valueDesc = &vd
+			}
+
+			p := newProperty(d.prefix+"/"+keyPath, keyPath, key, vals[key], valueDesc)
+			n.properties = append(n.properties, p)
+			p.topic = base + "/" + d.id + "/" + n.id + "/" + p.id
+			d.keys[p.key] = p
+			d.topics[p.topic] = p
+		}
+
+		if len(n.properties) > 0 {
+			d.nodes = append(d.nodes, n)
+		}
+
+		return nil
+	}, false)
+
+	return err
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatValue converts a value to a homie payload
+func formatValue(p *property, val interface{}) string {
+	if p.json {
+		b, _ := json.Marshal(val)
+		return string(b)
+	}
+
+	switch val := val.(type) {
+	case string:
+		return val
+	case float64:
+		return formatNumber(val)
+	case float32:
+		return formatNumber(float64(val))
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// parseValue converts a homie payload to a value
+func parseValue(p *property, payload string) (interface{}, error) {
+	if p.json {
+		var val interface{}
+		err := json.Unmarshal([]byte(payload), &val)
+		return val, err
+	}
+
+	switch p.datatype {
+	case datatypeBoolean:
+		switch payload {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid boolean %s", payload)
+	case datatypeInteger:
+		return strconv.ParseInt(payload, 10, 64)
+	case datatypeFloat:
+		return strconv.ParseFloat(payload, 64)
+	case datatypeEnum:
+		if p.format != "" {
+			for _, val := range strings.Split(p.format, ",") {
+				if val == payload {
+					return payload, nil
+				}
+			}
+			return nil, fmt.Errorf("invalid enum value %s", payload)
+		}
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,360 @@
+package homie
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	bridgeutil "github.com/orktes/homeautomation/bridge/util"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+// DefaultBaseTopic is used if no base topic has been configured
+const DefaultBaseTopic = "homie"
+
+const homieVersion = "4.0.0"
+
+// Device states
+const (
+	stateInit         = "init"
+	stateReady        = "ready"
+	stateDisconnected = "disconnected"
+	stateLost         = "lost"
+)
+
+var stateInterval = 10 * time.Second
+
+// Homie publishes the adapters using the homie convention. Each adapter is published as a homie device
+// with its own mqtt connection so that the last will can mark the device lost.
+type Homie struct {
+	conf    config.Config
+	adapter adapter.Adapter
+	topics  util.TopicLayout
+
+	newClient func(opts *mqtt.ClientOptions) mqtt.Client
+
+	sync.Mutex
+	devices   []*device
+	clients   map[string]mqtt.Client
+	stopState func()
+
+	// updates are queued so that adapters never wait for the homie brokers
+	updateMutex sync.Mutex
+	updates     []adapter.Update
+	wake        chan struct{}
+}
+
+// New returns a new homie publisher for the given adapter
+func New(conf config.Config, adapter adapter.Adapter) *Homie {
+	return &Homie{
+		conf:      conf,
+		adapter:   adapter,
+		topics:    util.MustTopicLayout(conf.Topics),
+		newClient: mqtt.NewClient,
+		clients:   map[string]mqtt.Client{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (h *Homie) baseTopic() string {
+	if h.conf.Homie.BaseTopic != "" {
+		return h.conf.Homie.BaseTopic
+	}
+	return DefaultBaseTopic
+}
+
+func (h *Homie) deviceTopic(d *device) string {
+	return h.baseTopic() + "/" + d.id
+}
+
+func (h *Homie) createDevices() {
+	multi, ok := h.adapter.(*adapter.MultiAdapter)
+	if !ok {
+		h.devices = []*device{{id: ID(h.adapter.ID()), prefix: h.adapter.ID(), adapter: h.adapter}}
+		return
+	}
+
+	vals, _ := multi.GetAll()
+	for _, val := range vals {
+		if a, ok := val.(adapter.Adapter); ok {
+			h.devices = append(h.devices, &device{
+				id:      ID(a.ID()),
+				prefix:  multi.ID() + "/" + a.ID(),
+				adapter: a,
+			})
+		}
+	}
+}
+
+func (h *Homie) deviceFor(key string) *device {
+	for _, d := range h.devices {
+		if key == d.prefix || strings.HasPrefix(key, d.prefix+"/") {
+			return d
+		}
+	}
+	return nil
+}
+
+// publish publishes a retained topic of the device. Must be called with the lock held.
+func (h *Homie) publish(d *device, topic string, payload string) {
+	send(h.clients[d.id], topic, payload)
+}
+
+func send(c mqtt.Client, topic string, payload string) {
+	if token := c.Publish(topic, 1, true, []byte(payload)); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error publishing homie topic %s %s\n", topic, token.Error())
+	}
+}
+
+func adapterState(a adapter.Adapter) string {
+	if connector, ok := a.(adapter.Connector); ok && !connector.Connected() {
+		return stateLost
+	}
+	return stateReady
+}
+
+func (h *Homie) setState(d *device, state string) {
+	if d.state == state {
+		return
+	}
+	d.state = state
+	h.publish(d, h.deviceTopic(d)+"/$state", state)
+}
+
+// publishDevice (re)publishes the structure and values of a device
+func (h *Homie) publishDevice(d *device) {
+	if err := d.scan(h.baseTopic()); err != nil {
+		fmt.Printf("Error reading homie device %s %s\n", d.id, err.Error())
+		return
+	}
+
+	h.setState(d, stateInit)
+
+	attributes := map[string]bool{}
+	attr := func(topic string, payload string) {
+		attributes[topic] = true
+		h.publish(d, topic, payload)
+	}
+
+	deviceTopic := h.deviceTopic(d)
+	nodeIDs := make([]string, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		nodeIDs = append(nodeIDs, n.id)
+	}
+
+	attr(deviceTopic+"/$homie", homieVersion)
+	attr(deviceTopic+"/$name", d.adapter.ID())
+	attr(deviceTopic+"/$nodes", strings.Join(nodeIDs, ","))
+	attr(deviceTopic+"/$extensions", "")
+
+	for _, n := range d.nodes {
+		nodeTopic := deviceTopic + "/" + n.id
+		propertyIDs := make([]string, 0, len(n.properties))
+		for _, p := range n.properties {
+			propertyIDs = append(propertyIDs, p.id)
+		}
+
+		attr(nodeTopic+"/$name", n.name)
+		attr(nodeTopic+"/$type", n.typ)
+		attr(nodeTopic+"/$properties", strings.Join(propertyIDs, ","))
+
+		for _, p := range n.properties {
+			attr(p.topic+"/$name", p.id)
+			attr(p.topic+"/$datatype", p.datatype)
+			attr(p.topic+"/$settable", fmt.Sprintf("%t", p.settable))
+			if p.unit != "" {
+				attr(p.topic+"/$unit", p.unit)
+			}
+			if p.format != "" {
+				attr(p.topic+"/$format", p.format)
+			}
+			attr(p.topic, formatValue(p, p.value))
+		}
+	}
+
+	// Clear attributes of nodes and properties that no longer exist
+	for topic := range d.attributes {
+		if !attributes[topic] {
+			h.publish(d, topic, "")
+		}
+	}
+	d.attributes = attributes
+
+	h.setState(d, adapterState(d.adapter))
+}
+
+func (h *Homie) setHandler(d *device) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		// Handle outside of the mqtt client goroutine as publishing may hold the lock
+		go h.handleSet(d, msg)
+	}
+}
+
+func (h *Homie) handleSet(d *device, msg mqtt.Message) {
+	h.Lock()
+	p, ok := d.topics[strings.TrimSuffix(msg.Topic(), "/set")]
+	h.Unlock()
+
+	if !ok || !p.settable {
+		fmt.Printf("Unknown homie property %s\n", msg.Topic())
+		return
+	}
+
+	val, err := parseValue(p, string(msg.Payload()))
+	if err != nil {
+		fmt.Printf("Invalid homie value for %s %s\n", msg.Topic(), err.Error())
+		return
+	}
+
+	// Sets go through the bridge so that they are attributed, audited and get a result
+	b, err := util.EncodeSetRequest(val, &adapter.Source{Type: adapter.SourceHomie, ID: d.id}, h.conf.SetSource)
+	if err != nil {
+		fmt.Printf("Error encoding homie set for %s %s\n", p.key, err.Error())
+		return
+	}
+
+	h.Lock()
+	c := h.clients[d.id]
+	h.Unlock()
+	if c == nil {
+		return
+	}
+
+	topic := h.topics.Build(util.FunctionSet, p.key)
+	if token := c.Publish(topic, 1, false, b); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error setting %s %s\n", p.key, token.Error())
+	}
+}
+
+func (h *Homie) subscribeToAdapter() {
+	ch := h.adapter.UpdateChannel()
+	go func() {
+		for u := range ch {
+			h.updateMutex.Lock()
+			h.updates = append(h.updates, u)
+			h.updateMutex.Unlock()
+
+			select {
+			case h.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	go h.publishUpdates()
+}
+
+// publishUpdates publishes the queued updates in order
+func (h *Homie) publishUpdates() {
+	for range h.wake {
+		h.updateMutex.Lock()
+		updates := h.updates
+		h.updates = nil
+		h.updateMutex.Unlock()
+
+		for _, u := range updates {
+			for _, kvu := range u.Updates {
+				h.publishUpdate(kvu)
+			}
+		}
+	}
+}
+
+func (h *Homie) publishUpdate(kvu adapter.ValueUpdate) {
+	h.Lock()
+	d := h.deviceFor(kvu.Key)
+	if d == nil || h.clients[d.id] == nil {
+		h.Unlock()
+		return
+	}
+
+	p, ok := d.keys[kvu.Key]
+	if kvu.Removed || !ok {
+		// Structure has changed
+		h.publishDevice(d)
+		h.Unlock()
+		return
+	}
+
+	p.value = kvu.Value
+	c, topic, payload := h.clients[d.id], p.topic, formatValue(p, kvu.Value)
+	h.Unlock()
+
+	// Values are published without holding the lock
+	send(c, topic, payload)
+}
+
+func (h *Homie) updateStates() {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, d := range h.devices {
+		if h.clients[d.id] != nil && d.state != stateInit {
+			h.setState(d, adapterState(d.adapter))
+		}
+	}
+}
+
+func (h *Homie) connectDevice(d *device) error {
+	opts := util.NewClientOptions(h.conf, "-homie-"+d.id)
+	opts.SetWill(h.deviceTopic(d)+"/$state", stateLost, 1, true)
+
+	c := h.newClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	h.clients[d.id] = c
+
+	h.publishDevice(d)
+
+	if token := c.Subscribe(h.deviceTopic(d)+"/+/+/set", 1, h.setHandler(d)); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// Connect publishes all adapters as homie devices
+func (h *Homie) Connect() error {
+	h.Lock()
+	h.createDevices()
+	h.subscribeToAdapter()
+
+	for _, d := range h.devices {
+		if err := h.connectDevice(d); err != nil {
+			h.Unlock()
+			return err
+		}
+	}
+	h.Unlock()
+
+	h.stopState = bridgeutil.Interval(h.updateStates, stateInterval)
+
+	return nil
+}
+
+// Disconnect marks all devices disconnected and closes the connections
+func (h *Homie) Disconnect(wait uint) error {
+	if h.stopState != nil {
+		h.stopState()
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, d := range h.devices {
+		c := h.clients[d.id]
+		if c == nil {
+			continue
+		}
+
+		h.setState(d, stateDisconnected)
+		c.Disconnect(wait)
+		delete(h.clients, d.id)
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package homie
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+type mockToken bool
+
+func (mt mockToken) Wait() bool                     { return bool(mt) }
+func (mt mockToken) WaitTimeout(time.Duration) bool { return bool(mt) }
+func (mt mockToken) Error() error                   { return nil }
+
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (mm mockMessage) Duplicate() bool   { return false }
+func (mm mockMessage) Qos() byte         { return 1 }
+func (mm mockMessage) Retained() bool    { return false }
+func (mm mockMessage) Topic() string     { return mm.topic }
+func (mm mockMessage) MessageID() uint16 { return 0 }
+func (mm mockMessage) Payload() []byte   { return mm.payload }
+
+type mockClient struct {
+	sync.Mutex
+	retained map[string]string
+	subs     []string
+}
+
+func (mc *mockClient) IsConnected() bool       { return true }
+func (mc *mockClient) Connect() mqtt.Token     { return mockToken(false) }
+func (mc *mockClient) Disconnect(quiesce uint) {}
+
+func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.retained[topic] = string(payload.([]byte))
+	return mockToken(false)
+}
+
+func (mc *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	mc.subs = append(mc.subs, topic)
+	return mockToken(false)
+}
+
+func (mc *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	panic("not implemented")
+}
+
+func (mc *mockClient) Unsubscribe(topics ...string) mqtt.Token {
+	return mockToken(false)
+}
+
+func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	panic("not implemented")
+}
+
+func (mc *mockClient) get(topic string) string {
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.retained[topic]
+}
+
+type mockAdapter struct {
+	id   string
+	vals map[string]interface{}
+	adapter.Updater
+}
+
+func (ma *mockAdapter) Get(id string) (interface{}, error) { return ma.vals[id], nil }
+
+func (ma *mockAdapter) Set(id string, val interface{}) error {
+	ma.vals[id] = val
+	go ma.Updater.SendUpdate(adapter.Update{
+		ValueContainer: ma,
+		Updates:        []adapter.ValueUpdate{{Key: ma.ID() + "/" + id, Value: val}},
+	})
+	return nil
+}
+
+func (ma *mockAdapter) GetAll() (map[string]interface{}, error) { return ma.vals, nil }
+func (ma *mockAdapter) ID() string                              { return ma.id }
+func (ma *mockAdapter) UpdateChannel() <-chan adapter.Update    { return ma.Updater.UpdateChannel() }
+func (ma *mockAdapter) Close() error                            { return nil }
+
+func (ma *mockAdapter) Describe() adapter.Description {
+	return adapter.Description{
+		Kind: adapter.KindSensor,
+		Values: map[string]adapter.ValueDescription{
+			"temperature": {Type: adapter.TypeFloat, Unit: "°C", Min: -40, Max: 80},
+		},
+	}
+}
+
+func TestHomie(t *testing.T) {
+	ma := &mockAdapter{id: "dev_1", vals: map[string]interface{}{
+		"temperature": 21.5,
+		"on":          true,
+	}}
+
+	h := New(config.Config{Homie: &config.Homie{}}, ma)
+	mc := &mockClient{retained: map[string]string{}}
+	h.newClient = func(opts *mqtt.ClientOptions) mqtt.Client { return mc }
+
+	if err := h.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Disconnect(0)
+
+	expected := map[string]string{
+		"homie/dev-1/$homie":                     "4.0.0",
+		"homie/dev-1/$state":                     "ready",
+		"homie/dev-1/$nodes":                     "root",
+		"homie/dev-1/root/$type":                 "sensor",
+		"homie/dev-1/root/$properties":           "on,temperature",
+		"homie/dev-1/root/on":                    "true",
+		"homie/dev-1/root/on/$datatype":          "boolean",
+		"homie/dev-1/root/on/$settable":          "true",
+		"homie/dev-1/root/temperature":           "21.5",
+		"homie/dev-1/root/temperature/$datatype": "float",
+		"homie/dev-1/root/temperature/$settable": "false",
+		"homie/dev-1/root/temperature/$unit":     "°C",
+		"homie/dev-1/root/temperature/$format":   "-40:80",
+	}
+
+	for topic, payload := range expected {
+		if val := mc.get(topic); val != payload {
+			t.Errorf("Wrong payload for %s: %s != %s", topic, val, payload)
+		}
+	}
+
+	if len(mc.subs) != 1 || mc.subs[0] != "homie/dev-1/+/+/set" {
+		t.Error("Wrong subscriptions", mc.subs)
+	}
+
+	h.handleSet(h.devices[0], mockMessage{topic: "homie/dev-1/root/on/set", payload: []byte("false")})
+	if val := mc.get("dev_1/set/on"); val != "false" {
+		t.Error("Set was not sent to the bridge", val)
+	}
+
+	ma.Set("on", false)
+	for i := 0; i < 100 && mc.get("homie/dev-1/root/on") != "false"; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if val := mc.get("homie/dev-1/root/on"); val != "false" {
+		t.Error("Updated value was not published", val)
+	}
+
+	h.handleSet(h.devices[0], mockMessage{topic: "homie/dev-1/root/temperature/set", payload: []byte("10")})
+	if val := mc.get("dev_1/set/temperature"); val != "" {
+		t.Error("Non settable value should not be set", val)
+	}
+
+	// Sets carry the homie source when set sources are enabled
+	h.conf.SetSource = true
+	h.handleSet(h.devices[0], mockMessage{topic: "homie/dev-1/root/on/set", payload: []byte("true")})
+	if val, source := util.DecodeSetRequest([]byte(mc.get("dev_1/set/on"))); val != true || source == nil || source.Type != adapter.SourceHomie || source.ID != "dev-1" {
+		t.Error("Wrong set request", mc.get("dev_1/set/on"))
+	}
+}
+
+// slowClient blocks publishes until released
+type slowClient struct {
+	mockClient
+	release chan struct{}
+}
+
+func (sc *slowClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	<-sc.release
+	return sc.mockClient.Publish(topic, qos, retained, payload)
+}
+
+func TestHomieSlowBroker(t *testing.T) {
+	ma := &mockAdapter{id: "dev_1", vals: map[string]interface{}{"on": true}}
+
+	h := New(config.Config{Homie: &config.Homie{}}, ma)
+	sc := &slowClient{mockClient{retained: map[string]string{}}, make(chan struct{})}
+	close(sc.release)
+	h.newClient = func(opts *mqtt.ClientOptions) mqtt.Client { return sc }
+
+	if err := h.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	sc.release = make(chan struct{})
+
+	// Adapters are not blocked while the broker doesn't acknowledge publishes
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			ma.Updater.SendUpdate(adapter.Update{
+				ValueContainer: ma,
+				Updates:        []adapter.ValueUpdate{{Key: "dev_1/on", Value: i%2 == 0}},
+			})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Update fan-out blocked on the broker")
+	}
+
+	close(sc.release)
+	h.Disconnect(0)
+}
@@ -9,7 +9,11 @@ import (
 
 	"github.com/orktes/homeautomation/alexa"
 	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/history"
+	"github.com/orktes/homeautomation/homie"
+	"github.com/orktes/homeautomation/scene"
 	"github.com/orktes/homeautomation/trigger"
+	"github.com/orktes/homeautomation/util"
 
 	"github.com/orktes/homeautomation/config"
 
@@ -17,6 +21,8 @@ import (
 	"github.com/orktes/homeautomation/bridge/adapter/bolt"
 	"github.com/orktes/homeautomation/bridge/adapter/deconz"
 	"github.com/orktes/homeautomation/bridge/adapter/dra"
+	"github.com/orktes/homeautomation/bridge/adapter/federation"
+	"github.com/orktes/homeautomation/bridge/adapter/sun"
 	"github.com/orktes/homeautomation/bridge/adapter/viera"
 
 	"github.com/orktes/homeautomation/bridge/mqtt"
@@ -49,6 +55,21 @@ func configureBridge(conf config.Config) func() error {
 			createFunc = viera.Create
 		case "bolt":
 			createFunc = bolt.Create
+		case "federation":
+			createFunc = federation.Create
+		case "sun":
+			createFunc = sun.Create
+			if conf.Location != nil {
+				if adapterConf.Config == nil {
+					adapterConf.Config = map[string]interface{}{}
+				}
+				if _, ok := adapterConf.Config["latitude"]; !ok {
+					adapterConf.Config["latitude"] = conf.Location.Latitude
+				}
+				if _, ok := adapterConf.Config["longitude"]; !ok {
+					adapterConf.Config["longitude"] = conf.Location.Longitude
+				}
+			}
 		default:
 			fmt.Printf("No such adapter %s\n", adapterConf.Type)
 			os.Exit(1)
@@ -62,6 +83,14 @@ func configureBridge(conf config.Config) func() error {
 		}
 
 		adapters = append(adapters, adapter)
+
+		if adapterConf.Retain {
+			pattern := adapterConf.ID + "/#"
+			if bridgeConf.Root != "" {
+				pattern = bridgeConf.Root + "/" + pattern
+			}
+			bridgeConf.Retain = append(bridgeConf.Retain, pattern)
+		}
 	}
 
 	var mainAdapter adapter.Adapter
@@ -81,7 +110,13 @@ func configureBridge(conf config.Config) func() error {
 		return NoopCloser
 	}
 
+	closeHistory := configureHistory(conf, mainAdapter)
+	closeHomie := configureHomie(conf, mainAdapter)
+
 	return func() error {
+		closeHistory()
+		closeHomie()
+
 		if err := mqttBridge.Disconnect(0); err != nil {
 			fmt.Printf("Error disconnecting from mqtt brokers %s\n", err.Error())
 			return err
@@ -92,8 +127,58 @@ func configureBridge(conf config.Config) func() error {
 
 }
 
+func configureHistory(conf config.Config, mainAdapter adapter.Adapter) func() error {
+	if conf.History == nil {
+		return NoopCloser
+	}
+
+	h, err := history.New(conf, mainAdapter)
+	if err != nil {
+		fmt.Printf("Error creating history %s\n", err.Error())
+		os.Exit(1)
+		return NoopCloser
+	}
+
+	if err := h.Connect(); err != nil {
+		fmt.Printf("Error starting history %s\n", err.Error())
+		os.Exit(1)
+		return NoopCloser
+	}
+
+	return func() error {
+		if err := h.Disconnect(0); err != nil {
+			fmt.Printf("Error closing history %s\n", err.Error())
+			return err
+		}
+
+		return nil
+	}
+}
+
+func configureHomie(conf config.Config, mainAdapter adapter.Adapter) func() error {
+	if conf.Homie == nil {
+		return NoopCloser
+	}
+
+	h := homie.New(conf, mainAdapter)
+	if err := h.Connect(); err != nil {
+		fmt.Printf("Error connecting homie devices to mqtt brokers %s\n", err.Error())
+		os.Exit(1)
+		return NoopCloser
+	}
+
+	return func() error {
+		if err := h.Disconnect(0); err != nil {
+			fmt.Printf("Error disconnecting homie devices %s\n", err.Error())
+			return err
+		}
+
+		return nil
+	}
+}
+
 func configureTriggerSystem(conf config.Config) func() error {
-	if len(conf.Triggers) == 0 {
+	if len(conf.Triggers) == 0 && len(conf.Automations) == 0 {
 		return NoopCloser
 	}
 
@@ -135,19 +220,75 @@ func configureAlexa(conf config.Config) func() error {
 	}
 }
 
-func main() {
-	file, err := os.Open(os.Args[1])
+func configureScenes(conf config.Config) func() error {
+	if conf.Scenes == nil {
+		return NoopCloser
+	}
+
+	s := scene.New(conf)
+	if err := s.Connect(); err != nil {
+		fmt.Printf("Error starting scenes %s\n", err.Error())
+		os.Exit(1)
+		return NoopCloser
+	}
+
+	return func() error {
+		if err := s.Disconnect(0); err != nil {
+			fmt.Printf("Error closing scenes %s\n", err.Error())
+			return err
+		}
+
+		return nil
+	}
+}
+
+func loadConfig(filename string) (config.Config, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return config.Config{}, err
+	}
+	defer file.Close()
+
+	conf, err := config.ParseConfig(bufio.NewReader(file))
+	if err != nil {
+		return conf, err
 	}
-	reader := bufio.NewReader(file)
-	conf, err := config.ParseConfig(reader)
+
+	if _, err := util.NewTopicLayout(conf.Topics); err != nil {
+		return conf, fmt.Errorf("invalid topic templates %s", err.Error())
+	}
+
+	if bridgeConf := conf.Bridge; bridgeConf != nil && !bridgeConf.IncludeSource && bridgeConf.PayloadFormat != util.PayloadEnvelope {
+		// Federations skip mirrored values by their source. Without it a remote instance federating
+		// this one would mirror the values back.
+		for _, adapterConf := range bridgeConf.Adapters {
+			if adapterConf.Type == "federation" {
+				return conf, fmt.Errorf("federation adapter %s requires include_source = true or payload_format = \"%s\"", adapterConf.ID, util.PayloadEnvelope)
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test":
+			os.Exit(runTests(os.Args[2:]))
+		case "console":
+			os.Exit(runConsole(os.Args[2:]))
+		}
+	}
+
+	conf, err := loadConfig(os.Args[1])
 	if err != nil {
 		panic(err)
 	}
 
 	closeBridge := configureBridge(conf)
 	closeTriggerSystem := configureTriggerSystem(conf)
+	closeScenes := configureScenes(conf)
 	closeAlexa := configureAlexa(conf)
 
 	c := make(chan os.Signal, 1)
@@ -157,6 +298,7 @@ func main() {
 
 	closeBridge()
 	closeTriggerSystem()
+	closeScenes()
 	closeAlexa()
 
 }
@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/config"
+)
+
+// DefaultSize is used if no queue size has been configured
+const DefaultSize = 1000
+
+var (
+	// publishTimeout defines how long a publish may take before the message is queued
+	publishTimeout = 5 * time.Second
+	// flushInterval defines how often the queue is flushed and spooled when there is no activity
+	flushInterval = time.Second
+)
+
+var ErrorTimeout = errors.New("publish timed out")
+
+// Message is a single queued mqtt message
+type Message struct {
+	Topic    string `json:"topic"`
+	QoS      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+	Payload  []byte `json:"payload"`
+	// Coalesce replaces older queued messages of the same topic. Used for status messages
+	// where only the latest value matters.
+	Coalesce bool `json:"coalesce,omitempty"`
+
+	// token of a publish which timed out. paho may still deliver the message.
+	token mqtt.Token
+	// id identifies the message while it is being published
+	id uint64
+}
+
+// Metrics describes the state of the queue
+type Metrics struct {
+	Depth   int    `json:"depth"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Queue publishes messages to a mqtt broker. Messages that can't be published are queued
+// and published in order once the broker is reachable again.
+type Queue struct {
+	size  int
+	spool string
+
+	// sendMutex keeps flushes from running concurrently
+	sendMutex sync.Mutex
+
+	sync.Mutex
+	client   mqtt.Client
+	messages []Message
+	nextID   uint64
+	dirty    bool
+	metrics  Metrics
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a new queue for the client. The client may be nil until it has been created.
+// The spool file of the queue is named after the component.
+func New(client mqtt.Client, name string, conf *config.Queue) *Queue {
+	q := &Queue{
+		client: client,
+		size:   DefaultSize,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if conf != nil {
+		if conf.Size > 0 {
+			q.size = conf.Size
+		}
+		if conf.SpoolDir != "" {
+			q.spool = filepath.Join(conf.SpoolDir, name+".spool")
+		}
+	}
+
+	if err := q.load(); err != nil {
+		fmt.Printf("Error reading spooled messages %s %s\n", q.spool, err.Error())
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Publish queues the message and publishes it in the background. Messages stay queued while the broker can't be reached.
+func (q *Queue) Publish(msg Message) {
+	q.enqueue(msg)
+	q.Flush()
+}
+
+// SetClient sets the client used for publishing and flushes the queue
+func (q *Queue) SetClient(client mqtt.Client) {
+	q.Lock()
+	q.client = client
+	q.Unlock()
+
+	q.Flush()
+}
+
+// Flush publishes the queued messages in the background
+func (q *Queue) Flush() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.messages)
+}
+
+// Metrics returns the current queue metrics
+func (q *Queue) Metrics() Metrics {
+	q.Lock()
+	defer q.Unlock()
+
+	metrics := q.metrics
+	metrics.Depth = len(q.messages)
+	return metrics
+}
+
+// Close stops flushing and spools the queued messages
+func (q *Queue) Close() error {
+	close(q.stop)
+	<-q.done
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.save()
+}
+
+// connectedClient returns the client if it is connected
+func (q *Queue) connectedClient() mqtt.Client {
+	q.Lock()
+	client := q.client
+	q.Unlock()
+
+	if client == nil || !client.IsConnected() {
+		return nil
+	}
+	return client
+}
+
+// send publishes a message. Returns the token of the publish with ErrorTimeout if it didn't complete in time.
+func (q *Queue) send(client mqtt.Client, msg Message) (mqtt.Token, error) {
+	token := client.Publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return token, ErrorTimeout
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	q.Lock()
+	q.metrics.Sent++
+	q.Unlock()
+
+	return nil, nil
+}
+
+// deliver publishes a queued message. Messages whose publish timed out are only published again
+// if the earlier publish failed so that they aren't sent twice.
+func (q *Queue) deliver(client mqtt.Client, msg Message) (mqtt.Token, error) {
+	if msg.token != nil {
+		if !msg.token.WaitTimeout(publishTimeout) {
+			return msg.token, ErrorTimeout
+		}
+		if msg.token.Error() == nil {
+			q.Lock()
+			q.metrics.Sent++
+			q.Unlock()
+			return nil, nil
+		}
+	}
+
+	return q.send(client, msg)
+}
+
+func (q *Queue) enqueue(msg Message) {
+	q.Lock()
+	defer q.Unlock()
+
+	if msg.Coalesce {
+		for i, queued := range q.messages {
+			if queued.Coalesce && queued.Topic == msg.Topic {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if len(q.messages) >= q.size {
+		fmt.Printf("Outbound queue full. Dropping message to %s\n", q.messages[0].Topic)
+		q.messages = q.messages[1:]
+		q.metrics.Dropped++
+	}
+
+	q.nextID++
+	msg.id = q.nextID
+	q.messages = append(q.messages, msg)
+	q.dirty = true
+}
+
+// index returns the position of the message with the id. Must be called with the lock held.
+func (q *Queue) index(id uint64) int {
+	for i, msg := range q.messages {
+		if msg.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// flush publishes queued messages in order until the queue is empty or publishing fails
+func (q *Queue) flush() {
+	q.sendMutex.Lock()
+	defer q.sendMutex.Unlock()
+
+	for {
+		client := q.connectedClient()
+		if client == nil {
+			return
+		}
+
+		q.Lock()
+		if len(q.messages) == 0 {
+			q.Unlock()
+			return
+		}
+		msg := q.messages[0]
+		q.Unlock()
+
+		// The message may be replaced or dropped by newer messages while it is published
+		token, err := q.deliver(client, msg)
+
+		q.Lock()
+		i := q.index(msg.id)
+		if err != nil {
+			fmt.Printf("Error publishing queued message to %s %s\n", msg.Topic, err.Error())
+			if i >= 0 {
+				q.messages[i].token = token
+			}
+			q.Unlock()
+			return
+		}
+		if i >= 0 {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.dirty = true
+		}
+		q.Unlock()
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+			q.flush()
+			continue
+		case <-ticker.C:
+		}
+
+		// The spool is written periodically instead of for every message
+		q.flush()
+
+		q.Lock()
+		if err := q.save(); err != nil {
+			fmt.Printf("Error spooling messages %s %s\n", q.spool, err.Error())
+		}
+		q.Unlock()
+	}
+}
+
+// load reads the spooled messages
+func (q *Queue) load() error {
+	if q.spool == "" {
+		return nil
+	}
+
+	f, err := os.Open(q.spool)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		msg := Message{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return err
+		}
+		q.enqueue(msg)
+	}
+
+	return scanner.Err()
+}
+
+// save writes the queued messages to the spool file when they have changed. Must be called with the lock held.
+func (q *Queue) save() error {
+	if q.spool == "" || !q.dirty {
+		return nil
+	}
+
+	if len(q.messages) == 0 {
+		q.dirty = false
+		if err := os.Remove(q.spool); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := q.spool + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, msg := range q.messages {
+		if err := enc.Encode(msg); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	q.dirty = false
+	return os.Rename(tmp, q.spool)
+}
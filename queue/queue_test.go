@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/config"
+)
+
+type mockToken struct {
+	err error
+}
+
+func (mt mockToken) Wait() bool                     { return true }
+func (mt mockToken) WaitTimeout(time.Duration) bool { return true }
+func (mt mockToken) Error() error                   { return mt.err }
+
+// slowToken completes when done is closed
+type slowToken struct {
+	done chan struct{}
+}
+
+func (st slowToken) Wait() bool {
+	<-st.done
+	return true
+}
+
+func (st slowToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-st.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (st slowToken) Error() error { return nil }
+
+type mockClient struct {
+	sync.Mutex
+	connected bool
+	topics    []string
+	// token is returned for publishes if set
+	token mqtt.Token
+}
+
+func (mc *mockClient) IsConnected() bool {
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.connected
+}
+
+func (mc *mockClient) setConnected(connected bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.connected = connected
+}
+
+func (mc *mockClient) Connect() mqtt.Token     { return mockToken{} }
+func (mc *mockClient) Disconnect(quiesce uint) {}
+
+func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	mc.Lock()
+	defer mc.Unlock()
+	if !mc.connected {
+		return mockToken{errors.New("not connected")}
+	}
+	mc.topics = append(mc.topics, topic+"="+string(payload.([]byte)))
+	if mc.token != nil {
+		return mc.token
+	}
+	return mockToken{}
+}
+
+func (mc *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	panic("not implemented")
+}
+
+func (mc *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	panic("not implemented")
+}
+
+func (mc *mockClient) Unsubscribe(topics ...string) mqtt.Token {
+	panic("not implemented")
+}
+
+func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	panic("not implemented")
+}
+
+func (mc *mockClient) count() int {
+	mc.Lock()
+	defer mc.Unlock()
+	return len(mc.topics)
+}
+
+func (mc *mockClient) published() []string {
+	mc.Lock()
+	defer mc.Unlock()
+	topics := mc.topics
+	mc.topics = nil
+	return topics
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Queue{Size: 3, SpoolDir: dir}
+	mc := &mockClient{connected: true}
+	q := New(mc, "test", conf)
+
+	q.Publish(Message{Topic: "a", Payload: []byte("1"), Coalesce: true})
+	waitFor(func() bool { return q.Len() == 0 })
+	if pubs := mc.published(); len(pubs) != 1 || pubs[0] != "a=1" {
+		t.Error("Message should be published", pubs)
+	}
+
+	mc.setConnected(false)
+	q.Publish(Message{Topic: "a", Payload: []byte("2"), Coalesce: true})
+	q.Publish(Message{Topic: "set", Payload: []byte("1")})
+	q.Publish(Message{Topic: "a", Payload: []byte("3"), Coalesce: true})
+	q.Publish(Message{Topic: "set", Payload: []byte("2")})
+
+	if metrics := q.Metrics(); metrics.Depth != 3 || metrics.Dropped != 0 {
+		t.Error("Wrong metrics", metrics)
+	}
+
+	q.Publish(Message{Topic: "b", Payload: []byte("1"), Coalesce: true})
+	if metrics := q.Metrics(); metrics.Depth != 3 || metrics.Dropped != 1 {
+		t.Error("Oldest message should be dropped", metrics)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spooled messages are published in order by the next queue
+	q = New(mc, "test", conf)
+	defer q.Close()
+
+	if q.Len() != 3 {
+		t.Fatal("Messages were not spooled", q.Len())
+	}
+
+	mc.setConnected(true)
+	q.Flush()
+
+	expected := []string{"a=3", "set=2", "b=1"}
+	waitFor(func() bool { return q.Len() == 0 })
+
+	pubs := mc.published()
+	if len(pubs) != len(expected) {
+		t.Fatal("Wrong messages flushed", pubs)
+	}
+	for i, pub := range pubs {
+		if pub != expected[i] {
+			t.Error("Wrong message", i, pub)
+		}
+	}
+}
+
+func TestQueueSetClient(t *testing.T) {
+	q := New(nil, "test", nil)
+	defer q.Close()
+
+	q.Publish(Message{Topic: "a", Payload: []byte("1")})
+	if q.Len() != 1 {
+		t.Fatal("Message should be queued until there is a client")
+	}
+
+	mc := &mockClient{connected: true}
+	q.SetClient(mc)
+
+	if !waitFor(func() bool { return q.Len() == 0 }) {
+		t.Fatal("Queue was not flushed")
+	}
+	if pubs := mc.published(); len(pubs) != 1 || pubs[0] != "a=1" {
+		t.Error("Wrong messages published", pubs)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { publishTimeout = timeout }(publishTimeout)
+	publishTimeout = 10 * time.Millisecond
+
+	token := slowToken{make(chan struct{})}
+	mc := &mockClient{connected: true, token: token}
+	q := New(mc, "test", nil)
+	defer q.Close()
+
+	q.Publish(Message{Topic: "set", Payload: []byte("1")})
+	if !waitFor(func() bool { return mc.count() == 1 }) {
+		t.Fatal("Message was not published")
+	}
+
+	// The message is not sent again while paho may still deliver it
+	mc.Lock()
+	mc.token = nil
+	mc.Unlock()
+	time.Sleep(5 * publishTimeout)
+	q.Flush()
+	time.Sleep(5 * publishTimeout)
+	if q.Len() != 1 || mc.count() != 1 {
+		t.Error("Pending message should stay queued", q.Len(), mc.count())
+	}
+
+	close(token.done)
+	q.Publish(Message{Topic: "set", Payload: []byte("2")})
+	waitFor(func() bool { return q.Len() == 0 })
+
+	if pubs := mc.published(); len(pubs) != 2 || pubs[0] != "set=1" || pubs[1] != "set=2" {
+		t.Error("Wrong messages published", pubs)
+	}
+	if metrics := q.Metrics(); metrics.Depth != 0 || metrics.Sent != 2 {
+		t.Error("Wrong metrics", metrics)
+	}
+}
@@ -0,0 +1,546 @@
+package scene
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/store"
+	"github.com/orktes/homeautomation/util"
+)
+
+// DefaultRoot is the first segment of scene keys if no root has been configured
+const DefaultRoot = "scenes"
+
+// Scene command actions
+const (
+	// ActionApply sets the values of a scene. The replaced values are stored so that they can be restored.
+	ActionApply = "apply"
+	// ActionRestore sets the values replaced when the scene was last applied
+	ActionRestore = "restore"
+	// ActionCapture stores the current values of the keys matching the capture patterns in the scene
+	ActionCapture = "capture"
+	// ActionDelete removes the captured values of a scene
+	ActionDelete = "delete"
+)
+
+// Store buckets
+const (
+	bucketScenes   = "scenes"
+	bucketPrevious = "previous"
+)
+
+var (
+	// ErrNoSuchScene is returned for scenes which are neither configured nor captured
+	ErrNoSuchScene = errors.New("no such scene")
+
+	errStoreNotConfigured = errors.New("scene store has not been configured")
+	errPublishTimeout     = errors.New("publish timed out")
+
+	// publishTimeout defines how long a set or result publish may take
+	publishTimeout = 10 * time.Second
+
+	// transitionStep is the interval of the sets fading numeric values during a transition
+	transitionStep = 500 * time.Millisecond
+)
+
+// Command is the value of a scene command request. A bare action string is accepted too and an
+// empty request applies the scene.
+type Command struct {
+	Action string `json:"action"`
+	// Transition overrides the transition of the scene (10s or milliseconds)
+	Transition interface{} `json:"transition,omitempty"`
+	// Patterns override the capture patterns of the scene
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// Root returns the first segment of the scene keys of a config
+func Root(conf config.Config) string {
+	if conf.Scenes != nil && conf.Scenes.Root != "" {
+		return conf.Scenes.Root
+	}
+	return DefaultRoot
+}
+
+// Key returns the key commands of a scene are sent to
+func Key(conf config.Config, name string) string {
+	return Root(conf) + "/" + name
+}
+
+// Scenes applies, captures and restores scenes on command requests sent to <root>/<name>. The
+// status of all keys is followed so that the current values can be captured and restored.
+type Scenes struct {
+	conf   config.Config
+	topics util.TopicLayout
+	scenes map[string]config.Scene
+
+	c     mqtt.Client
+	store *store.Store
+	// publish is used for set requests and results
+	publish func(topic string, payload []byte) error
+
+	sync.Mutex
+	data map[string]interface{}
+	// transitions are closed to stop the running transition of a scene
+	transitions map[string]chan struct{}
+}
+
+// New returns scenes for the given config
+func New(conf config.Config) *Scenes {
+	s := &Scenes{
+		conf:        conf,
+		topics:      util.MustTopicLayout(conf.Topics),
+		scenes:      map[string]config.Scene{},
+		data:        map[string]interface{}{},
+		transitions: map[string]chan struct{}{},
+	}
+	s.publish = s.mqttPublish
+
+	for _, sceneConf := range conf.Scenes.Scenes {
+		s.scenes[sceneConf.Name] = sceneConf
+	}
+
+	return s
+}
+
+func (s *Scenes) mqttPublish(topic string, payload []byte) error {
+	token := s.c.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (s *Scenes) statusHandler(client mqtt.Client, msg mqtt.Message) {
+	key, ok := s.topics.ParseFunction(util.FunctionStatus, msg.Topic())
+	if !ok {
+		return
+	}
+
+	val, _ := util.DecodeStatus(msg.Payload())
+
+	s.Lock()
+	s.data[key] = val
+	s.Unlock()
+}
+
+func (s *Scenes) commandHandler(client mqtt.Client, msg mqtt.Message) {
+	// Applying a scene waits for the store and publishes which can't be done in the message router
+	go s.command(msg.Topic(), msg.Payload())
+}
+
+// command runs the command of a message and publishes its result
+func (s *Scenes) command(topic string, payload []byte) {
+	key, ok := s.topics.ParseFunction(util.FunctionCommand, topic)
+	if !ok || !strings.HasPrefix(key, Root(s.conf)+"/") {
+		return
+	}
+	name := key[len(Root(s.conf))+1:]
+
+	req := util.DecodeRequest(payload)
+
+	cmd, err := decodeCommand(req.Value)
+	if err == nil {
+		err = s.Run(name, cmd)
+	}
+	if err != nil {
+		fmt.Printf("Error running scene command %s %s\n", key, err.Error())
+	}
+
+	res := util.NewResult(util.FunctionCommand, key, err, req.Correlation)
+	if err == ErrNoSuchScene {
+		res.Code = util.ErrorCodeNotFound
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	if err := s.publish(s.topics.Build(util.FunctionResult, key), b); err != nil {
+		fmt.Printf("Error publishing result for %s %s\n", key, err.Error())
+	}
+}
+
+func decodeCommand(val interface{}) (Command, error) {
+	cmd := Command{}
+	switch v := val.(type) {
+	case nil:
+	case string:
+		cmd.Action = v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return cmd, err
+		}
+		if err := json.Unmarshal(b, &cmd); err != nil {
+			return cmd, fmt.Errorf("invalid scene command %s", string(b))
+		}
+	}
+	return cmd, nil
+}
+
+// Run runs a command of a scene
+func (s *Scenes) Run(name string, cmd Command) error {
+	switch cmd.Action {
+	case "", ActionApply, ActionRestore:
+		transition, err := s.transition(name, cmd.Transition)
+		if err != nil {
+			return err
+		}
+		if cmd.Action == ActionRestore {
+			return s.Restore(name, transition)
+		}
+		return s.Apply(name, transition)
+	case ActionCapture:
+		return s.Capture(name, cmd.Patterns)
+	case ActionDelete:
+		return s.Delete(name)
+	}
+
+	return fmt.Errorf("unknown scene action %s", cmd.Action)
+}
+
+// transition returns the transition given in a command or the default transition of the scene
+func (s *Scenes) transition(name string, val interface{}) (time.Duration, error) {
+	switch v := val.(type) {
+	case nil:
+		if sceneConf, ok := s.scenes[name]; ok && sceneConf.Transition != "" {
+			return util.ParseDuration(sceneConf.Transition)
+		}
+		return 0, nil
+	case string:
+		return util.ParseDuration(v)
+	case float64:
+		return time.Duration(v * float64(time.Millisecond)), nil
+	}
+	return 0, fmt.Errorf("invalid transition %v", val)
+}
+
+// Values returns the values of a scene. Captured values override the configured ones.
+func (s *Scenes) Values(name string) (map[string]interface{}, error) {
+	vals := map[string]interface{}{}
+
+	sceneConf, configured := s.scenes[name]
+	for key, val := range sceneConf.Values {
+		vals[key] = val
+	}
+
+	captured, ok, err := s.load(bucketScenes, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && !configured {
+		return nil, ErrNoSuchScene
+	}
+	for key, val := range captured {
+		vals[key] = val
+	}
+
+	return vals, nil
+}
+
+// Apply sets the values of a scene fading numeric values over the transition. The values replaced
+// are stored unless the scene is already active so that the scene can be restored.
+func (s *Scenes) Apply(name string, transition time.Duration) error {
+	vals, err := s.Values(name)
+	if err != nil {
+		return err
+	}
+
+	if s.store != nil {
+		previous := map[string]interface{}{}
+		active := true
+
+		s.Lock()
+		for key, val := range vals {
+			current, ok := s.data[key]
+			if ok {
+				previous[key] = current
+			}
+			if !ok || !util.ValuesEqual(current, val) {
+				active = false
+			}
+		}
+		s.Unlock()
+
+		if !active {
+			if err := s.store.Set(bucketPrevious, name, previous, 0, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.set(name, vals, transition)
+}
+
+// Restore sets the values replaced when the scene was last applied
+func (s *Scenes) Restore(name string, transition time.Duration) error {
+	if s.store == nil {
+		return errStoreNotConfigured
+	}
+
+	vals, ok, err := s.load(bucketPrevious, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("scene %s has not been applied", name)
+	}
+
+	if err := s.set(name, vals, transition); err != nil {
+		return err
+	}
+	return s.store.Delete(bucketPrevious, name)
+}
+
+// Capture stores the current values of the keys matching the patterns in a scene. The capture
+// patterns of the scene are used if no patterns are given.
+func (s *Scenes) Capture(name string, patterns []string) error {
+	if s.store == nil {
+		return errStoreNotConfigured
+	}
+
+	if len(patterns) == 0 {
+		patterns = s.scenes[name].Capture
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("scene %s has no capture patterns", name)
+	}
+
+	vals := map[string]interface{}{}
+
+	s.Lock()
+	for key, val := range s.data {
+		for _, pattern := range patterns {
+			if util.MatchPattern(pattern, key) {
+				vals[key] = val
+				break
+			}
+		}
+	}
+	s.Unlock()
+
+	return s.store.Set(bucketScenes, name, vals, 0, time.Now())
+}
+
+// Delete removes the captured values of a scene
+func (s *Scenes) Delete(name string) error {
+	if s.store == nil {
+		return errStoreNotConfigured
+	}
+
+	if err := s.store.Delete(bucketScenes, name); err != nil {
+		return err
+	}
+	return s.store.Delete(bucketPrevious, name)
+}
+
+// load returns the values stored for a scene in a bucket
+func (s *Scenes) load(bucket string, name string) (map[string]interface{}, bool, error) {
+	if s.store == nil {
+		return nil, false, nil
+	}
+
+	val, ok, err := s.store.Get(bucket, name, time.Now())
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	vals, _ := val.(map[string]interface{})
+	return vals, true, nil
+}
+
+// set sets the values stopping a running transition of the scene. Numeric values with a known
+// numeric value are faded in steps over the transition and other values are set at once.
+func (s *Scenes) set(name string, vals map[string]interface{}, transition time.Duration) error {
+	stop := make(chan struct{})
+
+	s.Lock()
+	if running, ok := s.transitions[name]; ok {
+		close(running)
+		delete(s.transitions, name)
+	}
+
+	type fade struct {
+		from float64
+		to   float64
+		// round is set when both ends are integers
+		round bool
+	}
+	fades := map[string]fade{}
+	now := map[string]interface{}{}
+
+	for key, val := range vals {
+		to, ok := util.ToFloat(val)
+		from, known := util.ToFloat(s.data[key])
+		if transition <= 0 || !ok || !known || from == to {
+			now[key] = val
+			continue
+		}
+		fades[key] = fade{from: from, to: to, round: from == math.Trunc(from) && to == math.Trunc(to)}
+	}
+
+	if len(fades) > 0 {
+		s.transitions[name] = stop
+	}
+	s.Unlock()
+
+	if err := s.setValues(name, now); err != nil {
+		return err
+	}
+	if len(fades) == 0 {
+		return nil
+	}
+
+	steps := int(transition / transitionStep)
+	if steps < 1 {
+		steps = 1
+	}
+
+	go func() {
+		ticker := time.NewTicker(transition / time.Duration(steps))
+		defer ticker.Stop()
+
+		for i := 1; i <= steps; i++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			step := map[string]interface{}{}
+			for key, f := range fades {
+				val := f.from + (f.to-f.from)*float64(i)/float64(steps)
+				if f.round {
+					val = math.Round(val)
+				}
+				step[key] = val
+			}
+			if err := s.setValues(name, step); err != nil {
+				fmt.Printf("Error in transition of scene %s %s\n", name, err.Error())
+			}
+		}
+
+		s.Lock()
+		if s.transitions[name] == stop {
+			delete(s.transitions, name)
+		}
+		s.Unlock()
+	}()
+
+	return nil
+}
+
+// setValues publishes set requests for the values. Values of the same container are set with
+// a single request.
+func (s *Scenes) setValues(name string, vals map[string]interface{}) error {
+	containers := map[string]map[string]interface{}{}
+	for key, val := range vals {
+		parent, child := key, ""
+		// Keys right below a root are never grouped as the root isn't a container
+		if i := strings.LastIndex(key, "/"); i > 0 && strings.Contains(key[:i], "/") {
+			parent, child = key[:i], key[i+1:]
+		}
+		if containers[parent] == nil {
+			containers[parent] = map[string]interface{}{}
+		}
+		containers[parent][child] = val
+	}
+
+	keys := make([]string, 0, len(containers))
+	for key := range containers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	source := &adapter.Source{Type: adapter.SourceScene, ID: name, Client: s.conf.ClientID}
+
+	var errs []string
+	for _, parent := range keys {
+		children := containers[parent]
+
+		if _, ok := children[""]; ok || len(children) == 1 {
+			// Keys are set on their own
+			for child, val := range children {
+				key := parent
+				if child != "" {
+					key += "/" + child
+				}
+				if err := s.publishSet(key, val, source); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			continue
+		}
+
+		if err := s.publishSet(parent, children, source); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *Scenes) publishSet(key string, val interface{}, source *adapter.Source) error {
+	b, err := util.EncodeRequest(util.SetRequest{Value: val, Source: source}, s.conf.SetSource)
+	if err != nil {
+		return err
+	}
+	return s.publish(s.topics.Build(util.FunctionSet, key), b)
+}
+
+// Connect opens the scene store and connects to the mqtt brokers
+func (s *Scenes) Connect() error {
+	if s.conf.Scenes.DatabaseFile != "" {
+		st, err := store.Open(s.conf.Scenes.DatabaseFile)
+		if err != nil {
+			return err
+		}
+		s.store = st
+	}
+
+	opts := util.NewClientOptions(s.conf, "-scenes")
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	s.c = c
+
+	if token := c.Subscribe(s.topics.Subscription(util.FunctionStatus, "+"), 1, s.statusHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	if token := c.Subscribe(s.topics.Subscription(util.FunctionCommand, Root(s.conf)), 1, s.commandHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// Disconnect stops running transitions and closes all connections
+func (s *Scenes) Disconnect(wait uint) error {
+	s.Lock()
+	for name, stop := range s.transitions {
+		close(stop)
+		delete(s.transitions, name)
+	}
+	s.Unlock()
+
+	if s.c != nil {
+		s.c.Disconnect(wait)
+	}
+	if s.store != nil {
+		return s.store.Close()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package scene
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/store"
+	"github.com/orktes/homeautomation/util"
+)
+
+type published struct {
+	topic string
+	value interface{}
+}
+
+func newTestScenes(t *testing.T, conf config.Scenes) (*Scenes, chan published, func()) {
+	dir, err := ioutil.TempDir("", "scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(config.Config{Scenes: &conf})
+	s.store, err = store.Open(filepath.Join(dir, "scenes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubs := make(chan published, 20)
+	s.publish = func(topic string, payload []byte) error {
+		var val interface{}
+		if _, ok := s.topics.ParseFunction(util.FunctionSet, topic); ok {
+			val = util.DecodeRequest(payload).Value
+		} else {
+			res := util.Result{}
+			json.Unmarshal(payload, &res)
+			val = res
+		}
+		pubs <- published{topic, val}
+		return nil
+	}
+
+	return s, pubs, func() {
+		s.Disconnect(0)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestScenes(t *testing.T) {
+	s, pubs, done := newTestScenes(t, config.Scenes{
+		Scenes: []config.Scene{
+			config.Scene{
+				Name: "movie",
+				Values: map[string]interface{}{
+					"haaga/dra/volume":          -40,
+					"haaga/dra/input":           "hdmi1",
+					"haaga/viera/power":         true,
+					"haaga/deconz/groups/3/bri": 30,
+				},
+			},
+			config.Scene{Name: "evening", Capture: []string{"haaga/deconz/groups/+/bri"}},
+		},
+	})
+	defer done()
+
+	s.data = map[string]interface{}{
+		"haaga/dra/volume":          float64(-30),
+		"haaga/dra/input":           "tv",
+		"haaga/viera/power":         false,
+		"haaga/deconz/groups/3/bri": float64(200),
+		"haaga/deconz/groups/4/bri": float64(100),
+	}
+
+	// command returns the result of a command and the sets published before it
+	command := func(name string, payload string) (util.Result, map[string]interface{}) {
+		s.command("scenes/command/"+name, []byte(payload))
+
+		sets := map[string]interface{}{}
+		for p := range pubs {
+			if res, ok := p.value.(util.Result); ok {
+				if p.topic != "scenes/result/"+name {
+					t.Error("Wrong result topic", p.topic)
+				}
+				return res, sets
+			}
+			sets[p.topic] = p.value
+		}
+		return util.Result{}, nil
+	}
+
+	expectSets := func(sets map[string]interface{}, expected map[string]interface{}) {
+		b1, _ := json.Marshal(sets)
+		b2, _ := json.Marshal(expected)
+		if string(b1) != string(b2) {
+			t.Errorf("Wrong sets %s expected %s", b1, b2)
+		}
+	}
+
+	res, sets := command("movie", `{"value": "apply", "correlation": "1"}`)
+	if res.Status != util.ResultOK || res.Correlation != "1" {
+		t.Error("Wrong result", res)
+	}
+	expectSets(sets, map[string]interface{}{
+		"haaga/set/deconz/groups/3/bri": 30,
+		"haaga/set/dra":                 map[string]interface{}{"input": "hdmi1", "volume": -40},
+		"haaga/set/viera/power":         true,
+	})
+
+	// Applying an active scene keeps the values to restore
+	s.data["haaga/dra/volume"] = float64(-40)
+	s.data["haaga/dra/input"] = "hdmi1"
+	s.data["haaga/viera/power"] = true
+	s.data["haaga/deconz/groups/3/bri"] = float64(30)
+	if res, sets = command("movie", ""); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	expectSets(sets, map[string]interface{}{
+		"haaga/set/deconz/groups/3/bri": 30,
+		"haaga/set/dra":                 map[string]interface{}{"input": "hdmi1", "volume": -40},
+		"haaga/set/viera/power":         true,
+	})
+
+	if res, sets = command("movie", `"restore"`); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	expectSets(sets, map[string]interface{}{
+		"haaga/set/deconz/groups/3/bri": 200,
+		"haaga/set/dra":                 map[string]interface{}{"input": "tv", "volume": -30},
+		"haaga/set/viera/power":         false,
+	})
+	if res, _ := command("movie", `"restore"`); res.Status != util.ResultError {
+		t.Error("Restored twice", res)
+	}
+
+	if res, _ := command("evening", `"capture"`); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	if vals, err := s.Values("evening"); err != nil || len(vals) != 2 || vals["haaga/deconz/groups/4/bri"] != float64(100) {
+		t.Error("Wrong captured values", vals, err)
+	}
+
+	if res, _ := command("ad-hoc", `{"action": "capture", "patterns": ["haaga/dra/#"]}`); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	s.data["haaga/dra/volume"] = float64(-20)
+	if res, sets = command("ad-hoc", ""); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	expectSets(sets, map[string]interface{}{
+		"haaga/set/dra": map[string]interface{}{"input": "hdmi1", "volume": -40},
+	})
+
+	if res, _ := command("ad-hoc", `"delete"`); res.Status != util.ResultOK {
+		t.Error("Wrong result", res)
+	}
+	if res, _ := command("ad-hoc", ""); res.Code != util.ErrorCodeNotFound {
+		t.Error("Wrong result for a deleted scene", res)
+	}
+}
+
+func TestSceneTransition(t *testing.T) {
+	defer func(step time.Duration) { transitionStep = step }(transitionStep)
+	transitionStep = 10 * time.Millisecond
+
+	s, pubs, done := newTestScenes(t, config.Scenes{
+		Scenes: []config.Scene{
+			config.Scene{
+				Name:       "dim",
+				Transition: "40ms",
+				Values: map[string]interface{}{
+					"haaga/deconz/groups/3/on":  true,
+					"haaga/deconz/groups/3/bri": 100,
+				},
+			},
+		},
+	})
+	defer done()
+
+	s.data["haaga/deconz/groups/3/bri"] = float64(0)
+
+	if err := s.Run("dim", Command{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []published{
+		{"haaga/set/deconz/groups/3/on", true},
+		{"haaga/set/deconz/groups/3/bri", float64(25)},
+		{"haaga/set/deconz/groups/3/bri", float64(50)},
+		{"haaga/set/deconz/groups/3/bri", float64(75)},
+		{"haaga/set/deconz/groups/3/bri", float64(100)},
+	}
+	for _, e := range expected {
+		select {
+		case p := <-pubs:
+			if p != e {
+				t.Error("Wrong set", p, "expected", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for", e)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store is a persistent key-value store in a bolt database. Values are JSON encoded
+// and kept in named buckets.
+type Store struct {
+	db *bolt.DB
+}
+
+type entry struct {
+	Value interface{} `json:"v"`
+	// Expires is the expiration time in unix nanoseconds, zero if the entry doesn't expire
+	Expires int64 `json:"e,omitempty"`
+}
+
+func (e entry) expired(now time.Time) bool {
+	return e.Expires != 0 && e.Expires <= now.UnixNano()
+}
+
+// Open opens (or creates) a store in the given file
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Get returns the value of a key in a bucket. Returns false if the key doesn't exist or has expired.
+func (s *Store) Get(bucket string, key string, now time.Time) (interface{}, bool, error) {
+	var res entry
+	found := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		d := b.Get([]byte(key))
+		if d == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(d, &res); err != nil {
+			return err
+		}
+		found = !res.expired(now)
+
+		return nil
+	})
+
+	return res.Value, found, err
+}
+
+// Set stores a value. The value expires after ttl unless ttl is zero.
+func (s *Store) Set(bucket string, key string, val interface{}, ttl time.Duration, now time.Time) error {
+	e := entry{Value: val}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl).UnixNano()
+	}
+
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), d)
+	})
+}
+
+// Delete removes a key from a bucket
+func (s *Store) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// List returns the values of the keys starting with prefix. Expired keys are removed.
+func (s *Store) List(bucket string, prefix string, now time.Time) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		var expired [][]byte
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			var e entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			if e.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+				continue
+			}
+			res[string(k)] = e.Value
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC)
+
+	s.Set("porch", "count", 1, 0, now)
+	s.Set("porch", "doorbell/last", "21:00", time.Minute, now)
+	s.Set("porch", "doorbell/ring", true, 0, now)
+	s.Set("shared", "count", 2, 0, now)
+
+	if val, ok, _ := s.Get("porch", "count", now); !ok || val != float64(1) {
+		t.Error("Wrong value", val, ok)
+	}
+	if _, ok, _ := s.Get("porch", "missing", now); ok {
+		t.Error("Missing key found")
+	}
+	if _, ok, _ := s.Get("porch", "doorbell/last", now.Add(2*time.Minute)); ok {
+		t.Error("Expired key found")
+	}
+
+	list, _ := s.List("porch", "doorbell/", now)
+	if !reflect.DeepEqual(list, map[string]interface{}{"doorbell/last": "21:00", "doorbell/ring": true}) {
+		t.Error("Wrong list", list)
+	}
+
+	s.Delete("porch", "doorbell/ring")
+	list, _ = s.List("porch", "doorbell/", now.Add(2*time.Minute))
+	if len(list) != 0 {
+		t.Error("Wrong list after delete and expiration", list)
+	}
+
+	// Values persist over reopening
+	s.Close()
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if val, ok, _ := s.Get("shared", "count", now); !ok || val != float64(2) {
+		t.Error("Wrong value after reopen", val, ok)
+	}
+}
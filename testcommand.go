@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/trigger"
+)
+
+// runTests runs the triggers and automations of a config against JSON or YAML fixtures: homeautomation test <config> <fixture>...
+// Returns the exit code.
+func runTests(args []string) int {
+	if len(args) < 2 {
+		fmt.Println("usage: homeautomation test <config> <fixture>...")
+		fmt.Println("Fixtures are JSON or YAML (.yaml or .yml). Triggers and automations are run.")
+		return 2
+	}
+
+	conf, err := loadConfig(args[0])
+	if err != nil {
+		fmt.Printf("Error loading config %s\n", err.Error())
+		return 2
+	}
+
+	failed := 0
+	for _, filename := range args[1:] {
+		if !runFixture(conf, filename) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d fixtures failed\n", failed, len(args)-1)
+		return 1
+	}
+	return 0
+}
+
+func runFixture(conf config.Config, filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("FAIL %s: %s\n", filename, err.Error())
+		return false
+	}
+	defer file.Close()
+
+	fixture, err := trigger.LoadFixture(filename, file)
+	if err != nil {
+		fmt.Printf("FAIL %s: %s\n", filename, err.Error())
+		return false
+	}
+
+	name := filename
+	if fixture.Name != "" {
+		name = fmt.Sprintf("%s (%s)", fixture.Name, filename)
+	}
+
+	messages, failures, err := trigger.RunFixture(conf, fixture)
+	if err != nil {
+		fmt.Printf("FAIL %s: %s\n", name, err.Error())
+		return false
+	}
+
+	if len(failures) == 0 {
+		fmt.Printf("PASS %s\n", name)
+		return true
+	}
+
+	fmt.Printf("FAIL %s\n", name)
+	for _, failure := range failures {
+		fmt.Printf("    %s\n", failure)
+	}
+	fmt.Println("  published:")
+	for _, msg := range messages {
+		fmt.Printf("    %s\n", msg)
+	}
+	return false
+}
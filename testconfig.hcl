@@ -1,12 +1,63 @@
 # MQTT Brokers
 servers = ["tcp://localhost:1883"]
 
+# Publish the sets of triggers, alexa, scenes and homie as {"value": ..., "source": ...} so that the bridge can
+# attribute them in the audit log. Only enable when every consumer of the set topics understands the envelope.
+set_source = true
+
+# Topic layout templates. {root} is replaced with the first segment of a key and {path} with the rest of it.
+# Defaults to {root}/<function>/{path}
+# topics {
+#     status = "home/{path}/state"
+#     set = "home/{path}/set"
+#     get = "home/{path}/get"
+#     command = "home/{path}/command"
+#     result = "home/{path}/result"
+# }
+
+# Location of the home for solar calculations (onSun and the sun adapter)
+location {
+    latitude = 60.17
+    longitude = 24.94
+}
+
+# Outbound queue for messages published while the broker is unreachable
+queue {
+    size = 1000
+    spool_dir = "./spool"
+}
+
 bridge {
     # MQTT topic root path
     root = "haaga"
 
+    # Status payload format: "raw" (bare JSON values) or "envelope" ({value, timestamp, source, stale})
+    payload_format = "raw"
+
+    # Publish statuses as {value, source} when the source is known. Required by federation adapters.
+    include_source = true
+
+    # Append-only log of all set operations
+    audit_log = "./audit.log"
+
+    # Accept sets over HTTP (PUT /set/<key> with the JSON value as the body). Sets are attributed to the
+    # basic authentication user.
+    # http_address = ":8081"
+    # http_users {
+    #     jaakko = "secret"
+    # }
+
+    # Publish status messages matching these patterns as retained
+    retain = ["haaga/dra/#"]
+
+    # Publish Home Assistant MQTT discovery configs for described devices
+    homeassistant {
+        prefix = "homeassistant"
+    }
+
     adapter "deconz" {
         type = "deconz"
+        retain = true
         config {
             hostname = "10.0.1.22"
             port = 80
@@ -28,6 +79,28 @@ bridge {
         }
     }
 
+    # Mirror the status tree of the cabin instance under haaga/cabin and forward set/get/command to it.
+    # Values mirrored by a federation on the remote side are skipped by their source. Requires include_source
+    # or the envelope payload format.
+    adapter "cabin" {
+        type = "federation"
+        config {
+            servers = ["tcp://cabin.local:1883"]
+            root = "cabin"
+            share = ["cabin/deconz/#", "cabin/dra/#"]
+            exclude = ["cabin/haaga/#"]
+            # Topic layout of the remote instance if it doesn't use the default one
+            # topics {
+            #     status = "home/{path}/state"
+            # }
+        }
+    }
+
+    # Publishes sunrise, sunset, dawn, dusk and the elevation of the sun
+    adapter "sun" {
+        type = "sun"
+    }
+
     adapter "db" {
         type = "bolt"
         config {
@@ -36,17 +109,216 @@ bridge {
     } 
 }
 
-trigger {
+history {
+    database_file = "./history.db"
+    topic = "haaga/history"
+    http_address = ":8090"
+
+    rule "haaga/deconz/sensors/#" {
+        retention = "30d"
+    }
+
+    rule "#" {
+        retention = "7d"
+        resolution = "1m"
+    }
+}
+
+# Publish adapters as homie devices
+homie {
+    base_topic = "homie"
+}
+
+# Directory for trigger script files and modules loaded with require("./lib/name")
+scripts_dir = "./scripts"
+
+# Triggers can be loaded from a file in the scripts directory. The label names the trigger for its status
+# topics and stored state. Unlabeled triggers are named after a hash of their script or file.
+# trigger "bedroom" {
+#     file = "bedroom.js"
+# }
+
+# Persistent key-value store for trigger scripts (store.get, set, delete, list and namespace)
+store {
+    database_file = "./store.db"
+}
+
+# Hosts trigger scripts may send http.request calls to and the requests allowed per trigger
+http {
+    allowed_hosts = ["192.168.1.20", "notify.local:8080"]
+    timeout = "5s"
+    rate_limit = 10
+    rate_interval = "1m"
+}
+
+# Scenes are applied, restored and captured with commands to scenes/<name>, scene.apply(name) in
+# triggers or alexa scene devices. Applied scenes remember the values they replaced for restore.
+scenes {
+    database_file = "./scenes.db"
+
+    scene "movie" {
+        transition = "3s"
+        values {
+            "haaga/dra/master_volume" = -40
+            "haaga/dra/input" = "TV"
+            "haaga/tv/1/power" = true
+            "haaga/deconz/groups/1/bri" = 30
+            "haaga/deconz/groups/1/ct" = 450
+        }
+    }
+
+    # Captured with scene.capture("evening") and applied with scene.apply("evening")
+    scene "evening" {
+        capture = ["haaga/deconz/groups/+/bri", "haaga/deconz/groups/+/ct"]
+    }
+}
+
+trigger "doorbell" {
+    script = <<SOURCE
+        listen("haaga/deconz/sensors/5/buttonevent", function () {
+            store.set("rings", store.get("rings", 0) + 1);
+            http.request({method: "POST", url: "http://notify.local:8080/notify", body: {message: "Doorbell"}}).catch(function (err) {
+                print("Notification failed", err);
+            });
+            // Shared with other triggers, forgotten after an hour
+            store.namespace("home").set("visitor", true, {ttl: "1h"});
+        });
+    SOURCE
+}
+
+trigger "presence" {
+    script = <<SOURCE
+        // Lights off when nobody has been home for 10 minutes. Pending durations survive restarts with a store.
+        onChange("haaga/presence/home", {from: true, to: false, for: "10m"}, function (value, old) {
+            set("haaga/deconz/groups/3/on", false);
+        });
+
+        onThreshold("haaga/deconz/sensors/1/temperature", {above: 25, hysteresis: 0.5}, function (value) {
+            print("Living room is warm", value);
+        });
+    SOURCE
+}
+
+trigger "livingroom_button" {
     script = <<SOURCE
         listen("haaga/deconz/sensors/3/buttonevent", function () {
             var buttonEvent = get("haaga/deconz/sensors/3/buttonevent");
-            if (buttonEvent.value === 4000) {
+            if (buttonEvent === 4000) {
                 set("haaga/deconz/groups/1/on", false);
             }
         });
     SOURCE
 }
 
+# Trigger statuses (running, errored, disabled) are published to <trigger_topic>/<name>/status.
+# Publish true or false to <trigger_topic>/<name>/set to enable or disable a trigger.
+trigger_topic = "haaga/triggers"
+
+trigger "bedroom_button" {
+    script = <<SOURCE
+        // Built-in modules: time, color and state
+        var time = require("time");
+        var state = require("state");
+
+        listen("haaga/deconz/sensors/3/buttonevent", function (topic, payload, value) {
+            if (value === 1002 && time.between("22:00", "06:00")) {
+                // Hallway light off a minute after the bedroom lights without blocking the trigger
+                if (!state.toggle("haaga/deconz/groups/4/on")) {
+                    delay(60 * 1000).then(function () {
+                        return setAsync("haaga/deconz/lights/7/on", false, {wait: true});
+                    })["catch"](function (e) {
+                        print("Hallway light failed", e.message);
+                    });
+                }
+            }
+        });
+    SOURCE
+}
+
+trigger "porch" {
+    enabled = true
+    script = <<SOURCE
+        // Porch light on at 22:00 on weekdays and off in the morning
+        schedule("0 22 * * mon-fri", function () {
+            set("haaga/deconz/lights/4/on", true);
+        }, {timezone: "Europe/Helsinki"});
+
+        at("07:30", function () {
+            set("haaga/deconz/lights/4/on", false);
+        }, {timezone: "Europe/Helsinki"});
+
+        // Living room lights half an hour before sunset
+        onSun("sunset", "-30m", function () {
+            if (sun.position().elevation < 10) {
+                set("haaga/deconz/groups/1/on", true);
+            }
+        });
+    SOURCE
+}
+
+# Declarative automations. when blocks are state, schedule, at or sun. condition blocks are state or time.
+# action blocks are set, command, delay, publish or script and run in order.
+automation "livingroom_off_button" {
+    when "state" {
+        path = "haaga/deconz/sensors/3/buttonevent"
+        equals = 4000
+    }
+
+    action "set" {
+        path = "haaga/deconz/groups/1/on"
+        value = false
+    }
+}
+
+automation "amplifier_idle" {
+    when "state" {
+        path = "haaga/tv/1/power"
+        equals = false
+        for = "15m"
+    }
+
+    condition "state" {
+        path = "haaga/dra/power"
+        equals = true
+    }
+
+    action "set" {
+        path = "haaga/dra/power"
+        value = false
+    }
+}
+
+automation "evening_lights" {
+    when "sun" {
+        event = "sunset"
+        offset = "-30m"
+    }
+
+    when "at" {
+        time = "19:00"
+        timezone = "Europe/Helsinki"
+    }
+
+    condition "time" {
+        after = "15:00"
+        before = "23:00"
+    }
+
+    action "set" {
+        path = "haaga/deconz/groups/1/on"
+        value = true
+    }
+
+    action "delay" {
+        duration = "1s"
+    }
+
+    action "set" {
+        path = "haaga/deconz/groups/1/bri"
+        value = 120
+    }
+}
+
 
 alexa {
     topic = "haaga/aws/lambda/homeautomation"
@@ -94,7 +366,7 @@ alexa {
         capability "PowerController" {
             property "powerState" {
                 get = "get('haaga/deconz/groups/{{index . 1}}/any_on') ? 'ON' : 'OFF'"
-                set = "set('haaga/deconz/groups/{{index . 1}}/on', value === 'ON')"
+                set = "set('haaga/deconz/groups/{{index . 1}}/on', value === 'ON', {wait: true})"
             }
         }
 
@@ -173,6 +445,14 @@ alexa {
         }
     }
 
+    device "movie_mode" {
+        name = "Movie mode"
+        description = "Dims the living room and turns on the TV"
+        display_categories = ["SCENE_TRIGGER"]
+
+        scene = "movie"
+    }
+
     device "livingroom_tv" {
         name = "TV"
         description = "Living room TV"
@@ -0,0 +1,470 @@
+package trigger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+// automation is a compiled automation block
+type automation struct {
+	trigger *TriggerSystem
+	conf    config.Automation
+
+	actions []automationAction
+
+	// runtime runs script actions. Created on first use.
+	runtime *runtime
+
+	sync.Mutex
+	running bool
+}
+
+// Kinds of when, condition and action blocks
+const (
+	automationState    = "state"
+	automationSchedule = "schedule"
+	automationAt       = "at"
+	automationSun      = "sun"
+	automationTime     = "time"
+	automationSet      = util.FunctionSet
+	automationCommand  = util.FunctionCommand
+	automationDelay    = "delay"
+	automationPublish  = "publish"
+	automationScript   = "script"
+)
+
+type automationAction struct {
+	config.AutomationAction
+	value interface{}
+	delay time.Duration
+}
+
+func (trigger *TriggerSystem) initAutomations() {
+	for _, conf := range trigger.conf.Automations {
+		if err := trigger.startAutomation(conf); err != nil {
+			fmt.Printf("Error in automation %s: %s\n", conf.Name, err.Error())
+		}
+	}
+}
+
+// startAutomation compiles an automation into subscriptions and timers
+func (trigger *TriggerSystem) startAutomation(conf config.Automation) error {
+	a := &automation{trigger: trigger, conf: conf}
+
+	if len(conf.When) == 0 {
+		return errors.New("automation has no when blocks")
+	}
+	if len(conf.Actions) == 0 {
+		return errors.New("automation has no actions")
+	}
+
+	for _, actionConf := range conf.Actions {
+		action, err := compileAction(actionConf)
+		if err != nil {
+			return err
+		}
+		a.actions = append(a.actions, action)
+	}
+
+	for _, cond := range conf.Conditions {
+		if err := checkCondition(cond); err != nil {
+			return err
+		}
+	}
+
+	// Compile all whens before starting any of them
+	var starts []func()
+	for _, when := range conf.When {
+		start, err := a.compileWhen(when)
+		if err != nil {
+			return err
+		}
+		starts = append(starts, start)
+	}
+
+	for _, start := range starts {
+		start()
+	}
+
+	trigger.automationMutex.Lock()
+	trigger.automations = append(trigger.automations, a)
+	trigger.automationMutex.Unlock()
+
+	return nil
+}
+
+// addAutomationRuns adjusts the number of busy automation runs
+func (trigger *TriggerSystem) addAutomationRuns(delta int) {
+	trigger.automationMutex.Lock()
+	trigger.automationRuns += delta
+	trigger.automationMutex.Unlock()
+}
+
+// automationsIdle checks that no automation is running an action or a script
+func (trigger *TriggerSystem) automationsIdle() bool {
+	trigger.automationMutex.Lock()
+	defer trigger.automationMutex.Unlock()
+
+	if trigger.automationRuns > 0 {
+		return false
+	}
+	for _, a := range trigger.automations {
+		a.Lock()
+		r := a.runtime
+		a.Unlock()
+		if r != nil && !r.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+func compileAction(conf config.AutomationAction) (automationAction, error) {
+	action := automationAction{AutomationAction: conf, value: normalizeValue(conf.Value)}
+
+	switch conf.Kind {
+	case automationSet, automationCommand:
+		if conf.Path == "" {
+			return action, fmt.Errorf("%s action requires a path", conf.Kind)
+		}
+	case automationDelay:
+		d, err := util.ParseDuration(conf.Duration)
+		if err != nil {
+			return action, err
+		}
+		action.delay = d
+	case automationPublish:
+		if conf.Topic == "" {
+			return action, errors.New("publish action requires a topic")
+		}
+	case automationScript:
+	default:
+		return action, fmt.Errorf("unknown action %s", conf.Kind)
+	}
+
+	return action, nil
+}
+
+func checkCondition(cond config.AutomationCondition) error {
+	switch cond.Kind {
+	case automationState:
+		if cond.Path == "" {
+			return errors.New("state condition requires a path")
+		}
+	case automationTime:
+		for _, tod := range []string{cond.After, cond.Before} {
+			if tod == "" {
+				continue
+			}
+			if _, err := time.Parse("15:04", tod); err != nil {
+				return fmt.Errorf("invalid time of day %s", tod)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown condition %s", cond.Kind)
+	}
+	return nil
+}
+
+// compileWhen returns a function starting the subscription or timer of a when block
+func (a *automation) compileWhen(when config.AutomationWhen) (func(), error) {
+	loc := time.Local
+	if when.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(when.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	trigger := a.trigger
+
+	switch when.Kind {
+	case automationState:
+		if when.Path == "" {
+			return nil, errors.New("state when requires a path")
+		}
+
+		var duration time.Duration
+		if when.For != "" {
+			var err error
+			if duration, err = util.ParseDuration(when.For); err != nil {
+				return nil, err
+			}
+		}
+		when.Equals = normalizeValue(when.Equals)
+
+		return func() {
+			trigger.subscribe(trigger.topics.Build(util.FunctionStatus, when.Path), a.stateHandler(when, duration))
+		}, nil
+
+	case automationSchedule:
+		cron, err := util.ParseCron(when.Cron, loc)
+		if err != nil {
+			return nil, err
+		}
+		return func() { trigger.startTimer(a.run, cron.Next) }, nil
+
+	case automationAt:
+		next, err := parseAt(strings.TrimSpace(when.Time), loc)
+		if err != nil {
+			return nil, err
+		}
+		return func() { trigger.startTimer(a.run, next) }, nil
+
+	case automationSun:
+		if trigger.conf.Location == nil {
+			return nil, errNoLocation
+		}
+		if _, err := (util.SunTimes{}).Event(when.Event); err != nil {
+			return nil, err
+		}
+
+		var offset time.Duration
+		if when.Offset != "" {
+			var err error
+			if offset, err = util.ParseDuration(when.Offset); err != nil {
+				return nil, err
+			}
+		}
+
+		location := trigger.conf.Location
+		return func() {
+			trigger.startTimer(a.run, func(now time.Time) time.Time {
+				at, _ := util.NextSunEvent(now, when.Event, offset, location.Latitude, location.Longitude)
+				return at
+			})
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown when %s", when.Kind)
+}
+
+// stateHandler returns the handler for status messages of a when block with a path.
+// Equals fires on every matching message, changes when the value differs from the previous
+// one and above/below when the value crosses the threshold. With a duration the value has
+// to keep matching for the duration.
+func (a *automation) stateHandler(when config.AutomationWhen, duration time.Duration) mqtt.MessageHandler {
+	var (
+		mutex    sync.Mutex
+		prev     interface{}
+		known    bool
+		forTimer = -1
+	)
+
+	return func(client mqtt.Client, msg mqtt.Message) {
+		val, _ := util.DecodeStatus(msg.Payload())
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		holds := whenHolds(when, val)
+		fire := holds
+		if when.Changes {
+			fire = fire && known && !util.ValuesEqual(prev, val)
+		}
+		if when.Above != nil || when.Below != nil {
+			// Thresholds fire only when crossed
+			fire = fire && known && !whenHolds(when, prev)
+		}
+		prev, known = val, true
+
+		if duration == 0 {
+			if fire {
+				a.run()
+			}
+			return
+		}
+
+		if !holds {
+			if forTimer >= 0 {
+				a.trigger.stopTimer(forTimer)
+				forTimer = -1
+			}
+			return
+		}
+
+		if fire && forTimer < 0 {
+			started := false
+			forTimer = a.trigger.startTimer(a.run, func(now time.Time) time.Time {
+				if started {
+					return time.Time{}
+				}
+				started = true
+				return now.Add(duration)
+			})
+		}
+	}
+}
+
+// whenHolds checks the equals, above and below constraints of a when block
+func whenHolds(when config.AutomationWhen, val interface{}) bool {
+	if when.Equals != nil && !util.ValuesEqual(val, when.Equals) {
+		return false
+	}
+	return inRange(val, when.Above, when.Below)
+}
+
+func inRange(val interface{}, above *float64, below *float64) bool {
+	if above == nil && below == nil {
+		return true
+	}
+
+	n, ok := util.ToFloat(val)
+	if !ok {
+		return false
+	}
+
+	if above != nil && n <= *above {
+		return false
+	}
+	if below != nil && n >= *below {
+		return false
+	}
+	return true
+}
+
+// run checks the conditions and runs the actions in the background. Runs are skipped while a
+// previous run is in progress.
+func (a *automation) run() {
+	a.trigger.addAutomationRuns(1)
+	go func() {
+		defer a.trigger.addAutomationRuns(-1)
+
+		if !a.conditionsHold() {
+			return
+		}
+
+		a.Lock()
+		if a.running {
+			a.Unlock()
+			fmt.Printf("Automation %s is already running\n", a.conf.Name)
+			return
+		}
+		a.running = true
+		a.Unlock()
+
+		defer func() {
+			a.Lock()
+			a.running = false
+			a.Unlock()
+		}()
+
+		for _, action := range a.actions {
+			if err := a.runAction(action); err != nil {
+				fmt.Printf("Error in automation %s: %s\n", a.conf.Name, err.Error())
+				return
+			}
+		}
+	}()
+}
+
+func (a *automation) conditionsHold() bool {
+	for _, cond := range a.conf.Conditions {
+		if cond.Kind == automationTime {
+			if !timeOfDayBetween(a.trigger.now(), cond.After, cond.Before) {
+				return false
+			}
+			continue
+		}
+
+		val, err := a.trigger.value(cond.Path)
+		if err != nil {
+			fmt.Printf("Error in automation %s: %s\n", a.conf.Name, err.Error())
+			return false
+		}
+		if cond.Equals != nil && !util.ValuesEqual(val, normalizeValue(cond.Equals)) {
+			return false
+		}
+		if cond.NotEquals != nil && util.ValuesEqual(val, normalizeValue(cond.NotEquals)) {
+			return false
+		}
+		if !inRange(val, cond.Above, cond.Below) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// timeOfDayBetween checks if the time of day of t is after after and before before (15:04).
+// Ranges over midnight (22:00 - 06:00) are supported.
+func timeOfDayBetween(t time.Time, after string, before string) bool {
+	now := t.Format("15:04")
+
+	switch {
+	case after == "":
+		return now < before
+	case before == "":
+		return now >= after
+	case after <= before:
+		return now >= after && now < before
+	default:
+		return now >= after || now < before
+	}
+}
+
+func (a *automation) runAction(action automationAction) error {
+	trigger := a.trigger
+	source := &adapter.Source{Type: adapter.SourceTrigger, ID: a.conf.Name, Client: trigger.conf.ClientID}
+
+	switch action.Kind {
+	case automationSet, automationCommand:
+		return trigger.publishRequest(action.Kind, action.Path, util.SetRequest{Value: action.value, Source: source})
+	case automationDelay:
+		// The run isn't busy while it waits for the clock
+		done := make(chan struct{})
+		trigger.addAutomationRuns(-1)
+		trigger.getClock().AfterFunc(action.delay, func() {
+			trigger.addAutomationRuns(1)
+			close(done)
+		})
+		<-done
+	case automationPublish:
+		if token := trigger.c.Publish(action.Topic, 1, action.Retain, []byte(action.Payload)); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	case automationScript:
+		return a.runScript(action.Source)
+	}
+
+	return nil
+}
+
+// runScript runs the source in the runtime of the automation and waits for it to finish
+func (a *automation) runScript(source string) error {
+	a.Lock()
+	if a.runtime == nil {
+		a.runtime = a.trigger.newScriptRuntime(a.conf.Name)
+	}
+	r := a.runtime
+	a.Unlock()
+
+	return r.Run(func(r *runtime) error {
+		_, err := r.RunScript("automation."+a.conf.Name, source)
+		return err
+	})
+}
+
+// normalizeValue converts HCL objects (lists of maps) into maps
+func normalizeValue(val interface{}) interface{} {
+	objs, ok := val.([]map[string]interface{})
+	if !ok {
+		return val
+	}
+
+	res := map[string]interface{}{}
+	for _, obj := range objs {
+		for k, v := range obj {
+			res[k] = normalizeValue(v)
+		}
+	}
+	return res
+}
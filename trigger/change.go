@@ -0,0 +1,346 @@
+package trigger
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/util"
+)
+
+// watch is the state of an onChange or onThreshold callback. The state is persisted in the store
+// when it has been configured so that changes and pending durations survive restarts.
+type watch struct {
+	trigger *TriggerSystem
+	r       *runtime
+	fn      goja.Callable
+	path    string
+	// key of the state in the store, empty if the state isn't persisted
+	key string
+
+	mutex sync.Mutex
+	state watchState
+	timer int
+}
+
+type watchState struct {
+	Known bool        `json:"known"`
+	Value interface{} `json:"value"`
+	Old   interface{} `json:"old"`
+	// Since is the time in unix milliseconds when the change started waiting for its duration
+	Since  int64 `json:"since,omitempty"`
+	Inside bool  `json:"inside,omitempty"`
+}
+
+type watchKey struct {
+	bucket string
+	key    string
+}
+
+type pendingState struct {
+	state   watchState
+	version uint64
+}
+
+// changeBucket is the store bucket for the watch states of a runtime
+func changeBucket(r *runtime) string {
+	return "changes/" + r.name
+}
+
+// newWatch returns a watch and loads its persisted state
+func (trigger *TriggerSystem) newWatch(r *runtime, kind string, path string, opts map[string]interface{}, fn goja.Callable) *watch {
+	w := &watch{trigger: trigger, r: r, fn: fn, path: path, timer: -1}
+
+	s, err := trigger.kvStore()
+	if err != nil {
+		if err != errStoreNotConfigured {
+			fmt.Printf("Error opening store for %s %s: %s\n", kind, path, err.Error())
+		}
+		return w
+	}
+
+	// Options are part of the key so that watches of the same path don't share state
+	b, _ := json.Marshal(opts)
+	w.key = kind + " " + path + " " + string(b)
+
+	// A state saved by the previous runtime may not have been written yet
+	trigger.watchMutex.Lock()
+	pending, ok := trigger.watchStates[watchKey{changeBucket(r), w.key}]
+	trigger.watchMutex.Unlock()
+	if ok {
+		w.state = pending.state
+		return w
+	}
+
+	val, ok, err := s.Get(changeBucket(r), w.key, trigger.now())
+	if err != nil {
+		fmt.Printf("Error loading state of %s %s: %s\n", kind, path, err.Error())
+		return w
+	}
+	if ok {
+		b, _ := json.Marshal(val)
+		json.Unmarshal(b, &w.state)
+	}
+
+	return w
+}
+
+// save queues a copy of the state to be persisted so that the message router doesn't wait for
+// the store. Has to be called with the mutex held.
+func (w *watch) save() {
+	if w.key == "" {
+		return
+	}
+
+	trigger := w.trigger
+	trigger.watchMutex.Lock()
+	trigger.watchVersion++
+	trigger.watchStates[watchKey{changeBucket(w.r), w.key}] = pendingState{w.state, trigger.watchVersion}
+	trigger.watchMutex.Unlock()
+
+	select {
+	case trigger.watchWake <- struct{}{}:
+	default:
+	}
+}
+
+// writeWatchStates writes the queued watch states in the background
+func (trigger *TriggerSystem) writeWatchStates() {
+	for range trigger.watchWake {
+		trigger.flushWatchStates()
+	}
+}
+
+// flushWatchStates writes the queued watch states. States stay queued until they have been written
+// so that a restarted runtime loads the latest state.
+func (trigger *TriggerSystem) flushWatchStates() {
+	trigger.watchWrite.Lock()
+	defer trigger.watchWrite.Unlock()
+
+	trigger.watchMutex.Lock()
+	states := make(map[watchKey]pendingState, len(trigger.watchStates))
+	for k, pending := range trigger.watchStates {
+		states[k] = pending
+	}
+	trigger.watchMutex.Unlock()
+
+	if len(states) == 0 {
+		return
+	}
+
+	s, err := trigger.kvStore()
+	if err != nil {
+		fmt.Printf("Error saving watch states: %s\n", err.Error())
+		return
+	}
+
+	for k, pending := range states {
+		if err := s.Set(k.bucket, k.key, pending.state, 0, trigger.now()); err != nil {
+			fmt.Printf("Error saving state of %s: %s\n", k.key, err.Error())
+			continue
+		}
+
+		trigger.watchMutex.Lock()
+		if trigger.watchStates[k].version == pending.version {
+			delete(trigger.watchStates, k)
+		}
+		trigger.watchMutex.Unlock()
+	}
+}
+
+// call calls the callback with the new and old value in the runtime
+func (w *watch) call(val interface{}, old interface{}) {
+	w.r.Work(func(r *runtime) {
+		if _, err := w.fn(nil, r.ToValue(val), r.ToValue(old), r.ToValue(w.path)); err != nil {
+			r.fail(err)
+		}
+	})
+}
+
+// wait calls the callback after d unless cancelled. Has to be called with the mutex held.
+func (w *watch) wait(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	var id int
+	started := false
+	id = w.trigger.startRuntimeTimer(w.r, func() {
+		w.mutex.Lock()
+		if w.timer != id {
+			w.mutex.Unlock()
+			return
+		}
+		w.timer = -1
+		w.state.Since = 0
+		w.save()
+		val, old := w.state.Value, w.state.Old
+		w.mutex.Unlock()
+
+		w.call(val, old)
+	}, func(now time.Time) time.Time {
+		if started {
+			return time.Time{}
+		}
+		started = true
+		return now.Add(d)
+	})
+	w.timer = id
+}
+
+// cancel stops a pending duration. Has to be called with the mutex held.
+func (w *watch) cancel() {
+	if w.timer >= 0 {
+		w.trigger.stopTimer(w.timer)
+		w.timer = -1
+	}
+	w.state.Since = 0
+}
+
+// watchArguments returns the path, options and callback of onChange and onThreshold. Options are optional.
+func watchArguments(r *runtime, name string, call goja.FunctionCall) (string, map[string]interface{}, goja.Callable) {
+	path := call.Argument(0).String()
+
+	opts := map[string]interface{}{}
+	fnArg := call.Argument(1)
+	if _, ok := goja.AssertFunction(fnArg); !ok {
+		if o, ok := call.Argument(1).Export().(map[string]interface{}); ok {
+			opts = o
+		}
+		fnArg = call.Argument(2)
+	}
+
+	fn, ok := goja.AssertFunction(fnArg)
+	if !ok {
+		panic(r.NewTypeError(name + " requires a function"))
+	}
+
+	return path, opts, fn
+}
+
+// onChange calls fn(value, old, path) when the value of a path changes. Resent values are ignored.
+// The from and to options limit the values changed from and to. With the for option the value has to
+// stay unchanged for the duration (10m or milliseconds) and a pending call is cancelled by any change.
+func (trigger *TriggerSystem) onChange(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		path, opts, fn := watchArguments(r, "onChange", call)
+
+		from, hasFrom := opts["from"]
+		to, hasTo := opts["to"]
+
+		duration, err := durationOption(opts["for"])
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		matches := func(val interface{}, old interface{}) bool {
+			return (!hasFrom || util.ValuesEqual(old, from)) && (!hasTo || util.ValuesEqual(val, to))
+		}
+
+		w := trigger.newWatch(r, "onChange", path, opts, fn)
+
+		w.mutex.Lock()
+		if duration > 0 && w.state.Since != 0 {
+			// Resume a duration interrupted by a restart
+			since := time.Unix(0, w.state.Since*int64(time.Millisecond))
+			w.wait(since.Add(duration).Sub(trigger.now()))
+		}
+		w.mutex.Unlock()
+
+		handler := func(client mqtt.Client, msg mqtt.Message) {
+			val, _ := util.DecodeStatus(msg.Payload())
+
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			if w.state.Known && util.ValuesEqual(w.state.Value, val) {
+				return
+			}
+
+			known := w.state.Known
+			w.state.Old, w.state.Value, w.state.Known = w.state.Value, val, true
+			if !known {
+				// The first value has nothing to compare to
+				w.save()
+				return
+			}
+
+			if duration == 0 {
+				w.save()
+				if matches(w.state.Value, w.state.Old) {
+					w.call(w.state.Value, w.state.Old)
+				}
+				return
+			}
+
+			w.cancel()
+			if matches(w.state.Value, w.state.Old) {
+				w.state.Since = trigger.now().UnixNano() / int64(time.Millisecond)
+				w.wait(duration)
+			}
+			w.save()
+		}
+
+		topic := trigger.topics.Build(util.FunctionStatus, path)
+		return r.ToValue(trigger.subscribeRuntime(r, topic, handler))
+	}
+}
+
+// onThreshold calls fn(value, old, path) when a numeric value enters the range defined by the above
+// and below options. The value has to leave the range by the hysteresis option before it fires again.
+func (trigger *TriggerSystem) onThreshold(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		path, opts, fn := watchArguments(r, "onThreshold", call)
+
+		above, hasAbove := util.ToFloat(opts["above"])
+		below, hasBelow := util.ToFloat(opts["below"])
+		hysteresis, _ := util.ToFloat(opts["hysteresis"])
+		if !hasAbove && !hasBelow {
+			panic(r.NewTypeError("onThreshold requires above or below"))
+		}
+
+		enters := func(n float64) bool {
+			return (!hasAbove || n > above) && (!hasBelow || n < below)
+		}
+		leaves := func(n float64) bool {
+			return (hasAbove && n <= above-hysteresis) || (hasBelow && n >= below+hysteresis)
+		}
+
+		w := trigger.newWatch(r, "onThreshold", path, opts, fn)
+
+		handler := func(client mqtt.Client, msg mqtt.Message) {
+			val, _ := util.DecodeStatus(msg.Payload())
+			n, ok := util.ToFloat(val)
+			if !ok {
+				return
+			}
+
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+
+			known, inside, old := w.state.Known, w.state.Inside, w.state.Value
+			w.state.Value, w.state.Known = val, true
+
+			switch {
+			case !known:
+				w.state.Inside = enters(n)
+			case !inside && enters(n):
+				w.state.Inside = true
+				w.call(val, old)
+			case inside && leaves(n):
+				w.state.Inside = false
+			default:
+				// Only transitions are persisted
+				return
+			}
+
+			w.save()
+		}
+
+		topic := trigger.topics.Build(util.FunctionStatus, path)
+		return r.ToValue(trigger.subscribeRuntime(r, topic, handler))
+	}
+}
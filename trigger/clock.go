@@ -0,0 +1,104 @@
+package trigger
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timer is a timer created by a Clock
+type Timer interface {
+	Stop() bool
+}
+
+// Clock provides the time for timeouts, intervals and schedules
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// TestClock is a manually advanced clock for testing triggers
+type TestClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	clock *TestClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+func (tt *testTimer) Stop() bool {
+	tt.clock.Lock()
+	defer tt.clock.Unlock()
+
+	stopped := !tt.done
+	tt.done = true
+	return stopped
+}
+
+// NewTestClock returns a test clock set to now
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+// Now returns the current time of the clock
+func (tc *TestClock) Now() time.Time {
+	tc.Lock()
+	defer tc.Unlock()
+
+	return tc.now
+}
+
+// AfterFunc calls f when the clock has been advanced by d
+func (tc *TestClock) AfterFunc(d time.Duration, f func()) Timer {
+	tc.Lock()
+	defer tc.Unlock()
+
+	timer := &testTimer{clock: tc, at: tc.now.Add(d), f: f}
+	tc.timers = append(tc.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d and calls the functions of the timers that expire in order
+func (tc *TestClock) Advance(d time.Duration) {
+	tc.Lock()
+	target := tc.now.Add(d)
+
+	for {
+		pending := tc.timers[:0]
+		for _, timer := range tc.timers {
+			if !timer.done {
+				pending = append(pending, timer)
+			}
+		}
+		tc.timers = pending
+
+		sort.SliceStable(tc.timers, func(i, j int) bool { return tc.timers[i].at.Before(tc.timers[j].at) })
+		if len(tc.timers) == 0 || tc.timers[0].at.After(target) {
+			break
+		}
+
+		timer := tc.timers[0]
+		timer.done = true
+		tc.now = timer.at
+
+		tc.Unlock()
+		timer.f()
+		tc.Lock()
+	}
+
+	tc.now = target
+	tc.Unlock()
+}
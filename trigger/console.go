@@ -0,0 +1,186 @@
+package trigger
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/util"
+)
+
+// Console evaluates JavaScript in a runtime with the trigger API. Output of print, callback errors and
+// messages of listen and subscribe calls without a callback are passed to the output function.
+type Console struct {
+	trigger *TriggerSystem
+	runtime *runtime
+	output  func(string)
+}
+
+// NewConsole returns a console. The console subscribes to all status topics to learn the paths of
+// the live tree for completion and asks the bridge of the configured root to publish its values.
+func (trigger *TriggerSystem) NewConsole(output func(string)) *Console {
+	c := &Console{trigger: trigger, runtime: trigger.newScriptRuntime("console"), output: output}
+
+	r := c.runtime
+	r.onError = func(err error) {
+		// Errors in callbacks don't stop the console
+		c.output("Error: " + err.Error())
+	}
+
+	r.Set("print", func(call goja.FunctionCall) goja.Value {
+		strs := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			strs[i] = arg.String()
+		}
+		c.output(strings.Join(strs, " "))
+		return goja.Undefined()
+	})
+
+	// Without a callback messages are shown in the console
+	subscribe := func(name string, fn func(call goja.FunctionCall) goja.Value, topic func(string) string) {
+		r.Set(name, func(call goja.FunctionCall) goja.Value {
+			if _, ok := goja.AssertFunction(call.Argument(1)); ok {
+				return fn(call)
+			}
+
+			t := topic(call.Argument(0).String())
+			id := trigger.subscribeRuntime(r, t, func(client mqtt.Client, msg mqtt.Message) {
+				c.output(msg.Topic() + " " + string(msg.Payload()))
+			})
+			return r.ToValue(id)
+		})
+	}
+	subscribe("subscribe", trigger.jsSubscribe(r), func(topic string) string { return topic })
+	subscribe("listen", trigger.jsListen(r), func(key string) string { return trigger.topics.Build(util.FunctionStatus, key) })
+
+	trigger.subscribe(trigger.topics.Subscription(util.FunctionStatus, "+"), func(client mqtt.Client, msg mqtt.Message) {})
+	if conf := trigger.conf.Bridge; conf != nil && conf.Root != "" {
+		root := strings.Split(conf.Root, "/")[0]
+		trigger.c.Publish(trigger.topics.Build(util.FunctionGet, root), 0, false, []byte{})
+	}
+
+	return c
+}
+
+// Eval runs source and returns its result formatted for display
+func (c *Console) Eval(source string) (string, error) {
+	var res string
+	err := c.runtime.Run(func(r *runtime) error {
+		val, err := r.RunString(source)
+		if err != nil {
+			return err
+		}
+		res = inspect(val)
+		return nil
+	})
+	return res, err
+}
+
+// Close stops the runtime of the console
+func (c *Console) Close() {
+	c.trigger.stopRuntime(c.runtime)
+}
+
+// inspect formats a value. Objects and arrays are shown as JSON.
+func inspect(val goja.Value) string {
+	if val == nil || goja.IsUndefined(val) {
+		return "undefined"
+	}
+	if goja.IsNull(val) {
+		return "null"
+	}
+	if _, ok := goja.AssertFunction(val); ok {
+		return "[Function]"
+	}
+
+	if b, err := json.Marshal(val.Export()); err == nil {
+		return string(b)
+	}
+	return val.String()
+}
+
+// Complete returns the word at the end of line and its completions. Inside a string the completions
+// are paths of the live tree up to the next level and otherwise global names and their properties.
+func (c *Console) Complete(line string) (string, []string) {
+	if quote := openQuote(line); quote >= 0 {
+		word := line[quote+1:]
+		return word, c.completePath(word)
+	}
+
+	start := len(line)
+	for start > 0 && isIdentifier(line[start-1]) {
+		start--
+	}
+	word := line[start:]
+
+	var res []string
+	c.runtime.Run(func(r *runtime) error {
+		obj := r.GlobalObject()
+		prefix := word
+		if dot := strings.LastIndex(word, "."); dot >= 0 {
+			val, err := r.RunString(word[:dot])
+			if err != nil || goja.IsUndefined(val) || goja.IsNull(val) {
+				return nil
+			}
+			obj = val.ToObject(r.Runtime)
+			prefix = word[dot+1:]
+		}
+
+		for _, key := range obj.Keys() {
+			if strings.HasPrefix(key, prefix) {
+				res = append(res, word[:len(word)-len(prefix)]+key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(res)
+
+	return word, res
+}
+
+// completePath returns the known paths starting with prefix cut after the next level
+func (c *Console) completePath(prefix string) []string {
+	c.trigger.Lock()
+	defer c.trigger.Unlock()
+
+	found := map[string]bool{}
+	for key := range c.trigger.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			key = key[:len(prefix)+i+1]
+		}
+		found[key] = true
+	}
+
+	res := make([]string, 0, len(found))
+	for key := range found {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// openQuote returns the index of the quote of an unterminated string at the end of line or -1
+func openQuote(line string) int {
+	quote := -1
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && quote >= 0:
+			i++
+		case quote < 0 && (line[i] == '"' || line[i] == '\''):
+			quote = i
+		case quote >= 0 && line[i] == line[quote]:
+			quote = -1
+		}
+	}
+	return quote
+}
+
+func isIdentifier(b byte) bool {
+	return b == '_' || b == '$' || b == '.' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
@@ -0,0 +1,304 @@
+package trigger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Fixture is a timeline of events fed to triggers in a Harness and the messages expected from them
+type Fixture struct {
+	Name string `json:"name"`
+	// Start is the time the fixture starts at (RFC 3339). Defaults to the current time.
+	Start string `json:"start"`
+	// Triggers limits the triggers run to the named ones
+	Triggers []string `json:"triggers"`
+	// Automations limits the automations run to the named ones
+	Automations []string `json:"automations"`
+	// Values are the values known before the triggers start
+	Values map[string]interface{} `json:"values"`
+	Events []FixtureEvent         `json:"events"`
+	// Duration is the time the fixture runs. Defaults to the time of the last event.
+	Duration string               `json:"duration"`
+	Expect   []FixtureExpectation `json:"expect"`
+}
+
+// FixtureEvent is a status of a path or a raw message published at a time relative to the start
+type FixtureEvent struct {
+	At      string      `json:"at"`
+	Path    string      `json:"path"`
+	Value   interface{} `json:"value"`
+	Topic   string      `json:"topic"`
+	Payload string      `json:"payload"`
+}
+
+// FixtureExpectation is a message expected from the triggers. Expectations are matched in order.
+// Value and payload are only compared when given and at is the exact time relative to the start.
+type FixtureExpectation struct {
+	At      string      `json:"at"`
+	Set     string      `json:"set"`
+	Command string      `json:"command"`
+	Topic   string      `json:"topic"`
+	Value   interface{} `json:"value"`
+	Payload *string     `json:"payload"`
+	// Never expects no matching messages at any time
+	Never bool `json:"never"`
+}
+
+// LoadFixture decodes a fixture. Files with a .yaml or .yml extension are decoded as YAML and others as JSON.
+func LoadFixture(filename string, reader io.Reader) (Fixture, error) {
+	fixture := Fixture{}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return fixture, err
+		}
+
+		var val interface{}
+		if err := yaml.Unmarshal(data, &val); err != nil {
+			return fixture, err
+		}
+
+		// Values are decoded as they would be from JSON
+		b, err := json.Marshal(jsonValue(val))
+		if err != nil {
+			return fixture, err
+		}
+		err = json.Unmarshal(b, &fixture)
+		return fixture, err
+	}
+
+	err := json.NewDecoder(reader).Decode(&fixture)
+	return fixture, err
+}
+
+// jsonValue converts the maps with non-string keys decoded from YAML to maps with string keys
+func jsonValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = jsonValue(val)
+		}
+		return v
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			obj[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return obj
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, val := range v {
+			arr[i] = jsonValue(val)
+		}
+		return arr
+	}
+	return val
+}
+
+func (e FixtureExpectation) String() string {
+	var parts []string
+	switch {
+	case e.Set != "":
+		parts = append(parts, "set "+e.Set)
+	case e.Command != "":
+		parts = append(parts, "command "+e.Command)
+	default:
+		parts = append(parts, "publish "+e.Topic)
+	}
+	if e.Value != nil {
+		b, _ := json.Marshal(e.Value)
+		parts = append(parts, string(b))
+	}
+	if e.Payload != nil {
+		parts = append(parts, *e.Payload)
+	}
+	if e.At != "" {
+		parts = append(parts, "at "+e.At)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m Message) String() string {
+	if m.Function != "" {
+		b, _ := json.Marshal(m.Value)
+		return fmt.Sprintf("%s %s %s %s", m.At, m.Function, m.Path, string(b))
+	}
+	return fmt.Sprintf("%s publish %s %s", m.At, m.Topic, string(m.Payload))
+}
+
+func (e FixtureExpectation) matches(m Message, at time.Duration, hasAt bool) bool {
+	switch {
+	case e.Set != "":
+		if m.Function != util.FunctionSet || m.Path != e.Set {
+			return false
+		}
+	case e.Command != "":
+		if m.Function != util.FunctionCommand || m.Path != e.Command {
+			return false
+		}
+	default:
+		if m.Topic != e.Topic {
+			return false
+		}
+	}
+
+	if e.Value != nil && !util.ValuesEqual(m.Value, e.Value) {
+		return false
+	}
+	if e.Payload != nil && string(m.Payload) != *e.Payload {
+		return false
+	}
+	return !hasAt || m.At == at
+}
+
+// RunFixture runs the triggers and automations of a config against a fixture. Returns the published messages and
+// the failed expectations and trigger errors.
+func RunFixture(conf config.Config, fixture Fixture) ([]Message, []string, error) {
+	start := time.Now()
+	if fixture.Start != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, fixture.Start); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(fixture.Triggers) > 0 {
+		var triggers []config.Trigger
+		names := triggerNames(conf.Triggers)
+		for i, triggerConf := range conf.Triggers {
+			for _, name := range fixture.Triggers {
+				if names[i] == name {
+					// Keep the name when the other triggers are left out
+					triggerConf.Name = name
+					triggers = append(triggers, triggerConf)
+				}
+			}
+		}
+		if len(triggers) != len(fixture.Triggers) {
+			return nil, nil, fmt.Errorf("unknown triggers in %s", strings.Join(fixture.Triggers, ", "))
+		}
+		conf.Triggers = triggers
+	}
+
+	if len(fixture.Automations) > 0 {
+		var automations []config.Automation
+		for _, automationConf := range conf.Automations {
+			for _, name := range fixture.Automations {
+				if automationConf.Name == name {
+					automations = append(automations, automationConf)
+				}
+			}
+		}
+		if len(automations) != len(fixture.Automations) {
+			return nil, nil, fmt.Errorf("unknown automations in %s", strings.Join(fixture.Automations, ", "))
+		}
+		conf.Automations = automations
+	}
+
+	parseAt := func(at string) (time.Duration, error) {
+		if at == "" {
+			return 0, nil
+		}
+		return util.ParseDuration(at)
+	}
+
+	type event struct {
+		at time.Duration
+		FixtureEvent
+	}
+	events := make([]event, len(fixture.Events))
+	var duration time.Duration
+	for i, e := range fixture.Events {
+		at, err := parseAt(e.At)
+		if err != nil {
+			return nil, nil, err
+		}
+		events[i] = event{at, e}
+		if at > duration {
+			duration = at
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+
+	if fixture.Duration != "" {
+		d, err := util.ParseDuration(fixture.Duration)
+		if err != nil {
+			return nil, nil, err
+		}
+		duration = d
+	}
+
+	h, err := NewHarness(conf, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer h.Stop()
+
+	for path, value := range fixture.Values {
+		h.SetValue(path, value)
+	}
+	h.Start()
+
+	for _, e := range events {
+		if e.at > h.Elapsed() {
+			h.Advance(e.at - h.Elapsed())
+		}
+		if e.Topic != "" {
+			h.Publish(e.Topic, []byte(e.Payload))
+		} else {
+			h.Status(e.Path, e.Value)
+		}
+	}
+	if duration > h.Elapsed() {
+		h.Advance(duration - h.Elapsed())
+	}
+
+	messages := h.Messages()
+	var failures []string
+
+	for _, status := range h.Errors() {
+		failures = append(failures, fmt.Sprintf("trigger %s failed: %s", status.Name, status.Error))
+	}
+
+	next := 0
+	for _, e := range fixture.Expect {
+		at, err := parseAt(e.At)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if e.Never {
+			for _, m := range messages {
+				if e.matches(m, at, e.At != "") {
+					failures = append(failures, fmt.Sprintf("unexpected %s", m))
+				}
+			}
+			continue
+		}
+
+		found := false
+		for i := next; i < len(messages); i++ {
+			if e.matches(messages[i], at, e.At != "") {
+				next, found = i+1, true
+				break
+			}
+		}
+		if !found {
+			failures = append(failures, fmt.Sprintf("expected %s", e))
+		}
+	}
+
+	return messages, failures, nil
+}
@@ -0,0 +1,326 @@
+package trigger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+// Message is a message published by triggers in a Harness
+type Message struct {
+	// At is the time of the message relative to the start of the harness
+	At      time.Duration
+	Topic   string
+	Payload []byte
+	// Function is set, command or get for requests and empty for other messages
+	Function string
+	Path     string
+	Value    interface{}
+}
+
+// Harness runs triggers offline with a virtual clock. Status events are fed to the triggers and the
+// messages they publish are recorded. Set requests are applied to the state like a bridge would and
+// gets are answered from it. Automations are run against the same clock and client.
+type Harness struct {
+	ts     *TriggerSystem
+	clock  *TestClock
+	start  time.Time
+	tmpDir string
+
+	mutex    sync.Mutex
+	values   map[string]interface{}
+	messages []Message
+	errors   []Status
+}
+
+// NewHarness returns a harness for the triggers of a config starting at start. The store (if configured)
+// is replaced with a temporary one and the outbound queue is not spooled.
+func NewHarness(conf config.Config, start time.Time) (*Harness, error) {
+	h := &Harness{
+		clock:  NewTestClock(start),
+		start:  start,
+		values: map[string]interface{}{},
+	}
+
+	conf.Queue = nil
+	if conf.Store != nil {
+		dir, err := ioutil.TempDir("", "harness")
+		if err != nil {
+			return nil, err
+		}
+		h.tmpDir = dir
+		conf.Store = &config.Store{DatabaseFile: filepath.Join(dir, "store.db")}
+	}
+
+	h.ts = New(conf)
+	h.ts.SetClock(h.clock)
+	h.ts.c = &harnessClient{h}
+
+	return h, nil
+}
+
+// Start starts the triggers and automations and waits for their scripts to run
+func (h *Harness) Start() {
+	h.ts.initTriggers()
+	h.ts.initAutomations()
+	h.settle()
+}
+
+// Stop stops the triggers and the runtimes of the automations
+func (h *Harness) Stop() {
+	h.ts.instanceMutex.Lock()
+	var runtimes []*runtime
+	for _, inst := range h.ts.instances {
+		if inst.restart != nil {
+			inst.restart.Stop()
+		}
+		if inst.runtime != nil {
+			runtimes = append(runtimes, inst.runtime)
+		}
+	}
+	h.ts.instanceMutex.Unlock()
+
+	h.ts.automationMutex.Lock()
+	for _, a := range h.ts.automations {
+		a.Lock()
+		if a.runtime != nil {
+			runtimes = append(runtimes, a.runtime)
+		}
+		a.Unlock()
+	}
+	h.ts.automationMutex.Unlock()
+
+	for _, r := range runtimes {
+		h.ts.stopRuntime(r)
+	}
+
+	h.ts.closeStore()
+	if h.tmpDir != "" {
+		os.RemoveAll(h.tmpDir)
+	}
+}
+
+// SetValue sets the value of a path without publishing a status. Used for values known before the start.
+func (h *Harness) SetValue(path string, value interface{}) {
+	h.mutex.Lock()
+	h.values[path] = value
+	h.mutex.Unlock()
+
+	h.ts.Lock()
+	h.ts.data[path] = value
+	h.ts.Unlock()
+}
+
+// Status publishes the status of a path and waits for the triggers to handle it
+func (h *Harness) Status(path string, value interface{}) {
+	h.status(path, value)
+	h.settle()
+}
+
+// Publish publishes a message and waits for the triggers to handle it
+func (h *Harness) Publish(topic string, payload []byte) {
+	h.deliver(topic, payload)
+	h.settle()
+}
+
+// Advance moves the virtual clock forward running the timers that expire in order
+func (h *Harness) Advance(d time.Duration) {
+	target := h.clock.Now().Add(d)
+
+	for {
+		h.settle()
+
+		next, ok := h.clock.next()
+		if !ok || next.After(target) {
+			break
+		}
+		h.clock.Advance(next.Sub(h.clock.Now()))
+	}
+
+	h.clock.Advance(target.Sub(h.clock.Now()))
+	h.settle()
+}
+
+// Elapsed returns the time since the start
+func (h *Harness) Elapsed() time.Duration {
+	return h.clock.Now().Sub(h.start)
+}
+
+// Messages returns the messages published by the triggers
+func (h *Harness) Messages() []Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return append([]Message{}, h.messages...)
+}
+
+// Errors returns the errors of failed triggers
+func (h *Harness) Errors() []Status {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return append([]Status{}, h.errors...)
+}
+
+func (h *Harness) status(path string, value interface{}) {
+	h.mutex.Lock()
+	h.values[path] = value
+	h.mutex.Unlock()
+
+	b, _ := json.Marshal(value)
+	h.deliver(h.ts.topics.Build(util.FunctionStatus, path), b)
+}
+
+// deliver calls the handlers of a message synchronously
+func (h *Harness) deliver(topic string, payload []byte) {
+	msg := &harnessMessage{topic: topic, payload: payload}
+	for _, handler := range h.ts.receive(msg) {
+		handler(h.ts.c, msg)
+	}
+}
+
+// settle waits until the runtimes of the triggers and the automations have no work left
+func (h *Harness) settle() {
+	for {
+		idle := h.ts.automationsIdle()
+
+		h.ts.instanceMutex.Lock()
+		for _, inst := range h.ts.instances {
+			if inst.runtime != nil && !inst.runtime.idle() {
+				idle = false
+			}
+		}
+		h.ts.instanceMutex.Unlock()
+
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// published records a message published by the triggers and answers requests
+func (h *Harness) published(topic string, payload []byte) {
+	if strings.HasPrefix(topic, h.ts.statusTopic()+"/") {
+		status := Status{}
+		if err := json.Unmarshal(payload, &status); err == nil && status.Status == StatusErrored {
+			h.mutex.Lock()
+			h.errors = append(h.errors, status)
+			h.mutex.Unlock()
+		}
+		return
+	}
+
+	msg := Message{At: h.Elapsed(), Topic: topic, Payload: payload}
+	for _, function := range []string{util.FunctionSet, util.FunctionCommand, util.FunctionGet} {
+		if path, ok := h.ts.topics.ParseFunction(function, topic); ok {
+			msg.Function, msg.Path = function, path
+			break
+		}
+	}
+
+	var req util.SetRequest
+	if msg.Function == util.FunctionSet || msg.Function == util.FunctionCommand {
+		req = util.DecodeRequest(payload)
+		msg.Value = req.Value
+	}
+
+	if msg.Function != util.FunctionGet {
+		h.mutex.Lock()
+		h.messages = append(h.messages, msg)
+		h.mutex.Unlock()
+	}
+
+	switch msg.Function {
+	case util.FunctionSet:
+		h.status(msg.Path, msg.Value)
+	case util.FunctionGet:
+		// Unknown values are null
+		h.mutex.Lock()
+		val := h.values[msg.Path]
+		h.mutex.Unlock()
+		h.status(msg.Path, val)
+		return
+	default:
+		return
+	}
+
+	if req.Correlation != nil {
+		res, _ := json.Marshal(util.Result{Function: msg.Function, Path: msg.Path, Status: util.ResultOK, Correlation: req.Correlation})
+		h.deliver(h.ts.topics.Build(util.FunctionResult, msg.Path), res)
+	}
+}
+
+// next returns the time of the next pending timer
+func (tc *TestClock) next() (time.Time, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	var next time.Time
+	found := false
+	for _, timer := range tc.timers {
+		if !timer.done && (!found || timer.at.Before(next)) {
+			next, found = timer.at, true
+		}
+	}
+	return next, found
+}
+
+type harnessMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *harnessMessage) Duplicate() bool   { return false }
+func (m *harnessMessage) Qos() byte         { return 1 }
+func (m *harnessMessage) Retained() bool    { return false }
+func (m *harnessMessage) Topic() string     { return m.topic }
+func (m *harnessMessage) MessageID() uint16 { return 0 }
+func (m *harnessMessage) Payload() []byte   { return m.payload }
+
+// harnessClient is an mqtt client passing published messages to the harness
+type harnessClient struct {
+	h *Harness
+}
+
+type harnessToken struct{}
+
+func (harnessToken) Wait() bool                     { return true }
+func (harnessToken) WaitTimeout(time.Duration) bool { return true }
+func (harnessToken) Error() error                   { return nil }
+
+func (c *harnessClient) IsConnected() bool { return true }
+
+func (c *harnessClient) Connect() mqtt.Token { return harnessToken{} }
+
+func (c *harnessClient) Disconnect(quiesce uint) {}
+
+func (c *harnessClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	switch p := payload.(type) {
+	case []byte:
+		c.h.published(topic, p)
+	case string:
+		c.h.published(topic, []byte(p))
+	}
+	return harnessToken{}
+}
+
+func (c *harnessClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return harnessToken{}
+}
+
+func (c *harnessClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return harnessToken{}
+}
+
+func (c *harnessClient) Unsubscribe(topics ...string) mqtt.Token { return harnessToken{} }
+
+func (c *harnessClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
@@ -0,0 +1,288 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/util"
+)
+
+var (
+	errHTTPNotConfigured = errors.New("http has not been configured")
+	errRateLimited       = errors.New("http rate limit exceeded")
+
+	httpTimeout = 10 * time.Second
+	// httpMaxBody is the maximum size of a response body read
+	httpMaxBody int64 = 1 << 20
+)
+
+// allowedHost returns true if requests to the host of u are allowed. Hosts configured without
+// a port allow any port.
+func (trigger *TriggerSystem) allowedHost(u *url.URL) bool {
+	for _, host := range trigger.conf.HTTP.AllowedHosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpClient returns the client used for the requests of triggers. Redirects are only followed to allowed hosts.
+func (trigger *TriggerSystem) httpClient() *http.Client {
+	trigger.httpMutex.Lock()
+	defer trigger.httpMutex.Unlock()
+
+	if trigger.client == nil {
+		trigger.client = &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				if !trigger.allowedHost(req.URL) {
+					return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+				}
+				return nil
+			},
+		}
+	}
+
+	return trigger.client
+}
+
+// allowRequest records a request of a runtime. Returns false if the runtime has sent the maximum
+// number of requests within the rate interval.
+func (trigger *TriggerSystem) allowRequest(r *runtime) (bool, error) {
+	conf := trigger.conf.HTTP
+	if conf.RateLimit <= 0 {
+		return true, nil
+	}
+
+	interval := time.Minute
+	if conf.RateInterval != "" {
+		var err error
+		if interval, err = util.ParseDuration(conf.RateInterval); err != nil {
+			return false, err
+		}
+	}
+
+	trigger.httpMutex.Lock()
+	defer trigger.httpMutex.Unlock()
+
+	now := trigger.now()
+	var recent []time.Time
+	for _, t := range trigger.requests[r.name] {
+		if t.After(now.Add(-interval)) {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= conf.RateLimit {
+		trigger.requests[r.name] = recent
+		return false, nil
+	}
+	trigger.requests[r.name] = append(recent, now)
+
+	return true, nil
+}
+
+// httpModule returns the http object of a runtime
+func (trigger *TriggerSystem) httpModule(r *runtime) goja.Value {
+	obj := r.NewObject()
+	obj.Set("request", trigger.httpRequest(r))
+	return obj
+}
+
+// newHTTPRequest builds a request from the options of http.request. Objects and arrays given
+// as the body are sent as JSON.
+func (trigger *TriggerSystem) newHTTPRequest(opts map[string]interface{}) (*http.Request, time.Duration, error) {
+	if trigger.conf.HTTP == nil {
+		return nil, 0, errHTTPNotConfigured
+	}
+
+	u, err := url.Parse(fmt.Sprint(opts["url"]))
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, 0, fmt.Errorf("unsupported url %s", u.String())
+	}
+	if !trigger.allowedHost(u) {
+		return nil, 0, fmt.Errorf("host %s is not allowed", u.Host)
+	}
+
+	timeout := httpTimeout
+	if trigger.conf.HTTP.Timeout != "" {
+		if timeout, err = util.ParseDuration(trigger.conf.HTTP.Timeout); err != nil {
+			return nil, 0, err
+		}
+	}
+	if t, ok := opts["timeout"]; ok {
+		if timeout, err = durationOption(t); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	method := "GET"
+	if m, ok := opts["method"].(string); ok {
+		method = strings.ToUpper(m)
+	}
+
+	var body io.Reader
+	contentType := ""
+	switch b := opts["body"].(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if headers, ok := opts["headers"].(map[string]interface{}); ok {
+		for key, val := range headers {
+			req.Header.Set(key, fmt.Sprint(val))
+		}
+	}
+
+	return req, timeout, nil
+}
+
+// doHTTPRequest sends a request and returns the response as an object with the status, headers
+// (lowercase names), body and, for JSON responses, the decoded json. The request is cancelled
+// if the runtime is stopped.
+func (trigger *TriggerSystem) doHTTPRequest(r *runtime, req *http.Request, timeout time.Duration) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	res, err := trigger.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, httpMaxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]interface{}{}
+	for key, vals := range res.Header {
+		headers[strings.ToLower(key)] = strings.Join(vals, ", ")
+	}
+
+	obj := map[string]interface{}{
+		"status":     res.StatusCode,
+		"statusText": http.StatusText(res.StatusCode),
+		"headers":    headers,
+		"body":       string(body),
+	}
+	if strings.Contains(res.Header.Get("Content-Type"), "json") {
+		var val interface{}
+		if err := json.Unmarshal(body, &val); err == nil {
+			obj["json"] = val
+		}
+	}
+
+	return obj, nil
+}
+
+// httpRequest sends a request to an allowed host without blocking the runtime. Takes a url or an
+// object with the method, url, headers, body and timeout (10s or milliseconds). Returns a promise
+// resolved with the response or, when a callback is given, calls callback(err, response). Responses
+// with an error status are resolved like any other.
+func (trigger *TriggerSystem) httpRequest(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		opts := map[string]interface{}{}
+		switch arg := call.Argument(0).Export().(type) {
+		case string:
+			opts["url"] = arg
+		case map[string]interface{}:
+			opts = arg
+		default:
+			panic(r.NewTypeError("http.request requires a url or options"))
+		}
+
+		var promise goja.Value
+		var resolve, reject func(interface{})
+
+		callback, hasCallback := goja.AssertFunction(call.Argument(1))
+		if hasCallback {
+			promise = goja.Undefined()
+			resolve = func(res interface{}) {
+				if _, err := callback(nil, goja.Null(), r.ToValue(res)); err != nil {
+					r.fail(err)
+				}
+			}
+			reject = func(err interface{}) {
+				if _, err := callback(nil, r.ToValue(err)); err != nil {
+					r.fail(err)
+				}
+			}
+		} else {
+			promise, resolve, reject = r.newPromise()
+		}
+
+		// Callbacks are always called asynchronously
+		fail := func(err error) {
+			r.Work(func(r *runtime) {
+				reject(r.NewGoError(err))
+			})
+		}
+
+		req, timeout, err := trigger.newHTTPRequest(opts)
+		if err != nil {
+			fail(err)
+			return promise
+		}
+
+		if ok, err := trigger.allowRequest(r); err != nil {
+			fail(err)
+			return promise
+		} else if !ok {
+			fail(errRateLimited)
+			return promise
+		}
+
+		r.goAsync(func() {
+			res, err := trigger.doHTTPRequest(r, req, timeout)
+			r.Work(func(r *runtime) {
+				if err != nil {
+					reject(r.NewGoError(err))
+					return
+				}
+				resolve(res)
+			})
+		})
+
+		return promise
+	}
+}
@@ -0,0 +1,289 @@
+package trigger
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/queue"
+	"github.com/orktes/homeautomation/util"
+)
+
+// DefaultTopic is the topic under which trigger statuses are published
+const DefaultTopic = "triggers"
+
+// Trigger statuses
+const (
+	StatusRunning  = "running"
+	StatusErrored  = "errored"
+	StatusDisabled = "disabled"
+)
+
+var (
+	restartBackoff    = time.Second
+	maxRestartBackoff = 5 * time.Minute
+)
+
+// Status of a trigger. Published as retained to <topic>/<name>/status.
+type Status struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+	Restarts  int       `json:"restarts"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// instance is a trigger script and the runtime it currently runs in
+type instance struct {
+	name    string
+	conf    config.Trigger
+	enabled bool
+
+	runtime  *runtime
+	status   Status
+	failures int
+	started  time.Time
+	restart  Timer
+}
+
+// triggerNames returns the names of the triggers. Unnamed (legacy) trigger blocks are named after
+// their script or file so that reordering the config doesn't hand their state to another trigger.
+// Unnamed triggers with the same script are numbered.
+func triggerNames(confs []config.Trigger) []string {
+	names := make([]string, len(confs))
+	used := map[string]int{}
+	for i, conf := range confs {
+		if conf.Name != "" {
+			names[i] = conf.Name
+			continue
+		}
+
+		name := fmt.Sprintf("%x", sha1.Sum([]byte(conf.File+"\x00"+conf.Script)))[:8]
+		used[name]++
+		if used[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, used[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+func (trigger *TriggerSystem) statusTopic() string {
+	if trigger.conf.TriggerTopic != "" {
+		return trigger.conf.TriggerTopic
+	}
+	return DefaultTopic
+}
+
+func (trigger *TriggerSystem) initTriggers() {
+	var instances []*instance
+
+	names := triggerNames(trigger.conf.Triggers)
+
+	trigger.instanceMutex.Lock()
+	for i, triggerConf := range trigger.conf.Triggers {
+		name := names[i]
+		if _, ok := trigger.instances[name]; ok {
+			fmt.Printf("Duplicate trigger %s\n", name)
+			continue
+		}
+
+		inst := &instance{
+			name:    name,
+			conf:    triggerConf,
+			enabled: triggerConf.Enabled == nil || *triggerConf.Enabled,
+			status:  Status{Name: name, Status: StatusDisabled},
+		}
+		trigger.instances[name] = inst
+		instances = append(instances, inst)
+	}
+	trigger.instanceMutex.Unlock()
+
+	if len(instances) > 0 {
+		trigger.subscribe(trigger.statusTopic()+"/#", trigger.controlHandler)
+	}
+
+	for _, inst := range instances {
+		if inst.enabled {
+			trigger.startInstance(inst)
+		} else {
+			trigger.publishStatus(inst.status)
+		}
+	}
+}
+
+// controlHandler enables or disables triggers with messages to <topic>/<name>/set
+func (trigger *TriggerSystem) controlHandler(client mqtt.Client, msg mqtt.Message) {
+	name := strings.TrimPrefix(msg.Topic(), trigger.statusTopic()+"/")
+	if !strings.HasSuffix(name, "/"+util.FunctionSet) {
+		return
+	}
+	name = strings.TrimSuffix(name, "/"+util.FunctionSet)
+
+	trigger.instanceMutex.Lock()
+	inst, ok := trigger.instances[name]
+	trigger.instanceMutex.Unlock()
+	if !ok {
+		fmt.Printf("Unknown trigger %s\n", name)
+		return
+	}
+
+	val, _ := util.DecodeSetRequest(msg.Payload())
+	enabled, ok := val.(bool)
+	if !ok {
+		fmt.Printf("Invalid value for trigger %s: %s\n", name, string(msg.Payload()))
+		return
+	}
+
+	// Stopping a trigger waits for unsubscribes which can't be done in the message router
+	go trigger.setEnabled(inst, enabled)
+}
+
+func (trigger *TriggerSystem) setEnabled(inst *instance, enabled bool) {
+	trigger.instanceMutex.Lock()
+	inst.enabled = enabled
+	inst.failures = 0
+	if inst.restart != nil {
+		inst.restart.Stop()
+		inst.restart = nil
+	}
+	r := inst.runtime
+	if !enabled {
+		inst.runtime = nil
+		inst.status = Status{Name: inst.name, Status: StatusDisabled, Restarts: inst.status.Restarts}
+	}
+	status := inst.status
+	trigger.instanceMutex.Unlock()
+
+	if enabled {
+		if r == nil {
+			trigger.startInstance(inst)
+		}
+		return
+	}
+
+	if r != nil {
+		trigger.stopRuntime(r)
+	}
+	trigger.publishStatus(status)
+}
+
+// startInstance runs the script of a trigger in a new runtime
+func (trigger *TriggerSystem) startInstance(inst *instance) {
+	trigger.instanceMutex.Lock()
+	if !inst.enabled || inst.runtime != nil {
+		trigger.instanceMutex.Unlock()
+		return
+	}
+
+	r := trigger.newScriptRuntime(inst.name)
+	r.onError = func(err error) {
+		trigger.failInstance(inst, r, err)
+	}
+	inst.runtime = r
+	inst.started = trigger.now()
+	trigger.instanceMutex.Unlock()
+
+	if err := trigger.runTrigger(r, inst.conf); err != nil {
+		trigger.failInstance(inst, r, err)
+		return
+	}
+
+	trigger.instanceMutex.Lock()
+	if inst.runtime != r {
+		// Failed or disabled while starting
+		trigger.instanceMutex.Unlock()
+		return
+	}
+	inst.status = Status{Name: inst.name, Status: StatusRunning, Restarts: inst.status.Restarts, Timestamp: trigger.now()}
+	status := inst.status
+	trigger.instanceMutex.Unlock()
+
+	trigger.publishStatus(status)
+}
+
+// failInstance stops the runtime of a failed trigger and restarts it with an exponential backoff
+func (trigger *TriggerSystem) failInstance(inst *instance, r *runtime, err error) {
+	trigger.instanceMutex.Lock()
+	if inst.runtime != r {
+		// Already stopped
+		trigger.instanceMutex.Unlock()
+		return
+	}
+	inst.runtime = nil
+
+	now := trigger.now()
+	if now.Sub(inst.started) > maxRestartBackoff {
+		// Ran long enough to be considered healthy
+		inst.failures = 0
+	}
+	inst.failures++
+
+	backoff := restartBackoff
+	for i := 1; i < inst.failures && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+
+	inst.status = Status{
+		Name:      inst.name,
+		Status:    StatusErrored,
+		Error:     err.Error(),
+		Restarts:  inst.status.Restarts,
+		Timestamp: now,
+	}
+	if exception, ok := err.(*goja.Exception); ok {
+		inst.status.Stack = exception.String()
+	}
+
+	inst.restart = trigger.getClock().AfterFunc(backoff, func() {
+		trigger.instanceMutex.Lock()
+		inst.restart = nil
+		inst.status.Restarts++
+		trigger.instanceMutex.Unlock()
+
+		trigger.startInstance(inst)
+	})
+	status := inst.status
+	trigger.instanceMutex.Unlock()
+
+	fmt.Printf("Trigger %s failed, restarting in %s: %s\n", inst.name, backoff, err.Error())
+
+	trigger.stopRuntime(r)
+	trigger.publishStatus(status)
+}
+
+// stopRuntime stops a runtime and removes its subscriptions and timers
+func (trigger *TriggerSystem) stopRuntime(r *runtime) {
+	subs := r.stop()
+	r.Interrupt("trigger stopped")
+
+	for id, topic := range subs {
+		trigger.unsubscribe(topic, id)
+	}
+	trigger.stopRuntimeTimers(r)
+}
+
+func (trigger *TriggerSystem) publishStatus(status Status) {
+	b, err := json.Marshal(status)
+	if err != nil {
+		fmt.Printf("Error encoding trigger status %s\n", err.Error())
+		return
+	}
+
+	trigger.outbound().Publish(queue.Message{
+		Topic:    trigger.statusTopic() + "/" + status.Name + "/" + util.FunctionStatus,
+		QoS:      1,
+		Retained: true,
+		Payload:  b,
+		Coalesce: true,
+	})
+}
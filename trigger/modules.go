@@ -0,0 +1,248 @@
+package trigger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/util"
+)
+
+// builtinModules are the modules available to require by name
+var builtinModules = map[string]func(trigger *TriggerSystem, r *runtime) goja.Value{
+	"time":  (*TriggerSystem).timeModule,
+	"color": (*TriggerSystem).colorModule,
+	"state": (*TriggerSystem).stateModule,
+}
+
+// scriptPath returns the path of a script file relative to the scripts directory
+func (trigger *TriggerSystem) scriptPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(trigger.conf.ScriptsDir, name)
+}
+
+// require loads CommonJS modules. Relative names are resolved from dir and other names from the
+// scripts directory. Modules are cached per runtime.
+func (trigger *TriggerSystem) require(r *runtime, dir string) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		exports, err := trigger.loadModule(r, dir, call.Argument(0).String())
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		return exports
+	}
+}
+
+func (trigger *TriggerSystem) loadModule(r *runtime, dir string, name string) (goja.Value, error) {
+	if builtin, ok := builtinModules[name]; ok {
+		if exports, ok := r.modules[name]; ok {
+			return exports, nil
+		}
+		exports := builtin(trigger, r)
+		r.modules[name] = exports
+		return exports, nil
+	}
+
+	var filename string
+	if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") {
+		filename = filepath.Join(dir, name)
+	} else {
+		filename = trigger.scriptPath(name)
+	}
+
+	filename, err := resolveModule(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find module %s", name)
+	}
+
+	if exports, ok := r.modules[filename]; ok {
+		return exports, nil
+	}
+
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper, err := r.RunScript(filename, "(function (exports, require, module, __filename, __dirname) {"+string(source)+"\n})")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(wrapper)
+	if !ok {
+		return nil, fmt.Errorf("invalid module %s", name)
+	}
+
+	exports := r.NewObject()
+	module := r.NewObject()
+	module.Set("exports", exports)
+	module.Set("id", filename)
+
+	// Cache before running so that circular requires get the partial exports
+	r.modules[filename] = exports
+
+	moduleDir := filepath.Dir(filename)
+	if _, err := fn(nil, exports, r.ToValue(trigger.require(r, moduleDir)), module, r.ToValue(filename), r.ToValue(moduleDir)); err != nil {
+		delete(r.modules, filename)
+		return nil, err
+	}
+
+	r.modules[filename] = module.Get("exports")
+
+	return r.modules[filename], nil
+}
+
+// resolveModule returns the absolute path of a module trying the name as is, with a .js extension and as a directory with an index.js
+func resolveModule(name string) (string, error) {
+	for _, candidate := range []string{name, name + ".js", filepath.Join(name, "index.js")} {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return filepath.Abs(candidate)
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func (trigger *TriggerSystem) timeModule(r *runtime) goja.Value {
+	obj := r.NewObject()
+
+	obj.Set("now", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(trigger.now().UnixNano() / int64(time.Millisecond))
+	})
+
+	obj.Set("parseDuration", func(call goja.FunctionCall) goja.Value {
+		d, err := util.ParseDuration(call.Argument(0).String())
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		return r.ToValue(int64(d / time.Millisecond))
+	})
+
+	obj.Set("timeOfDay", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(trigger.now().Format("15:04"))
+	})
+
+	obj.Set("weekday", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(int(trigger.now().Weekday()))
+	})
+
+	// between checks if the time of day is between two times (15:04). Ranges over midnight are supported.
+	obj.Set("between", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(timeOfDayBetween(trigger.now(), call.Argument(0).String(), call.Argument(1).String()))
+	})
+
+	return obj
+}
+
+func (trigger *TriggerSystem) colorModule(r *runtime) goja.Value {
+	obj := r.NewObject()
+
+	args := func(call goja.FunctionCall, defaults ...float64) []float64 {
+		res := make([]float64, len(defaults))
+		for i := range defaults {
+			res[i] = defaults[i]
+			if arg := call.Argument(i); !goja.IsUndefined(arg) {
+				res[i] = arg.ToFloat()
+			}
+		}
+		return res
+	}
+
+	obj.Set("rgbToXy", func(call goja.FunctionCall) goja.Value {
+		a := args(call, 0, 0, 0)
+		x, y, _ := util.RGBToXY(a[0], a[1], a[2])
+		return r.ToValue([]interface{}{math.Round(x*10000) / 10000, math.Round(y*10000) / 10000})
+	})
+
+	obj.Set("xyToRgb", func(call goja.FunctionCall) goja.Value {
+		a := args(call, 0, 0, 1)
+		red, green, blue := util.XYToRGB(a[0], a[1], a[2])
+		return r.ToValue([]interface{}{red, green, blue})
+	})
+
+	obj.Set("hsvToRgb", func(call goja.FunctionCall) goja.Value {
+		a := args(call, 0, 1, 1)
+		red, green, blue := util.HSVToRGB(a[0], a[1], a[2])
+		return r.ToValue([]interface{}{red, green, blue})
+	})
+
+	obj.Set("rgbToHsv", func(call goja.FunctionCall) goja.Value {
+		a := args(call, 0, 0, 0)
+		h, s, v := util.RGBToHSV(a[0], a[1], a[2])
+		return r.ToValue([]interface{}{h, s, v})
+	})
+
+	obj.Set("kelvinToMired", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(util.KelvinToMired(call.Argument(0).ToFloat()))
+	})
+
+	obj.Set("miredToKelvin", func(call goja.FunctionCall) goja.Value {
+		return r.ToValue(util.MiredToKelvin(call.Argument(0).ToFloat()))
+	})
+
+	return obj
+}
+
+func (trigger *TriggerSystem) stateModule(r *runtime) goja.Value {
+	obj := r.NewObject()
+
+	setValue := func(key string, val interface{}) {
+		req := util.SetRequest{
+			Value:  val,
+			Source: &adapter.Source{Type: adapter.SourceTrigger, ID: r.name, Client: trigger.conf.ClientID},
+		}
+		if err := trigger.publishRequest(util.FunctionSet, key, req); err != nil {
+			panic(r.NewGoError(err))
+		}
+	}
+
+	getValue := func(key string) interface{} {
+		val, err := trigger.value(key)
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		return val
+	}
+
+	obj.Set("get", trigger.get(r))
+	obj.Set("getAsync", trigger.getAsync(r))
+	obj.Set("set", trigger.set(r))
+
+	// toggle sets a boolean value to the opposite of its current value
+	obj.Set("toggle", func(call goja.FunctionCall) goja.Value {
+		key := call.Argument(0).String()
+		val := !r.ToValue(getValue(key)).ToBoolean()
+		setValue(key, val)
+		return r.ToValue(val)
+	})
+
+	// increment adds step to a numeric value limiting the result between optional min and max
+	obj.Set("increment", func(call goja.FunctionCall) goja.Value {
+		key := call.Argument(0).String()
+		step := float64(1)
+		if arg := call.Argument(1); !goja.IsUndefined(arg) {
+			step = arg.ToFloat()
+		}
+
+		current, _ := util.ToFloat(getValue(key))
+		val := current + step
+		if arg := call.Argument(2); !goja.IsUndefined(arg) && !goja.IsNull(arg) {
+			val = math.Max(val, arg.ToFloat())
+		}
+		if arg := call.Argument(3); !goja.IsUndefined(arg) && !goja.IsNull(arg) {
+			val = math.Min(val, arg.ToFloat())
+		}
+
+		setValue(key, val)
+		return r.ToValue(val)
+	})
+
+	return obj
+}
@@ -2,6 +2,7 @@ package trigger
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -62,10 +63,11 @@ type mockClient struct {
 		topic   string
 		payload []byte
 	}
+	unsubs chan string
 }
 
 func (mc *mockClient) IsConnected() bool {
-	panic("not implemented")
+	return true
 }
 
 func (mc *mockClient) Connect() mqtt.Token {
@@ -76,7 +78,15 @@ func (mc *mockClient) Disconnect(quiesce uint) {
 	panic("not implemented")
 }
 
+// ignored returns true for trigger statuses and control under the default topic which are not part of most tests
+func (mc *mockClient) ignored(topic string) bool {
+	return strings.HasPrefix(topic, DefaultTopic+"/")
+}
+
 func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if mc.ignored(topic) {
+		return mockToken(false)
+	}
 	mc.pubs <- struct {
 		topic   string
 		payload []byte
@@ -85,6 +95,9 @@ func (mc *mockClient) Publish(topic string, qos byte, retained bool, payload int
 }
 
 func (mc *mockClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if mc.ignored(topic) {
+		return mockToken(false)
+	}
 	mc.subs <- struct {
 		topic    string
 		callback mqtt.MessageHandler
@@ -98,7 +111,12 @@ func (mc *mockClient) SubscribeMultiple(filters map[string]byte, callback mqtt.M
 }
 
 func (mc *mockClient) Unsubscribe(topics ...string) mqtt.Token {
-	panic("not implemented")
+	if mc.unsubs != nil {
+		for _, topic := range topics {
+			mc.unsubs <- topic
+		}
+	}
+	return mockToken(false)
 }
 
 func (mc *mockClient) AddRoute(topic string, callback mqtt.MessageHandler) {
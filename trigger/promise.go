@@ -0,0 +1,273 @@
+package trigger
+
+import (
+	"errors"
+
+	"github.com/orktes/goja"
+)
+
+// promiseSource implements Promises for the ES5 runtime. Reactions are run as jobs of the runtime
+// after the current callback has finished.
+const promiseSource = `(function (global, enqueue, unhandled) {
+	var PENDING = 0, FULFILLED = 1, REJECTED = 2;
+
+	function Promise(executor) {
+		if (!(this instanceof Promise)) {
+			throw new TypeError("Promise must be called with new");
+		}
+		if (typeof executor !== "function") {
+			throw new TypeError("Promise resolver is not a function");
+		}
+
+		this._state = PENDING;
+		this._value = undefined;
+		this._reactions = [];
+		this._handled = false;
+
+		var self = this, done = false;
+		try {
+			executor(function (value) {
+				if (!done) {
+					done = true;
+					resolve(self, value);
+				}
+			}, function (reason) {
+				if (!done) {
+					done = true;
+					settle(self, REJECTED, reason);
+				}
+			});
+		} catch (e) {
+			if (!done) {
+				done = true;
+				settle(self, REJECTED, e);
+			}
+		}
+	}
+
+	function resolve(promise, value) {
+		if (value === promise) {
+			return settle(promise, REJECTED, new TypeError("A promise cannot be resolved with itself"));
+		}
+
+		if (value !== null && (typeof value === "object" || typeof value === "function")) {
+			var then;
+			try {
+				then = value.then;
+			} catch (e) {
+				return settle(promise, REJECTED, e);
+			}
+
+			if (typeof then === "function") {
+				var called = false;
+				try {
+					then.call(value, function (v) {
+						if (!called) {
+							called = true;
+							resolve(promise, v);
+						}
+					}, function (r) {
+						if (!called) {
+							called = true;
+							settle(promise, REJECTED, r);
+						}
+					});
+				} catch (e) {
+					if (!called) {
+						called = true;
+						settle(promise, REJECTED, e);
+					}
+				}
+				return;
+			}
+		}
+
+		settle(promise, FULFILLED, value);
+	}
+
+	function settle(promise, state, value) {
+		if (promise._state !== PENDING) {
+			return;
+		}
+		promise._state = state;
+		promise._value = value;
+
+		var reactions = promise._reactions;
+		promise._reactions = [];
+		for (var i = 0; i < reactions.length; i++) {
+			react(promise, reactions[i]);
+		}
+
+		if (state === REJECTED && !promise._handled) {
+			enqueue(function () {
+				if (!promise._handled) {
+					unhandled(value);
+				}
+			});
+		}
+	}
+
+	function react(promise, reaction) {
+		enqueue(function () {
+			var fulfilled = promise._state === FULFILLED;
+			var handler = fulfilled ? reaction.onFulfilled : reaction.onRejected;
+
+			if (typeof handler !== "function") {
+				if (fulfilled) {
+					resolve(reaction.promise, promise._value);
+				} else {
+					settle(reaction.promise, REJECTED, promise._value);
+				}
+				return;
+			}
+
+			var res;
+			try {
+				res = handler(promise._value);
+			} catch (e) {
+				settle(reaction.promise, REJECTED, e);
+				return;
+			}
+			resolve(reaction.promise, res);
+		});
+	}
+
+	Promise.prototype.then = function (onFulfilled, onRejected) {
+		var reaction = {onFulfilled: onFulfilled, onRejected: onRejected, promise: new Promise(function () {})};
+
+		this._handled = true;
+		if (this._state === PENDING) {
+			this._reactions.push(reaction);
+		} else {
+			react(this, reaction);
+		}
+
+		return reaction.promise;
+	};
+
+	Promise.prototype["catch"] = function (onRejected) {
+		return this.then(undefined, onRejected);
+	};
+
+	Promise.prototype["finally"] = function (fn) {
+		return this.then(function (value) {
+			return Promise.resolve(fn()).then(function () {
+				return value;
+			});
+		}, function (reason) {
+			return Promise.resolve(fn()).then(function () {
+				throw reason;
+			});
+		});
+	};
+
+	Promise.resolve = function (value) {
+		if (value instanceof Promise) {
+			return value;
+		}
+		return new Promise(function (resolve) {
+			resolve(value);
+		});
+	};
+
+	Promise.reject = function (reason) {
+		return new Promise(function (resolve, reject) {
+			reject(reason);
+		});
+	};
+
+	Promise.all = function (values) {
+		return new Promise(function (resolve, reject) {
+			var results = [], remaining = values.length;
+			if (remaining === 0) {
+				return resolve(results);
+			}
+
+			for (var i = 0; i < values.length; i++) {
+				(function (i) {
+					Promise.resolve(values[i]).then(function (value) {
+						results[i] = value;
+						if (--remaining === 0) {
+							resolve(results);
+						}
+					}, reject);
+				})(i);
+			}
+		});
+	};
+
+	Promise.race = function (values) {
+		return new Promise(function (resolve, reject) {
+			for (var i = 0; i < values.length; i++) {
+				Promise.resolve(values[i]).then(resolve, reject);
+			}
+		});
+	};
+
+	global.Promise = Promise;
+
+	// deferred is used to create promises from Go
+	return function deferred() {
+		var d = {};
+		d.promise = new Promise(function (resolve, reject) {
+			d.resolve = resolve;
+			d.reject = reject;
+		});
+		return d;
+	};
+})`
+
+// installPromises defines Promise in the runtime
+func (r *runtime) installPromises() {
+	install, err := r.RunScript("promise.js", promiseSource)
+	if err != nil {
+		panic(err)
+	}
+	fn, _ := goja.AssertFunction(install)
+
+	enqueue := func(call goja.FunctionCall) goja.Value {
+		if job, ok := goja.AssertFunction(call.Argument(0)); ok {
+			r.jobs = append(r.jobs, job)
+		}
+		return goja.Undefined()
+	}
+
+	unhandled := func(call goja.FunctionCall) goja.Value {
+		r.fail(errors.New("unhandled promise rejection: " + call.Argument(0).String()))
+		return goja.Undefined()
+	}
+
+	deferred, err := fn(nil, r.GlobalObject(), r.ToValue(enqueue), r.ToValue(unhandled))
+	if err != nil {
+		panic(err)
+	}
+	r.deferred, _ = goja.AssertFunction(deferred)
+}
+
+// newPromise returns a promise and the functions resolving and rejecting it. The functions
+// have to be called in the runtime.
+func (r *runtime) newPromise() (promise goja.Value, resolve func(interface{}), reject func(interface{})) {
+	d, err := r.deferred(nil)
+	if err != nil {
+		panic(err)
+	}
+	obj := d.ToObject(r.Runtime)
+
+	settle := func(name string) func(interface{}) {
+		fn, _ := goja.AssertFunction(obj.Get(name))
+		return func(val interface{}) {
+			fn(nil, r.ToValue(val))
+		}
+	}
+
+	return obj.Get("promise"), settle("resolve"), settle("reject")
+}
+
+// runJobs runs queued promise reactions until the queue is empty
+func (r *runtime) runJobs() {
+	for len(r.jobs) > 0 {
+		job := r.jobs[0]
+		r.jobs = r.jobs[1:]
+		job(nil)
+	}
+}
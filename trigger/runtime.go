@@ -1,30 +1,201 @@
 package trigger
 
-import "github.com/orktes/goja"
+import (
+	"errors"
+	"fmt"
+	"sync"
 
+	"github.com/orktes/goja"
+)
+
+var errRuntimeStopped = errors.New("runtime has been stopped")
+
+// runtime is a goja runtime with an event loop. All JavaScript of a runtime is run by the loop
+// one callback at a time in the order the callbacks were queued.
 type runtime struct {
-	workChannel chan func(r *runtime)
+	name string
+	// modules caches the exports of required modules by name or filename
+	modules map[string]goja.Value
+	// onError is called with errors thrown by callbacks
+	onError func(err error)
+	// jobs are promise reactions run after the current callback
+	jobs     []goja.Callable
+	deferred goja.Callable
 	*goja.Runtime
-}
 
-func newRuntime() *runtime {
-	gr := goja.New()
-	ch := make(chan func(*runtime))
+	mutex   sync.Mutex
+	wake    *sync.Cond
+	queue   []func(r *runtime)
+	running bool
+	// inflight is the number of goroutines which will queue work when they finish
+	inflight      int
+	done          chan struct{}
+	stopped       bool
+	subscriptions map[int]string
+}
 
+func newRuntime(name string) *runtime {
 	r := &runtime{
-		Runtime:     gr,
-		workChannel: ch,
+		name:          name,
+		Runtime:       goja.New(),
+		modules:       map[string]goja.Value{},
+		done:          make(chan struct{}),
+		subscriptions: map[int]string{},
 	}
+	r.wake = sync.NewCond(&r.mutex)
+	r.installPromises()
 
-	go func() {
-		for w := range ch {
-			w(r)
+	go r.loop()
+
+	return r
+}
+
+// loop runs queued callbacks until the runtime is stopped
+func (r *runtime) loop() {
+	for {
+		r.mutex.Lock()
+		for len(r.queue) == 0 && !r.stopped {
+			r.wake.Wait()
+		}
+		if r.stopped {
+			r.queue = nil
+			r.mutex.Unlock()
+			return
+		}
+		w := r.queue[0]
+		r.queue = r.queue[1:]
+		r.running = true
+		r.mutex.Unlock()
+
+		r.run(w)
+
+		r.mutex.Lock()
+		r.running = false
+		r.mutex.Unlock()
+	}
+}
+
+func (r *runtime) run(w func(r *runtime)) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.fail(fmt.Errorf("%v", err))
 		}
 	}()
 
-	return r
+	w(r)
+	r.runJobs()
 }
 
+// Work queues cb to be run by the event loop. Work is dropped if the runtime has been stopped.
 func (r *runtime) Work(cb func(*runtime)) {
-	r.workChannel <- cb
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopped {
+		return
+	}
+	r.queue = append(r.queue, cb)
+	r.wake.Signal()
+}
+
+// goAsync runs fn in a goroutine. fn is expected to queue its result with Work before it returns.
+func (r *runtime) goAsync(fn func()) {
+	r.mutex.Lock()
+	r.inflight++
+	r.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			r.mutex.Lock()
+			r.inflight--
+			r.mutex.Unlock()
+		}()
+		fn()
+	}()
+}
+
+// idle returns true if the runtime has no queued, running or pending work
+func (r *runtime) idle() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stopped || (len(r.queue) == 0 && !r.running && r.inflight == 0)
+}
+
+// Run runs cb in the runtime and waits for it to finish. Panics are returned as errors.
+func (r *runtime) Run(cb func(*runtime) error) error {
+	errCh := make(chan error, 1)
+	r.Work(func(r *runtime) {
+		defer func() {
+			if err := recover(); err != nil {
+				errCh <- fmt.Errorf("%v", err)
+			}
+		}()
+		errCh <- cb(r)
+	})
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-r.done:
+		select {
+		case err := <-errCh:
+			return err
+		default:
+			return errRuntimeStopped
+		}
+	}
+}
+
+// fail reports an error thrown by a callback
+func (r *runtime) fail(err error) {
+	if r.onError != nil {
+		r.onError(err)
+		return
+	}
+	fmt.Printf("Error in trigger %s: %s\n", r.name, err)
+}
+
+// addSubscription records a subscription made by the runtime. Returns false if the runtime has been stopped.
+func (r *runtime) addSubscription(topic string, id int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopped {
+		return false
+	}
+	r.subscriptions[id] = topic
+	return true
+}
+
+func (r *runtime) removeSubscription(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.subscriptions, id)
+}
+
+func (r *runtime) isStopped() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stopped
+}
+
+// stop stops the runtime and returns the subscriptions it owned
+func (r *runtime) stop() map[int]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopped {
+		return nil
+	}
+	r.stopped = true
+	close(r.done)
+	r.wake.Broadcast()
+
+	subs := r.subscriptions
+	r.subscriptions = map[int]string{}
+
+	return subs
 }
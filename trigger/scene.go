@@ -0,0 +1,56 @@
+package trigger
+
+import (
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/scene"
+	"github.com/orktes/homeautomation/util"
+)
+
+// sceneModule returns the scene object of a runtime. apply(name, opts), restore(name, opts),
+// capture(name, patterns, opts) and delete(name, opts) send commands to the scenes. The transition
+// option overrides the transition of the scene and capture patterns are optional. With the wait
+// option the calls return the result of the command.
+func (trigger *TriggerSystem) sceneModule(r *runtime) goja.Value {
+	obj := r.NewObject()
+
+	command := func(action string) func(call goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			cmd := scene.Command{Action: action}
+
+			optsArg := call.Argument(1)
+			if action == scene.ActionCapture {
+				if patterns, ok := optsArg.Export().([]interface{}); ok {
+					for _, pattern := range patterns {
+						cmd.Patterns = append(cmd.Patterns, r.ToValue(pattern).String())
+					}
+					optsArg = call.Argument(2)
+				}
+			}
+
+			opts, _ := optsArg.Export().(map[string]interface{})
+			cmd.Transition = opts["transition"]
+
+			key := scene.Key(trigger.conf, call.Argument(0).String())
+			publish, await := trigger.request(r, util.FunctionCommand, key, cmd, opts)
+			if await == nil {
+				if err := publish(); err != nil {
+					panic(r.NewGoError(err))
+				}
+				return goja.Undefined()
+			}
+
+			res, err := await()
+			if err != nil {
+				panic(r.NewGoError(err))
+			}
+
+			return r.ToValue(res)
+		}
+	}
+
+	for _, action := range []string{scene.ActionApply, scene.ActionRestore, scene.ActionCapture, scene.ActionDelete} {
+		obj.Set(action, command(action))
+	}
+
+	return obj
+}
@@ -0,0 +1,350 @@
+package trigger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/util"
+)
+
+// scheduledTimer is a timeout, interval or schedule started by a script
+type scheduledTimer struct {
+	timer Timer
+	at    time.Time
+	// owner is the runtime which started the timer
+	owner *runtime
+}
+
+// SetClock replaces the clock used by timeouts, intervals and schedules. Used for testing.
+func (trigger *TriggerSystem) SetClock(clock Clock) {
+	trigger.timeoutMutex.Lock()
+	defer trigger.timeoutMutex.Unlock()
+
+	trigger.clock = clock
+}
+
+func (trigger *TriggerSystem) getClock() Clock {
+	trigger.timeoutMutex.Lock()
+	defer trigger.timeoutMutex.Unlock()
+
+	return trigger.clock
+}
+
+func (trigger *TriggerSystem) now() time.Time {
+	return trigger.getClock().Now()
+}
+
+// wait blocks for the duration d of the clock
+func (trigger *TriggerSystem) wait(d time.Duration) {
+	done := make(chan struct{})
+	trigger.getClock().AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// jsCallback returns a function calling fn in the runtime
+func jsCallback(r *runtime, fn goja.Callable, args []goja.Value) func() {
+	return func() {
+		r.Work(func(r *runtime) {
+			if _, err := fn(nil, args...); err != nil {
+				r.fail(err)
+			}
+		})
+	}
+}
+
+// startTimer calls fire at the times returned by next until next returns a zero time or the timer is cleared
+func (trigger *TriggerSystem) startTimer(fire func(), next func(now time.Time) time.Time) int {
+	trigger.timeoutMutex.Lock()
+	id := trigger.timeoutID
+	trigger.timeoutID++
+	trigger.timeouts[id] = &scheduledTimer{}
+	clock := trigger.clock
+	trigger.timeoutMutex.Unlock()
+
+	var arm func(now time.Time)
+	arm = func(now time.Time) {
+		at := next(now)
+
+		trigger.timeoutMutex.Lock()
+		defer trigger.timeoutMutex.Unlock()
+
+		st, ok := trigger.timeouts[id]
+		if !ok {
+			// Cleared while running
+			return
+		}
+		if at.IsZero() {
+			delete(trigger.timeouts, id)
+			return
+		}
+
+		st.at = at
+		st.timer = clock.AfterFunc(at.Sub(now), func() {
+			trigger.timeoutMutex.Lock()
+			_, ok := trigger.timeouts[id]
+			trigger.timeoutMutex.Unlock()
+			if !ok {
+				return
+			}
+
+			arm(clock.Now())
+			fire()
+		})
+	}
+
+	arm(clock.Now())
+
+	return id
+}
+
+// startRuntimeTimer starts a timer owned by a runtime. The timer is stopped with the runtime.
+func (trigger *TriggerSystem) startRuntimeTimer(r *runtime, fire func(), next func(now time.Time) time.Time) int {
+	id := trigger.startTimer(fire, next)
+
+	trigger.timeoutMutex.Lock()
+	if st, ok := trigger.timeouts[id]; ok {
+		st.owner = r
+	}
+	trigger.timeoutMutex.Unlock()
+
+	if r.isStopped() {
+		trigger.stopTimer(id)
+	}
+
+	return id
+}
+
+// stopRuntimeTimers stops all timers started by a runtime
+func (trigger *TriggerSystem) stopRuntimeTimers(r *runtime) {
+	trigger.timeoutMutex.Lock()
+	defer trigger.timeoutMutex.Unlock()
+
+	for id, st := range trigger.timeouts {
+		if st.owner != r {
+			continue
+		}
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		delete(trigger.timeouts, id)
+	}
+}
+
+func (trigger *TriggerSystem) stopTimer(id int) {
+	trigger.timeoutMutex.Lock()
+	defer trigger.timeoutMutex.Unlock()
+
+	if st, ok := trigger.timeouts[id]; ok && st.timer != nil {
+		st.timer.Stop()
+	}
+	delete(trigger.timeouts, id)
+}
+
+func (trigger *TriggerSystem) nextRun(id int) time.Time {
+	trigger.timeoutMutex.Lock()
+	defer trigger.timeoutMutex.Unlock()
+
+	if st, ok := trigger.timeouts[id]; ok {
+		return st.at
+	}
+	return time.Time{}
+}
+
+// handle returns the object returned by schedule and at
+func (trigger *TriggerSystem) handle(r *runtime, id int) goja.Value {
+	obj := r.NewObject()
+	obj.Set("id", id)
+	obj.Set("cancel", func(call goja.FunctionCall) goja.Value {
+		trigger.stopTimer(id)
+		return goja.Undefined()
+	})
+	obj.Set("next", func(call goja.FunctionCall) goja.Value {
+		at := trigger.nextRun(id)
+		if at.IsZero() {
+			return goja.Null()
+		}
+		return r.ToValue(at.UnixNano() / int64(time.Millisecond))
+	})
+	return obj
+}
+
+// timerLocation returns the location defined by the timezone option
+func timerLocation(opts goja.Value) (*time.Location, error) {
+	options, _ := opts.Export().(map[string]interface{})
+	zone, _ := options["timezone"].(string)
+	if zone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+func (trigger *TriggerSystem) setTimeout(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(0))
+		if !ok {
+			panic(r.NewTypeError("setTimeout requires a function"))
+		}
+
+		d := time.Duration(call.Argument(1).ToInteger()) * time.Millisecond
+		fired := false
+		id := trigger.startRuntimeTimer(r, jsCallback(r, fn, restArguments(call, 2)), func(now time.Time) time.Time {
+			if fired {
+				return time.Time{}
+			}
+			fired = true
+			return now.Add(d)
+		})
+
+		return r.ToValue(id)
+	}
+}
+
+func (trigger *TriggerSystem) setInterval(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(0))
+		if !ok {
+			panic(r.NewTypeError("setInterval requires a function"))
+		}
+
+		d := time.Duration(call.Argument(1).ToInteger()) * time.Millisecond
+		if d < time.Millisecond {
+			d = time.Millisecond
+		}
+
+		id := trigger.startRuntimeTimer(r, jsCallback(r, fn, restArguments(call, 2)), func(now time.Time) time.Time {
+			return now.Add(d)
+		})
+
+		return r.ToValue(id)
+	}
+}
+
+// delay returns a promise resolved after the given number of milliseconds
+func (trigger *TriggerSystem) delay(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		promise, resolve, _ := r.newPromise()
+
+		d := time.Duration(call.Argument(0).ToInteger()) * time.Millisecond
+		fired := false
+		trigger.startRuntimeTimer(r, func() {
+			r.Work(func(r *runtime) {
+				resolve(goja.Undefined())
+			})
+		}, func(now time.Time) time.Time {
+			if fired {
+				return time.Time{}
+			}
+			fired = true
+			return now.Add(d)
+		})
+
+		return promise
+	}
+}
+
+// clearTimer cancels a timeout, interval or schedule. Accepts both ids and handles.
+func (trigger *TriggerSystem) clearTimer(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		arg := call.Argument(0)
+		if obj, ok := arg.(*goja.Object); ok {
+			arg = obj.Get("id")
+		}
+		if arg == nil || goja.IsUndefined(arg) || goja.IsNull(arg) {
+			return goja.Undefined()
+		}
+
+		trigger.stopTimer(int(arg.ToInteger()))
+
+		return goja.Undefined()
+	}
+}
+
+// schedule runs a function at the times matching a cron expression
+func (trigger *TriggerSystem) schedule(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(r.NewTypeError("schedule requires a cron expression and a function"))
+		}
+
+		loc, err := timerLocation(call.Argument(2))
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		cron, err := util.ParseCron(call.Argument(0).String(), loc)
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		return trigger.handle(r, trigger.startRuntimeTimer(r, jsCallback(r, fn, nil), cron.Next))
+	}
+}
+
+// at runs a function every day at the given time of day (15:04 or 15:04:05) or once at a date
+// and time (2006-01-02 15:04 or RFC3339)
+func (trigger *TriggerSystem) at(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(r.NewTypeError("at requires a time and a function"))
+		}
+
+		loc, err := timerLocation(call.Argument(2))
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		next, err := parseAt(strings.TrimSpace(call.Argument(0).String()), loc)
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		return trigger.handle(r, trigger.startRuntimeTimer(r, jsCallback(r, fn, nil), next))
+	}
+}
+
+// parseAt returns the next function for a time of day or a date and time
+func parseAt(str string, loc *time.Location) (func(now time.Time) time.Time, error) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		t, err := time.ParseInLocation(layout, str, loc)
+		if err != nil {
+			continue
+		}
+
+		return func(now time.Time) time.Time {
+			now = now.In(loc)
+			for days := 0; ; days++ {
+				next := time.Date(now.Year(), now.Month(), now.Day()+days, t.Hour(), t.Minute(), t.Second(), 0, loc)
+				if next.After(now) {
+					return next
+				}
+			}
+		}, nil
+	}
+
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		t, err := time.ParseInLocation(layout, str, loc)
+		if err != nil {
+			continue
+		}
+
+		return func(now time.Time) time.Time {
+			if !t.After(now) {
+				return time.Time{}
+			}
+			return t
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid time %s", str)
+}
+
+func restArguments(call goja.FunctionCall, from int) []goja.Value {
+	if len(call.Arguments) <= from {
+		return nil
+	}
+	return call.Arguments[from:]
+}
@@ -0,0 +1,121 @@
+package trigger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/store"
+)
+
+var errStoreNotConfigured = errors.New("store has not been configured")
+
+// kvStore returns the persistent store opening it on first use
+func (trigger *TriggerSystem) kvStore() (*store.Store, error) {
+	trigger.storeMutex.Lock()
+	defer trigger.storeMutex.Unlock()
+
+	if trigger.conf.Store == nil || trigger.conf.Store.DatabaseFile == "" {
+		return nil, errStoreNotConfigured
+	}
+
+	if trigger.store == nil {
+		s, err := store.Open(trigger.conf.Store.DatabaseFile)
+		if err != nil {
+			return nil, err
+		}
+		trigger.store = s
+	}
+
+	return trigger.store, nil
+}
+
+func (trigger *TriggerSystem) closeStore() error {
+	trigger.flushWatchStates()
+
+	trigger.storeMutex.Lock()
+	defer trigger.storeMutex.Unlock()
+
+	if trigger.store == nil {
+		return nil
+	}
+	err := trigger.store.Close()
+	trigger.store = nil
+	return err
+}
+
+// jsStore returns the store object of a runtime. Keys are stored in a bucket of the trigger and
+// namespace(name) returns a store shared by all triggers using the same name.
+func (trigger *TriggerSystem) jsStore(r *runtime) goja.Value {
+	obj := trigger.storeObject(r, "trigger/"+r.name)
+
+	obj.Set("namespace", func(call goja.FunctionCall) goja.Value {
+		return trigger.storeObject(r, "namespace/"+call.Argument(0).String())
+	})
+
+	return obj
+}
+
+func (trigger *TriggerSystem) storeObject(r *runtime, bucket string) *goja.Object {
+	obj := r.NewObject()
+
+	open := func() *store.Store {
+		s, err := trigger.kvStore()
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		return s
+	}
+
+	// get returns the value of a key or the default (undefined) if the key doesn't exist or has expired
+	obj.Set("get", func(call goja.FunctionCall) goja.Value {
+		val, ok, err := open().Get(bucket, call.Argument(0).String(), trigger.now())
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		if !ok {
+			return call.Argument(1)
+		}
+		return r.ToValue(val)
+	})
+
+	// set stores a value. The ttl option expires the value after milliseconds or a duration string (10m).
+	obj.Set("set", func(call goja.FunctionCall) goja.Value {
+		var ttl time.Duration
+		if opts, ok := call.Argument(2).Export().(map[string]interface{}); ok {
+			d, err := durationOption(opts["ttl"])
+			if err != nil {
+				panic(r.NewGoError(err))
+			}
+			ttl = d
+		}
+
+		if err := open().Set(bucket, call.Argument(0).String(), call.Argument(1).Export(), ttl, trigger.now()); err != nil {
+			panic(r.NewGoError(err))
+		}
+		return goja.Undefined()
+	})
+
+	obj.Set("delete", func(call goja.FunctionCall) goja.Value {
+		if err := open().Delete(bucket, call.Argument(0).String()); err != nil {
+			panic(r.NewGoError(err))
+		}
+		return goja.Undefined()
+	})
+
+	// list returns an object of the keys starting with the prefix
+	obj.Set("list", func(call goja.FunctionCall) goja.Value {
+		prefix := ""
+		if arg := call.Argument(0); !goja.IsUndefined(arg) {
+			prefix = arg.String()
+		}
+
+		res, err := open().List(bucket, prefix, trigger.now())
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+		return r.ToValue(res)
+	})
+
+	return obj
+}
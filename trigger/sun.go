@@ -0,0 +1,92 @@
+package trigger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
+)
+
+var errNoLocation = errors.New("location has not been configured")
+
+func (trigger *TriggerSystem) location(r *runtime) *config.Location {
+	if trigger.conf.Location == nil {
+		panic(r.NewGoError(errNoLocation))
+	}
+	return trigger.conf.Location
+}
+
+// onSun runs a function every day at a solar event shifted by an optional offset (e.g. "-30m")
+func (trigger *TriggerSystem) onSun(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		event := call.Argument(0).String()
+		offsetArg, fnArg := call.Argument(1), call.Argument(2)
+		if _, ok := goja.AssertFunction(offsetArg); ok {
+			offsetArg, fnArg = goja.Undefined(), offsetArg
+		}
+
+		fn, ok := goja.AssertFunction(fnArg)
+		if !ok {
+			panic(r.NewTypeError("onSun requires an event and a function"))
+		}
+
+		var offset time.Duration
+		if !goja.IsUndefined(offsetArg) {
+			var err error
+			if offset, err = util.ParseDuration(offsetArg.String()); err != nil {
+				panic(r.NewGoError(err))
+			}
+		}
+
+		loc := trigger.location(r)
+		if _, err := (util.SunTimes{}).Event(event); err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		id := trigger.startRuntimeTimer(r, jsCallback(r, fn, nil), func(now time.Time) time.Time {
+			at, _ := util.NextSunEvent(now, event, offset, loc.Latitude, loc.Longitude)
+			return at
+		})
+
+		return trigger.handle(r, id)
+	}
+}
+
+// sun returns the sun helper object with position and times functions
+func (trigger *TriggerSystem) sun(r *runtime) *goja.Object {
+	obj := r.NewObject()
+
+	obj.Set("position", func(call goja.FunctionCall) goja.Value {
+		loc := trigger.location(r)
+		elevation, azimuth := util.SunPosition(trigger.now(), loc.Latitude, loc.Longitude)
+		return r.ToValue(map[string]interface{}{
+			"elevation": elevation,
+			"azimuth":   azimuth,
+			"up":        elevation > util.SunriseAltitude,
+		})
+	})
+
+	obj.Set("times", func(call goja.FunctionCall) goja.Value {
+		loc := trigger.location(r)
+		day := trigger.now()
+		if ms := call.Argument(0); !goja.IsUndefined(ms) {
+			day = time.Unix(0, ms.ToInteger()*int64(time.Millisecond))
+		}
+
+		times := util.CalculateSunTimes(day, loc.Latitude, loc.Longitude)
+		res := map[string]interface{}{}
+		for _, event := range util.SunEvents {
+			at, _ := times.Event(event)
+			if at.IsZero() {
+				res[event] = nil
+				continue
+			}
+			res[event] = at.UnixNano() / int64(time.Millisecond)
+		}
+		return r.ToValue(res)
+	})
+
+	return obj
+}
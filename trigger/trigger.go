@@ -2,128 +2,182 @@ package trigger
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	"github.com/orktes/goja"
+	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/history"
+	"github.com/orktes/homeautomation/queue"
+	"github.com/orktes/homeautomation/store"
 	"github.com/orktes/homeautomation/util"
 )
 
+var (
+	historyTimeout = 10 * time.Second
+	getTimeout     = 10 * time.Second
+)
+
 type TriggerSystem struct {
-	conf config.Config
-	c    mqtt.Client
+	conf   config.Config
+	c      mqtt.Client
+	topics util.TopicLayout
 	sync.Mutex
 
-	subscriptionID int
-	subscriptions  map[string]map[int]mqtt.MessageHandler
-	data           map[string]interface{}
+	subscriptions *util.Subscriptions
+	data          map[string]interface{}
 
 	timeoutMutex sync.Mutex
 	timeoutID    int
-	timeouts     map[int]*time.Timer
-
-	runtimes []*runtime
+	timeouts     map[int]*scheduledTimer
+	clock        Clock
+
+	instanceMutex sync.Mutex
+	instances     map[string]*instance
+
+	automationMutex sync.Mutex
+	automations     []*automation
+	// automationRuns is the number of automation runs not waiting for the clock
+	automationRuns int
+
+	queueMutex sync.Mutex
+	queue      *queue.Queue
+
+	storeMutex sync.Mutex
+	store      *store.Store
+
+	// watch states waiting to be written to the store
+	watchMutex   sync.Mutex
+	watchWrite   sync.Mutex
+	watchStates  map[watchKey]pendingState
+	watchVersion uint64
+	watchWake    chan struct{}
+
+	httpMutex sync.Mutex
+	client    *http.Client
+	// requests are the times of the recent http requests of each runtime
+	requests map[string][]time.Time
 }
 
 func New(conf config.Config) *TriggerSystem {
 
 	ts := &TriggerSystem{
 		conf:          conf,
-		subscriptions: map[string]map[int]mqtt.MessageHandler{},
+		topics:        util.MustTopicLayout(conf.Topics),
+		subscriptions: util.NewSubscriptions(),
 		data:          map[string]interface{}{},
-		timeouts:      map[int]*time.Timer{},
+		timeouts:      map[int]*scheduledTimer{},
+		clock:         realClock{},
+		instances:     map[string]*instance{},
+		requests:      map[string][]time.Time{},
+		watchStates:   map[watchKey]pendingState{},
+		watchWake:     make(chan struct{}, 1),
 	}
+	go ts.writeWatchStates()
 
 	return ts
 }
 
-func (trigger *TriggerSystem) initTriggers() {
-	for _, triggerConf := range trigger.conf.Triggers {
-		trigger.runtimes = append(trigger.runtimes, trigger.getRuntime(triggerConf))
+// handler calls the handlers of a message in message order. Handlers must not block as they are
+// called from the message router of the client.
+func (trigger *TriggerSystem) handler(client mqtt.Client, msg mqtt.Message) {
+	for _, sub := range trigger.receive(msg) {
+		sub(client, msg)
 	}
 }
 
-func (trigger *TriggerSystem) handler(client mqtt.Client, msg mqtt.Message) {
+// receive stores the value of a status message and returns the handlers subscribed to its topic
+func (trigger *TriggerSystem) receive(msg mqtt.Message) []mqtt.MessageHandler {
 	trigger.Lock()
 	defer trigger.Unlock()
 
 	topic := msg.Topic()
-	topicParts := strings.Split(topic, "/")
-	if len(topicParts) >= 2 && topicParts[1] == "status" {
-		valKey := strings.Join(append([]string{topicParts[0]}, topicParts[2:]...), "/")
-		var val interface{}
-		json.Unmarshal(msg.Payload(), &val)
+	if valKey, ok := trigger.topics.ParseFunction(util.FunctionStatus, topic); ok {
+		val, _ := util.DecodeStatus(msg.Payload())
 		trigger.data[valKey] = val
 	}
 
-	for subTopic, subs := range trigger.subscriptions {
-		if subTopic != topic {
-			if strings.HasSuffix(subTopic, "#") {
-				if !strings.HasPrefix(topic, subTopic[:len(subTopic)-1]) {
-					continue
-				}
-			} else {
-				continue
-			}
-		}
-		for _, sub := range subs {
-			go sub(client, msg)
-		}
-	}
+	return trigger.subscriptions.Match(topic)
 }
 
 func (trigger *TriggerSystem) subscribe(topic string, handler mqtt.MessageHandler) int {
 	trigger.Lock()
 	defer trigger.Unlock()
 
-	id := trigger.subscriptionID
-	trigger.subscriptionID++
-
-	if len(trigger.subscriptions[topic]) == 0 {
+	id, first := trigger.subscriptions.Add(topic, handler)
+	if first {
 		// TODO figure out qos
 		trigger.c.Subscribe(topic, 1, nil)
-		trigger.subscriptions[topic] = map[int]mqtt.MessageHandler{}
 	}
 
-	trigger.subscriptions[topic][id] = handler
-
 	return id
 }
 
+// unsubscribe removes a handler and unsubscribes the topic after the last one. The lock isn't held
+// while waiting for the broker as the message router may be waiting for it.
 func (trigger *TriggerSystem) unsubscribe(topic string, id int) {
 	trigger.Lock()
-	defer trigger.Unlock()
+	last := trigger.subscriptions.Remove(topic, id)
+	trigger.Unlock()
 
-	if subs, ok := trigger.subscriptions[topic]; ok {
-		delete(subs, id)
-		if len(subs) == 0 {
-			// TODO figure out a proper way to unsubscribe
-		}
+	if !last {
+		return
+	}
+
+	if token := trigger.c.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		fmt.Printf("Error unsubscribing from %s %s\n", topic, token.Error().Error())
+	}
+
+	// Subscribe again if a handler was added while unsubscribing
+	trigger.Lock()
+	defer trigger.Unlock()
+	if trigger.subscriptions.Has(topic) {
+		trigger.c.Subscribe(topic, 1, nil)
 	}
 }
 
-func (trigger *TriggerSystem) getRuntime(triggerConf config.Trigger) *runtime {
-	runtime := newRuntime()
+// newScriptRuntime returns a runtime with the trigger functions
+func (trigger *TriggerSystem) newScriptRuntime(name string) *runtime {
+	runtime := newRuntime(name)
 
 	runtime.Set("get", trigger.get(runtime))
+	runtime.Set("getAsync", trigger.getAsync(runtime))
 	runtime.Set("set", trigger.set(runtime))
+	runtime.Set("setAsync", trigger.setAsync(runtime))
 	runtime.Set("subscribe", trigger.jsSubscribe(runtime))
 	runtime.Set("unsubscribe", trigger.jsUnsubscribe(runtime))
+	runtime.Set("listen", trigger.jsListen(runtime))
+	runtime.Set("onChange", trigger.onChange(runtime))
+	runtime.Set("onThreshold", trigger.onThreshold(runtime))
 	runtime.Set("publish", trigger.publish(runtime))
 	runtime.Set("topic", trigger.topic(runtime))
 	runtime.Set("sleep", trigger.sleep(runtime))
+	runtime.Set("delay", trigger.delay(runtime))
 	runtime.Set("print", trigger.print(runtime))
 	runtime.Set("setTimeout", trigger.setTimeout(runtime))
-	runtime.Set("clearTimeout", trigger.clearTimeout(runtime))
+	runtime.Set("clearTimeout", trigger.clearTimer(runtime))
+	runtime.Set("setInterval", trigger.setInterval(runtime))
+	runtime.Set("clearInterval", trigger.clearTimer(runtime))
+	runtime.Set("schedule", trigger.schedule(runtime))
+	runtime.Set("at", trigger.at(runtime))
+	runtime.Set("onSun", trigger.onSun(runtime))
+	runtime.Set("sun", trigger.sun(runtime))
+	runtime.Set("history", trigger.history(runtime))
+	runtime.Set("store", trigger.jsStore(runtime))
+	runtime.Set("http", trigger.httpModule(runtime))
+	runtime.Set("scene", trigger.sceneModule(runtime))
+	runtime.Set("require", trigger.require(runtime, trigger.conf.ScriptsDir))
 
 	_, err := runtime.RunString(`
-		function listen(key, cb) {
-			return subscribe(topic(key, "status"), cb);
-		}
 		function unlisten(key, id) {
 			return unsubscribe(topic(key, "status"), id);
 		}
@@ -132,133 +186,348 @@ func (trigger *TriggerSystem) getRuntime(triggerConf config.Trigger) *runtime {
 		panic(err)
 	}
 
-	_, err = runtime.RunScript("trigger.Script", triggerConf.Script)
-	if err != nil {
-		// TODO proper error prosessing
-		panic(err)
+	return runtime
+}
+
+// runTrigger runs the script of a trigger in a runtime
+func (trigger *TriggerSystem) runTrigger(r *runtime, triggerConf config.Trigger) error {
+	script, filename := triggerConf.Script, "trigger."+r.name
+	if triggerConf.File != "" {
+		filename = trigger.scriptPath(triggerConf.File)
+
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		script = string(b)
+		r.Set("require", trigger.require(r, filepath.Dir(filename)))
 	}
 
-	// fmt.Printf("Eval trigger \n%s\n", triggerConf.Script)
+	return r.Run(func(r *runtime) error {
+		_, err := r.RunScript(filename, script)
+		return err
+	})
+}
+
+// getOptions returns the timeout and the default value (nil if not given) of get options
+func getOptions(opts goja.Value) (time.Duration, goja.Value) {
+	timeout := getTimeout
+	obj, ok := opts.(*goja.Object)
+	if !ok {
+		return timeout, nil
+	}
 
-	return runtime
+	if t := obj.Get("timeout"); t != nil && !goja.IsUndefined(t) {
+		timeout = time.Duration(t.ToInteger()) * time.Millisecond
+	}
+
+	def := obj.Get("default")
+	if def != nil && goja.IsUndefined(def) {
+		def = nil
+	}
+
+	return timeout, def
 }
 
-func (trigger *TriggerSystem) setTimeout(r *runtime) func(call goja.FunctionCall) goja.Value {
+// durationOption returns the duration of an option given as a duration string (10m) or milliseconds
+func durationOption(val interface{}) (time.Duration, error) {
+	switch v := val.(type) {
+	case string:
+		return util.ParseDuration(v)
+	case nil:
+		return 0, nil
+	default:
+		ms, _ := util.ToFloat(v)
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+}
 
+// get returns the value of a key. Throws if the value is not received within the timeout
+// unless a default value is given.
+func (trigger *TriggerSystem) get(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		trigger.timeoutMutex.Lock()
-		defer trigger.timeoutMutex.Unlock()
-
-		id := trigger.timeoutID
-		trigger.timeoutID++
-
-		if fn, ok := goja.AssertFunction(call.Argument(0)); ok {
-			timeInMS := call.Argument(1).ToInteger()
-			timeout := time.AfterFunc(time.Duration(timeInMS)*time.Millisecond, func() {
-				trigger.timeoutMutex.Lock()
-				delete(trigger.timeouts, id)
-				trigger.timeoutMutex.Unlock()
-
-				defer func() {
-					err := recover()
-					if err != nil {
-						fmt.Printf("Error: %s\n", err)
-					}
-				}()
-				fn(nil)
-			})
+		timeout, def := getOptions(call.Argument(1))
 
-			trigger.timeouts[id] = timeout
+		val, err := trigger.valueTimeout(call.Argument(0).String(), timeout)
+		if err != nil {
+			if def != nil {
+				return def
+			}
+			panic(r.NewGoError(err))
 		}
 
-		return r.ToValue(id)
+		return r.ToValue(val)
 	}
-}
 
-func (trigger *TriggerSystem) clearTimeout(r *runtime) func(call goja.FunctionCall) goja.Value {
+}
 
+// getAsync returns a promise resolved with the value of a key
+func (trigger *TriggerSystem) getAsync(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		trigger.timeoutMutex.Lock()
-		defer trigger.timeoutMutex.Unlock()
+		key := call.Argument(0).String()
+		timeout, def := getOptions(call.Argument(1))
+
+		promise, resolve, reject := r.newPromise()
+
+		r.goAsync(func() {
+			val, err := trigger.valueTimeout(key, timeout)
+			r.Work(func(r *runtime) {
+				switch {
+				case err == nil:
+					resolve(val)
+				case def != nil:
+					resolve(def)
+				default:
+					reject(r.NewGoError(err))
+				}
+			})
+		})
 
-		id := call.Argument(0).ToInteger()
+		return promise
+	}
+}
+
+// value returns the latest status of a key using the default timeout
+func (trigger *TriggerSystem) value(key string) (interface{}, error) {
+	return trigger.valueTimeout(key, getTimeout)
+}
 
-		timer, ok := trigger.timeouts[int(id)]
-		if ok {
-			timer.Stop()
+// valueTimeout returns the latest status of a key. Unknown keys are requested with a get.
+func (trigger *TriggerSystem) valueTimeout(key string, timeout time.Duration) (interface{}, error) {
+	trigger.Lock()
+	val, ok := trigger.data[key]
+	trigger.Unlock()
+
+	if ok {
+		return val, nil
+	}
+
+	ch := make(chan struct{}, 1)
+
+	statusTopic := trigger.topics.Build(util.FunctionStatus, key)
+	id := trigger.subscribe(statusTopic, func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case ch <- struct{}{}:
+		default:
 		}
-		delete(trigger.timeouts, int(id))
+	})
+	defer trigger.unsubscribe(statusTopic, id)
 
-		return goja.Undefined()
+	// TODO figure out right qos and retain
+	trigger.c.Publish(trigger.topics.Build(util.FunctionGet, key), 0, false, []byte{})
+
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no value received for %s in %s", key, timeout)
 	}
+
+	trigger.Lock()
+	defer trigger.Unlock()
+
+	return trigger.data[key], nil
 }
 
-func (trigger *TriggerSystem) get(r *runtime) func(call goja.FunctionCall) goja.Value {
+func (trigger *TriggerSystem) history(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		key := call.Argument(0).String()
+		if trigger.conf.History == nil {
+			panic(r.NewGoError(errors.New("history has not been configured")))
+		}
 
-	getVal:
-		trigger.Lock()
-		val, ok := trigger.data[key]
-		trigger.Unlock()
+		topic := trigger.conf.History.Topic
+		if topic == "" {
+			topic = history.DefaultTopic
+		}
 
-		if !ok {
-			ch := make(chan struct{})
+		key := call.Argument(0).String()
+		q := history.Query{
+			Path:          key,
+			ResponseTopic: topic + "/result/" + uuid.New().String(),
+		}
 
-			statusTopic := util.ConvertValueToTopic(key, "status")
-			id := trigger.subscribe(statusTopic, func(client mqtt.Client, msg mqtt.Message) {
-				ch <- struct{}{}
-			})
+		if opts, ok := call.Argument(1).Export().(map[string]interface{}); ok {
+			q.From, _ = opts["from"].(string)
+			q.To, _ = opts["to"].(string)
+			q.Aggregate, _ = opts["aggregate"].(string)
+		}
 
-			// TODO figure out right qos and retain
-			trigger.c.Publish(util.ConvertValueToTopic(key, "get"), 0, false, []byte{})
+		b, err := json.Marshal(q)
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
 
-			<-ch // TODO timeout etc
+		ch := make(chan []byte, 1)
+		id := trigger.subscribe(q.ResponseTopic, func(client mqtt.Client, msg mqtt.Message) {
+			select {
+			case ch <- msg.Payload():
+			default:
+			}
+		})
+		defer trigger.unsubscribe(q.ResponseTopic, id)
 
-			trigger.unsubscribe(statusTopic, id)
+		if token := trigger.c.Publish(topic+"/get/"+key, 1, false, b); token.Wait() && token.Error() != nil {
+			panic(r.NewGoError(token.Error()))
+		}
 
-			goto getVal
+		select {
+		case payload := <-ch:
+			res := map[string]interface{}{}
+			if err := json.Unmarshal(payload, &res); err != nil {
+				panic(r.NewGoError(err))
+			}
+			if errStr, _ := res["error"].(string); errStr != "" {
+				panic(r.NewGoError(errors.New(errStr)))
+			}
+			return r.ToValue(res)
+		case <-time.After(historyTimeout):
+			panic(r.NewGoError(fmt.Errorf("history query for %s timed out", key)))
 		}
+	}
+}
 
-		return r.ToValue(val)
+// setRequest returns the set request of a set call and a function awaiting its result when the wait option is set
+func (trigger *TriggerSystem) setRequest(r *runtime, call goja.FunctionCall) (publish func() error, await func() (interface{}, error)) {
+	return trigger.request(r, util.FunctionSet, call.Argument(0).String(), call.Argument(1).Export(), call.Argument(2).Export())
+}
+
+// request returns a set or command request and a function awaiting its result when the wait option is set
+func (trigger *TriggerSystem) request(r *runtime, function string, key string, val interface{}, opts interface{}) (publish func() error, await func() (interface{}, error)) {
+	req := util.SetRequest{
+		Value:  val,
+		Source: &adapter.Source{Type: adapter.SourceTrigger, ID: r.name, Client: trigger.conf.ClientID},
+	}
+
+	publish = func() error {
+		return trigger.publishRequest(function, key, req)
 	}
 
+	wait, timeout := util.ResultOptions(opts)
+	if !wait {
+		return publish, nil
+	}
+
+	correlation := uuid.New().String()
+	req.Correlation = correlation
+
+	return publish, func() (interface{}, error) {
+		res, err := util.AwaitResult(trigger.topics.Build(util.FunctionResult, key), correlation, timeout, trigger.subscribe, trigger.unsubscribe, publish)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"status":      res.Status,
+			"path":        res.Path,
+			"correlation": res.Correlation,
+		}, nil
+	}
 }
 
 func (trigger *TriggerSystem) set(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		key := call.Argument(0).String()
-		val := call.Argument(1).Export()
+		publish, await := trigger.setRequest(r, call)
+		if await == nil {
+			if err := publish(); err != nil {
+				panic(r.NewGoError(err))
+			}
+			return goja.Undefined()
+		}
 
-		topic := util.ConvertValueToTopic(key, "set")
+		res, err := await()
+		if err != nil {
+			panic(r.NewGoError(err))
+		}
+
+		return r.ToValue(res)
+	}
 
-		if b, err := json.Marshal(val); err == nil {
-			if token := trigger.c.Publish(topic, 1, false, b); token.Wait() && token.Error() != nil {
-				panic(token.Error())
+}
+
+// setAsync returns a promise resolved when the set has been published or, with the wait option, when its result is received
+func (trigger *TriggerSystem) setAsync(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		promise, resolve, reject := r.newPromise()
+
+		publish, await := trigger.setRequest(r, call)
+		if await == nil {
+			if err := publish(); err != nil {
+				reject(r.NewGoError(err))
+			} else {
+				resolve(goja.Undefined())
 			}
+			return promise
 		}
 
-		return goja.Undefined()
+		r.goAsync(func() {
+			res, err := await()
+			r.Work(func(r *runtime) {
+				if err != nil {
+					reject(r.NewGoError(err))
+					return
+				}
+				resolve(res)
+			})
+		})
+
+		return promise
 	}
+}
+
+// publishRequest publishes a set or command request through the outbound queue
+func (trigger *TriggerSystem) publishRequest(function string, key string, req util.SetRequest) error {
+	b, err := util.EncodeRequest(req, trigger.conf.SetSource)
+	if err != nil {
+		return err
+	}
+	trigger.outbound().Publish(queue.Message{Topic: trigger.topics.Build(function, key), QoS: 1, Payload: b})
+	return nil
+}
+
+// jsSubscribeHandler returns a handler calling fn with the topic and payload of a message.
+// Status values are decoded and passed as the third argument when decode is set.
+func (trigger *TriggerSystem) jsSubscribeHandler(r *runtime, fn goja.Callable, decode bool) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		r.Work(func(r *runtime) {
+			args := []goja.Value{r.ToValue(msg.Topic()), r.ToValue(string(msg.Payload()))}
+			if decode {
+				val, _ := util.DecodeStatus(msg.Payload())
+				args = append(args, r.ToValue(val))
+			}
+
+			if _, err := fn(nil, args...); err != nil {
+				r.fail(err)
+			}
+		})
+	}
+}
 
+// subscribeRuntime subscribes to a topic on behalf of a runtime. The subscription is removed with the runtime.
+func (trigger *TriggerSystem) subscribeRuntime(r *runtime, topic string, handler mqtt.MessageHandler) int {
+	id := trigger.subscribe(topic, handler)
+	if !r.addSubscription(topic, id) {
+		trigger.unsubscribe(topic, id)
+	}
+	return id
 }
+
 func (trigger *TriggerSystem) jsSubscribe(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
 		topic := call.Argument(0).String()
 		if fn, ok := goja.AssertFunction(call.Argument(1)); ok {
-			id := trigger.subscribe(topic, func(client mqtt.Client, msg mqtt.Message) {
-				go r.Work(func(r *runtime) {
-					defer func() {
-						err := recover()
-						if err != nil {
-							fmt.Printf("Error: %s\n", err)
-						}
-					}()
-
-					fn(nil, r.ToValue(msg.Topic()), r.ToValue(string(msg.Payload())))
-				})
-			})
+			id := trigger.subscribeRuntime(r, topic, trigger.jsSubscribeHandler(r, fn, false))
+			return r.ToValue(id)
+		}
 
+		panic("Invalid arguments passed to subscribe")
+	}
+
+}
+
+func (trigger *TriggerSystem) jsListen(r *runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		topic := trigger.topics.Build(util.FunctionStatus, call.Argument(0).String())
+		if fn, ok := goja.AssertFunction(call.Argument(1)); ok {
+			id := trigger.subscribeRuntime(r, topic, trigger.jsSubscribeHandler(r, fn, true))
 			return r.ToValue(id)
 		}
 
@@ -270,8 +539,9 @@ func (trigger *TriggerSystem) jsSubscribe(r *runtime) func(call goja.FunctionCal
 func (trigger *TriggerSystem) jsUnsubscribe(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
 		topic := call.Argument(0).String()
-		id := call.Argument(0).ToInteger()
-		trigger.unsubscribe(topic, int(id))
+		id := int(call.Argument(1).ToInteger())
+		trigger.unsubscribe(topic, id)
+		r.removeSubscription(id)
 
 		return goja.Undefined()
 	}
@@ -293,10 +563,12 @@ func (trigger *TriggerSystem) publish(r *runtime) func(call goja.FunctionCall) g
 
 func (trigger *TriggerSystem) topic(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		return r.ToValue(util.ConvertValueToTopic(call.Argument(0).String(), call.Argument(1).String()))
+		return r.ToValue(trigger.topics.Build(call.Argument(1).String(), call.Argument(0).String()))
 	}
 
 }
+
+// sleep blocks the event loop of the runtime. Use delay instead.
 func (trigger *TriggerSystem) sleep(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
 		timeInMS := call.Argument(0).ToInteger()
@@ -308,15 +580,13 @@ func (trigger *TriggerSystem) sleep(r *runtime) func(call goja.FunctionCall) goj
 
 func (trigger *TriggerSystem) print(r *runtime) func(call goja.FunctionCall) goja.Value {
 	return func(call goja.FunctionCall) goja.Value {
-		// TODO proper indicator on which of the riggers this is
-
 		strs := make([]string, len(call.Arguments))
 
 		for i, arg := range call.Arguments {
 			strs[i] = arg.String()
 		}
 
-		fmt.Printf("[TRIGGER]: %s\n", strings.Join(strs, " "))
+		fmt.Printf("[TRIGGER %s]: %s\n", r.name, strings.Join(strs, " "))
 
 		return goja.Undefined()
 	}
@@ -341,6 +611,15 @@ func (trigger *TriggerSystem) Connect() error {
 	}
 
 	opts = opts.SetDefaultPublishHandler(trigger.handler)
+	opts = opts.SetOnConnectHandler(func(c mqtt.Client) {
+		trigger.queueMutex.Lock()
+		q := trigger.queue
+		trigger.queueMutex.Unlock()
+
+		if q != nil {
+			q.Flush()
+		}
+	})
 	c := mqtt.NewClient(opts)
 
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
@@ -350,11 +629,27 @@ func (trigger *TriggerSystem) Connect() error {
 	trigger.c = c
 
 	trigger.initTriggers()
+	trigger.initAutomations()
 
 	return nil
 }
 
 func (trigger *TriggerSystem) Disconnect(wait uint) error {
 	trigger.c.Disconnect(wait)
-	return nil
+	if err := trigger.closeStore(); err != nil {
+		fmt.Printf("Error closing trigger store %s\n", err.Error())
+	}
+	return trigger.outbound().Close()
+}
+
+// outbound returns the queue used for set messages
+func (trigger *TriggerSystem) outbound() *queue.Queue {
+	trigger.queueMutex.Lock()
+	defer trigger.queueMutex.Unlock()
+
+	if trigger.queue == nil {
+		trigger.queue = queue.New(trigger.c, "trigger", trigger.conf.Queue)
+	}
+
+	return trigger.queue
 }
@@ -1,14 +1,29 @@
 package trigger
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
 	"github.com/orktes/homeautomation/config"
+	"github.com/orktes/homeautomation/util"
 )
 
 func TestTriggerListenAndGet(t *testing.T) {
 	ts := New(config.Config{
+		SetSource: true,
 		Triggers: []config.Trigger{
 			config.Trigger{
 				Script: `listen("haaga/foo/bar", function () {
@@ -31,7 +46,7 @@ func TestTriggerListenAndGet(t *testing.T) {
 		topic   string
 		payload []byte
 	})
-	ts.c = &mockClient{subs, pubs}
+	ts.c = &mockClient{subs, pubs, nil}
 
 	go ts.initTriggers()
 
@@ -65,7 +80,1190 @@ func TestTriggerListenAndGet(t *testing.T) {
 		t.Error("Wrong topic publish", p.topic)
 	}
 
-	if string(p.payload) != `"bizgoz"` {
+	val, source := util.DecodeSetRequest(p.payload)
+	if val != "bizgoz" {
 		t.Error("Wrong payload received", string(p.payload))
 	}
+
+	if source == nil || source.Type != adapter.SourceTrigger || source.ID != triggerNames(ts.conf.Triggers)[0] {
+		t.Error("Wrong source received", string(p.payload))
+	}
+}
+
+func TestTriggerNames(t *testing.T) {
+	a := config.Trigger{Script: "print(1)"}
+	b := config.Trigger{File: "b.js"}
+	named := config.Trigger{Name: "named", Script: "print(1)"}
+
+	names := triggerNames([]config.Trigger{a, named, b, a})
+	if names[1] != "named" || names[0] == names[2] || names[3] != names[0]+"-2" {
+		t.Error("Wrong names", names)
+	}
+
+	// Reordering doesn't rename triggers
+	if reordered := triggerNames([]config.Trigger{b, a}); reordered[0] != names[2] || reordered[1] != names[0] {
+		t.Error("Names should not depend on the order", reordered, names)
+	}
+}
+
+func TestTriggerSetWait(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `listen("haaga/foo/bar", function (topic, payload, value) {
+					try {
+						var res = set("haaga/foo/diz", value, {wait: true, timeout: 1000});
+						publish("haaga/out", 0, false, res.status);
+					} catch (e) {
+						publish("haaga/out", 0, false, "error");
+					}
+				})`,
+			},
+		},
+	})
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	})
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	ts.c = &mockClient{subs, pubs, nil}
+
+	go ts.initTriggers()
+	<-subs
+
+	for _, status := range []string{util.ResultOK, util.ResultError} {
+		go ts.handler(nil, &mockMessage{
+			topic:   "haaga/status/foo/bar",
+			payload: []byte(`1`),
+		})
+
+		s := <-subs
+		if s.topic != "haaga/result/foo/diz" {
+			t.Error("Wrong topic subscription", s.topic)
+		}
+
+		p := <-pubs
+		req := util.DecodeRequest(p.payload)
+		if p.topic != "haaga/set/foo/diz" || req.Value != float64(1) || req.Correlation == nil {
+			t.Error("Wrong set request", p.topic, string(p.payload))
+		}
+
+		res, _ := json.Marshal(util.Result{Function: util.FunctionSet, Path: "haaga/foo/diz", Status: status, Correlation: req.Correlation})
+		go ts.handler(nil, &mockMessage{topic: "haaga/result/foo/diz", payload: res})
+
+		p = <-pubs
+		expected := "ok"
+		if status == util.ResultError {
+			expected = "error"
+		}
+		if p.topic != "haaga/out" || string(p.payload) != expected {
+			t.Error("Wrong result handled", p.topic, string(p.payload))
+		}
+	}
+}
+
+func TestTriggerSetError(t *testing.T) {
+	conf := config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "set",
+				Script: `listen("haaga/foo/bar", function () {
+					try {
+						set("haaga/foo/diz", function () {});
+					} catch (e) {
+						publish("haaga/out", 0, false, "error");
+					}
+				})`,
+			},
+		},
+	}
+
+	fixture := Fixture{
+		Events: []FixtureEvent{FixtureEvent{Path: "haaga/foo/bar", Value: 1}},
+		Expect: []FixtureExpectation{FixtureExpectation{Topic: "haaga/out", Payload: func(s string) *string { return &s }("error")}},
+	}
+
+	messages, failures, err := RunFixture(conf, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) > 0 {
+		t.Error("Set error not caught", failures, messages)
+	}
+}
+
+func TestTriggerSchedule(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `
+					var count = 0;
+					var interval = setInterval(function () {
+						count++;
+						if (count === 2) {
+							clearInterval(interval);
+						}
+						publish("out", 0, false, "interval " + count);
+					}, 1000);
+
+					var porch = schedule("0 22 * * mon-fri", function () {
+						publish("out", 0, false, "porch");
+					}, {timezone: "UTC"});
+
+					var daily = at("22:30", function () {
+						porch.cancel();
+						daily.cancel();
+						publish("out", 0, false, "at " + (porch.next() === null));
+					}, {timezone: "UTC"});
+				`,
+			},
+		},
+	})
+
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	expect := func(d time.Duration, expected string) {
+		clock.Advance(d)
+
+		timeout := time.Second
+		if expected == "" {
+			timeout = 50 * time.Millisecond
+		}
+
+		select {
+		case p := <-pubs:
+			if string(p.payload) != expected {
+				t.Error("Wrong message", string(p.payload), "expected", expected)
+			}
+		case <-time.After(timeout):
+			if expected != "" {
+				t.Error("Timeout waiting for", expected)
+			}
+		}
+	}
+
+	expect(time.Second, "interval 1")
+	expect(time.Second, "interval 2")
+	expect(time.Second, "")
+	expect(time.Hour, "porch")
+	expect(30*time.Minute, "at true")
+	expect(7*24*time.Hour, "")
+}
+
+func TestTriggerOnSun(t *testing.T) {
+	conf := config.Config{
+		Location: &config.Location{Latitude: 60.17, Longitude: 24.94},
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `onSun("sunset", "-30m", function () {
+					publish("out", 0, false, "sunset " + sun.position().up);
+				});`,
+			},
+		},
+	}
+	ts := New(conf)
+
+	start := time.Date(2026, 6, 21, 12, 0, 0, 0, time.FixedZone("EEST", 3*60*60))
+	clock := NewTestClock(start)
+	ts.SetClock(clock)
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	sunset, _ := util.NextSunEvent(start, util.SunSunset, -30*time.Minute, 60.17, 24.94)
+	clock.Advance(sunset.Sub(start))
+
+	select {
+	case p := <-pubs:
+		if string(p.payload) != "sunset true" {
+			t.Error("Wrong message", string(p.payload))
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for sunset")
+	}
+}
+
+func TestTriggerAutomation(t *testing.T) {
+	conf, err := config.ParseConfig(strings.NewReader(`
+		set_source = true
+
+		automation "button" {
+			when "state" {
+				path = "haaga/foo/button"
+				equals = 4000
+			}
+			action "set" {
+				path = "haaga/foo/light"
+				value = {
+					on = false
+				}
+			}
+		}
+
+		automation "hot" {
+			when "state" {
+				path = "haaga/foo/temperature"
+				above = 25
+				for = "10m"
+			}
+			action "delay" { duration = "1m" }
+			action "publish" {
+				topic = "out"
+				payload = "hot"
+			}
+		}
+
+		automation "evening" {
+			when "at" {
+				time = "22:30"
+				timezone = "UTC"
+			}
+			condition "time" { after = "22:00" }
+			action "command" {
+				path = "haaga/foo/tv"
+				value = "off"
+			}
+		}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := New(conf)
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initAutomations()
+
+	expect := func(topic string) []byte {
+		select {
+		case p := <-pubs:
+			if p.topic != topic {
+				t.Error("Wrong topic", p.topic, "expected", topic)
+			}
+			return p.payload
+		case <-time.After(time.Second):
+			t.Error("Timeout waiting for", topic)
+		}
+		return nil
+	}
+	expectNone := func() {
+		select {
+		case p := <-pubs:
+			t.Error("Unexpected publish", p.topic, string(p.payload))
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/foo/button", payload: []byte(`1002`)})
+	expectNone()
+
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/foo/button", payload: []byte(`4000`)})
+	req := util.DecodeRequest(expect("haaga/set/foo/light"))
+	if !reflect.DeepEqual(req.Value, map[string]interface{}{"on": false}) {
+		t.Error("Wrong value", req.Value)
+	}
+	if req.Source == nil || req.Source.Type != adapter.SourceTrigger || req.Source.ID != "button" {
+		t.Error("Wrong source", req.Source)
+	}
+
+	// Crossing the threshold starts the timer which is cancelled when the value drops
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/temperature", payload: []byte(`20`)})
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/temperature", payload: []byte(`26`)})
+	time.Sleep(10 * time.Millisecond)
+	clock.Advance(5 * time.Minute)
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/temperature", payload: []byte(`24`)})
+	time.Sleep(10 * time.Millisecond)
+	clock.Advance(10 * time.Minute)
+	expectNone()
+
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/temperature", payload: []byte(`27`)})
+	time.Sleep(10 * time.Millisecond)
+	clock.Advance(10 * time.Minute)
+	expectNone()
+	clock.Advance(time.Minute)
+	if payload := expect("out"); string(payload) != "hot" {
+		t.Error("Wrong payload", string(payload))
+	}
+
+	clock.Advance(2 * time.Hour)
+	expect("haaga/command/foo/tv")
+}
+
+func TestTriggerRequire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"lib/lights.js": `
+			var loads = require("./counter");
+			loads.count++;
+			exports.off = function (group) {
+				set("haaga/deconz/groups/" + group + "/on", false);
+			};
+		`,
+		"lib/counter.js": `module.exports = {count: 0};`,
+		"main.js": `
+			var lights = require("./lib/lights");
+			var again = require("lib/lights.js");
+			var color = require("color");
+			var counter = require("./lib/counter");
+			publish("out", 0, false, (lights === again) + " " + counter.count + " " + color.rgbToXy(255, 0, 0).join(","));
+			lights.off(1);
+		`,
+	}
+	for name, source := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := New(config.Config{
+		ScriptsDir: dir,
+		Triggers:   []config.Trigger{config.Trigger{File: "main.js"}},
+	})
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 2)
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	if p := <-pubs; string(p.payload) != "true 1 0.7006,0.2993" {
+		t.Error("Wrong modules", string(p.payload))
+	}
+	if p := <-pubs; p.topic != "haaga/set/deconz/groups/1/on" {
+		t.Error("Wrong topic", p.topic)
+	}
+}
+
+func TestTriggerRestart(t *testing.T) {
+	ts := New(config.Config{
+		TriggerTopic: "control",
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "flaky",
+				Script: `listen("haaga/foo/bar", function (topic, payload, value) {
+					if (value === "fail") {
+						throw new Error("boom");
+					}
+					publish("out", 0, false, "flaky " + value);
+				})`,
+			},
+			config.Trigger{
+				Name: "steady",
+				Script: `listen("haaga/foo/bar", function (topic, payload, value) {
+					publish("out", 0, false, "steady " + value);
+				})`,
+			},
+		},
+	})
+
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 10)
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initTriggers()
+
+	// received collects published payloads by topic until the expected one arrives
+	received := map[string]bool{}
+	expect := func(expected string) {
+		timeout := time.After(time.Second)
+		for !received[expected] {
+			select {
+			case p := <-pubs:
+				msg := string(p.payload)
+				if strings.HasPrefix(p.topic, "control/") {
+					status := Status{}
+					json.Unmarshal(p.payload, &status)
+					msg = status.Name + " " + status.Status
+					if status.Status == StatusErrored && (!strings.Contains(status.Error, "boom") || status.Stack == "") {
+						t.Error("Missing error", string(p.payload))
+					}
+				}
+				received[msg] = true
+			case <-timeout:
+				t.Fatal("Timeout waiting for", expected)
+			}
+		}
+		delete(received, expected)
+	}
+
+	expect("flaky running")
+	expect("steady running")
+
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/bar", payload: []byte(`"fail"`)})
+	expect("flaky errored")
+	expect("steady fail")
+
+	// Not running until restarted
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/bar", payload: []byte(`"a"`)})
+	expect("steady a")
+	if received["flaky a"] {
+		t.Error("Errored trigger should not run")
+	}
+
+	clock.Advance(time.Second)
+	expect("flaky running")
+
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/bar", payload: []byte(`"b"`)})
+	expect("flaky b")
+	expect("steady b")
+
+	ts.handler(nil, &mockMessage{topic: "control/flaky/set", payload: []byte(`false`)})
+	expect("flaky disabled")
+
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/bar", payload: []byte(`"c"`)})
+	expect("steady c")
+	time.Sleep(50 * time.Millisecond)
+	if received["flaky c"] || len(pubs) > 0 {
+		t.Error("Disabled trigger should not run")
+	}
+
+	ts.handler(nil, &mockMessage{topic: "control/flaky/set", payload: []byte(`true`)})
+	expect("flaky running")
+}
+
+func TestTriggerGetTimeout(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `listen("haaga/foo/bar", function () {
+					try {
+						get("haaga/foo/missing", {timeout: 50});
+					} catch (e) {
+						publish("out", 0, false, "caught " + e.message);
+					}
+
+					publish("out", 0, false, "default " + get("haaga/foo/missing", {timeout: 50, default: 5}));
+
+					getAsync("haaga/foo/bar").then(function (value) {
+						publish("out", 0, false, "async " + value);
+						return getAsync("haaga/foo/missing", {timeout: 50});
+					})["catch"](function (e) {
+						publish("out", 0, false, "rejected " + e.message);
+					});
+				})`,
+			},
+		},
+	})
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 10)
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initTriggers()
+
+	ts.handler(nil, &mockMessage{topic: "haaga/status/foo/bar", payload: []byte(`1`)})
+
+	for _, expected := range []string{
+		"caught no value received for haaga/foo/missing in 50ms",
+		"default 5",
+		"async 1",
+		"rejected no value received for haaga/foo/missing in 50ms",
+	} {
+		for {
+			p := <-pubs
+			if p.topic == "out" {
+				if string(p.payload) != expected {
+					t.Error("Wrong message", string(p.payload), "expected", expected)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestTriggerEventLoop(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `
+					var order = [];
+
+					delay(1000).then(function () {
+						order.push("delay");
+						return setAsync("haaga/foo/diz", order.length, {wait: true, timeout: 1000});
+					}).then(function (res) {
+						publish("out", 0, false, order.join(",") + " " + res.status);
+					});
+
+					Promise.resolve("job").then(function (value) {
+						order.push(value);
+					});
+
+					order.push("sync");
+				`,
+			},
+		},
+	})
+
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initTriggers()
+
+	clock.Advance(time.Second)
+
+	p := <-pubs
+	req := util.DecodeRequest(p.payload)
+	if p.topic != "haaga/set/foo/diz" || req.Value != float64(3) {
+		t.Error("Wrong set request", p.topic, string(p.payload))
+	}
+
+	res, _ := json.Marshal(util.Result{Function: util.FunctionSet, Path: "haaga/foo/diz", Status: util.ResultOK, Correlation: req.Correlation})
+	go ts.handler(nil, &mockMessage{topic: "haaga/result/foo/diz", payload: res})
+
+	if p := <-pubs; string(p.payload) != "sync,job,delay ok" {
+		t.Error("Wrong order", string(p.payload))
+	}
+}
+
+func TestTriggerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := `
+		var count = store.get("count", 0) + 1;
+		store.set("count", count);
+		store.set("doorbell/last", "21:00", {ttl: "1m"});
+		store.set("doorbell/ring", true);
+		store.namespace("shared").set("owner", "first");
+
+		setTimeout(function () {
+			var keys = Object.keys(store.list("doorbell/")).join(",");
+			var shared = store.namespace("shared").get("owner");
+			store.delete("doorbell/ring");
+			publish("out", 0, false, count + " " + keys + " " + shared + " " + Object.keys(store.list("doorbell/")).length);
+		}, 2 * 60 * 1000);
+	`
+
+	ts := New(config.Config{
+		Store: &config.Store{DatabaseFile: filepath.Join(dir, "store.db")},
+		Triggers: []config.Trigger{
+			config.Trigger{Name: "doorbell", Script: script},
+			config.Trigger{Name: "other", Script: `publish("out", 0, false, store.get("count", "none") + " " + store.namespace("shared").get("owner"));`},
+		},
+	})
+	defer ts.closeStore()
+
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 2)
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	if p := <-pubs; string(p.payload) != "none first" {
+		t.Error("Wrong values in other trigger", string(p.payload))
+	}
+
+	clock.Advance(2 * time.Minute)
+	if p := <-pubs; string(p.payload) != "1 doorbell/ring first 0" {
+		t.Error("Wrong values", string(p.payload))
+	}
+
+	// Values survive restarts
+	inst := ts.instances["doorbell"]
+	ts.setEnabled(inst, false)
+	ts.setEnabled(inst, true)
+
+	clock.Advance(2 * time.Minute)
+	if p := <-pubs; !strings.HasPrefix(string(p.payload), "2 ") {
+		t.Error("Wrong values after restart", string(p.payload))
+	}
+}
+
+func TestTriggerWildcardSubscribe(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Script: `
+					var sensors = subscribe("haaga/status/+/sensors/#", function (topic, payload) {
+						publish("out", 0, false, "sensor " + topic);
+					});
+					subscribe("haaga/status/deconz/sensors/1/temperature", function (topic, payload) {
+						unsubscribe("haaga/status/+/sensors/#", sensors);
+						publish("out", 0, false, "temperature " + payload);
+					});
+				`,
+			},
+		},
+	})
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 2)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	})
+	unsubs := make(chan string, 1)
+	ts.c = &mockClient{subs, pubs, unsubs}
+	ts.initTriggers()
+
+	if s := <-subs; s.topic != "haaga/status/+/sensors/#" {
+		t.Error("Wrong topic subscription", s.topic)
+	}
+	if s := <-subs; s.topic != "haaga/status/deconz/sensors/1/temperature" {
+		t.Error("Wrong topic subscription", s.topic)
+	}
+
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/deconz/sensors/2/buttonevent", payload: []byte("1002")})
+	if p := <-pubs; string(p.payload) != "sensor haaga/status/deconz/sensors/2/buttonevent" {
+		t.Error("Wrong message", string(p.payload))
+	}
+
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/deconz/lights/1/on", payload: []byte("true")})
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/deconz/sensors/1/temperature", payload: []byte("21")})
+
+	// Both handlers matched the temperature before the wildcard was unsubscribed
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		received[string((<-pubs).payload)] = true
+	}
+	if !received["sensor haaga/status/deconz/sensors/1/temperature"] || !received["temperature 21"] {
+		t.Error("Wrong messages", received)
+	}
+
+	if topic := <-unsubs; topic != "haaga/status/+/sensors/#" {
+		t.Error("Wrong topic unsubscribed", topic)
+	}
+}
+
+func TestTriggerOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := New(config.Config{
+		Store: &config.Store{DatabaseFile: filepath.Join(dir, "store.db")},
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "watch",
+				Script: `
+					onChange("haaga/deconz/lights/1/on", function (value, old) {
+						publish("out", 0, false, "light " + old + "->" + value);
+					});
+					onChange("haaga/presence/home", {from: true, to: false, for: "10m"}, function (value, old, path) {
+						publish("out", 0, false, "away " + path);
+					});
+					onThreshold("haaga/deconz/sensors/1/temperature", {above: 25, hysteresis: 1}, function (value, old) {
+						publish("out", 0, false, "hot " + old + "->" + value);
+					});
+				`,
+			},
+		},
+	})
+	defer ts.closeStore()
+
+	clock := NewTestClock(time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC))
+	ts.SetClock(clock)
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 10)
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initTriggers()
+
+	// deliver calls the handlers synchronously to keep the order of the messages
+	deliver := func(path string, payload string) {
+		topic := "haaga/status/" + strings.TrimPrefix(path, "haaga/")
+		msg := &mockMessage{topic: topic, payload: []byte(payload)}
+		for _, h := range ts.receive(msg) {
+			h(nil, msg)
+		}
+	}
+	expect := func(payload string) {
+		if p := <-pubs; string(p.payload) != payload {
+			t.Errorf("Expected %s got %s", payload, string(p.payload))
+		}
+	}
+
+	deliver("haaga/deconz/lights/1/on", "true")
+	deliver("haaga/deconz/lights/1/on", "true")
+	deliver("haaga/deconz/lights/1/on", "false")
+	expect("light true->false")
+
+	for _, temp := range []string{"24", "26", "24.5", "26", "23.9", "25.5"} {
+		deliver("haaga/deconz/sensors/1/temperature", temp)
+	}
+	expect("hot 24->26")
+	expect("hot 23.9->25.5")
+
+	deliver("haaga/presence/home", "true")
+	deliver("haaga/presence/home", "false")
+	clock.Advance(5 * time.Minute)
+	deliver("haaga/presence/home", "true")
+	deliver("haaga/presence/home", "false")
+	clock.Advance(9 * time.Minute)
+	deliver("haaga/presence/home", "true")
+	clock.Advance(10 * time.Minute)
+	deliver("haaga/presence/home", "false")
+	clock.Advance(10 * time.Minute)
+	expect("away haaga/presence/home")
+
+	// Pending durations and previous values survive restarts
+	deliver("haaga/presence/home", "true")
+	deliver("haaga/presence/home", "false")
+	clock.Advance(5 * time.Minute)
+
+	inst := ts.instances["watch"]
+	ts.setEnabled(inst, false)
+	ts.setEnabled(inst, true)
+
+	deliver("haaga/deconz/lights/1/on", "true")
+	expect("light false->true")
+
+	clock.Advance(5 * time.Minute)
+	expect("away haaga/presence/home")
+
+	select {
+	case p := <-pubs:
+		t.Error("Unexpected message", string(p.payload))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHarness(t *testing.T) {
+	conf := config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "hallway",
+				Script: `
+					onChange("haaga/hallway/motion", {to: false, for: "5m"}, function () {
+						setAsync("haaga/deconz/lights/7/on", false, {wait: true}).then(function () {
+							publish("out", 0, false, "off " + get("haaga/deconz/lights/7/on") + " " + get("haaga/unknown"));
+						});
+					});
+					listen("haaga/hallway/motion", function (topic, payload, value) {
+						if (value) {
+							set("haaga/deconz/lights/7/on", true);
+						}
+					});
+					setInterval(function () {
+						set("haaga/hallway/heartbeat", Date.now());
+					}, 60 * 60 * 1000);
+				`,
+			},
+			config.Trigger{Name: "broken", Script: `listen("haaga/hallway/motion", function () { throw new Error("boom"); });`},
+		},
+	}
+
+	fixture := Fixture{
+		Start:    "2026-10-16T21:00:00Z",
+		Triggers: []string{"hallway"},
+		Values:   map[string]interface{}{"haaga/hallway/motion": false},
+		Events: []FixtureEvent{
+			FixtureEvent{At: "1m", Path: "haaga/hallway/motion", Value: true},
+			FixtureEvent{At: "2m", Path: "haaga/hallway/motion", Value: false},
+		},
+		Duration: "1h",
+		Expect: []FixtureExpectation{
+			FixtureExpectation{Set: "haaga/deconz/lights/7/on", Value: true, At: "1m"},
+			FixtureExpectation{Set: "haaga/deconz/lights/7/on", Value: false, At: "7m"},
+			FixtureExpectation{Topic: "out", At: "7m", Payload: func(s string) *string { return &s }("off false null")},
+			FixtureExpectation{Set: "haaga/hallway/heartbeat", At: "1h"},
+			FixtureExpectation{Set: "haaga/deconz/lights/7/on", Value: true, At: "10m", Never: true},
+		},
+	}
+
+	messages, failures, err := RunFixture(conf, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) > 0 {
+		t.Error("Fixture failed", failures, messages)
+	}
+
+	fixture.Triggers = nil
+	fixture.Expect = append(fixture.Expect, FixtureExpectation{Topic: "out", At: "8m"})
+	_, failures, _ = RunFixture(conf, fixture)
+	// The broken trigger fails on both motion events
+	if len(failures) != 3 || !strings.HasPrefix(failures[0], "trigger broken failed") || failures[2] != "expected publish out at 8m" {
+		t.Error("Wrong failures", failures)
+	}
+}
+
+func TestHarnessAutomation(t *testing.T) {
+	conf := config.Config{
+		Automations: []config.Automation{
+			config.Automation{
+				Name: "hallway",
+				When: []config.AutomationWhen{
+					config.AutomationWhen{Kind: "state", Path: "haaga/hallway/motion", Equals: true},
+				},
+				Conditions: []config.AutomationCondition{
+					config.AutomationCondition{Kind: "state", Path: "haaga/hallway/enabled", Equals: true},
+				},
+				Actions: []config.AutomationAction{
+					config.AutomationAction{Kind: "set", Path: "haaga/deconz/lights/7/on", Value: true},
+					config.AutomationAction{Kind: "delay", Duration: "5m"},
+					config.AutomationAction{Kind: "set", Path: "haaga/deconz/lights/7/on", Value: false},
+					config.AutomationAction{Kind: "script", Source: `setTimeout(function () { publish("out", 0, false, "off " + get("haaga/deconz/lights/7/on")); }, 1000);`},
+				},
+			},
+			config.Automation{
+				Name: "other",
+				When: []config.AutomationWhen{
+					config.AutomationWhen{Kind: "state", Path: "haaga/hallway/motion"},
+				},
+				Actions: []config.AutomationAction{
+					config.AutomationAction{Kind: "publish", Topic: "other"},
+				},
+			},
+		},
+	}
+
+	fixture := Fixture{
+		Start:       "2026-10-16T21:00:00Z",
+		Automations: []string{"hallway"},
+		Values:      map[string]interface{}{"haaga/hallway/enabled": true},
+		Events: []FixtureEvent{
+			FixtureEvent{At: "1m", Path: "haaga/hallway/motion", Value: true},
+			FixtureEvent{At: "2m", Path: "haaga/hallway/motion", Value: false},
+		},
+		Duration: "10m",
+		Expect: []FixtureExpectation{
+			FixtureExpectation{Set: "haaga/deconz/lights/7/on", Value: true, At: "1m"},
+			FixtureExpectation{Set: "haaga/deconz/lights/7/on", Value: false, At: "6m"},
+			FixtureExpectation{Topic: "out", At: "6m1s", Payload: func(s string) *string { return &s }("off false")},
+			FixtureExpectation{Topic: "other", Never: true},
+		},
+	}
+
+	messages, failures, err := RunFixture(conf, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) > 0 {
+		t.Error("Fixture failed", failures, messages)
+	}
+
+	fixture.Automations = []string{"unknown"}
+	if _, _, err := RunFixture(conf, fixture); err == nil {
+		t.Error("Unknown automation should fail")
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	jsonFixture, err := LoadFixture("lights.json", strings.NewReader(`{
+		"start": "2026-10-16T21:00:00Z",
+		"values": {"haaga/deconz/lights/7": {"on": true, "bri": 100}},
+		"events": [{"at": "1m", "path": "haaga/hallway/motion", "value": true}],
+		"expect": [{"set": "haaga/deconz/lights/7/on", "value": false, "at": "7m", "never": true}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlFixture, err := LoadFixture("lights.yaml", strings.NewReader(`
+start: "2026-10-16T21:00:00Z"
+values:
+  haaga/deconz/lights/7: {on: true, bri: 100}
+events:
+  - {at: 1m, path: haaga/hallway/motion, value: true}
+expect:
+  - set: haaga/deconz/lights/7/on
+    value: false
+    at: 7m
+    never: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(jsonFixture, yamlFixture) {
+		t.Errorf("YAML fixture decoded differently %v %v", jsonFixture, yamlFixture)
+	}
+}
+
+func TestTriggerConsole(t *testing.T) {
+	ts := New(config.Config{Bridge: &config.BridgeConfig{Root: "haaga"}})
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 10)
+	ts.c = &mockClient{subs, pubs, nil}
+
+	output := make(chan string, 10)
+	console := ts.NewConsole(func(str string) { output <- str })
+	defer console.Close()
+
+	if s := <-subs; s.topic != "+/status/#" {
+		t.Error("Wrong tree subscription", s.topic)
+	}
+	if p := <-pubs; p.topic != "haaga/get" {
+		t.Error("Wrong tree request", p.topic)
+	}
+
+	for _, topic := range []string{"haaga/status/deconz/lights/1/on", "haaga/status/deconz/lights/2/on", "haaga/status/dra/power"} {
+		ts.receive(&mockMessage{topic: topic, payload: []byte("true")})
+	}
+
+	if res, err := console.Eval(`var lights = {count: 2}; [get("haaga/dra/power"), lights]`); err != nil || res != `[true,{"count":2}]` {
+		t.Error("Wrong result", res, err)
+	}
+	if _, err := console.Eval(`throw new Error("boom")`); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Error("Expected an error", err)
+	}
+
+	testData := []struct {
+		line        string
+		word        string
+		completions []string
+	}{
+		{`get("haaga/`, "haaga/", []string{"haaga/deconz/", "haaga/dra/"}},
+		{`get('haaga/deconz/lights/1`, "haaga/deconz/lights/1", []string{"haaga/deconz/lights/1/"}},
+		{`lights.co`, "lights.co", []string{"lights.count"}},
+		{`1 + getA`, "getA", []string{"getAsync"}},
+		{`unknown.x`, "unknown.x", nil},
+	}
+	for _, test := range testData {
+		word, completions := console.Complete(test.line)
+		if word != test.word || !reflect.DeepEqual(completions, test.completions) {
+			t.Errorf("Wrong completions for %s: %s %v", test.line, word, completions)
+		}
+	}
+
+	if _, err := console.Eval(`listen("haaga/dra/power"); print("listening")`); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-subs; s.topic != "haaga/status/dra/power" {
+		t.Error("Wrong subscription", s.topic)
+	}
+	go ts.handler(nil, &mockMessage{topic: "haaga/status/dra/power", payload: []byte("false")})
+
+	if str := <-output; str != "listening" {
+		t.Error("Wrong output", str)
+	}
+	if str := <-output; str != "haaga/status/dra/power false" {
+		t.Error("Wrong output", str)
+	}
+}
+
+func TestTriggerHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/echo" {
+			http.NotFound(w, req)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"method":       req.Method,
+			"header":       req.Header.Get("X-Test"),
+			"content_type": req.Header.Get("Content-Type"),
+			"body":         string(body),
+		})
+	}))
+	defer server.Close()
+
+	script := `
+		var base = "` + server.URL + `";
+		function out(str) { publish("out", 0, false, str); }
+
+		http.request({method: "post", url: base + "/echo", headers: {"X-Test": "yes"}, body: {on: true}}).then(function (res) {
+			var json = res.json;
+			out([res.status, res.headers["content-type"], json.method, json.header, json.content_type, json.body].join(" "));
+		});
+		http.request(base + "/missing", function (err, res) {
+			out("callback " + err + " " + res.status);
+		});
+		http.request("http://example.com/").catch(function (err) {
+			out("denied " + err);
+		});
+		http.request({url: base + "/echo", body: "raw", timeout: "1s"}).then(function (res) {
+			out("raw " + res.json.body + " " + res.json.content_type);
+		});
+		http.request(base + "/echo").catch(function (err) {
+			out("limited " + err);
+		});
+	`
+
+	ts := New(config.Config{
+		HTTP: &config.HTTP{AllowedHosts: []string{"127.0.0.1"}, RateLimit: 3},
+		Triggers: []config.Trigger{
+			config.Trigger{Name: "doorbell", Script: script},
+		},
+	})
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 5)
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	var res []string
+	for i := 0; i < 5; i++ {
+		res = append(res, string((<-pubs).payload))
+	}
+	sort.Strings(res)
+
+	expected := []string{
+		`200 application/json POST yes application/json {"on":true}`,
+		"callback null 404",
+		"denied GoError: host example.com is not allowed",
+		"limited GoError: http rate limit exceeded",
+		"raw raw ",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Wrong responses %#v", res)
+	}
+}
+
+func TestTriggerScene(t *testing.T) {
+	ts := New(config.Config{
+		SetSource: true,
+		Scenes:    &config.Scenes{Root: "scene"},
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "movie",
+				Script: `
+					scene.capture("before", ["haaga/dra/#", "haaga/viera/power"]);
+					scene.apply("movie", {transition: "2s"});
+					scene.restore("movie");
+					scene.delete("before");
+				`,
+			},
+		},
+	})
+
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 4)
+	ts.c = &mockClient{nil, pubs, nil}
+	ts.initTriggers()
+
+	expected := []struct {
+		topic string
+		value string
+	}{
+		{"scene/command/before", `{"action":"capture","patterns":["haaga/dra/#","haaga/viera/power"]}`},
+		{"scene/command/movie", `{"action":"apply","transition":"2s"}`},
+		{"scene/command/movie", `{"action":"restore"}`},
+		{"scene/command/before", `{"action":"delete"}`},
+	}
+	for _, e := range expected {
+		p := <-pubs
+		req := util.DecodeRequest(p.payload)
+		b, _ := json.Marshal(req.Value)
+		if p.topic != e.topic || string(b) != e.value || req.Source == nil || req.Source.ID != "movie" {
+			t.Error("Wrong scene command", p.topic, string(p.payload))
+		}
+	}
+}
+
+func TestTriggerHandlerOrder(t *testing.T) {
+	ts := New(config.Config{
+		Triggers: []config.Trigger{
+			config.Trigger{
+				Name: "order",
+				Script: `
+					onChange("haaga/foo/level", function (value, old) {
+						publish("out", 0, false, old + "->" + value);
+					});
+				`,
+			},
+		},
+	})
+
+	subs := make(chan struct {
+		topic    string
+		callback mqtt.MessageHandler
+	}, 10)
+	pubs := make(chan struct {
+		topic   string
+		payload []byte
+	}, 50)
+	ts.c = &mockClient{subs, pubs, nil}
+	ts.initTriggers()
+
+	if s := <-subs; s.topic != "haaga/status/foo/level" {
+		t.Fatal("Wrong subscription", s.topic)
+	}
+
+	// Quick updates reach the callbacks in message order
+	for i := 0; i <= 30; i++ {
+		ts.handler(nil, &mockMessage{topic: "haaga/status/foo/level", payload: []byte(strconv.Itoa(i))})
+	}
+
+	for i := 1; i <= 30; i++ {
+		if p := <-pubs; string(p.payload) != fmt.Sprintf("%d->%d", i-1, i) {
+			t.Fatal("Wrong order", string(p.payload))
+		}
+	}
 }
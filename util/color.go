@@ -0,0 +1,133 @@
+package util
+
+import "math"
+
+// RGBToXY converts a RGB color (0-255) to CIE xy coordinates and brightness (0-1) using the
+// gamma correction and wide gamut conversion used by Hue compatible lights
+func RGBToXY(r, g, b float64) (x float64, y float64, bri float64) {
+	gamma := func(c float64) float64 {
+		c = clamp(c/255, 0, 1)
+		if c > 0.04045 {
+			return math.Pow((c+0.055)/1.055, 2.4)
+		}
+		return c / 12.92
+	}
+	r, g, b = gamma(r), gamma(g), gamma(b)
+
+	cx := r*0.664511 + g*0.154324 + b*0.162028
+	cy := r*0.283881 + g*0.668433 + b*0.047685
+	cz := r*0.000088 + g*0.072310 + b*0.986039
+
+	sum := cx + cy + cz
+	if sum == 0 {
+		return 0, 0, 0
+	}
+
+	return cx / sum, cy / sum, cy
+}
+
+// XYToRGB converts CIE xy coordinates and brightness (0-1) to a RGB color (0-255)
+func XYToRGB(x, y, bri float64) (r float64, g float64, b float64) {
+	if y == 0 {
+		return 0, 0, 0
+	}
+
+	cy := bri
+	cx := (cy / y) * x
+	cz := (cy / y) * (1 - x - y)
+
+	r = cx*1.656492 - cy*0.354851 - cz*0.255038
+	g = -cx*0.707196 + cy*1.655397 + cz*0.036152
+	b = cx*0.051713 - cy*0.121364 + cz*1.011530
+
+	// Scale down if a component is out of range
+	if max := math.Max(r, math.Max(g, b)); max > 1 {
+		r, g, b = r/max, g/max, b/max
+	}
+
+	gamma := func(c float64) float64 {
+		c = clamp(c, 0, 1)
+		if c <= 0.0031308 {
+			return 255 * 12.92 * c
+		}
+		return 255 * (1.055*math.Pow(c, 1/2.4) - 0.055)
+	}
+
+	return math.Round(gamma(r)), math.Round(gamma(g)), math.Round(gamma(b))
+}
+
+// HSVToRGB converts hue (0-360), saturation (0-1) and value (0-1) to a RGB color (0-255)
+func HSVToRGB(h, s, v float64) (r float64, g float64, b float64) {
+	h = math.Mod(math.Mod(h, 360)+360, 360)
+	s, v = clamp(s, 0, 1), clamp(v, 0, 1)
+
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return math.Round((r + m) * 255), math.Round((g + m) * 255), math.Round((b + m) * 255)
+}
+
+// RGBToHSV converts a RGB color (0-255) to hue (0-360), saturation (0-1) and value (0-1)
+func RGBToHSV(r, g, b float64) (h float64, s float64, v float64) {
+	r, g, b = clamp(r/255, 0, 1), clamp(g/255, 0, 1), clamp(b/255, 0, 1)
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	switch {
+	case delta == 0:
+		h = 0
+	case max == r:
+		h = 60 * math.Mod((g-b)/delta, 6)
+	case max == g:
+		h = 60 * ((b-r)/delta + 2)
+	default:
+		h = 60 * ((r-g)/delta + 4)
+	}
+	if h < 0 {
+		h += 360
+	}
+
+	if max > 0 {
+		s = delta / max
+	}
+
+	return h, s, max
+}
+
+// KelvinToMired converts a color temperature in kelvins to mireds (used by ct of Hue and deCONZ lights)
+func KelvinToMired(k float64) float64 {
+	if k <= 0 {
+		return 0
+	}
+	return math.Round(1000000 / k)
+}
+
+// MiredToKelvin converts a color temperature in mireds to kelvins
+func MiredToKelvin(m float64) float64 {
+	if m <= 0 {
+		return 0
+	}
+	return math.Round(1000000 / m)
+}
+
+func clamp(val, min, max float64) float64 {
+	return math.Max(min, math.Min(max, val))
+}
@@ -0,0 +1,205 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchYears limits how far in the future the next run of a schedule is searched for
+const cronSearchYears = 5
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// CronSchedule is a parsed five field cron expression (minute hour day-of-month month day-of-week)
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month and day of week are combined with OR when both are restricted
+	domStar, dowStar bool
+
+	// Location the expression is evaluated in
+	Location *time.Location
+}
+
+// ParseCron parses a cron expression. Names (jan, mon), ranges, lists, steps and @daily style
+// shortcuts are supported. The expression may be prefixed with CRON_TZ=<zone> or TZ=<zone>.
+// Expressions without a zone are evaluated in loc.
+func ParseCron(expr string, loc *time.Location) (CronSchedule, error) {
+	s := CronSchedule{Location: loc}
+	if s.Location == nil {
+		s.Location = time.Local
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		zone := fields[0][strings.Index(fields[0], "=")+1:]
+		l, err := time.LoadLocation(zone)
+		if err != nil {
+			return s, err
+		}
+		s.Location = l
+		fields = fields[1:]
+	}
+
+	if len(fields) == 1 {
+		if shortcut, ok := cronShortcuts[fields[0]]; ok {
+			fields = strings.Fields(shortcut)
+		}
+	}
+
+	if len(fields) != 5 {
+		return s, fmt.Errorf("cron expression %q should have five fields", expr)
+	}
+
+	var err error
+	if s.minute, _, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return s, err
+	}
+	if s.hour, _, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return s, err
+	}
+	if s.dom, s.domStar, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return s, err
+	}
+	if s.month, _, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return s, err
+	}
+	if s.dow, s.dowStar, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return s, err
+	}
+
+	// 7 is an alias for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+func parseCronValue(str string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(str)]; ok {
+		return n, nil
+	}
+	return strconv.Atoi(str)
+}
+
+// parseCronField returns the bitset of the values matched by a field and whether the field was a *
+func parseCronField(field string, min, max int, names map[string]int) (uint64, bool, error) {
+	var bits uint64
+	star := field == "*" || field == "?"
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false, fmt.Errorf("invalid cron step %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, false, fmt.Errorf("invalid cron range %q", part)
+			}
+			if end, err = parseCronValue(bounds[1], names); err != nil {
+				return 0, false, fmt.Errorf("invalid cron range %q", part)
+			}
+		default:
+			n, err := parseCronValue(part, names)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid cron value %q", part)
+			}
+			start = n
+			if step == 1 {
+				end = n
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, false, fmt.Errorf("cron value %q out of range %d-%d", part, min, max)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, star, nil
+}
+
+// wallClock returns the wall clock time of t in the schedule location as UTC
+func (s CronSchedule) wallClock(t time.Time) time.Time {
+	local := t.In(s.Location)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+}
+
+func (s CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after t matching the schedule or a zero time if there is none.
+// Times are matched against the wall clock of the schedule location. A time skipped by a
+// daylight saving transition runs right after the transition and a repeated time runs once.
+func (s CronSchedule) Next(t time.Time) time.Time {
+	// Search using the wall clock without daylight saving transitions
+	w := s.wallClock(t).Truncate(time.Minute).Add(time.Minute)
+	limit := w.Year() + cronSearchYears
+
+	for w.Year() <= limit {
+		switch {
+		case s.month&(1<<uint(w.Month())) == 0:
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(w):
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(w.Hour())) == 0:
+			w = w.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(w.Minute())) == 0:
+			w = w.Add(time.Minute)
+		default:
+			next := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, s.Location)
+			if !s.wallClock(next).Equal(w) {
+				// w was skipped by a daylight saving transition. Run at the transition instead.
+				for prev := next.Add(-time.Minute); s.wallClock(prev).After(w); prev = prev.Add(-time.Minute) {
+					next = prev
+				}
+			}
+			if next.After(t) {
+				return next
+			}
+			w = w.Add(time.Minute)
+		}
+	}
+
+	return time.Time{}
+}
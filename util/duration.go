@@ -0,0 +1,38 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration works like time.ParseDuration but also understands days (d) and weeks (w)
+func ParseDuration(str string) (time.Duration, error) {
+	str = strings.TrimSpace(str)
+
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(str, suffix) {
+			n, err := strconv.ParseFloat(str[:len(str)-len(suffix)], 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(str)
+}
+
+// ParseTime parses either a RFC3339 timestamp or a duration relative to now (e.g. -24h)
+func ParseTime(str string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+
+	d, err := ParseDuration(str)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return now.Add(d), nil
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/config"
+)
+
+// NewClientOptions returns mqtt client options for the brokers defined in the config.
+// Suffix is appended to the configured client id so multiple components can share a config.
+func NewClientOptions(conf config.Config, suffix string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	for _, server := range conf.Servers {
+		opts = opts.AddBroker(server)
+	}
+	if conf.ClientID != "" {
+		opts = opts.SetClientID(conf.ClientID + suffix)
+	}
+	if conf.Username != "" {
+		opts = opts.SetUsername(conf.Username)
+	}
+	if conf.Password != "" {
+		opts = opts.SetPassword(conf.Password)
+	}
+	return opts
+}
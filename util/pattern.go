@@ -0,0 +1,26 @@
+package util
+
+import "strings"
+
+// MatchPattern checks if a slash separated path matches a pattern using MQTT wildcard rules
+// (+ matches a single level and # matches all remaining levels)
+func MatchPattern(pattern, path string) bool {
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(path, "/")
+
+	for i, part := range patternParts {
+		if part == "#" {
+			return true
+		}
+
+		if i >= len(pathParts) {
+			return false
+		}
+
+		if part != "+" && part != pathParts[i] {
+			return false
+		}
+	}
+
+	return len(patternParts) == len(pathParts)
+}
@@ -0,0 +1,202 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+// Status payload formats
+const (
+	// PayloadRaw publishes bare JSON values
+	PayloadRaw = "raw"
+	// PayloadEnvelope publishes values wrapped in a StatusPayload with timestamp, source and stale flag
+	PayloadEnvelope = "envelope"
+)
+
+// SetRequest is the envelope used for set and command messages that carry a source or correlation data
+type SetRequest struct {
+	Value  interface{}     `json:"value"`
+	Source *adapter.Source `json:"source,omitempty"`
+	// Correlation is echoed back in the result of the request
+	Correlation interface{} `json:"correlation,omitempty"`
+}
+
+// GetRequest is the optional payload of get messages
+type GetRequest struct {
+	Source      *adapter.Source `json:"source,omitempty"`
+	Correlation interface{}     `json:"correlation,omitempty"`
+}
+
+// requestKeys are the keys that can be found in a request envelope
+var requestKeys = map[string]func(json.RawMessage) bool{"source": isSource, "correlation": isCorrelation}
+
+// StatusPayload is the envelope used for status messages that carry metadata
+type StatusPayload struct {
+	Value     interface{}     `json:"value"`
+	Timestamp *time.Time      `json:"timestamp,omitempty"`
+	Source    *adapter.Source `json:"source,omitempty"`
+	Stale     *bool           `json:"stale,omitempty"`
+}
+
+// statusKeys are the keys that can be found in a status envelope.
+// updated is included for payloads published by older deconz adapters.
+var statusKeys = map[string]func(json.RawMessage) bool{"timestamp": isTime, "source": isSource, "stale": isBool, "updated": isString}
+
+// ValidatePayloadFormat returns an error for unknown payload formats
+func ValidatePayloadFormat(format string) error {
+	switch format {
+	case "", PayloadRaw, PayloadEnvelope:
+		return nil
+	}
+	return fmt.Errorf("unknown payload format %s", format)
+}
+
+// EncodeStatus returns the status payload for an update in the given format.
+// Raw payloads only carry the source when includeSource is set.
+func EncodeStatus(kvu adapter.ValueUpdate, format string, includeSource bool) ([]byte, error) {
+	switch {
+	case format == PayloadEnvelope:
+		timestamp := kvu.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		stale := kvu.Stale
+		return json.Marshal(StatusPayload{Value: kvu.Value, Timestamp: &timestamp, Source: kvu.Source, Stale: &stale})
+	case includeSource && kvu.Source != nil:
+		return json.Marshal(StatusPayload{Value: kvu.Value, Source: kvu.Source})
+	}
+
+	return json.Marshal(kvu.Value)
+}
+
+// isEnvelope checks that obj contains the value key and only known envelope keys with valid values
+// so that objects which happen to use the same keys are not mistaken for envelopes
+func isEnvelope(obj map[string]json.RawMessage, keys map[string]func(json.RawMessage) bool) bool {
+	if _, ok := obj["value"]; !ok || len(obj) < 2 {
+		return false
+	}
+
+	for key, raw := range obj {
+		if key == "value" {
+			continue
+		}
+		if valid, ok := keys[key]; !ok || !valid(raw) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSource checks that raw is a source object with a type or a client and no unknown keys.
+// MQTT clients may identify themselves with just the client id.
+func isSource(raw json.RawMessage) bool {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	source := adapter.Source{}
+	return dec.Decode(&source) == nil && (source.Type != "" || source.Client != "")
+}
+
+// isCorrelation checks that raw is a string or a number
+func isCorrelation(raw json.RawMessage) bool {
+	var val interface{}
+	if err := json.Unmarshal(raw, &val); err != nil {
+		return false
+	}
+	switch val.(type) {
+	case string, float64:
+		return true
+	}
+	return false
+}
+
+// isTime checks that raw is a timestamp
+func isTime(raw json.RawMessage) bool {
+	var t time.Time
+	return json.Unmarshal(raw, &t) == nil
+}
+
+// isString checks that raw is a string
+func isString(raw json.RawMessage) bool {
+	var str string
+	return json.Unmarshal(raw, &str) == nil
+}
+
+// isBool checks that raw is a boolean
+func isBool(raw json.RawMessage) bool {
+	var b bool
+	return json.Unmarshal(raw, &b) == nil
+}
+
+// EncodeSetRequest returns the payload for a set message
+func EncodeSetRequest(val interface{}, source *adapter.Source, includeSource bool) ([]byte, error) {
+	return EncodeRequest(SetRequest{Value: val, Source: source}, includeSource)
+}
+
+// EncodeRequest returns the payload for a set or command message. The source is only included
+// when includeSource is set as consumers of the topics may expect plain values. Plain values are
+// used when the request has no source or correlation data.
+func EncodeRequest(req SetRequest, includeSource bool) ([]byte, error) {
+	if !includeSource {
+		req.Source = nil
+	}
+	if req.Source == nil && req.Correlation == nil {
+		return json.Marshal(req.Value)
+	}
+	return json.Marshal(req)
+}
+
+// DecodeRequest decodes a set or command message payload which can either be a plain JSON value
+// or a SetRequest envelope
+func DecodeRequest(payload []byte) SetRequest {
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &obj); err == nil && isEnvelope(obj, requestKeys) {
+		req := SetRequest{}
+		if err := json.Unmarshal(payload, &req); err == nil {
+			return req
+		}
+	}
+
+	req := SetRequest{}
+	json.Unmarshal(payload, &req.Value)
+	return req
+}
+
+// DecodeSetRequest decodes the value and source of a set message payload
+func DecodeSetRequest(payload []byte) (interface{}, *adapter.Source) {
+	req := DecodeRequest(payload)
+	return req.Value, req.Source
+}
+
+// DecodeGetRequest decodes a get message payload. Payloads are usually empty.
+func DecodeGetRequest(payload []byte) GetRequest {
+	req := GetRequest{}
+	json.Unmarshal(payload, &req)
+	return req
+}
+
+// DecodeStatusPayload decodes a status message payload which can either be a plain JSON value
+// or a StatusPayload envelope
+func DecodeStatusPayload(payload []byte) StatusPayload {
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &obj); err == nil && isEnvelope(obj, statusKeys) {
+		status := StatusPayload{}
+		if err := json.Unmarshal(payload, &status); err == nil {
+			return status
+		}
+	}
+
+	status := StatusPayload{}
+	json.Unmarshal(payload, &status.Value)
+	return status
+}
+
+// DecodeStatus decodes the value and source of a status message payload
+func DecodeStatus(payload []byte) (interface{}, *adapter.Source) {
+	status := DecodeStatusPayload(payload)
+	return status.Value, status.Source
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+)
+
+// Result statuses
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// Result error codes
+const (
+	ErrorCodeNotFound     = "not_found"
+	ErrorCodeNotSupported = "not_supported"
+	ErrorCodePartial      = "partial"
+	ErrorCodeFailed       = "failed"
+)
+
+// DefaultResultTimeout is used when waiting for results if no timeout has been given
+var DefaultResultTimeout = 10 * time.Second
+
+// Result is published to the result topic of a path after each set, get and command
+type Result struct {
+	Function    string      `json:"function"`
+	Path        string      `json:"path"`
+	Status      string      `json:"status"`
+	Code        string      `json:"code,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Correlation interface{} `json:"correlation,omitempty"`
+}
+
+// ResultErr is returned when a request resulted in an error
+type ResultErr struct {
+	Result
+}
+
+func (re ResultErr) Error() string {
+	return fmt.Sprintf("%s %s failed (%s): %s", re.Function, re.Path, re.Code, re.Result.Error)
+}
+
+// ErrorCode returns the result error code for an error
+func ErrorCode(err error) string {
+	switch err.(type) {
+	case adapter.MultiSetError:
+		return ErrorCodePartial
+	}
+
+	switch err {
+	case adapter.NoSuchAdapterError:
+		return ErrorCodeNotFound
+	case adapter.NoSuchCommandError:
+		return ErrorCodeNotSupported
+	}
+
+	return ErrorCodeFailed
+}
+
+// NewResult returns the result of an operation
+func NewResult(function string, path string, err error, correlation interface{}) Result {
+	res := Result{Function: function, Path: path, Status: ResultOK, Correlation: correlation}
+	if err != nil {
+		res.Status = ResultError
+		res.Code = ErrorCode(err)
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// ResultOptions reads the wait and timeout (in milliseconds) options given to set calls in scripts
+func ResultOptions(val interface{}) (wait bool, timeout time.Duration) {
+	if opts, ok := val.(map[string]interface{}); ok {
+		wait, _ = opts["wait"].(bool)
+		switch ms := opts["timeout"].(type) {
+		case int64:
+			timeout = time.Duration(ms) * time.Millisecond
+		case float64:
+			timeout = time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	return
+}
+
+// AwaitResult publishes a request with a correlation id using publish and waits for the matching result on resultTopic.
+// A ResultErr is returned if the request failed.
+func AwaitResult(
+	resultTopic string,
+	correlation string,
+	timeout time.Duration,
+	subscribe func(topic string, handler mqtt.MessageHandler) int,
+	unsubscribe func(topic string, id int),
+	publish func() error,
+) (Result, error) {
+	ch := make(chan Result, 1)
+	id := subscribe(resultTopic, func(client mqtt.Client, msg mqtt.Message) {
+		res := Result{}
+		if err := json.Unmarshal(msg.Payload(), &res); err != nil || res.Correlation != correlation {
+			return
+		}
+
+		select {
+		case ch <- res:
+		default:
+		}
+	})
+	defer unsubscribe(resultTopic, id)
+
+	if err := publish(); err != nil {
+		return Result{}, err
+	}
+
+	if timeout == 0 {
+		timeout = DefaultResultTimeout
+	}
+
+	select {
+	case res := <-ch:
+		if res.Status != ResultOK {
+			return res, ResultErr{res}
+		}
+		return res, nil
+	case <-time.After(timeout):
+		return Result{}, fmt.Errorf("timed out waiting for result on %s", resultTopic)
+	}
+}
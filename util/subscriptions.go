@@ -0,0 +1,160 @@
+package util
+
+import (
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Subscriptions keeps message handlers in a topic trie. Topic filters may contain MQTT wildcards
+// (+ matches a single level and # matches the parent level and all levels below it). Subscriptions
+// counts the handlers of each filter so that the broker subscription can be made for the first handler
+// and removed after the last one. Subscriptions is not safe for concurrent use.
+type Subscriptions struct {
+	id   int
+	root *topicNode
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	handlers map[int]mqtt.MessageHandler
+}
+
+type handlerEntry struct {
+	id      int
+	handler mqtt.MessageHandler
+}
+
+// NewSubscriptions returns an empty Subscriptions
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{root: &topicNode{}}
+}
+
+// Add adds a handler for a topic filter. Returns the id of the handler and true if the filter had no
+// other handlers and should be subscribed from the broker.
+func (s *Subscriptions) Add(topic string, handler mqtt.MessageHandler) (int, bool) {
+	node := s.root
+	for _, level := range strings.Split(topic, "/") {
+		if node.children == nil {
+			node.children = map[string]*topicNode{}
+		}
+		child, ok := node.children[level]
+		if !ok {
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	if node.handlers == nil {
+		node.handlers = map[int]mqtt.MessageHandler{}
+	}
+
+	id := s.id
+	s.id++
+	node.handlers[id] = handler
+
+	return id, len(node.handlers) == 1
+}
+
+// Remove removes a handler. Returns true if it was the last handler of the filter and the filter
+// should be unsubscribed from the broker.
+func (s *Subscriptions) Remove(topic string, id int) bool {
+	levels := strings.Split(topic, "/")
+	path := make([]*topicNode, 0, len(levels)+1)
+
+	node := s.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return false
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	if _, ok := node.handlers[id]; !ok {
+		return false
+	}
+	delete(node.handlers, id)
+
+	if len(node.handlers) > 0 {
+		return false
+	}
+
+	// Prune empty nodes
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.handlers) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+
+	return true
+}
+
+// Has returns true if a topic filter has handlers
+func (s *Subscriptions) Has(topic string) bool {
+	node := s.root
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			return false
+		}
+		node = child
+	}
+
+	return len(node.handlers) > 0
+}
+
+// Match returns the handlers of the filters matching a topic in the order they were added
+func (s *Subscriptions) Match(topic string) []mqtt.MessageHandler {
+	levels := strings.Split(topic, "/")
+
+	var entries []handlerEntry
+	collect := func(node *topicNode) {
+		for id, handler := range node.handlers {
+			entries = append(entries, handlerEntry{id, handler})
+		}
+	}
+
+	// Wildcards don't match topics starting with $ (such as $SYS) at the first level
+	system := strings.HasPrefix(topic, "$")
+
+	var match func(node *topicNode, i int)
+	match = func(node *topicNode, i int) {
+		wildcards := i > 0 || !system
+
+		if wildcards {
+			if child, ok := node.children["#"]; ok {
+				collect(child)
+			}
+		}
+
+		if i == len(levels) {
+			collect(node)
+			return
+		}
+
+		if wildcards {
+			if child, ok := node.children["+"]; ok {
+				match(child, i+1)
+			}
+		}
+		if child, ok := node.children[levels[i]]; ok {
+			match(child, i+1)
+		}
+	}
+	match(s.root, 0)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	handlers := make([]mqtt.MessageHandler, len(entries))
+	for i, entry := range entries {
+		handlers[i] = entry.handler
+	}
+	return handlers
+}
@@ -0,0 +1,179 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Solar events
+const (
+	SunDawn    = "dawn"
+	SunSunrise = "sunrise"
+	SunNoon    = "noon"
+	SunSunset  = "sunset"
+	SunDusk    = "dusk"
+)
+
+// SunEvents lists the solar events in the order they happen during a day
+var SunEvents = []string{SunDawn, SunSunrise, SunNoon, SunSunset, SunDusk}
+
+const (
+	// SunriseAltitude is the elevation (degrees) of the sun at sunrise and sunset
+	SunriseAltitude = -0.833
+	// TwilightAltitude is the elevation (degrees) of the sun at civil dawn and dusk
+	TwilightAltitude = -6.0
+)
+
+const (
+	rad     = math.Pi / 180
+	j1970   = 2440588
+	j2000   = 2451545
+	j0      = 0.0009
+	obliq   = rad * 23.4397
+	secsDay = 60 * 60 * 24
+)
+
+// SunTimes contains the solar events of a day. Events that don't happen
+// (e.g. sunset during polar day) are zero.
+type SunTimes struct {
+	Dawn    time.Time
+	Sunrise time.Time
+	Noon    time.Time
+	Sunset  time.Time
+	Dusk    time.Time
+}
+
+// Event returns the time of a solar event by name
+func (st SunTimes) Event(name string) (time.Time, error) {
+	switch name {
+	case SunDawn:
+		return st.Dawn, nil
+	case SunSunrise:
+		return st.Sunrise, nil
+	case SunNoon:
+		return st.Noon, nil
+	case SunSunset:
+		return st.Sunset, nil
+	case SunDusk:
+		return st.Dusk, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown solar event %s", name)
+}
+
+func toJulian(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(time.Second)/secsDay - 0.5 + j1970
+}
+
+func fromJulian(j float64) time.Time {
+	if math.IsNaN(j) {
+		return time.Time{}
+	}
+	return time.Unix(0, int64((j+0.5-j1970)*secsDay*float64(time.Second)))
+}
+
+func toDays(t time.Time) float64 {
+	return toJulian(t) - j2000
+}
+
+func rightAscension(l, b float64) float64 {
+	return math.Atan2(math.Sin(l)*math.Cos(obliq)-math.Tan(b)*math.Sin(obliq), math.Cos(l))
+}
+
+func declination(l, b float64) float64 {
+	return math.Asin(math.Sin(b)*math.Cos(obliq) + math.Cos(b)*math.Sin(obliq)*math.Sin(l))
+}
+
+func siderealTime(d, lw float64) float64 {
+	return rad*(280.16+360.9856235*d) - lw
+}
+
+func solarMeanAnomaly(d float64) float64 {
+	return rad * (357.5291 + 0.98560028*d)
+}
+
+func eclipticLongitude(m float64) float64 {
+	c := rad * (1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m))
+	p := rad * 102.9372
+	return m + c + p + math.Pi
+}
+
+// SunPosition returns the elevation and azimuth (degrees, clockwise from north) of the sun
+func SunPosition(t time.Time, latitude, longitude float64) (elevation float64, azimuth float64) {
+	lw := rad * -longitude
+	phi := rad * latitude
+	d := toDays(t)
+
+	l := eclipticLongitude(solarMeanAnomaly(d))
+	dec := declination(l, 0)
+	h := siderealTime(d, lw) - rightAscension(l, 0)
+
+	elevation = math.Asin(math.Sin(phi)*math.Sin(dec) + math.Cos(phi)*math.Cos(dec)*math.Cos(h))
+	azimuth = math.Atan2(math.Sin(h), math.Cos(h)*math.Sin(phi)-math.Tan(dec)*math.Cos(phi))
+
+	return elevation / rad, math.Mod(azimuth/rad+180, 360)
+}
+
+// CalculateSunTimes returns the solar events of the day of t (in the location of t)
+func CalculateSunTimes(t time.Time, latitude, longitude float64) SunTimes {
+	noon := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, t.Location())
+
+	lw := rad * -longitude
+	phi := rad * latitude
+	d := toDays(noon)
+
+	n := math.Round(d - j0 - lw/(2*math.Pi))
+	ds := j0 + lw/(2*math.Pi) + n
+	m := solarMeanAnomaly(ds)
+	l := eclipticLongitude(m)
+	dec := declination(l, 0)
+
+	transit := func(ds float64) float64 {
+		return j2000 + ds + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*l)
+	}
+	jnoon := transit(ds)
+
+	// set and rise return the julian dates when the sun is at the given altitude
+	set := func(altitude float64) float64 {
+		w := math.Acos((math.Sin(altitude*rad) - math.Sin(phi)*math.Sin(dec)) / (math.Cos(phi) * math.Cos(dec)))
+		return transit(j0 + (w+lw)/(2*math.Pi) + n)
+	}
+	rise := func(altitude float64) float64 {
+		return jnoon - (set(altitude) - jnoon)
+	}
+
+	in := func(j float64) time.Time {
+		res := fromJulian(j)
+		if res.IsZero() {
+			return res
+		}
+		return res.In(t.Location())
+	}
+
+	return SunTimes{
+		Dawn:    in(rise(TwilightAltitude)),
+		Sunrise: in(rise(SunriseAltitude)),
+		Noon:    in(jnoon),
+		Sunset:  in(set(SunriseAltitude)),
+		Dusk:    in(set(TwilightAltitude)),
+	}
+}
+
+// NextSunEvent returns the first time after t when the solar event (shifted by offset) happens.
+// Returns a zero time if the event doesn't happen within a year (e.g. polar regions).
+func NextSunEvent(t time.Time, event string, offset time.Duration, latitude, longitude float64) (time.Time, error) {
+	for days := -1; days <= 366; days++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+days, 12, 0, 0, 0, t.Location())
+
+		at, err := CalculateSunTimes(day, latitude, longitude).Event(event)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if !at.IsZero() && at.Add(offset).After(t) {
+			return at.Add(offset), nil
+		}
+	}
+
+	return time.Time{}, nil
+}
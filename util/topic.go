@@ -0,0 +1,231 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/orktes/homeautomation/config"
+)
+
+// Topic functions
+const (
+	FunctionStatus  = "status"
+	FunctionSet     = "set"
+	FunctionGet     = "get"
+	FunctionCommand = "command"
+	FunctionResult  = "result"
+)
+
+// Template placeholders. {root} is the first segment of a key and {path} the rest of it.
+const (
+	placeholderRoot = "{root}"
+	placeholderPath = "{path}"
+)
+
+// Default topic templates
+const (
+	DefaultStatusTemplate  = "{root}/status/{path}"
+	DefaultSetTemplate     = "{root}/set/{path}"
+	DefaultGetTemplate     = "{root}/get/{path}"
+	DefaultCommandTemplate = "{root}/command/{path}"
+	DefaultResultTemplate  = "{root}/result/{path}"
+)
+
+var functions = []string{FunctionStatus, FunctionSet, FunctionGet, FunctionCommand, FunctionResult}
+
+type template struct {
+	segments  []string
+	pathIndex int
+	// hasRoot is false when the root is the first segment of {path}
+	hasRoot bool
+}
+
+func compileTemplate(tmpl string) (template, error) {
+	t := template{segments: strings.Split(tmpl, "/"), pathIndex: -1}
+	for i, segment := range t.segments {
+		switch {
+		case segment == placeholderPath:
+			if t.pathIndex != -1 {
+				return t, fmt.Errorf("topic template %s must contain %s only once", tmpl, placeholderPath)
+			}
+			t.pathIndex = i
+		case segment == placeholderRoot:
+			if t.hasRoot || t.pathIndex != -1 {
+				return t, fmt.Errorf("topic template %s must contain %s once before %s", tmpl, placeholderRoot, placeholderPath)
+			}
+			t.hasRoot = true
+		case segment == "" || strings.ContainsAny(segment, "+#{}"):
+			return t, fmt.Errorf("invalid segment %q in topic template %s", segment, tmpl)
+		}
+	}
+
+	if t.pathIndex == -1 {
+		return t, fmt.Errorf("topic template %s must contain %s", tmpl, placeholderPath)
+	}
+
+	return t, nil
+}
+
+func mustCompileTemplate(tmpl string) template {
+	t, err := compileTemplate(tmpl)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DefaultTopicLayout uses the <root>/<function>/<path> layout
+var DefaultTopicLayout = TopicLayout{templates: map[string]template{
+	FunctionStatus:  mustCompileTemplate(DefaultStatusTemplate),
+	FunctionSet:     mustCompileTemplate(DefaultSetTemplate),
+	FunctionGet:     mustCompileTemplate(DefaultGetTemplate),
+	FunctionCommand: mustCompileTemplate(DefaultCommandTemplate),
+	FunctionResult:  mustCompileTemplate(DefaultResultTemplate),
+}}
+
+// TopicLayout builds and parses topics using the configured templates
+type TopicLayout struct {
+	templates map[string]template
+}
+
+// NewTopicLayout returns a layout for the given config. Missing templates use the defaults.
+func NewTopicLayout(conf *config.Topics) (TopicLayout, error) {
+	if conf == nil {
+		return DefaultTopicLayout, nil
+	}
+
+	layout := TopicLayout{templates: map[string]template{}}
+	for function, tmpl := range map[string]string{
+		FunctionStatus:  conf.Status,
+		FunctionSet:     conf.Set,
+		FunctionGet:     conf.Get,
+		FunctionCommand: conf.Command,
+		FunctionResult:  conf.Result,
+	} {
+		if tmpl == "" {
+			layout.templates[function] = DefaultTopicLayout.templates[function]
+			continue
+		}
+
+		t, err := compileTemplate(tmpl)
+		if err != nil {
+			return layout, err
+		}
+		layout.templates[function] = t
+	}
+
+	return layout, nil
+}
+
+// MustTopicLayout is like NewTopicLayout but panics on invalid templates
+func MustTopicLayout(conf *config.Topics) TopicLayout {
+	layout, err := NewTopicLayout(conf)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+func (tl TopicLayout) template(function string) template {
+	if t, ok := tl.templates[function]; ok {
+		return t
+	}
+	// Unknown functions use the default layout
+	return mustCompileTemplate(placeholderRoot + "/" + function + "/" + placeholderPath)
+}
+
+// Build returns the topic of a function for a key (root/path)
+func (tl TopicLayout) Build(function string, key string) string {
+	t := tl.template(function)
+
+	parts := strings.Split(key, "/")
+	root, path := parts[0], parts[1:]
+	if !t.hasRoot {
+		path = parts
+	}
+
+	topic := make([]string, 0, len(t.segments)+len(path))
+	for _, segment := range t.segments {
+		switch segment {
+		case placeholderRoot:
+			topic = append(topic, root)
+		case placeholderPath:
+			topic = append(topic, path...)
+		default:
+			topic = append(topic, segment)
+		}
+	}
+
+	return strings.Join(topic, "/")
+}
+
+func (tl TopicLayout) match(function string, parts []string) (key string, ok bool) {
+	t := tl.template(function)
+	suffix := len(t.segments) - t.pathIndex - 1
+
+	if len(parts) < len(t.segments)-1 {
+		return "", false
+	}
+
+	root := ""
+	for i := 0; i < t.pathIndex; i++ {
+		if t.segments[i] == placeholderRoot {
+			root = parts[i]
+		} else if t.segments[i] != parts[i] {
+			return "", false
+		}
+	}
+
+	for i := 1; i <= suffix; i++ {
+		if t.segments[len(t.segments)-i] != parts[len(parts)-i] {
+			return "", false
+		}
+	}
+
+	path := parts[t.pathIndex : len(parts)-suffix]
+	if t.hasRoot {
+		path = append([]string{root}, path...)
+	}
+
+	if len(path) == 0 || path[0] == "" {
+		return "", false
+	}
+
+	return strings.Join(path, "/"), true
+}
+
+// Parse returns the function and key (root/path) of a topic
+func (tl TopicLayout) Parse(topic string) (function string, key string, ok bool) {
+	parts := strings.Split(topic, "/")
+	for _, function := range functions {
+		if key, ok := tl.match(function, parts); ok {
+			return function, key, true
+		}
+	}
+	return "", "", false
+}
+
+// ParseFunction returns the key of a topic if it matches the template of the given function
+func (tl TopicLayout) ParseFunction(function string, topic string) (key string, ok bool) {
+	return tl.match(function, strings.Split(topic, "/"))
+}
+
+// Subscription returns a topic filter matching all topics of the function under root.
+// The filter may match other topics too when the path is not at the end of the template.
+func (tl TopicLayout) Subscription(function string, root string) string {
+	t := tl.template(function)
+
+	filter := []string{}
+	for _, segment := range t.segments[:t.pathIndex] {
+		if segment == placeholderRoot {
+			segment = root
+		}
+		filter = append(filter, segment)
+	}
+
+	if !t.hasRoot {
+		filter = append(filter, root)
+	}
+
+	return strings.Join(append(filter, "#"), "/")
+}
@@ -1,16 +1,10 @@
 package util
 
-import "strings"
+import "reflect"
 
+// ConvertValueToTopic returns the topic of a function for a key using the default topic layout
 func ConvertValueToTopic(str string, typ string) string {
-	parts := strings.Split(str, "/")
-
-	fullTopic := make([]string, len(parts)+1)
-	fullTopic[0] = parts[0]
-	fullTopic[1] = typ
-	copy(fullTopic[2:], parts[1:])
-
-	return strings.Join(fullTopic, "/")
+	return DefaultTopicLayout.Build(typ, str)
 }
 
 func ConvertFloatValueToRange(inputRange, outputRange []float64, val float64) (float64, error) {
@@ -40,3 +34,28 @@ func ConvertFloatValueToRange(inputRange, outputRange []float64, val float64) (f
 
 	return outputRangeStart + (inputPos * outputRangeDelta), nil
 }
+
+// ValuesEqual compares values. Numbers are compared as floats as HCL and JSON decode them differently.
+func ValuesEqual(a interface{}, b interface{}) bool {
+	an, aok := ToFloat(a)
+	bn, bok := ToFloat(b)
+	if aok && bok {
+		return an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// ToFloat returns numeric values as a float64
+func ToFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -1,6 +1,16 @@
 package util
 
-import "testing"
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/orktes/homeautomation/bridge/adapter"
+	"github.com/orktes/homeautomation/config"
+)
 
 type rangeTestData struct {
 	inputRange  []float64
@@ -33,3 +43,381 @@ func TestConvertFloatValueToRange(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	testData := map[string]time.Duration{
+		"10m":  10 * time.Minute,
+		"-24h": -24 * time.Hour,
+		"7d":   7 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+	}
+
+	for str, expected := range testData {
+		d, err := ParseDuration(str)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if d != expected {
+			t.Errorf("ParseDuration returned wrong result for %s got %s\n", str, d)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	testData := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"haaga/#", "haaga/deconz/lights/1/on", true},
+		{"haaga/+/lights/+/on", "haaga/deconz/lights/1/on", true},
+		{"haaga/+/lights/+/on", "haaga/deconz/lights/1/bri", false},
+		{"haaga/deconz", "haaga/deconz/lights", false},
+		{"haaga/deconz/lights", "haaga/deconz", false},
+		{"#", "haaga", true},
+	}
+
+	for _, test := range testData {
+		if MatchPattern(test.pattern, test.path) != test.match {
+			t.Errorf("MatchPattern returned wrong result %+v\n", test)
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := NewSubscriptions()
+
+	var matched []string
+	handler := func(name string) mqtt.MessageHandler {
+		return func(client mqtt.Client, msg mqtt.Message) {
+			matched = append(matched, name)
+		}
+	}
+	match := func(topic string) string {
+		matched = nil
+		for _, h := range s.Match(topic) {
+			h(nil, nil)
+		}
+		return strings.Join(matched, ",")
+	}
+
+	filters := []string{"haaga/#", "haaga/+/lights/+/on", "haaga/deconz/lights/1/on", "#", "+/+", "haaga/deconz/#", "haaga/deconz/lights/1/on"}
+	ids := make([]int, len(filters))
+	for i, filter := range filters {
+		var first bool
+		ids[i], first = s.Add(filter, handler(filter))
+		if first != (i != 6) {
+			t.Error("Wrong first subscription", filter, first)
+		}
+	}
+
+	testData := []struct {
+		topic   string
+		matched string
+	}{
+		{"haaga/deconz/lights/1/on", "haaga/#,haaga/+/lights/+/on,haaga/deconz/lights/1/on,#,haaga/deconz/#,haaga/deconz/lights/1/on"},
+		{"haaga/deconz/lights/1/bri", "haaga/#,#,haaga/deconz/#"},
+		{"haaga/deconz", "haaga/#,#,+/+,haaga/deconz/#"},
+		{"haaga", "haaga/#,#"},
+		{"$SYS/broker", ""},
+	}
+
+	for _, test := range testData {
+		if res := match(test.topic); res != test.matched {
+			t.Errorf("Wrong handlers for %s: %s", test.topic, res)
+		}
+	}
+
+	if s.Remove(filters[2], ids[2]) {
+		t.Error("Filter with handlers left should not be unsubscribed")
+	}
+	if !s.Has(filters[6]) || s.Has("haaga/deconz/lights") {
+		t.Error("Wrong filters with handlers")
+	}
+	if !s.Remove(filters[6], ids[6]) {
+		t.Error("Last handler should unsubscribe the filter")
+	}
+	if s.Has(filters[6]) {
+		t.Error("Removed filter should not have handlers")
+	}
+	if s.Remove(filters[6], ids[6]) {
+		t.Error("Removed handler removed twice")
+	}
+	if !s.Remove(filters[1], ids[1]) || !s.Remove(filters[5], ids[5]) {
+		t.Error("Last handler should unsubscribe the filter")
+	}
+
+	if res := match("haaga/deconz/lights/1/on"); res != "haaga/#,#" {
+		t.Error("Wrong handlers after remove", res)
+	}
+	if _, ok := s.root.children["haaga"].children["deconz"]; ok {
+		t.Error("Empty nodes not pruned")
+	}
+}
+
+func TestDecodeSetRequest(t *testing.T) {
+	val, source := DecodeSetRequest([]byte(`{"value":true,"source":{"type":"alexa","id":"livingroom_tv"}}`))
+	if val != true || source == nil || source.ID != "livingroom_tv" {
+		t.Error("Wrong envelope decoded", val, source)
+	}
+
+	val, source = DecodeSetRequest([]byte(`{"value":1,"updated":"2018-01-01T00:00:00Z"}`))
+	if _, ok := val.(map[string]interface{}); !ok || source != nil {
+		t.Error("Plain object should not be treated as an envelope", val, source)
+	}
+
+	for _, payload := range []string{
+		`{"value":1,"source":"kitchen"}`,
+		`{"value":1,"source":{"name":"kitchen"}}`,
+		`{"value":1,"correlation":{"id":1}}`,
+	} {
+		if val, source := DecodeSetRequest([]byte(payload)); source != nil || len(val.(map[string]interface{})) != 2 {
+			t.Error("Object with envelope keys should not be treated as an envelope", payload, val, source)
+		}
+	}
+
+	val, source = DecodeSetRequest([]byte(`"foo"`))
+	if val != "foo" || source != nil {
+		t.Error("Wrong plain value decoded", val, source)
+	}
+}
+
+func TestEncodeSetRequest(t *testing.T) {
+	source := &adapter.Source{Type: adapter.SourceTrigger, ID: "porch"}
+
+	if b, _ := EncodeSetRequest(true, source, false); string(b) != "true" {
+		t.Error("Source should only be included when enabled", string(b))
+	}
+	if b, _ := EncodeSetRequest(true, source, true); string(b) != `{"value":true,"source":{"type":"trigger","id":"porch"}}` {
+		t.Error("Wrong envelope", string(b))
+	}
+	if b, _ := EncodeRequest(SetRequest{Value: true, Source: source, Correlation: "1"}, false); string(b) != `{"value":true,"correlation":"1"}` {
+		t.Error("Wrong envelope", string(b))
+	}
+}
+
+func TestStatusPayload(t *testing.T) {
+	timestamp := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	kvu := adapter.ValueUpdate{
+		Key:       "haaga/foo",
+		Value:     float64(21),
+		Timestamp: timestamp,
+		Source:    &adapter.Source{Type: adapter.SourceDevice, ID: "haaga/foo"},
+		Stale:     true,
+	}
+
+	b, err := EncodeStatus(kvu, PayloadEnvelope, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := DecodeStatusPayload(b)
+	if status.Value != float64(21) || status.Timestamp == nil || !status.Timestamp.Equal(timestamp) ||
+		status.Source == nil || status.Stale == nil || !*status.Stale {
+		t.Error("Wrong envelope decoded", string(b))
+	}
+
+	b, _ = EncodeStatus(kvu, PayloadRaw, false)
+	if string(b) != "21" {
+		t.Error("Wrong raw payload", string(b))
+	}
+
+	if val, _ := DecodeStatus([]byte(`{"value":4002,"updated":"2018-01-01T00:00:00"}`)); val != float64(4002) {
+		t.Error("Legacy deconz payload should be decoded", val)
+	}
+
+	if err := ValidatePayloadFormat("xml"); err == nil {
+		t.Error("Expected an error for unknown format")
+	}
+}
+
+func TestTopicLayout(t *testing.T) {
+	layout, err := NewTopicLayout(&config.Topics{
+		Status: "home/{path}/state",
+		Set:    "home/{path}/set",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type topicTest struct {
+		function string
+		key      string
+		topic    string
+	}
+
+	for _, test := range []topicTest{
+		{FunctionStatus, "haaga/deconz/lights/1/on", "home/haaga/deconz/lights/1/on/state"},
+		{FunctionSet, "haaga/deconz/lights/1/on", "home/haaga/deconz/lights/1/on/set"},
+		{FunctionGet, "haaga/deconz", "haaga/get/deconz"},
+		{FunctionGet, "haaga", "haaga/get"},
+	} {
+		if topic := layout.Build(test.function, test.key); topic != test.topic {
+			t.Errorf("Build returned wrong topic for %+v got %s", test, topic)
+		}
+
+		function, key, ok := layout.Parse(test.topic)
+		if !ok || function != test.function || key != test.key {
+			t.Errorf("Parse returned wrong result for %+v got %s %s %t", test, function, key, ok)
+		}
+	}
+
+	if _, _, ok := layout.Parse("home/haaga/foo"); ok {
+		t.Error("Parse should not match unknown topics")
+	}
+
+	if sub := layout.Subscription(FunctionSet, "haaga"); sub != "home/haaga/#" {
+		t.Error("Wrong subscription", sub)
+	}
+
+	if sub := DefaultTopicLayout.Subscription(FunctionSet, "haaga"); sub != "haaga/set/#" {
+		t.Error("Wrong subscription", sub)
+	}
+
+	for _, tmpl := range []string{"home/state", "{path}/{root}", "home/+/{path}", "{path}/{path}"} {
+		if _, err := NewTopicLayout(&config.Topics{Status: tmpl}); err == nil {
+			t.Error("Expected an error for invalid template", tmpl)
+		}
+	}
+}
+
+func TestNewResult(t *testing.T) {
+	res := NewResult(FunctionSet, "haaga/foo", adapter.MultiSetError{"on": errors.New("failed")}, "abc")
+	if res.Status != ResultError || res.Code != ErrorCodePartial || res.Error != "on: failed" || res.Correlation != "abc" {
+		t.Error("Wrong result", res)
+	}
+
+	res = NewResult(FunctionCommand, "haaga/foo", adapter.NoSuchCommandError, nil)
+	if res.Code != ErrorCodeNotSupported {
+		t.Error("Wrong error code", res.Code)
+	}
+
+	if res := NewResult(FunctionGet, "haaga/foo", nil, nil); res.Status != ResultOK || res.Code != "" {
+		t.Error("Wrong result", res)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	helsinki, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("No timezone data", err)
+	}
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* * * foo *", "*/0 * * * *", "TZ=Nowhere/Foo * * * * *"} {
+		if _, err := ParseCron(invalid, helsinki); err == nil {
+			t.Error("Expected error for", invalid)
+		}
+	}
+
+	tests := []struct {
+		expr  string
+		after string
+		next  string
+	}{
+		// Weekdays at 22:00
+		{"0 22 * * mon-fri", "2026-10-16T21:00:00+03:00", "2026-10-16T22:00:00+03:00"},
+		{"0 22 * * mon-fri", "2026-10-16T22:00:00+03:00", "2026-10-19T22:00:00+03:00"},
+		{"*/15 * * * *", "2026-10-16T21:07:30+03:00", "2026-10-16T21:15:00+03:00"},
+		{"@monthly", "2026-10-16T21:00:00+03:00", "2026-11-01T00:00:00+02:00"},
+		// Day of month or day of week
+		{"0 12 1 * sun", "2026-10-16T21:00:00+03:00", "2026-10-18T12:00:00+03:00"},
+		{"CRON_TZ=UTC 0 12 * * *", "2026-10-16T21:00:00+03:00", "2026-10-17T12:00:00Z"},
+		// 03:30 is skipped when clocks are turned forward
+		{"30 3 * * *", "2026-03-29T01:00:00+02:00", "2026-03-29T04:00:00+03:00"},
+		// 03:30 is repeated when clocks are turned back but only runs once
+		{"30 3 * * *", "2026-10-25T03:30:00+03:00", "2026-10-26T03:30:00+02:00"},
+		{"30 3 * * *", "2026-10-25T03:10:00+02:00", "2026-10-25T03:30:00+02:00"},
+	}
+
+	for _, test := range tests {
+		s, err := ParseCron(test.expr, helsinki)
+		if err != nil {
+			t.Fatal(test.expr, err)
+		}
+		after, _ := time.Parse(time.RFC3339, test.after)
+		expected, _ := time.Parse(time.RFC3339, test.next)
+
+		if next := s.Next(after); !next.Equal(expected) {
+			t.Error("Wrong next time for", test.expr, test.after, next, "expected", expected)
+		}
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	helsinki := time.FixedZone("EEST", 3*60*60)
+	times := CalculateSunTimes(time.Date(2026, 6, 21, 0, 0, 0, 0, helsinki), 60.17, 24.94)
+
+	// Published times for Helsinki on the summer solstice
+	for _, test := range []struct {
+		event    string
+		expected string
+	}{
+		{SunSunrise, "03:54"},
+		{SunNoon, "13:22"},
+		{SunSunset, "22:50"},
+	} {
+		at, _ := times.Event(test.event)
+		expected, _ := time.ParseInLocation("2006-01-02 15:04", "2026-06-21 "+test.expected, helsinki)
+		if diff := at.Sub(expected); diff > 3*time.Minute || diff < -3*time.Minute {
+			t.Error("Wrong time for", test.event, at, "expected", expected)
+		}
+	}
+
+	// Midnight sun in Utsjoki
+	if polar := CalculateSunTimes(times.Noon, 69.9, 27.0); !polar.Sunset.IsZero() || polar.Noon.IsZero() {
+		t.Error("Sun should not set", polar.Sunset)
+	}
+
+	elevation, azimuth := SunPosition(times.Noon, 60.17, 24.94)
+	if math.Abs(elevation-53.3) > 0.5 || math.Abs(azimuth-180) > 1 {
+		t.Error("Wrong sun position at noon", elevation, azimuth)
+	}
+
+	next, err := NextSunEvent(times.Sunset, SunSunset, -30*time.Minute, 60.17, 24.94)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Day() != 22 || next.Hour() != 22 {
+		t.Error("Wrong next sunset", next)
+	}
+
+	if _, err := NextSunEvent(times.Sunset, "moonrise", 0, 60.17, 24.94); err == nil {
+		t.Error("Expected error for unknown event")
+	}
+}
+
+func TestColorConversions(t *testing.T) {
+	if x, y, _ := RGBToXY(255, 0, 0); math.Abs(x-0.7006) > 0.001 || math.Abs(y-0.2993) > 0.001 {
+		t.Error("Wrong xy for red", x, y)
+	}
+
+	for _, rgb := range [][3]float64{{255, 0, 0}, {0, 255, 0}, {255, 255, 255}, {255, 128, 0}} {
+		x, y, bri := RGBToXY(rgb[0], rgb[1], rgb[2])
+		r, g, b := XYToRGB(x, y, bri)
+		if math.Abs(r-rgb[0]) > 2 || math.Abs(g-rgb[1]) > 2 || math.Abs(b-rgb[2]) > 2 {
+			t.Error("Wrong round trip for", rgb, r, g, b)
+		}
+
+		h, s, v := RGBToHSV(rgb[0], rgb[1], rgb[2])
+		if r, g, b := HSVToRGB(h, s, v); r != rgb[0] || g != rgb[1] || b != rgb[2] {
+			t.Error("Wrong hsv round trip for", rgb, h, s, v)
+		}
+	}
+
+	if m := KelvinToMired(2700); m != 370 {
+		t.Error("Wrong mireds", m)
+	}
+	if k := MiredToKelvin(153); k != 6536 {
+		t.Error("Wrong kelvins", k)
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	if !ValuesEqual(1, float64(1)) || !ValuesEqual(int64(2), float32(2)) {
+		t.Error("Numbers of different types should be equal")
+	}
+	if ValuesEqual(1, "1") || !ValuesEqual(map[string]interface{}{"on": true}, map[string]interface{}{"on": true}) {
+		t.Error("Wrong result for non-numeric values")
+	}
+}